@@ -26,8 +26,27 @@ type KeyValueClient interface {
 	Put(ctx context.Context, in *PutRequest, opts ...grpc.CallOption) (*PutResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
 	GetKeys(ctx context.Context, in *GetKeysRequest, opts ...grpc.CallOption) (*GetKeysResponse, error)
-	GetKeysValuesStream(ctx context.Context, in *Empty, opts ...grpc.CallOption) (KeyValue_GetKeysValuesStreamClient, error)
+	GetKeysValuesStream(ctx context.Context, in *GetKeysValuesRequest, opts ...grpc.CallOption) (KeyValue_GetKeysValuesStreamClient, error)
 	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
+	Incr(ctx context.Context, in *IncrRequest, opts ...grpc.CallOption) (*IncrResponse, error)
+	Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error)
+	BatchPut(ctx context.Context, in *BatchPutRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	BatchGet(ctx context.Context, in *BatchGetRequest, opts ...grpc.CallOption) (*BatchGetResponse, error)
+	BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchResponse, error)
+	// the puts are applied by batches as they arrive, the results are sent at the end
+	PutStream(ctx context.Context, opts ...grpc.CallOption) (KeyValue_PutStreamClient, error)
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KeyValue_WatchClient, error)
+	// the records in the keys order, by pages
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error)
+	ListPrefix(ctx context.Context, in *ListPrefixRequest, opts ...grpc.CallOption) (*ScanResponse, error)
+	// the moves of the partitions led by the node
+	GetRebalance(ctx context.Context, in *GetRebalanceRequest, opts ...grpc.CallOption) (*GetRebalanceResponse, error)
+	// the snapshots of the partitions of the node, to restore a fresh cluster from them
+	CreateSnapshot(ctx context.Context, in *CreateSnapshotRequest, opts ...grpc.CallOption) (*SnapshotsResponse, error)
+	ListSnapshots(ctx context.Context, in *ListSnapshotsRequest, opts ...grpc.CallOption) (*SnapshotsResponse, error)
+	DownloadSnapshot(ctx context.Context, in *DownloadSnapshotRequest, opts ...grpc.CallOption) (KeyValue_DownloadSnapshotClient, error)
+	// replaces the state of a partition on all its nodes, the first chunk names the partition
+	RestoreSnapshot(ctx context.Context, opts ...grpc.CallOption) (KeyValue_RestoreSnapshotClient, error)
 }
 
 type keyValueClient struct {
@@ -74,7 +93,7 @@ func (c *keyValueClient) GetKeys(ctx context.Context, in *GetKeysRequest, opts .
 	return out, nil
 }
 
-func (c *keyValueClient) GetKeysValuesStream(ctx context.Context, in *Empty, opts ...grpc.CallOption) (KeyValue_GetKeysValuesStreamClient, error) {
+func (c *keyValueClient) GetKeysValuesStream(ctx context.Context, in *GetKeysValuesRequest, opts ...grpc.CallOption) (KeyValue_GetKeysValuesStreamClient, error) {
 	stream, err := c.cc.NewStream(ctx, &KeyValue_ServiceDesc.Streams[0], "/KeyValue/GetKeysValuesStream", opts...)
 	if err != nil {
 		return nil, err
@@ -115,6 +134,228 @@ func (c *keyValueClient) GetServers(ctx context.Context, in *GetServersRequest,
 	return out, nil
 }
 
+func (c *keyValueClient) Incr(ctx context.Context, in *IncrRequest, opts ...grpc.CallOption) (*IncrResponse, error) {
+	out := new(IncrResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/Incr", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error) {
+	out := new(TxnResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/Txn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) BatchPut(ctx context.Context, in *BatchPutRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/BatchPut", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) BatchGet(ctx context.Context, in *BatchGetRequest, opts ...grpc.CallOption) (*BatchGetResponse, error) {
+	out := new(BatchGetResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/BatchGet", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) BatchDelete(ctx context.Context, in *BatchDeleteRequest, opts ...grpc.CallOption) (*BatchResponse, error) {
+	out := new(BatchResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/BatchDelete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) PutStream(ctx context.Context, opts ...grpc.CallOption) (KeyValue_PutStreamClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KeyValue_ServiceDesc.Streams[1], "/KeyValue/PutStream", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &keyValuePutStreamClient{stream}
+	return x, nil
+}
+
+type KeyValue_PutStreamClient interface {
+	Send(*PutRequest) error
+	CloseAndRecv() (*BatchResponse, error)
+	grpc.ClientStream
+}
+
+type keyValuePutStreamClient struct {
+	grpc.ClientStream
+}
+
+func (x *keyValuePutStreamClient) Send(m *PutRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *keyValuePutStreamClient) CloseAndRecv() (*BatchResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(BatchResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *keyValueClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (KeyValue_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KeyValue_ServiceDesc.Streams[2], "/KeyValue/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &keyValueWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KeyValue_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type keyValueWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *keyValueWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *keyValueClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error) {
+	out := new(ScanResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/Scan", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) ListPrefix(ctx context.Context, in *ListPrefixRequest, opts ...grpc.CallOption) (*ScanResponse, error) {
+	out := new(ScanResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/ListPrefix", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) GetRebalance(ctx context.Context, in *GetRebalanceRequest, opts ...grpc.CallOption) (*GetRebalanceResponse, error) {
+	out := new(GetRebalanceResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/GetRebalance", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) CreateSnapshot(ctx context.Context, in *CreateSnapshotRequest, opts ...grpc.CallOption) (*SnapshotsResponse, error) {
+	out := new(SnapshotsResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/CreateSnapshot", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) ListSnapshots(ctx context.Context, in *ListSnapshotsRequest, opts ...grpc.CallOption) (*SnapshotsResponse, error) {
+	out := new(SnapshotsResponse)
+	err := c.cc.Invoke(ctx, "/KeyValue/ListSnapshots", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *keyValueClient) DownloadSnapshot(ctx context.Context, in *DownloadSnapshotRequest, opts ...grpc.CallOption) (KeyValue_DownloadSnapshotClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KeyValue_ServiceDesc.Streams[3], "/KeyValue/DownloadSnapshot", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &keyValueDownloadSnapshotClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type KeyValue_DownloadSnapshotClient interface {
+	Recv() (*SnapshotChunk, error)
+	grpc.ClientStream
+}
+
+type keyValueDownloadSnapshotClient struct {
+	grpc.ClientStream
+}
+
+func (x *keyValueDownloadSnapshotClient) Recv() (*SnapshotChunk, error) {
+	m := new(SnapshotChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *keyValueClient) RestoreSnapshot(ctx context.Context, opts ...grpc.CallOption) (KeyValue_RestoreSnapshotClient, error) {
+	stream, err := c.cc.NewStream(ctx, &KeyValue_ServiceDesc.Streams[4], "/KeyValue/RestoreSnapshot", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &keyValueRestoreSnapshotClient{stream}
+	return x, nil
+}
+
+type KeyValue_RestoreSnapshotClient interface {
+	Send(*SnapshotChunk) error
+	CloseAndRecv() (*RestoreSnapshotResponse, error)
+	grpc.ClientStream
+}
+
+type keyValueRestoreSnapshotClient struct {
+	grpc.ClientStream
+}
+
+func (x *keyValueRestoreSnapshotClient) Send(m *SnapshotChunk) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *keyValueRestoreSnapshotClient) CloseAndRecv() (*RestoreSnapshotResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(RestoreSnapshotResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // KeyValueServer is the server API for KeyValue service.
 // All implementations must embed UnimplementedKeyValueServer
 // for forward compatibility
@@ -123,8 +364,27 @@ type KeyValueServer interface {
 	Put(context.Context, *PutRequest) (*PutResponse, error)
 	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
 	GetKeys(context.Context, *GetKeysRequest) (*GetKeysResponse, error)
-	GetKeysValuesStream(*Empty, KeyValue_GetKeysValuesStreamServer) error
+	GetKeysValuesStream(*GetKeysValuesRequest, KeyValue_GetKeysValuesStreamServer) error
 	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
+	Incr(context.Context, *IncrRequest) (*IncrResponse, error)
+	Txn(context.Context, *TxnRequest) (*TxnResponse, error)
+	BatchPut(context.Context, *BatchPutRequest) (*BatchResponse, error)
+	BatchGet(context.Context, *BatchGetRequest) (*BatchGetResponse, error)
+	BatchDelete(context.Context, *BatchDeleteRequest) (*BatchResponse, error)
+	// the puts are applied by batches as they arrive, the results are sent at the end
+	PutStream(KeyValue_PutStreamServer) error
+	Watch(*WatchRequest, KeyValue_WatchServer) error
+	// the records in the keys order, by pages
+	Scan(context.Context, *ScanRequest) (*ScanResponse, error)
+	ListPrefix(context.Context, *ListPrefixRequest) (*ScanResponse, error)
+	// the moves of the partitions led by the node
+	GetRebalance(context.Context, *GetRebalanceRequest) (*GetRebalanceResponse, error)
+	// the snapshots of the partitions of the node, to restore a fresh cluster from them
+	CreateSnapshot(context.Context, *CreateSnapshotRequest) (*SnapshotsResponse, error)
+	ListSnapshots(context.Context, *ListSnapshotsRequest) (*SnapshotsResponse, error)
+	DownloadSnapshot(*DownloadSnapshotRequest, KeyValue_DownloadSnapshotServer) error
+	// replaces the state of a partition on all its nodes, the first chunk names the partition
+	RestoreSnapshot(KeyValue_RestoreSnapshotServer) error
 	mustEmbedUnimplementedKeyValueServer()
 }
 
@@ -144,12 +404,54 @@ func (UnimplementedKeyValueServer) Delete(context.Context, *DeleteRequest) (*Del
 func (UnimplementedKeyValueServer) GetKeys(context.Context, *GetKeysRequest) (*GetKeysResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetKeys not implemented")
 }
-func (UnimplementedKeyValueServer) GetKeysValuesStream(*Empty, KeyValue_GetKeysValuesStreamServer) error {
+func (UnimplementedKeyValueServer) GetKeysValuesStream(*GetKeysValuesRequest, KeyValue_GetKeysValuesStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method GetKeysValuesStream not implemented")
 }
 func (UnimplementedKeyValueServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
 }
+func (UnimplementedKeyValueServer) Incr(context.Context, *IncrRequest) (*IncrResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Incr not implemented")
+}
+func (UnimplementedKeyValueServer) Txn(context.Context, *TxnRequest) (*TxnResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Txn not implemented")
+}
+func (UnimplementedKeyValueServer) BatchPut(context.Context, *BatchPutRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchPut not implemented")
+}
+func (UnimplementedKeyValueServer) BatchGet(context.Context, *BatchGetRequest) (*BatchGetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchGet not implemented")
+}
+func (UnimplementedKeyValueServer) BatchDelete(context.Context, *BatchDeleteRequest) (*BatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method BatchDelete not implemented")
+}
+func (UnimplementedKeyValueServer) PutStream(KeyValue_PutStreamServer) error {
+	return status.Errorf(codes.Unimplemented, "method PutStream not implemented")
+}
+func (UnimplementedKeyValueServer) Watch(*WatchRequest, KeyValue_WatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedKeyValueServer) Scan(context.Context, *ScanRequest) (*ScanResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Scan not implemented")
+}
+func (UnimplementedKeyValueServer) ListPrefix(context.Context, *ListPrefixRequest) (*ScanResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListPrefix not implemented")
+}
+func (UnimplementedKeyValueServer) GetRebalance(context.Context, *GetRebalanceRequest) (*GetRebalanceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetRebalance not implemented")
+}
+func (UnimplementedKeyValueServer) CreateSnapshot(context.Context, *CreateSnapshotRequest) (*SnapshotsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateSnapshot not implemented")
+}
+func (UnimplementedKeyValueServer) ListSnapshots(context.Context, *ListSnapshotsRequest) (*SnapshotsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSnapshots not implemented")
+}
+func (UnimplementedKeyValueServer) DownloadSnapshot(*DownloadSnapshotRequest, KeyValue_DownloadSnapshotServer) error {
+	return status.Errorf(codes.Unimplemented, "method DownloadSnapshot not implemented")
+}
+func (UnimplementedKeyValueServer) RestoreSnapshot(KeyValue_RestoreSnapshotServer) error {
+	return status.Errorf(codes.Unimplemented, "method RestoreSnapshot not implemented")
+}
 func (UnimplementedKeyValueServer) mustEmbedUnimplementedKeyValueServer() {}
 
 // UnsafeKeyValueServer may be embedded to opt out of forward compatibility for this service.
@@ -236,7 +538,7 @@ func _KeyValue_GetKeys_Handler(srv interface{}, ctx context.Context, dec func(in
 }
 
 func _KeyValue_GetKeysValuesStream_Handler(srv interface{}, stream grpc.ServerStream) error {
-	m := new(Empty)
+	m := new(GetKeysValuesRequest)
 	if err := stream.RecvMsg(m); err != nil {
 		return err
 	}
@@ -274,6 +576,280 @@ func _KeyValue_GetServers_Handler(srv interface{}, ctx context.Context, dec func
 	return interceptor(ctx, in, info, handler)
 }
 
+func _KeyValue_Incr_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IncrRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).Incr(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/Incr",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).Incr(ctx, req.(*IncrRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_Txn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).Txn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/Txn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).Txn(ctx, req.(*TxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_BatchPut_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchPutRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).BatchPut(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/BatchPut",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).BatchPut(ctx, req.(*BatchPutRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_BatchGet_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchGetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).BatchGet(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/BatchGet",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).BatchGet(ctx, req.(*BatchGetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_BatchDelete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).BatchDelete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/BatchDelete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).BatchDelete(ctx, req.(*BatchDeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_PutStream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KeyValueServer).PutStream(&keyValuePutStreamServer{stream})
+}
+
+type KeyValue_PutStreamServer interface {
+	SendAndClose(*BatchResponse) error
+	Recv() (*PutRequest, error)
+	grpc.ServerStream
+}
+
+type keyValuePutStreamServer struct {
+	grpc.ServerStream
+}
+
+func (x *keyValuePutStreamServer) SendAndClose(m *BatchResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *keyValuePutStreamServer) Recv() (*PutRequest, error) {
+	m := new(PutRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _KeyValue_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KeyValueServer).Watch(m, &keyValueWatchServer{stream})
+}
+
+type KeyValue_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type keyValueWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *keyValueWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KeyValue_Scan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).Scan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/Scan",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).Scan(ctx, req.(*ScanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_ListPrefix_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListPrefixRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).ListPrefix(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/ListPrefix",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).ListPrefix(ctx, req.(*ListPrefixRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_GetRebalance_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRebalanceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).GetRebalance(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/GetRebalance",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).GetRebalance(ctx, req.(*GetRebalanceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_CreateSnapshot_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateSnapshotRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).CreateSnapshot(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/CreateSnapshot",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).CreateSnapshot(ctx, req.(*CreateSnapshotRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_ListSnapshots_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSnapshotsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(KeyValueServer).ListSnapshots(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/KeyValue/ListSnapshots",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(KeyValueServer).ListSnapshots(ctx, req.(*ListSnapshotsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _KeyValue_DownloadSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(DownloadSnapshotRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(KeyValueServer).DownloadSnapshot(m, &keyValueDownloadSnapshotServer{stream})
+}
+
+type KeyValue_DownloadSnapshotServer interface {
+	Send(*SnapshotChunk) error
+	grpc.ServerStream
+}
+
+type keyValueDownloadSnapshotServer struct {
+	grpc.ServerStream
+}
+
+func (x *keyValueDownloadSnapshotServer) Send(m *SnapshotChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _KeyValue_RestoreSnapshot_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(KeyValueServer).RestoreSnapshot(&keyValueRestoreSnapshotServer{stream})
+}
+
+type KeyValue_RestoreSnapshotServer interface {
+	SendAndClose(*RestoreSnapshotResponse) error
+	Recv() (*SnapshotChunk, error)
+	grpc.ServerStream
+}
+
+type keyValueRestoreSnapshotServer struct {
+	grpc.ServerStream
+}
+
+func (x *keyValueRestoreSnapshotServer) SendAndClose(m *RestoreSnapshotResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *keyValueRestoreSnapshotServer) Recv() (*SnapshotChunk, error) {
+	m := new(SnapshotChunk)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // KeyValue_ServiceDesc is the grpc.ServiceDesc for KeyValue service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -301,6 +877,46 @@ var KeyValue_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetServers",
 			Handler:    _KeyValue_GetServers_Handler,
 		},
+		{
+			MethodName: "Incr",
+			Handler:    _KeyValue_Incr_Handler,
+		},
+		{
+			MethodName: "Txn",
+			Handler:    _KeyValue_Txn_Handler,
+		},
+		{
+			MethodName: "BatchPut",
+			Handler:    _KeyValue_BatchPut_Handler,
+		},
+		{
+			MethodName: "BatchGet",
+			Handler:    _KeyValue_BatchGet_Handler,
+		},
+		{
+			MethodName: "BatchDelete",
+			Handler:    _KeyValue_BatchDelete_Handler,
+		},
+		{
+			MethodName: "Scan",
+			Handler:    _KeyValue_Scan_Handler,
+		},
+		{
+			MethodName: "ListPrefix",
+			Handler:    _KeyValue_ListPrefix_Handler,
+		},
+		{
+			MethodName: "GetRebalance",
+			Handler:    _KeyValue_GetRebalance_Handler,
+		},
+		{
+			MethodName: "CreateSnapshot",
+			Handler:    _KeyValue_CreateSnapshot_Handler,
+		},
+		{
+			MethodName: "ListSnapshots",
+			Handler:    _KeyValue_ListSnapshots_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -308,6 +924,26 @@ var KeyValue_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _KeyValue_GetKeysValuesStream_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "PutStream",
+			Handler:       _KeyValue_PutStream_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _KeyValue_Watch_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "DownloadSnapshot",
+			Handler:       _KeyValue_DownloadSnapshot_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "RestoreSnapshot",
+			Handler:       _KeyValue_RestoreSnapshot_Handler,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "api/v1/keyvalue/keyvalue.proto",
 }
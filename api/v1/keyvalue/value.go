@@ -0,0 +1,132 @@
+package keyvalue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var ErrInvalidValue = errors.New("invalid value")
+
+// names of the value types, used by the text forms(rest, transaction logger)
+const (
+	TypeString = "string"
+	TypeInt    = "int"
+	TypeFloat  = "float"
+	TypeBytes  = "bytes"
+	TypeJSON   = "json"
+)
+
+// NewValue wraps a go value, which must be a string, an int64, a float64,
+// a []byte or a json.RawMessage(int and float32 are converted)
+func NewValue(v interface{}) (*Value, error) {
+	switch v := v.(type) {
+	case string:
+		return &Value{Kind: &Value_StringValue{StringValue: v}}, nil
+	case int64:
+		return &Value{Kind: &Value_IntValue{IntValue: v}}, nil
+	case int:
+		return &Value{Kind: &Value_IntValue{IntValue: int64(v)}}, nil
+	case float64:
+		return &Value{Kind: &Value_FloatValue{FloatValue: v}}, nil
+	case float32:
+		return &Value{Kind: &Value_FloatValue{FloatValue: float64(v)}}, nil
+	case []byte:
+		return &Value{Kind: &Value_BytesValue{BytesValue: v}}, nil
+	case json.RawMessage:
+		if !json.Valid(v) {
+			return nil, ErrInvalidValue
+		}
+		return &Value{Kind: &Value_JsonValue{JsonValue: string(v)}}, nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %T", ErrInvalidValue, v)
+	}
+}
+
+// ParseValue reads the text form of a value of the type typ
+func ParseValue(typ, text string) (*Value, error) {
+	switch typ {
+	case TypeString, "":
+		return NewValue(text)
+	case TypeInt:
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, ErrInvalidValue
+		}
+		return NewValue(i)
+	case TypeFloat:
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			return nil, ErrInvalidValue
+		}
+		return NewValue(f)
+	case TypeBytes:
+		b, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, ErrInvalidValue
+		}
+		return NewValue(b)
+	case TypeJSON:
+		return NewValue(json.RawMessage(text))
+	default:
+		return nil, fmt.Errorf("%w: unknown type %s", ErrInvalidValue, typ)
+	}
+}
+
+// Interface returns the go value, a nil Value is an empty string
+func (x *Value) Interface() interface{} {
+	switch k := x.GetKind().(type) {
+	case *Value_IntValue:
+		return k.IntValue
+	case *Value_FloatValue:
+		return k.FloatValue
+	case *Value_BytesValue:
+		return k.BytesValue
+	case *Value_JsonValue:
+		return json.RawMessage(k.JsonValue)
+	default:
+		return x.GetStringValue()
+	}
+}
+
+func (x *Value) TypeName() string {
+	switch x.GetKind().(type) {
+	case *Value_IntValue:
+		return TypeInt
+	case *Value_FloatValue:
+		return TypeFloat
+	case *Value_BytesValue:
+		return TypeBytes
+	case *Value_JsonValue:
+		return TypeJSON
+	default:
+		return TypeString
+	}
+}
+
+// Text is the text form of the value, bytes are base64 encoded
+func (x *Value) Text() string {
+	switch k := x.GetKind().(type) {
+	case *Value_IntValue:
+		return strconv.FormatInt(k.IntValue, 10)
+	case *Value_FloatValue:
+		return strconv.FormatFloat(k.FloatValue, 'g', -1, 64)
+	case *Value_BytesValue:
+		return base64.StdEncoding.EncodeToString(k.BytesValue)
+	case *Value_JsonValue:
+		return k.JsonValue
+	default:
+		return x.GetStringValue()
+	}
+}
+
+// Data returns the go value of the record,
+// the records written before the typed values existed only have a string value
+func (x *Records) Data() interface{} {
+	if x.GetTypedValue() == nil {
+		return x.GetValue()
+	}
+	return x.GetTypedValue().Interface()
+}
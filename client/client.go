@@ -0,0 +1,712 @@
+// Package client is a leader aware client of the key value store.
+// It learns the topology of the cluster from a list of seeds, sends the writes of a key
+// to the leader of its partition, spreads the stale reads over the voters of the partition
+// and retries the calls which failed because the leader moved or a node is unavailable.
+package client
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/config"
+	"github.com/djedjethai/generation/partition"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	ErrNoSuchKey = errors.New("no such key")
+	ErrNoSeeds   = errors.New("client needs at least one seed")
+	// the precondition of a PutIf or a DeleteIf did not hold
+	ErrPreconditionFailed = errors.New("precondition failed")
+
+	errNoLeader = status.Error(codes.Unavailable, "no leader known")
+)
+
+const (
+	defaultMaxAttempts  = 3
+	defaultRetryBackoff = 100 * time.Millisecond
+)
+
+type Config struct {
+	// rpc addresses of some nodes of the cluster
+	Seeds []string
+	// tls is used when CAFile is set, CertFile and KeyFile for a mutual tls
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string
+	// number of times a call is tried, default to 3
+	MaxAttempts int
+	// wait between two attempts, default to 100ms
+	RetryBackoff time.Duration
+}
+
+type Client struct {
+	config Config
+	creds  credentials.TransportCredentials
+
+	mu        sync.Mutex
+	conns     map[string]*grpc.ClientConn
+	leader    string
+	followers []string
+	next      int
+	// the leader and the voters of each partition, placed by the partitioner
+	partitions  []*api.Partition
+	partitioner *partition.Ring
+}
+
+// New creates the client and learns the topology from the seeds
+func New(ctx context.Context, cfg Config) (*Client, error) {
+	if len(cfg.Seeds) == 0 {
+		return nil, ErrNoSeeds
+	}
+	if cfg.MaxAttempts < 1 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+
+	c := &Client{
+		config: cfg,
+		creds:  insecure.NewCredentials(),
+		conns:  make(map[string]*grpc.ClientConn),
+	}
+
+	if cfg.CAFile != "" {
+		tlsConfig, err := config.SetupTLSConfig(config.TLSConfig{
+			CertFile:      cfg.CertFile,
+			KeyFile:       cfg.KeyFile,
+			CAFile:        cfg.CAFile,
+			ServerAddress: cfg.ServerName,
+		})
+		if err != nil {
+			return nil, err
+		}
+		c.creds = credentials.NewTLS(tlsConfig)
+	}
+
+	if err := c.refresh(ctx); err != nil {
+		_ = c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Put sets the value on the leader, a ttl of 0 means the key never expire.
+// The value is a string, an int64, a float64, a []byte or a json.RawMessage
+func (c *Client) Put(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	_, err := c.PutIf(ctx, key, value, ttl, nil)
+	return err
+}
+
+// PutIf sets the value only if the precondition holds, ErrPreconditionFailed otherwise,
+// and returns the new version of the key
+func (c *Client) PutIf(ctx context.Context, key string, value interface{}, ttl time.Duration, pre *api.Precondition) (uint64, error) {
+	typed, err := api.NewValue(value)
+	if err != nil {
+		return 0, err
+	}
+	var version uint64
+	err = c.call(ctx, c.keyLeader(key), func(cl api.KeyValueClient) error {
+		res, err := cl.Put(ctx, &api.PutRequest{
+			Records: &api.Records{
+				Key:        key,
+				TypedValue: typed,
+			},
+			TtlMs:        ttl.Milliseconds(),
+			Precondition: pre,
+		})
+		if err != nil {
+			return err
+		}
+		version = res.Version
+		return nil
+	})
+	if status.Code(err) == codes.FailedPrecondition {
+		return 0, ErrPreconditionFailed
+	}
+	return version, err
+}
+
+// Incr adds delta to the integer value of the key and returns the new value,
+// a missing key starts from 0. It is not tried again on an unavailable node, see callOnce
+func (c *Client) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	var value int64
+	err := c.callOnce(ctx, c.keyLeader(key), func(cl api.KeyValueClient) error {
+		res, err := cl.Incr(ctx, &api.IncrRequest{
+			Key:   key,
+			Delta: delta,
+		})
+		if err != nil {
+			return err
+		}
+		value = res.Value
+		return nil
+	})
+	return value, err
+}
+
+func (c *Client) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	return c.Incr(ctx, key, -delta)
+}
+
+// Txn applies the success ops if all the compares hold, the failure ones otherwise,
+// the transaction is applied entirely or not at all. Its keys are in the same partition.
+// Applied twice it could take the other branch, so it is not tried again on an unavailable node
+func (c *Client) Txn(ctx context.Context, req *api.TxnRequest) (*api.TxnResponse, error) {
+	var res *api.TxnResponse
+	err := c.callOnce(ctx, c.keyLeader(txnKey(req)), func(cl api.KeyValueClient) error {
+		var err error
+		res, err = cl.Txn(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// BatchPut sets many values with few log entries, each item has its own result.
+// The puts of each partition are sent to its leader
+func (c *Client) BatchPut(ctx context.Context, puts []*api.PutRequest) ([]*api.ItemResult, error) {
+	keys := make([]string, 0, len(puts))
+	for _, put := range puts {
+		keys = append(keys, put.GetRecords().GetKey())
+	}
+	results := make([]*api.ItemResult, len(puts))
+	for _, group := range c.byPartition(keys) {
+		chunk := make([]*api.PutRequest, 0, len(group))
+		for _, j := range group {
+			chunk = append(chunk, puts[j])
+		}
+		err := c.call(ctx, c.keyLeader(keys[group[0]]), func(cl api.KeyValueClient) error {
+			res, err := cl.BatchPut(ctx, &api.BatchPutRequest{Puts: chunk})
+			if err != nil {
+				return err
+			}
+			for k, j := range group {
+				results[j] = res.Results[k]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (c *Client) BatchGet(ctx context.Context, keys []string, consistency api.Consistency) ([]*api.GetResult, error) {
+	var results []*api.GetResult
+	err := c.call(ctx, c.readAddr(consistency), func(cl api.KeyValueClient) error {
+		res, err := cl.BatchGet(ctx, &api.BatchGetRequest{
+			Keys:        keys,
+			Consistency: consistency,
+		})
+		if err != nil {
+			return err
+		}
+		results = res.Results
+		return nil
+	})
+	return results, err
+}
+
+// ListPrefix returns a page of the records starting with prefix, in the keys order,
+// and the token of the next page(empty on the last one)
+func (c *Client) ListPrefix(ctx context.Context, prefix string, limit int, pageToken string, consistency api.Consistency) ([]*api.GetResult, string, error) {
+	var res *api.ScanResponse
+	err := c.call(ctx, c.readAddr(consistency), func(cl api.KeyValueClient) error {
+		var err error
+		res, err = cl.ListPrefix(ctx, &api.ListPrefixRequest{
+			Prefix:      prefix,
+			Limit:       int32(limit),
+			PageToken:   pageToken,
+			Consistency: consistency,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return res.Results, res.NextPageToken, nil
+}
+
+func (c *Client) Scan(ctx context.Context, start, end string, limit int, pageToken string, consistency api.Consistency) ([]*api.GetResult, string, error) {
+	var res *api.ScanResponse
+	err := c.call(ctx, c.readAddr(consistency), func(cl api.KeyValueClient) error {
+		var err error
+		res, err = cl.Scan(ctx, &api.ScanRequest{
+			Start:       start,
+			End:         end,
+			Limit:       int32(limit),
+			PageToken:   pageToken,
+			Consistency: consistency,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return res.Results, res.NextPageToken, nil
+}
+
+// BatchDelete sends the deletes of each partition to its leader
+func (c *Client) BatchDelete(ctx context.Context, keys []string) ([]*api.ItemResult, error) {
+	results := make([]*api.ItemResult, len(keys))
+	for _, group := range c.byPartition(keys) {
+		deletes := make([]*api.DeleteRequest, 0, len(group))
+		for _, j := range group {
+			deletes = append(deletes, &api.DeleteRequest{Key: keys[j]})
+		}
+		err := c.call(ctx, c.keyLeader(keys[group[0]]), func(cl api.KeyValueClient) error {
+			res, err := cl.BatchDelete(ctx, &api.BatchDeleteRequest{Deletes: deletes})
+			if err != nil {
+				return err
+			}
+			for k, j := range group {
+				results[j] = res.Results[k]
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// Get reads the value of the key, stale reads are spread over the voters of its partition
+// the others are sent to the leader of the partition
+func (c *Client) Get(ctx context.Context, key string, consistency api.Consistency) (interface{}, error) {
+	value, _, err := c.GetWithVersion(ctx, key, consistency)
+	return value, err
+}
+
+// GetWithVersion returns the version of the key too, to use in a precondition
+func (c *Client) GetWithVersion(ctx context.Context, key string, consistency api.Consistency) (interface{}, uint64, error) {
+	var value interface{}
+	var version uint64
+	err := c.call(ctx, c.keyRead(key, consistency), func(cl api.KeyValueClient) error {
+		res, err := cl.Get(ctx, &api.GetRequest{
+			Key:         key,
+			Consistency: consistency,
+		})
+		if err != nil {
+			return err
+		}
+		value = res.Value
+		if res.TypedValue != nil {
+			value = res.TypedValue.Interface()
+		}
+		version = res.Version
+		return nil
+	})
+	if status.Code(err) == codes.Code(404) {
+		return nil, 0, ErrNoSuchKey
+	}
+	return value, version, err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.DeleteIf(ctx, key, nil)
+}
+
+// DeleteIf deletes the key only if the precondition holds, ErrPreconditionFailed otherwise
+func (c *Client) DeleteIf(ctx context.Context, key string, pre *api.Precondition) error {
+	err := c.call(ctx, c.keyLeader(key), func(cl api.KeyValueClient) error {
+		_, err := cl.Delete(ctx, &api.DeleteRequest{
+			Key:          key,
+			Precondition: pre,
+		})
+		return err
+	})
+	if status.Code(err) == codes.FailedPrecondition {
+		return ErrPreconditionFailed
+	}
+	return err
+}
+
+// Keys returns all the keys, read page after page
+func (c *Client) Keys(ctx context.Context, consistency api.Consistency) ([]string, error) {
+	var keys []string
+	req := &api.GetKeysRequest{Consistency: consistency}
+	for {
+		res, err := c.keysPage(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, res.Keys...)
+		if res.NextCursor == "" {
+			return keys, nil
+		}
+		req.Cursor = res.NextCursor
+	}
+}
+
+// CountKeys returns the number of keys matching the glob, all of them if glob is empty
+func (c *Client) CountKeys(ctx context.Context, glob string, consistency api.Consistency) (int64, error) {
+	res, err := c.keysPage(ctx, &api.GetKeysRequest{
+		Consistency: consistency,
+		Glob:        glob,
+		CountOnly:   true,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Count, nil
+}
+
+func (c *Client) keysPage(ctx context.Context, req *api.GetKeysRequest) (*api.GetKeysResponse, error) {
+	var res *api.GetKeysResponse
+	err := c.call(ctx, c.readAddr(req.Consistency), func(cl api.KeyValueClient) error {
+		var err error
+		res, err = cl.GetKeys(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// Watch streams the events of the key, or of the keys with the prefix, from startIndex(0 for now).
+// When the stream breaks it reconnects, to the new leader if needed, and resumes each partition
+// from the last index received of it, so an event can be received twice. The channel is closed
+// when ctx is done, when the node can not be reached anymore or when the events to resume from
+// are not kept anymore
+func (c *Client) Watch(ctx context.Context, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, error) {
+	stream, err := c.watch(ctx, key, prefix, startIndex, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make(chan *api.WatchEvent)
+	go func() {
+		defer close(events)
+		// the partitions number their own indexes, the ones without event resume from startIndex
+		next := make(map[int32]uint64)
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				// Aborted, the watcher was too late
+				if ctx.Err() != nil || !retryable(err) && status.Code(err) != codes.Aborted {
+					return
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(c.config.RetryBackoff):
+				}
+				_ = c.refresh(ctx)
+				if stream, err = c.watch(ctx, key, prefix, startIndex, next); err != nil {
+					return
+				}
+				continue
+			}
+			next[ev.Partition] = ev.Index
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// the events of a key are sent by the leader of its partition, the ones of a prefix
+// are merged by the node from the leaders of the partitions
+func (c *Client) watch(ctx context.Context, key string, prefix bool, startIndex uint64, startIndexes map[int32]uint64) (api.KeyValue_WatchClient, error) {
+	pick := c.leaderAddr
+	if !prefix {
+		pick = c.keyLeader(key)
+	}
+	var stream api.KeyValue_WatchClient
+	err := c.call(ctx, pick, func(cl api.KeyValueClient) error {
+		var err error
+		stream, err = cl.Watch(ctx, &api.WatchRequest{
+			Key:          key,
+			Prefix:       prefix,
+			StartIndex:   startIndex,
+			StartIndexes: startIndexes,
+		})
+		return err
+	})
+	return stream, err
+}
+
+// Servers returns the topology as last learned by the client
+func (c *Client) Servers() (leader string, followers []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.leader, append([]string(nil), c.followers...)
+}
+
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for addr, cc := range c.conns {
+		if e := cc.Close(); e != nil {
+			err = e
+		}
+		delete(c.conns, addr)
+	}
+	return err
+}
+
+// call runs fn against the node returned by pick. When the node is not the leader(anymore)
+// or is unavailable the topology is refreshed and fn tried again
+func (c *Client) call(ctx context.Context, pick func() (string, error), fn func(api.KeyValueClient) error) error {
+	return c.retry(ctx, pick, fn, retryable)
+}
+
+// callOnce is call for the writes which are not idempotent. An unavailable node may have
+// applied the write before failing(or its leader, when it forwarded it), so fn is only
+// tried again when the node answered it is not the leader, the write was not applied
+func (c *Client) callOnce(ctx context.Context, pick func() (string, error), fn func(api.KeyValueClient) error) error {
+	return c.retry(ctx, pick, fn, notLeader)
+}
+
+func (c *Client) retry(ctx context.Context, pick func() (string, error), fn func(api.KeyValueClient) error, again func(error) bool) error {
+	var err error
+	for attempt := 0; attempt < c.config.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(c.config.RetryBackoff):
+			}
+			if rerr := c.refresh(ctx); rerr != nil {
+				err = rerr
+				continue
+			}
+		}
+
+		var addr string
+		addr, err = pick()
+		if err != nil {
+			continue
+		}
+		var cl api.KeyValueClient
+		cl, err = c.client(addr)
+		if err != nil {
+			return err
+		}
+		err = fn(cl)
+		if !again(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		return false
+	}
+	return st.Code() == codes.Unavailable || st.Message() == raft.ErrNotLeader.Error()
+}
+
+func notLeader(err error) bool {
+	st, ok := status.FromError(err)
+	return err != nil && ok && st.Message() == raft.ErrNotLeader.Error()
+}
+
+func (c *Client) leaderAddr() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.leader == "" {
+		return "", errNoLeader
+	}
+	return c.leader, nil
+}
+
+// keyLeader picks the leader of the partition of the key, the leader of the cluster
+// while the client does not know it, the node then forwards the call
+func (c *Client) keyLeader(key string) func() (string, error) {
+	return func() (string, error) {
+		c.mu.Lock()
+		part := c.partitionOf(key)
+		c.mu.Unlock()
+		if part != nil && part.LeaderAddr != "" {
+			return part.LeaderAddr, nil
+		}
+		return c.leaderAddr()
+	}
+}
+
+// keyRead spreads the stale reads of the key over the voters of its partition,
+// the others go to the leader of the partition
+func (c *Client) keyRead(key string, consistency api.Consistency) func() (string, error) {
+	if consistency != api.Consistency_STALE {
+		return c.keyLeader(key)
+	}
+	return func() (string, error) {
+		c.mu.Lock()
+		part := c.partitionOf(key)
+		if part != nil && len(part.Servers) > 0 {
+			c.next = (c.next + 1) % len(part.Servers)
+			addr := part.Servers[c.next].RpcAddr
+			c.mu.Unlock()
+			return addr, nil
+		}
+		c.mu.Unlock()
+		return c.readAddr(consistency)()
+	}
+}
+
+// partitionOf returns the partition of the key, nil if the partitions are not known,
+// it is called under the lock
+func (c *Client) partitionOf(key string) *api.Partition {
+	if c.partitioner == nil {
+		return nil
+	}
+	return c.partitions[c.partitioner.Locate(key)]
+}
+
+// byPartition groups the positions of the keys by partition, in the order of the partitions
+func (c *Client) byPartition(keys []string) [][]int {
+	c.mu.Lock()
+	partitioner := c.partitioner
+	c.mu.Unlock()
+	if partitioner == nil {
+		all := make([]int, len(keys))
+		for j := range all {
+			all[j] = j
+		}
+		return [][]int{all}
+	}
+
+	groups := make(map[int][]int)
+	var order []int
+	for j, key := range keys {
+		i := partitioner.Locate(key)
+		if _, ok := groups[i]; !ok {
+			order = append(order, i)
+		}
+		groups[i] = append(groups[i], j)
+	}
+	sort.Ints(order)
+	res := make([][]int, 0, len(order))
+	for _, i := range order {
+		res = append(res, groups[i])
+	}
+	return res
+}
+
+// the key of the first op of the transaction, they are all in the same partition
+func txnKey(r *api.TxnRequest) string {
+	for _, c := range r.Compares {
+		return c.Key
+	}
+	for _, ops := range [][]*api.TxnOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			switch o := op.GetOp().(type) {
+			case *api.TxnOp_Put:
+				return o.Put.Key
+			case *api.TxnOp_Delete:
+				return o.Delete.Key
+			case *api.TxnOp_Get:
+				return o.Get.Key
+			}
+		}
+	}
+	return ""
+}
+
+func (c *Client) readAddr(consistency api.Consistency) func() (string, error) {
+	if consistency != api.Consistency_STALE {
+		return c.leaderAddr
+	}
+	return func() (string, error) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if len(c.followers) == 0 {
+			if c.leader == "" {
+				return "", errNoLeader
+			}
+			return c.leader, nil
+		}
+		c.next = (c.next + 1) % len(c.followers)
+		return c.followers[c.next], nil
+	}
+}
+
+// refresh asks the known nodes, then the seeds, for the servers of the cluster
+func (c *Client) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	candidates := []string{}
+	if c.leader != "" {
+		candidates = append(candidates, c.leader)
+	}
+	candidates = append(candidates, c.followers...)
+	candidates = append(candidates, c.config.Seeds...)
+	c.mu.Unlock()
+
+	var err error
+	for _, addr := range candidates {
+		var cl api.KeyValueClient
+		cl, err = c.client(addr)
+		if err != nil {
+			continue
+		}
+		var res *api.GetServersResponse
+		res, err = cl.GetServers(ctx, &api.GetServersRequest{})
+		if err != nil {
+			continue
+		}
+
+		var leader string
+		var followers []string
+		for _, srv := range res.Servers {
+			if srv.IsLeader {
+				leader = srv.RpcAddr
+			} else {
+				followers = append(followers, srv.RpcAddr)
+			}
+		}
+
+		c.mu.Lock()
+		c.leader = leader
+		c.followers = followers
+		if len(res.Partitions) > 0 && len(res.Partitions) != len(c.partitions) {
+			c.partitioner = partition.NewRing(len(res.Partitions))
+		}
+		c.partitions = res.Partitions
+		if len(c.partitions) == 0 {
+			c.partitioner = nil
+		}
+		c.mu.Unlock()
+		return nil
+	}
+	return err
+}
+
+func (c *Client) client(addr string) (api.KeyValueClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cc, ok := c.conns[addr]
+	if !ok {
+		var err error
+		cc, err = grpc.Dial(addr, grpc.WithTransportCredentials(c.creds))
+		if err != nil {
+			return nil, err
+		}
+		c.conns[addr] = cc
+	}
+	return api.NewKeyValueClient(cc), nil
+}
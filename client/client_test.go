@@ -0,0 +1,295 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/agent"
+	"github.com/djedjethai/generation/internal/config"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the certs are generated for the run, see config.GenerateCerts
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		panic(err)
+	}
+	if err := config.GenerateCerts(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestClient(t *testing.T) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ClientCertFile,
+		KeyFile:       config.ClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	var agents []*agent.Agent
+	var bindAddrs, rpcAddrs []string
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		dataDir, err := ioutil.TempDir("", "client-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, bindAddrs[0])
+		}
+		obs := &observability.Observability{
+			Logger: observability.NewSrvLogger("prod"),
+		}
+
+		a, err := agent.New(agent.Config{
+			NodeName:        fmt.Sprintf("%d", i),
+			StartJoinAddrs:  startJoinAddrs,
+			BindAddr:        bindAddr,
+			PortGRPC:        ports[1],
+			DataDir:         dataDir,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Bootstrap:       i == 0,
+			Shards:          3,
+			ItemsPerShard:   10,
+			Protocol:        "grpc",
+			Observability:   obs,
+		})
+		require.NoError(t, err)
+		agents = append(agents, a)
+		bindAddrs = append(bindAddrs, bindAddr)
+		rpcAddrs = append(rpcAddrs, fmt.Sprintf("%s:%d", "127.0.0.1", ports[1]))
+	}
+	defer func() {
+		for _, a := range agents {
+			_ = a.Shutdown()
+		}
+	}()
+
+	time.Sleep(3 * time.Second)
+
+	ctx := context.Background()
+
+	// bootstrap from a follower only
+	cl, err := New(ctx, Config{
+		Seeds:      rpcAddrs[2:],
+		CertFile:   config.ClientCertFile,
+		KeyFile:    config.ClientKeyFile,
+		CAFile:     config.CAFile,
+		ServerName: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	defer cl.Close()
+
+	leader, followers := cl.Servers()
+	require.Equal(t, rpcAddrs[0], leader)
+	require.Equal(t, 2, len(followers))
+
+	err = cl.Put(ctx, "key1", "value1", 0)
+	require.NoError(t, err)
+
+	value, err := cl.Get(ctx, "key1", api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	require.Equal(t, "value1", value)
+
+	// stale reads are served by the followers
+	require.Eventually(t, func() bool {
+		for range followers {
+			value, err := cl.Get(ctx, "key1", api.Consistency_STALE)
+			if err != nil || value != "value1" {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 50*time.Millisecond)
+
+	keys, err := cl.Keys(ctx, api.Consistency_LEADER)
+	require.NoError(t, err)
+	require.Equal(t, []string{"key1"}, keys)
+
+	err = cl.Delete(ctx, "key1")
+	require.NoError(t, err)
+
+	_, err = cl.Get(ctx, "key1", api.Consistency_LINEARIZABLE)
+	require.Equal(t, ErrNoSuchKey, err)
+
+	// the values keep their type
+	err = cl.Put(ctx, "counter", int64(0), 0)
+	require.NoError(t, err)
+	value, err = cl.Get(ctx, "counter", api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), value)
+
+	n, err := cl.Incr(ctx, "counter", 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), n)
+	n, err = cl.Decr(ctx, "counter", 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+
+	// optimistic locking on the version of the key
+	_, version, err := cl.GetWithVersion(ctx, "counter", api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	_, err = cl.PutIf(ctx, "counter", int64(4), 0, &api.Precondition{ExpectedVersion: version})
+	require.NoError(t, err)
+	_, err = cl.PutIf(ctx, "counter", int64(5), 0, &api.Precondition{ExpectedVersion: version})
+	require.Equal(t, ErrPreconditionFailed, err)
+
+	res, err := cl.Txn(ctx, &api.TxnRequest{
+		Compares: []*api.Compare{
+			{Key: "counter", Precondition: &api.Precondition{IfPresent: true}},
+		},
+		Success: []*api.TxnOp{{Op: &api.TxnOp_Delete{Delete: &api.TxnDelete{Key: "counter"}}}},
+	})
+	require.NoError(t, err)
+	require.True(t, res.Succeeded)
+
+	var puts []*api.PutRequest
+	for _, key := range []string{"b1", "b2", "b3"} {
+		puts = append(puts, &api.PutRequest{Records: &api.Records{Key: key, Value: key}})
+	}
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	events, err := cl.Watch(watchCtx, "b", true, 1)
+	require.NoError(t, err)
+
+	items, err := cl.BatchPut(ctx, puts)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(items))
+	got, err := cl.BatchGet(ctx, []string{"b1", "b4"}, api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	require.True(t, got[0].Found)
+	require.False(t, got[1].Found)
+	page, next, err := cl.ListPrefix(ctx, "b", 2, "", api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	require.Equal(t, "b2", page[1].Key)
+	page, next, err = cl.ListPrefix(ctx, "b", 2, next, api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	require.Equal(t, "b3", page[0].Key)
+	require.Empty(t, next)
+	_, err = cl.BatchDelete(ctx, []string{"b1", "b2", "b3"})
+	require.NoError(t, err)
+
+	// the events of the batch, from the replay or live
+	for _, key := range []string{"b1", "b2", "b3"} {
+		ev := <-events
+		require.Equal(t, api.WatchEvent_PUT, ev.Type)
+		require.Equal(t, key, ev.Key)
+		require.Equal(t, items[0].Version, ev.Index)
+	}
+
+	// the leader is gone, the client finds the new one
+	err = agents[0].Shutdown()
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return cl.Put(ctx, "key2", "value2", 0) == nil
+	}, 10*time.Second, 200*time.Millisecond)
+
+	leader, _ = cl.Servers()
+	require.NotEqual(t, rpcAddrs[0], leader)
+}
+
+func TestNewWithoutSeeds(t *testing.T) {
+	_, err := New(context.Background(), Config{})
+	require.Equal(t, ErrNoSeeds, err)
+}
+
+// failingServer is the leader of the cluster, its writes fail with err
+type failingServer struct {
+	api.UnimplementedKeyValueServer
+	addr  string
+	err   error
+	calls int32
+}
+
+func (s *failingServer) GetServers(ctx context.Context, r *api.GetServersRequest) (*api.GetServersResponse, error) {
+	return &api.GetServersResponse{Servers: []*api.Server{{Id: "0", RpcAddr: s.addr, IsLeader: true}}}, nil
+}
+
+func (s *failingServer) Put(ctx context.Context, r *api.PutRequest) (*api.PutResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, s.err
+}
+
+func (s *failingServer) Incr(ctx context.Context, r *api.IncrRequest) (*api.IncrResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, s.err
+}
+
+func (s *failingServer) Txn(ctx context.Context, r *api.TxnRequest) (*api.TxnResponse, error) {
+	atomic.AddInt32(&s.calls, 1)
+	return nil, s.err
+}
+
+// an unavailable node may have applied the write, Incr and Txn are only tried again on a follower
+func TestWritesNotIdempotentAreNotRetried(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := &failingServer{addr: ln.Addr().String()}
+	gsrv := grpc.NewServer()
+	api.RegisterKeyValueServer(gsrv, srv)
+	go func() {
+		_ = gsrv.Serve(ln)
+	}()
+	defer gsrv.Stop()
+
+	ctx := context.Background()
+	cl, err := New(ctx, Config{Seeds: []string{srv.addr}, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+	defer cl.Close()
+
+	for _, tc := range []struct {
+		err   error
+		calls int32
+	}{
+		{status.Error(codes.Unavailable, "leadership lost"), 1},
+		{status.Error(codes.Unavailable, raft.ErrNotLeader.Error()), defaultMaxAttempts},
+	} {
+		srv.err = tc.err
+		atomic.StoreInt32(&srv.calls, 0)
+		_, err = cl.Incr(ctx, "counter", 1)
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Equal(t, tc.calls, atomic.LoadInt32(&srv.calls))
+
+		atomic.StoreInt32(&srv.calls, 0)
+		_, err = cl.Txn(ctx, &api.TxnRequest{})
+		require.Equal(t, codes.Unavailable, status.Code(err))
+		require.Equal(t, tc.calls, atomic.LoadInt32(&srv.calls))
+	}
+
+	// a put applied twice sets the same value
+	srv.err = status.Error(codes.Unavailable, "leadership lost")
+	atomic.StoreInt32(&srv.calls, 0)
+	require.Error(t, cl.Put(ctx, "key", "value", 0))
+	require.Equal(t, int32(defaultMaxAttempts), atomic.LoadInt32(&srv.calls))
+}
@@ -45,4 +45,17 @@ func main() {
 	for _, server := range res.Servers {
 		fmt.Printf("\t- %v\n", server)
 	}
+	fmt.Println("partitions:")
+	for _, partition := range res.Partitions {
+		fmt.Printf("\t- %v\n", partition)
+	}
+
+	rebalance, err := client.GetRebalance(ctx, &api.GetRebalanceRequest{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("moves led by %s, balanced: %v\n", *addr, rebalance.Status.Balanced)
+	for _, move := range rebalance.Status.Moves {
+		fmt.Printf("\t- %v\n", move)
+	}
 }
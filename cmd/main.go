@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/djedjethai/generation/internal/agent"
 	"github.com/djedjethai/generation/internal/config"
@@ -18,7 +19,31 @@ import (
 var environment string
 var jaegerEndpoint string
 var shards int
+var hash string
+var partitions int
+var rebalanceBytesPerSecond int64
+var replicas int
+var maxMoves int
 var itemsPerShard int
+var evictionPolicy string
+var maxBytesPerShard int64
+var maxBytes int64
+var diskTierBytes uint64
+var compression string
+var encryptionKeyFile string
+var snapshotStore string
+var snapshotRetain int
+var snapshotMaxAge time.Duration
+var s3Endpoint string
+var s3Bucket string
+var s3Region string
+var s3Prefix string
+var snapshotThreshold uint64
+var snapshotInterval time.Duration
+var trailingLogs uint64
+var raftSegmentBytes uint64
+var raftSync string
+var raftSyncInterval time.Duration
 var fileLoggerActive bool
 var dbLoggerActive bool
 var isTracing bool
@@ -82,7 +107,31 @@ func setupFlags(cmd *cobra.Command) error {
 	cmd.Flags().StringVarP(&environment, "environment", "e", "dev", "set the environment dev or prod")
 	cmd.Flags().StringVarP(&jaegerEndpoint, "jaeger", "j", "http://jaeger:14268/api/traces", "the Jaeger end point to connect")
 	cmd.Flags().IntVarP(&shards, "shards", "s", 2, "number of shards")
+	cmd.Flags().StringVar(&hash, "hash", "fnv", "hash placing the keys on the shards fnv or xxhash")
+	cmd.Flags().IntVar(&partitions, "partitions", 1, "number of raft groups sharing the keys")
+	cmd.Flags().Int64Var(&rebalanceBytesPerSecond, "rebalanceBytesPerSecond", 0, "bytes per second streamed to a node catching up on a partition, 0 for no limit")
+	cmd.Flags().IntVar(&replicas, "replicas", 0, "voters of each partition, 0 for all the nodes")
+	cmd.Flags().IntVar(&maxMoves, "maxMoves", 1, "nodes catching up at once on the partitions led by a node")
 	cmd.Flags().IntVarP(&itemsPerShard, "itemPerShard", "i", 10, "number of shards")
+	cmd.Flags().StringVar(&evictionPolicy, "evictionPolicy", "lru", "eviction policy lru, lfu, arc or tinylfu")
+	cmd.Flags().Int64Var(&maxBytesPerShard, "maxBytesPerShard", 0, "max bytes of the records of a shard, 0 for no limit")
+	cmd.Flags().Int64Var(&maxBytes, "maxBytes", 0, "max bytes of the records of the node, 0 for no limit")
+	cmd.Flags().Uint64Var(&diskTierBytes, "diskTierBytes", 0, "max bytes of the disk tier keeping the evicted records, 0 for none")
+	cmd.Flags().StringVar(&compression, "compression", "none", "compression of the snapshots, the raft log and the disk tier none, zstd or snappy")
+	cmd.Flags().StringVar(&encryptionKeyFile, "encryptionKeyFile", "", "file of the aes-gcm keys encrypting the data on disk, one \"<id> <base64 key>\" per line, the last one encrypts")
+	cmd.Flags().StringVar(&snapshotStore, "snapshotStore", "file", "store of the raft snapshots file, in the data dir, or s3")
+	cmd.Flags().IntVar(&snapshotRetain, "snapshotRetain", 1, "number of snapshots kept by partition")
+	cmd.Flags().DurationVar(&snapshotMaxAge, "snapshotMaxAge", 0, "max age of the snapshots, the latest one is kept whatever its age, 0 for no limit")
+	cmd.Flags().StringVar(&s3Endpoint, "s3Endpoint", "", "url of the s3-compatible snapshot store, the credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	cmd.Flags().StringVar(&s3Bucket, "s3Bucket", "", "bucket of the snapshots")
+	cmd.Flags().StringVar(&s3Region, "s3Region", "us-east-1", "region of the bucket")
+	cmd.Flags().StringVar(&s3Prefix, "s3Prefix", "", "prefix of the snapshots in the bucket, they are under <prefix>/<node name>/<partition>")
+	cmd.Flags().Uint64Var(&snapshotThreshold, "snapshotThreshold", 8192, "number of entries in the raft log since the previous snapshot which triggers a snapshot")
+	cmd.Flags().DurationVar(&snapshotInterval, "snapshotInterval", 2*time.Minute, "how often the snapshot threshold is checked")
+	cmd.Flags().Uint64Var(&trailingLogs, "trailingLogs", 10240, "number of entries left in the raft log after a snapshot, for the followers a bit behind")
+	cmd.Flags().Uint64Var(&raftSegmentBytes, "raftSegmentBytes", 64<<10, "max bytes of a segment of the raft log, the log is compacted by whole segments")
+	cmd.Flags().StringVar(&raftSync, "raftSync", "always", "when the entries of the raft log are synced to the disk always, periodic or never")
+	cmd.Flags().DurationVar(&raftSyncInterval, "raftSyncInterval", 100*time.Millisecond, "how often the raft log is synced with the periodic policy")
 	cmd.Flags().BoolVarP(&dbLoggerActive, "dbLogger", "d", false, "enable the database logging")
 	cmd.Flags().BoolVarP(&isTracing, "isTracing", "t", false, "enable Jaeger tracing")
 	cmd.Flags().BoolVarP(&isMetrics, "isMetrics", "m", false, "enable Prometheus metrics")
@@ -165,7 +214,31 @@ func (c *cli) run(cmd *cobra.Command, args []string) error {
 	c.cfg.FileLoggerActive = fileLoggerActive
 	c.cfg.DBLoggerActive = dbLoggerActive
 	c.cfg.Shards = shards
+	c.cfg.Hash = hash
+	c.cfg.Partitions = partitions
+	c.cfg.RebalanceBytesPerSecond = rebalanceBytesPerSecond
+	c.cfg.Replicas = replicas
+	c.cfg.MaxMoves = maxMoves
 	c.cfg.ItemsPerShard = itemsPerShard
+	c.cfg.EvictionPolicy = evictionPolicy
+	c.cfg.MaxBytesPerShard = maxBytesPerShard
+	c.cfg.MaxBytes = maxBytes
+	c.cfg.DiskTierBytes = diskTierBytes
+	c.cfg.Compression = compression
+	c.cfg.EncryptionKeyFile = encryptionKeyFile
+	c.cfg.SnapshotStore = snapshotStore
+	c.cfg.SnapshotRetain = snapshotRetain
+	c.cfg.SnapshotMaxAge = snapshotMaxAge
+	c.cfg.S3Endpoint = s3Endpoint
+	c.cfg.S3Bucket = s3Bucket
+	c.cfg.S3Region = s3Region
+	c.cfg.S3Prefix = s3Prefix
+	c.cfg.SnapshotThreshold = snapshotThreshold
+	c.cfg.SnapshotInterval = snapshotInterval
+	c.cfg.TrailingLogs = trailingLogs
+	c.cfg.RaftSegmentBytes = raftSegmentBytes
+	c.cfg.RaftSync = raftSync
+	c.cfg.RaftSyncInterval = raftSyncInterval
 	c.cfg.IsTracing = isTracing
 	c.cfg.IsMetrics = isMetrics
 	c.cfg.JaegerEndpoint = jaegerEndpoint
@@ -0,0 +1,145 @@
+// snapshot takes, lists, downloads and restores the snapshots of the partitions of a node:
+//
+//	snapshot -addr :8400 create
+//	snapshot -addr :8400 list
+//	snapshot -addr :8400 -partition 0 [-id <id>] download <file>
+//	snapshot -addr :8400 -partition 0 restore <file>
+//
+// To restore a fresh cluster, with the partitions and the encryption keys of the
+// cluster of the snapshots, the snapshot of each partition is restored
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+func main() {
+	addr := flag.String("addr", ":8400", "service address")
+	partition := flag.Uint("partition", 0, "partition of the snapshot")
+	id := flag.String("id", "", "snapshot to download, the latest one if empty")
+	flag.Parse()
+
+	clientTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: config.ClientCertFile,
+		KeyFile:  config.ClientKeyFile,
+		CAFile:   config.CAFile,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := grpc.Dial(*addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(clientTLSConfig)),
+		grpc.WithBlock(),
+		grpc.WithTimeout(time.Second),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := api.NewKeyValueClient(conn)
+	ctx := context.Background()
+
+	switch flag.Arg(0) {
+	case "create":
+		res, err := client.CreateSnapshot(ctx, &api.CreateSnapshotRequest{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		printSnapshots(res.Snapshots)
+	case "list":
+		res, err := client.ListSnapshots(ctx, &api.ListSnapshotsRequest{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		printSnapshots(res.Snapshots)
+	case "download":
+		err = download(ctx, client, uint32(*partition), *id, flag.Arg(1))
+	case "restore":
+		err = restore(ctx, client, uint32(*partition), flag.Arg(1))
+	default:
+		err = fmt.Errorf("unknown command %q, create, list, download or restore", flag.Arg(0))
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func printSnapshots(snapshots []*api.SnapshotInfo) {
+	for _, s := range snapshots {
+		fmt.Printf("partition %d\t%s\tindex %d\t%d bytes\t%s\n",
+			s.Partition, s.Id, s.Index, s.Size, time.UnixMilli(s.CreatedAt).Format(time.RFC3339))
+	}
+}
+
+func download(ctx context.Context, client api.KeyValueClient, partition uint32, id, file string) error {
+	stream, err := client.DownloadSnapshot(ctx, &api.DownloadSnapshotRequest{Partition: partition, Id: id})
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return f.Sync()
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.Info != nil {
+			fmt.Printf("downloading %s of partition %d, %d bytes\n", chunk.Info.Id, chunk.Info.Partition, chunk.Info.Size)
+		}
+		if _, err := f.Write(chunk.Data); err != nil {
+			return err
+		}
+	}
+}
+
+func restore(ctx context.Context, client api.KeyValueClient, partition uint32, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stream, err := client.RestoreSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	chunk := &api.SnapshotChunk{Info: &api.SnapshotInfo{Partition: partition}}
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 || chunk.Info != nil {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &api.SnapshotChunk{}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("partition %d restored, snapshot %s at index %d\n", res.Snapshot.Partition, res.Snapshot.Id, res.Snapshot.Index)
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/djedjethai/generation/internal/codec"
 	"github.com/djedjethai/generation/internal/config"
 	"github.com/djedjethai/generation/internal/deleter"
 	"github.com/djedjethai/generation/internal/discovery"
@@ -18,6 +19,7 @@ import (
 	"github.com/djedjethai/generation/internal/handlers/grpc"
 	"github.com/djedjethai/generation/internal/handlers/rest"
 	"github.com/djedjethai/generation/internal/logger"
+	"github.com/djedjethai/generation/internal/objstore"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/setter"
 	"github.com/djedjethai/generation/internal/storage"
@@ -32,7 +34,8 @@ type Agent struct {
 
 	mux          cmux.CMux
 	server       *gglGrpc.Server
-	Storage      *storage.DistributedStorage
+	forwarder    *grpc.Forwarder
+	Storage      *storage.PartitionedStorage
 	membership   *discovery.Membership
 	shutdown     bool
 	shutdowns    chan struct{}
@@ -47,6 +50,51 @@ type Config struct {
 	DBLoggerActive   bool
 	Shards           int
 	ItemsPerShard    int
+	// fnv(default) or xxhash, the shards and the hash can change between two runs
+	Hash string
+	// number of raft groups sharing the keys, default to 1
+	Partitions int
+	// bytes per second streamed to a node catching up on a partition, 0 for no limit
+	RebalanceBytesPerSecond int64
+	// the voters of each partition, 0 for all the nodes
+	Replicas int
+	// the nodes catching up at once on the partitions led by a node, default to 1
+	MaxMoves int
+	// lru(default), lfu, arc or tinylfu
+	EvictionPolicy string
+	// byte budgets of a shard and of the node, 0 for no limit
+	MaxBytesPerShard int64
+	MaxBytes         int64
+	// max bytes of the disk tier keeping the evicted records of the node, 0 for none
+	DiskTierBytes uint64
+	// none(default), zstd or snappy, for the snapshots, the raft log and the disk tier
+	Compression string
+	// the aes-gcm keys encrypting them, without file the keys are read from the env
+	// variable GENERATION_ENCRYPTION_KEYS, and without both nothing is encrypted
+	EncryptionKeyFile string
+	// file(default), in the data dir, or s3, where the raft snapshots are kept
+	SnapshotStore string
+	// the snapshots kept by partition, default to 1, and their max age, the latest
+	// one is kept whatever its age
+	SnapshotRetain int
+	SnapshotMaxAge time.Duration
+	// the bucket of the s3 snapshot store, the credentials are read from the env
+	// variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+	S3Endpoint string
+	S3Bucket   string
+	S3Region   string
+	S3Prefix   string
+	// a raft snapshot is taken once SnapshotThreshold entries are in the log, checked
+	// every SnapshotInterval, then the log is compacted but the TrailingLogs last entries,
+	// by segments of RaftSegmentBytes. The defaults of raft and 1024 bytes if zero
+	SnapshotThreshold uint64
+	SnapshotInterval  time.Duration
+	TrailingLogs      uint64
+	RaftSegmentBytes  uint64
+	// always(default), periodic, every RaftSyncInterval, or never, when the entries of
+	// the raft log are synced to the disk
+	RaftSync         string
+	RaftSyncInterval time.Duration
 	Protocol         string
 	IsTracing        bool
 	IsMetrics        bool
@@ -138,7 +186,7 @@ func (a *Agent) setupMux() error {
 }
 
 func (a *Agent) setupStorage(shards, itemsPerShard int) error {
-	if shards > 0 && itemsPerShard > 0 {
+	if shards > 0 && (itemsPerShard > 0 || a.config.MaxBytesPerShard > 0 || a.config.MaxBytes > 0) {
 		// TODO replace shardedMap with distributed.go, New
 		// shardedMap := storage.NewShardedMap(shards, itemsPerShard, a.config.Observability)
 		// TODO replace ....
@@ -153,12 +201,44 @@ func (a *Agent) setupStorage(shards, itemsPerShard int) error {
 		})
 
 		logConfig := storage.Config{}
-		logConfig.Raft.StreamLayer = storage.NewStreamLayer(
+		logConfig.Eviction = storage.Eviction{
+			Policy:           a.config.EvictionPolicy,
+			MaxBytesPerShard: a.config.MaxBytesPerShard,
+			MaxBytes:         a.config.MaxBytes,
+		}
+		logConfig.DiskTierBytes = a.config.DiskTierBytes
+		logConfig.Hash = a.config.Hash
+		logConfig.Rebalance.BytesPerSecond = a.config.RebalanceBytesPerSecond
+		logConfig.Rebalance.Replicas = a.config.Replicas
+		logConfig.Rebalance.MaxMoves = a.config.MaxMoves
+		keys, err := codec.LoadKeys(a.config.EncryptionKeyFile)
+		if err != nil {
+			return err
+		}
+		if logConfig.Codec, err = codec.New(a.config.Compression, keys); err != nil {
+			return err
+		}
+		logConfig.Snapshots = storage.Snapshots{
+			Store:  a.config.SnapshotStore,
+			Retain: a.config.SnapshotRetain,
+			MaxAge: a.config.SnapshotMaxAge,
+			S3: objstore.S3Config{
+				Endpoint: a.config.S3Endpoint,
+				Bucket:   a.config.S3Bucket,
+				Region:   a.config.S3Region,
+			},
+			Prefix: a.config.S3Prefix,
+		}
+		partitions := a.config.Partitions
+		if partitions == 0 {
+			partitions = 1
+		}
+		layers := storage.NewStreamLayers(
 			raftLn,
+			partitions,
 			a.config.ServerTLSConfig,
 			a.config.PeerTLSConfig,
 		)
-		var err error
 		rpcAddr, err := a.config.RPCAddr()
 		if err != nil {
 			return err
@@ -166,10 +246,17 @@ func (a *Agent) setupStorage(shards, itemsPerShard int) error {
 		logConfig.Raft.BindAddr = rpcAddr
 		logConfig.Raft.LocalID = raft.ServerID(a.config.NodeName)
 		logConfig.Raft.Bootstrap = a.config.Bootstrap
-
-		a.Storage, err = storage.NewDistributedStorage(
+		logConfig.Raft.SnapshotThreshold = a.config.SnapshotThreshold
+		logConfig.Raft.SnapshotInterval = a.config.SnapshotInterval
+		logConfig.Raft.TrailingLogs = a.config.TrailingLogs
+		logConfig.Raft.SegmentBytes = a.config.RaftSegmentBytes
+		logConfig.Raft.Sync = a.config.RaftSync
+		logConfig.Raft.SyncInterval = a.config.RaftSyncInterval
+
+		a.Storage, err = storage.NewPartitionedStorage(
 			a.config.DataDir,
 			logConfig,
+			layers,
 			shards,
 			itemsPerShard,
 			a.config.Observability,
@@ -177,6 +264,9 @@ func (a *Agent) setupStorage(shards, itemsPerShard int) error {
 		if err != nil {
 			return err
 		}
+		// the partitions the node does not serve are read from their leader
+		a.forwarder = grpc.NewForwarder(a.config.PeerTLSConfig)
+		a.Storage.SetRemote(grpc.NewRemote(a.forwarder))
 
 		if a.config.Bootstrap {
 			err = a.Storage.WaitForLeader(3 * time.Second)
@@ -248,7 +338,7 @@ func (a *Agent) runGRPC() error {
 	}
 
 	var err error
-	a.server, err = grpc.NewGRPCServer(a.config.Services, a.config.LoggerFacade, opts...)
+	a.server, err = grpc.NewGRPCServer(a.config.Services, a.config.LoggerFacade, a.forwarder, opts...)
 	if err != nil {
 		return err
 	}
@@ -267,7 +357,11 @@ func (a *Agent) setupMembership() error {
 	if err != nil {
 		return err
 	}
-	a.membership, err = discovery.New(a.Storage, discovery.Config{
+	a.membership, err = discovery.New(&handler{
+		storage:   a.Storage,
+		forwarder: a.forwarder,
+		addrs:     make(map[string]string),
+	}, discovery.Config{
 		NodeName: a.config.NodeName,
 		BindAddr: a.config.BindAddr,
 		Tags: map[string]string{
@@ -278,6 +372,36 @@ func (a *Agent) setupMembership() error {
 	return err
 }
 
+// handler tells the membership to the storage, the connections to a server leaving are closed
+type handler struct {
+	storage   *storage.PartitionedStorage
+	forwarder *grpc.Forwarder
+
+	mu sync.Mutex
+	// the rpc address of the servers, by name
+	addrs map[string]string
+}
+
+func (h *handler) Join(name, addr string) error {
+	h.mu.Lock()
+	if old, ok := h.addrs[name]; ok && old != addr {
+		h.forwarder.Forget(old)
+	}
+	h.addrs[name] = addr
+	h.mu.Unlock()
+	return h.storage.Join(name, addr)
+}
+
+func (h *handler) Leave(name string) error {
+	h.mu.Lock()
+	if addr, ok := h.addrs[name]; ok {
+		h.forwarder.Forget(addr)
+		delete(h.addrs, name)
+	}
+	h.mu.Unlock()
+	return h.storage.Leave(name)
+}
+
 func (a *Agent) Shutdown() error {
 	a.shutdownLock.Lock()
 	defer a.shutdownLock.Unlock()
@@ -292,10 +416,13 @@ func (a *Agent) Shutdown() error {
 	shutdown := []func() error{
 		a.membership.Leave,
 		func() error {
+			// the watch streams would never let GracefulStop return
+			a.Storage.StopWatches()
 			a.server.GracefulStop()
 			return nil
 		},
 		a.Storage.Close,
+		a.forwarder.Close,
 	}
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
@@ -8,6 +8,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"sync"
 	"testing"
 	"time"
@@ -18,91 +21,34 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/status"
 )
 
-func TestAgent(t *testing.T) {
-	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		CertFile:      config.ServerCertFile,
-		KeyFile:       config.ServerKeyFile,
-		CAFile:        config.CAFile,
-		Server:        true,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
-	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
-		// CertFile:      config.RootClientCertFile,
-		CertFile: config.ClientCertFile,
-		// KeyFile:       config.RootClientKeyFile,
-		KeyFile:       config.ClientKeyFile,
-		CAFile:        config.CAFile,
-		Server:        false,
-		ServerAddress: "127.0.0.1",
-	})
-	require.NoError(t, err)
-	// var agents []*agent.Agent
-	var agents []*Agent
-	for i := 0; i < 3; i++ {
-		ports := dynaport.Get(2)
-		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
-		rpcPort := ports[1]
-		dataDir, err := ioutil.TempDir("", "agent-test-log")
-		require.NoError(t, err)
-		var startJoinAddrs []string
-		if i != 0 {
-			startJoinAddrs = append(
-				startJoinAddrs,
-				agents[0].config.BindAddr,
-			)
-		}
-
-		// set the configs
-		config := Config{
-			NodeName:       fmt.Sprintf("%d", i),
-			StartJoinAddrs: startJoinAddrs,
-			BindAddr:       bindAddr,
-			PortGRPC:       rpcPort,
-			DataDir:        dataDir,
-			// ACLModelFile:    config.ACLModelFile,
-			// ACLPolicyFile:   config.ACLPolicyFile,
-			ServerTLSConfig: serverTLSConfig,
-			PeerTLSConfig:   peerTLSConfig,
-			Bootstrap:       i == 0,
-			//
-			FileLoggerActive: false,
-			DBLoggerActive:   false,
-			Shards:           3,
-			ItemsPerShard:    10,
-			Protocol:         "grpc",
-			IsTracing:        false,
-			IsMetrics:        false,
-			JaegerEndpoint:   "",
-			Observability:    &observability.Observability{},
-		}
-
-		logger := observability.NewSrvLogger("debug")
-		config.Observability.Logger = logger
-
-		agent, err := New(config)
-		require.NoError(t, err)
-		agents = append(agents, agent)
+// the certs are generated for the run, see config.GenerateCerts
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		panic(err)
 	}
-	defer func() {
-		for _, agent := range agents {
-			err := agent.Shutdown()
-			require.NoError(t, err)
-			require.NoError(t,
-				os.RemoveAll(agent.config.DataDir),
-			)
-		}
-	}()
+	if err := config.GenerateCerts(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestAgent(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 10, 1, 0)
+	defer teardown()
 
 	time.Sleep(3 * time.Second)
 	leaderClient := client(t, agents[0], peerTLSConfig)
 
 	// put 2 values(from leader)
-	_, err = leaderClient.Put(
+	_, err := leaderClient.Put(
 		context.Background(),
 		&api.PutRequest{
 			Records: &api.Records{
@@ -154,15 +100,30 @@ func TestAgent(t *testing.T) {
 	followerClient := client(t, agents[1], peerTLSConfig)
 	response, err := followerClient.GetKeys(
 		context.Background(),
-		&api.GetKeysRequest{},
+		&api.GetKeysRequest{
+			Consistency: api.Consistency_STALE,
+		},
 	)
 	require.NoError(t, err)
 	require.Equal(t, len(response.Keys), 2)
+	require.NotZero(t, response.AppliedIndex)
+
+	// a follower reads a linearizable read from the leader
+	consume, err = followerClient.Get(
+		context.Background(),
+		&api.GetRequest{
+			Key: "key1",
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, "value1", consume.Value)
 
 	// get all keysvalues(from follower)
 	keysvalues, err := followerClient.GetKeysValuesStream(
 		context.Background(),
-		&api.Empty{},
+		&api.GetKeysValuesRequest{
+			Consistency: api.Consistency_STALE,
+		},
 	)
 
 	var keys []string
@@ -212,10 +173,407 @@ func TestAgent(t *testing.T) {
 	// get all keys(from leader), make sure the deleted one is gone
 	response, err = followerClient.GetKeys(
 		context.Background(),
-		&api.GetKeysRequest{},
+		&api.GetKeysRequest{
+			Consistency: api.Consistency_STALE,
+		},
 	)
 	require.NoError(t, err)
 	require.Equal(t, len(response.Keys), 1)
+
+	// a put sent to a follower is forwarded to the leader
+	_, err = followerClient.Put(
+		context.Background(),
+		&api.PutRequest{
+			Records: &api.Records{
+				Key:   "key3",
+				Value: "value3",
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	consume, err = leaderClient.Get(
+		context.Background(),
+		&api.GetRequest{
+			Key: "key3",
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, consume.Value, "value3")
+
+	// so is a delete
+	_, err = followerClient.Delete(
+		context.Background(),
+		&api.DeleteRequest{
+			Key: "key3",
+		},
+	)
+	require.NoError(t, err)
+
+	_, err = leaderClient.Get(
+		context.Background(),
+		&api.GetRequest{
+			Key: "key3",
+		},
+	)
+	st, ok = status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, st.Code().String(), "Code(404)")
+}
+
+// the followers are read locally(stale reads), which must not change the keys they evict
+func TestAgentsEvictTheSameKeys(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 5, 1, 0)
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	var followerClients []api.KeyValueClient
+	for _, agent := range agents[1:] {
+		followerClients = append(followerClients, client(t, agent, peerTLSConfig))
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 60; i++ {
+		_, err := leaderClient.Put(ctx, &api.PutRequest{
+			Records: &api.Records{
+				Key:   fmt.Sprintf("key%d", i),
+				Value: fmt.Sprintf("value%d", i),
+			},
+		})
+		require.NoError(t, err)
+
+		// each follower keeps other keys alive
+		for j, c := range followerClients {
+			_, _ = c.Get(ctx, &api.GetRequest{
+				Key:         fmt.Sprintf("key%d", (i/2)*j),
+				Consistency: api.Consistency_STALE,
+			})
+		}
+	}
+
+	keys := func(c api.KeyValueClient) []string {
+		res, err := c.GetKeys(ctx, &api.GetKeysRequest{
+			Consistency: api.Consistency_STALE,
+		})
+		require.NoError(t, err)
+		sort.Strings(res.Keys)
+		return res.Keys
+	}
+
+	require.Eventually(t, func() bool {
+		leaderKeys := keys(leaderClient)
+		if len(leaderKeys) > 3*5 {
+			return false
+		}
+		for _, c := range followerClients {
+			if !reflect.DeepEqual(leaderKeys, keys(c)) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+// setupAgents starts a cluster of 3 agents, the first one bootstraps it
+func setupAgents(t *testing.T, itemsPerShard, partitions, replicas int) ([]*Agent, *tls.Config, func()) {
+	serverTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetupTLSConfig(config.TLSConfig{
+		// CertFile:      config.RootClientCertFile,
+		CertFile: config.ClientCertFile,
+		// KeyFile:       config.RootClientKeyFile,
+		KeyFile:       config.ClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	// var agents []*agent.Agent
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		ports := dynaport.Get(2)
+		bindAddr := fmt.Sprintf("%s:%d", "127.0.0.1", ports[0])
+		rpcPort := ports[1]
+		dataDir, err := ioutil.TempDir("", "agent-test-log")
+		require.NoError(t, err)
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(
+				startJoinAddrs,
+				agents[0].config.BindAddr,
+			)
+		}
+
+		// set the configs
+		config := Config{
+			NodeName:       fmt.Sprintf("%d", i),
+			StartJoinAddrs: startJoinAddrs,
+			BindAddr:       bindAddr,
+			PortGRPC:       rpcPort,
+			DataDir:        dataDir,
+			// ACLModelFile:    config.ACLModelFile,
+			// ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Bootstrap:       i == 0,
+			//
+			FileLoggerActive: false,
+			DBLoggerActive:   false,
+			Shards:           3,
+			ItemsPerShard:    itemsPerShard,
+			Partitions:       partitions,
+			Replicas:         replicas,
+			Protocol:         "grpc",
+			IsTracing:        false,
+			IsMetrics:        false,
+			JaegerEndpoint:   "",
+			Observability:    &observability.Observability{},
+		}
+
+		logger := observability.NewSrvLogger("debug")
+		config.Observability.Logger = logger
+
+		agent, err := New(config)
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	return agents, peerTLSConfig, func() {
+		for _, agent := range agents {
+			err := agent.Shutdown()
+			require.NoError(t, err)
+			require.NoError(t,
+				os.RemoveAll(agent.config.DataDir),
+			)
+		}
+	}
+}
+
+// the keys are split between the raft groups, a write is forwarded to the leader of its partition
+func TestAgentPartitions(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 100, 3, 0)
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+	followerClient := client(t, agents[1], peerTLSConfig)
+	ctx := context.Background()
+
+	servers, err := followerClient.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, servers.Servers, 3)
+	require.Len(t, servers.Partitions, 3)
+	for i, p := range servers.Partitions {
+		require.Equal(t, uint32(i), p.Id)
+		require.NotEmpty(t, p.LeaderAddr)
+		// the partition 0 keeps the layout of a single partition
+		dir := filepath.Join(agents[0].config.DataDir, fmt.Sprintf("partition-%d", i))
+		if i == 0 {
+			dir = agents[0].config.DataDir
+		}
+		_, err := os.Stat(filepath.Join(dir, "raft"))
+		require.NoError(t, err)
+	}
+
+	var clients []api.KeyValueClient
+	for _, agent := range agents {
+		clients = append(clients, client(t, agent, peerTLSConfig))
+	}
+	// the rebalancer moves the leaders of the partitions to their placement
+	require.Eventually(t, func() bool {
+		servers, err := followerClient.GetServers(ctx, &api.GetServersRequest{})
+		if err != nil || len(servers.Partitions) != 3 {
+			return false
+		}
+		for _, p := range servers.Partitions {
+			if p.LeaderId == "" {
+				return false
+			}
+		}
+		for _, c := range clients {
+			res, err := c.GetRebalance(ctx, &api.GetRebalanceRequest{})
+			if err != nil || !res.Status.Balanced {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+
+	partitions := make(map[int]bool)
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%d", i)
+		partitions[agents[0].Storage.PartitionOf(key)] = true
+		_, err := followerClient.Put(ctx, &api.PutRequest{
+			Records: &api.Records{Key: key, Value: "value"},
+		})
+		require.NoError(t, err)
+	}
+	require.Len(t, partitions, 3)
+
+	// a transaction must stay in a partition
+	var other string
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("other%d", i); agents[0].Storage.PartitionOf(key) != agents[0].Storage.PartitionOf("key0") {
+			other = key
+		}
+	}
+	_, err = followerClient.Txn(ctx, &api.TxnRequest{
+		Success: []*api.TxnOp{txnPut("key0", "a"), txnPut(other, "b")},
+	})
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+
+	for _, c := range clients {
+		require.Eventually(t, func() bool {
+			res, err := c.GetKeys(ctx, &api.GetKeysRequest{
+				Consistency: api.Consistency_STALE,
+			})
+			return err == nil && len(res.Keys) == 30
+		}, 5*time.Second, 100*time.Millisecond)
+	}
+}
+
+// a partition has two voters, the reads of a partition a node does not serve go to its leader
+func TestAgentReplicas(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 100, 3, 2)
+	defer teardown()
+
+	time.Sleep(3 * time.Second)
+	ctx := context.Background()
+	var clients []api.KeyValueClient
+	for _, agent := range agents {
+		clients = append(clients, client(t, agent, peerTLSConfig))
+	}
+
+	// each partition is placed on two nodes, led by one of them
+	require.Eventually(t, func() bool {
+		for _, c := range clients {
+			res, err := c.GetRebalance(ctx, &api.GetRebalanceRequest{})
+			if err != nil || !res.Status.Balanced {
+				return false
+			}
+		}
+		servers, err := clients[2].GetServers(ctx, &api.GetServersRequest{})
+		if err != nil {
+			return false
+		}
+		for _, p := range servers.Partitions {
+			var voters []string
+			for _, srv := range p.Servers {
+				voters = append(voters, srv.Id)
+			}
+			if len(voters) != 2 || (voters[0] != p.LeaderId && voters[1] != p.LeaderId) {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 100*time.Millisecond)
+
+	for i := 0; i < 30; i++ {
+		_, err := clients[i%3].Put(ctx, &api.PutRequest{
+			Records: &api.Records{Key: fmt.Sprintf("key%d", i), Value: "value"},
+		})
+		require.NoError(t, err)
+	}
+
+	for _, c := range clients {
+		for i := 0; i < 30; i++ {
+			res, err := c.Get(ctx, &api.GetRequest{Key: fmt.Sprintf("key%d", i)})
+			require.NoError(t, err)
+			require.Equal(t, "value", res.Value)
+		}
+		require.Eventually(t, func() bool {
+			for i := 0; i < 30; i++ {
+				res, err := c.Get(ctx, &api.GetRequest{Key: fmt.Sprintf("key%d", i), Consistency: api.Consistency_STALE})
+				if err != nil || res.Value != "value" {
+					return false
+				}
+			}
+			return true
+		}, 5*time.Second, 100*time.Millisecond)
+
+		keys, err := c.GetKeys(ctx, &api.GetKeysRequest{Limit: 7})
+		require.NoError(t, err)
+		require.Len(t, keys.Keys, 7)
+		count, err := c.GetKeys(ctx, &api.GetKeysRequest{Glob: "key1*", CountOnly: true})
+		require.NoError(t, err)
+		require.Equal(t, int64(11), count.Count)
+		scan, err := c.Scan(ctx, &api.ScanRequest{Start: "key", Limit: 100})
+		require.NoError(t, err)
+		require.Len(t, scan.Results, 30)
+	}
+}
+
+// the snapshot of a cluster restores a fresh one, the restore sent to a follower is relayed to the leader
+func TestAgentSnapshots(t *testing.T) {
+	agents, peerTLSConfig, teardown := setupAgents(t, 100, 1, 0)
+	time.Sleep(3 * time.Second)
+	leaderClient := client(t, agents[0], peerTLSConfig)
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		_, err := leaderClient.Put(ctx, &api.PutRequest{
+			Records: &api.Records{Key: fmt.Sprintf("key%d", i), Value: "value"},
+		})
+		require.NoError(t, err)
+	}
+	created, err := leaderClient.CreateSnapshot(ctx, &api.CreateSnapshotRequest{})
+	require.NoError(t, err)
+	require.Len(t, created.Snapshots, 1)
+	listed, err := leaderClient.ListSnapshots(ctx, &api.ListSnapshotsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, created.Snapshots[0].Id, listed.Snapshots[0].Id)
+
+	stream, err := leaderClient.DownloadSnapshot(ctx, &api.DownloadSnapshotRequest{})
+	require.NoError(t, err)
+	var snapshot []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if chunk.Info != nil {
+			require.Equal(t, created.Snapshots[0].Id, chunk.Info.Id)
+		}
+		snapshot = append(snapshot, chunk.Data...)
+	}
+	require.Equal(t, created.Snapshots[0].Size, int64(len(snapshot)))
+	teardown()
+
+	agents, peerTLSConfig, teardown = setupAgents(t, 100, 1, 0)
+	defer teardown()
+	time.Sleep(3 * time.Second)
+	restore, err := client(t, agents[1], peerTLSConfig).RestoreSnapshot(ctx)
+	require.NoError(t, err)
+	for i, chunk := range []*api.SnapshotChunk{
+		{Info: &api.SnapshotInfo{}, Data: snapshot[:len(snapshot)/2]},
+		{Data: snapshot[len(snapshot)/2:]},
+	} {
+		require.NoError(t, restore.Send(chunk), i)
+	}
+	res, err := restore.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, uint32(0), res.Snapshot.Partition)
+
+	for _, agent := range agents {
+		c := client(t, agent, peerTLSConfig)
+		require.Eventually(t, func() bool {
+			res, err := c.GetKeys(ctx, &api.GetKeysRequest{
+				Consistency: api.Consistency_STALE,
+			})
+			return err == nil && len(res.Keys) == 10
+		}, 5*time.Second, 100*time.Millisecond)
+	}
+}
+
+func txnPut(key, value string) *api.TxnOp {
+	return &api.TxnOp{Op: &api.TxnOp_Put{Put: &api.TxnPut{Key: key, Value: &api.Value{Kind: &api.Value_StringValue{StringValue: value}}}}}
 }
 
 func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.KeyValueClient {
@@ -0,0 +1,173 @@
+// Package codec compresses and encrypts the data the node keeps on its disk,
+// the raft snapshots, the segments of the raft log and the disk tier.
+//
+// A sealed blob starts with a byte naming its algorithms, the compression in the
+// low 4 bits and the encryption in the high 4 bits. An encrypted blob goes on with
+// the id of its key(uint32, big endian), the nonce and the ciphertext
+package codec
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone   = "none"
+	CompressionZstd   = "zstd"
+	CompressionSnappy = "snappy"
+)
+
+// the algorithms of the header of a blob
+const (
+	compressNone byte = iota
+	compressZstd
+	compressSnappy
+)
+
+const (
+	encryptNone byte = iota
+	encryptAESGCM
+)
+
+const (
+	// the algorithms and the key id, authenticated with the ciphertext
+	headerSize = 5
+	nonceSize  = 12
+)
+
+var (
+	ErrorUnknownCompression = errors.New("unknown compression, none, zstd or snappy")
+	ErrorUnknownKey         = errors.New("unknown encryption key")
+	ErrorCorrupted          = errors.New("sealed data corrupted")
+)
+
+// Codec seals the blobs with its compression and the active key of its keyring.
+// It opens the blobs of any compression and of any key of its keyring, so the
+// algorithms and the keys can change between two runs. A nil Codec does not compress
+// nor encrypt
+type Codec struct {
+	compression byte
+	keys        *Keyring
+}
+
+// New returns the codec of the compression(none, zstd or snappy),
+// the blobs are not encrypted if keys is nil
+func New(compression string, keys *Keyring) (*Codec, error) {
+	c := &Codec{keys: keys}
+	switch compression {
+	case "", CompressionNone:
+	case CompressionZstd:
+		c.compression = compressZstd
+	case CompressionSnappy:
+		c.compression = compressSnappy
+	default:
+		return nil, ErrorUnknownCompression
+	}
+	return c, nil
+}
+
+// Seal returns the blob of p
+func (c *Codec) Seal(p []byte) ([]byte, error) {
+	var alg byte
+	var keys *Keyring
+	if c != nil {
+		alg, keys = c.compression, c.keys
+	}
+
+	body := p
+	switch alg {
+	case compressZstd:
+		enc, _ := zstdCodec()
+		body = enc.EncodeAll(p, nil)
+	case compressSnappy:
+		body = snappy.Encode(nil, p)
+	}
+
+	if keys == nil {
+		return append([]byte{alg}, body...), nil
+	}
+	id, aead := keys.activeKey()
+	out := make([]byte, headerSize+nonceSize, headerSize+nonceSize+len(body)+aead.Overhead())
+	out[0] = alg | encryptAESGCM<<4
+	binary.BigEndian.PutUint32(out[1:], id)
+	nonce := out[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, body, out[:headerSize]), nil
+}
+
+// Open returns the bytes sealed in the blob, they may share the memory of blob
+func (c *Codec) Open(blob []byte) ([]byte, error) {
+	if len(blob) == 0 {
+		return nil, ErrorCorrupted
+	}
+	alg := blob[0]
+
+	body := blob[1:]
+	switch alg >> 4 {
+	case encryptNone:
+	case encryptAESGCM:
+		if len(blob) < headerSize+nonceSize {
+			return nil, ErrorCorrupted
+		}
+		var keys *Keyring
+		if c != nil {
+			keys = c.keys
+		}
+		aead, ok := keys.key(binary.BigEndian.Uint32(blob[1:]))
+		if !ok {
+			return nil, ErrorUnknownKey
+		}
+		var err error
+		nonce := blob[headerSize : headerSize+nonceSize]
+		body, err = aead.Open(nil, nonce, blob[headerSize+nonceSize:], blob[:headerSize])
+		if err != nil {
+			return nil, ErrorCorrupted
+		}
+	default:
+		return nil, ErrorCorrupted
+	}
+
+	switch alg & 0x0f {
+	case compressNone:
+		return body, nil
+	case compressZstd:
+		_, dec := zstdCodec()
+		p, err := dec.DecodeAll(body, nil)
+		if err != nil {
+			return nil, ErrorCorrupted
+		}
+		return p, nil
+	case compressSnappy:
+		p, err := snappy.Decode(nil, body)
+		if err != nil {
+			return nil, ErrorCorrupted
+		}
+		return p, nil
+	default:
+		return nil, ErrorCorrupted
+	}
+}
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// zstdCodec returns the encoder and the decoder shared by the codecs,
+// their EncodeAll and DecodeAll can be called concurrently
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		// the options are valid, they can not fail
+		zstdEnc, _ = zstd.NewWriter(nil)
+		zstdDec, _ = zstd.NewReader(nil)
+	})
+	return zstdEnc, zstdDec
+}
@@ -0,0 +1,144 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newKey(t *testing.T, size int) string {
+	key := make([]byte, size)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestSealOpen(t *testing.T) {
+	keys, err := ParseKeys("1 " + newKey(t, 32))
+	require.NoError(t, err)
+	plain := bytes.Repeat([]byte("customer data\n"), 100)
+
+	for _, compression := range []string{CompressionNone, CompressionZstd, CompressionSnappy} {
+		for _, keys := range []*Keyring{nil, keys} {
+			t.Run(fmt.Sprintf("%s/encrypted=%t", compression, keys != nil), func(t *testing.T) {
+				c, err := New(compression, keys)
+				require.NoError(t, err)
+				blob, err := c.Seal(plain)
+				require.NoError(t, err)
+				if compression != CompressionNone {
+					require.Less(t, len(blob), len(plain))
+				}
+				if keys != nil {
+					require.False(t, bytes.Contains(blob, []byte("customer data")))
+				}
+
+				got, err := c.Open(blob)
+				require.NoError(t, err)
+				require.Equal(t, plain, got)
+
+				// a codec opens the blobs of the other compressions
+				other, err := New(CompressionSnappy, keys)
+				require.NoError(t, err)
+				got, err = other.Open(blob)
+				require.NoError(t, err)
+				require.Equal(t, plain, got)
+
+				if keys != nil {
+					tampered := append([]byte(nil), blob...)
+					tampered[len(tampered)-1] ^= 1
+					_, err = c.Open(tampered)
+					require.Equal(t, ErrorCorrupted, err)
+
+					// the header is authenticated
+					tampered = append([]byte(nil), blob...)
+					tampered[0] ^= compressSnappy
+					_, err = c.Open(tampered)
+					require.Equal(t, ErrorCorrupted, err)
+
+					var none *Codec
+					_, err = none.Open(blob)
+					require.Equal(t, ErrorUnknownKey, err)
+				}
+			})
+		}
+	}
+
+	var none *Codec
+	blob, err := none.Seal(plain)
+	require.NoError(t, err)
+	got, err := none.Open(blob)
+	require.NoError(t, err)
+	require.Equal(t, plain, got)
+
+	_, err = New("gzip", nil)
+	require.Equal(t, ErrorUnknownCompression, err)
+	_, err = none.Open(nil)
+	require.Equal(t, ErrorCorrupted, err)
+}
+
+// the new key encrypts, the previous one still decrypts
+func TestKeyRotation(t *testing.T) {
+	first := "1 " + newKey(t, 16)
+	before, err := ParseKeys(first)
+	require.NoError(t, err)
+	c, err := New(CompressionZstd, before)
+	require.NoError(t, err)
+	old, err := c.Seal([]byte("old"))
+	require.NoError(t, err)
+
+	after, err := ParseKeys("# rotated\n" + first + "\n\n7 " + newKey(t, 32) + "\n")
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), after.Active())
+	c, err = New(CompressionZstd, after)
+	require.NoError(t, err)
+	got, err := c.Open(old)
+	require.NoError(t, err)
+	require.Equal(t, []byte("old"), got)
+
+	blob, err := c.Seal([]byte("new"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 7}, blob[1:headerSize])
+	c, err = New(CompressionZstd, before)
+	require.NoError(t, err)
+	_, err = c.Open(blob)
+	require.Equal(t, ErrorUnknownKey, err)
+}
+
+func TestLoadKeys(t *testing.T) {
+	keys, err := LoadKeys("")
+	require.NoError(t, err)
+	require.Nil(t, keys)
+
+	t.Setenv(EnvKeys, "1 "+newKey(t, 32)+",2 "+newKey(t, 32))
+	keys, err = LoadKeys("")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), keys.Active())
+
+	// the file wins over the env
+	file := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(file, []byte("3 "+newKey(t, 24)+"\n"), 0600))
+	keys, err = LoadKeys(file)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), keys.Active())
+
+	_, err = LoadKeys(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	for _, invalid := range []string{
+		"",
+		"1",
+		"one " + newKey(t, 32),
+		"1 not-base64",
+		"1 " + newKey(t, 10),
+		"1 " + newKey(t, 32) + "\n1 " + newKey(t, 32),
+	} {
+		_, err := ParseKeys(invalid)
+		require.ErrorIs(t, err, ErrorInvalidKeys, invalid)
+	}
+}
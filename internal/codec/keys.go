@@ -0,0 +1,101 @@
+package codec
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// EnvKeys holds the keys when there is no key file, the lines may be separated by commas
+const EnvKeys = "GENERATION_ENCRYPTION_KEYS"
+
+var ErrorInvalidKeys = errors.New(`invalid encryption keys, one "<id> <base64 key of 16, 24 or 32 bytes>" per line`)
+
+// Keyring holds the aes-gcm keys by id. The last key encrypts, the others only decrypt.
+// To rotate the keys a new key is added at the end, the previous keys must be kept
+// until the data they sealed is rewritten: at the next snapshot for the snapshots,
+// once compacted for the raft log
+type Keyring struct {
+	keys   map[uint32]cipher.AEAD
+	active uint32
+}
+
+// ParseKeys reads one key per line, "<id> <base64 key>", the empty lines
+// and the lines starting with # are skipped
+func ParseKeys(s string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[uint32]cipher.AEAD)}
+	lines := strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' })
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, ErrorInvalidKeys
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, ErrorInvalidKeys
+		}
+		if _, ok := k.keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("%w: key %d is twice", ErrorInvalidKeys, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, ErrorInvalidKeys
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, ErrorInvalidKeys
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[uint32(id)] = aead
+		k.active = uint32(id)
+	}
+	if len(k.keys) == 0 {
+		return nil, ErrorInvalidKeys
+	}
+	return k, nil
+}
+
+// LoadKeys reads the keys of the file, or of the env variable EnvKeys if file is empty.
+// It returns nil if there is neither
+func LoadKeys(file string) (*Keyring, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return ParseKeys(string(b))
+	}
+	if s := os.Getenv(EnvKeys); s != "" {
+		return ParseKeys(s)
+	}
+	return nil, nil
+}
+
+// Active returns the id of the key encrypting
+func (k *Keyring) Active() uint32 {
+	return k.active
+}
+
+func (k *Keyring) activeKey() (uint32, cipher.AEAD) {
+	return k.active, k.keys[k.active]
+}
+
+func (k *Keyring) key(id uint32) (cipher.AEAD, bool) {
+	if k == nil {
+		return nil, false
+	}
+	aead, ok := k.keys[id]
+	return aead, ok
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+)
+
+// GenerateCerts writes a CA and the server and client certs it signs into dir,
+// like make gencert(see test/*-csr.json), and points the files at them. The tests
+// generate their certs so they never run with expired ones
+func GenerateCerts(dir string) error {
+	subject := pkix.Name{
+		Country:            []string{"CA"},
+		Locality:           []string{"ON"},
+		Province:           []string{"Toronto"},
+		Organization:       []string{"Generation project"},
+		OrganizationalUnit: []string{"Key-value(lru) store"},
+	}
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	subject.CommonName = "Generation"
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               subject,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER); err != nil {
+		return err
+	}
+
+	subject.CommonName = "127.0.0.1"
+	server := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      subject,
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if err := signCert(dir, "server", server, ca, caKey); err != nil {
+		return err
+	}
+	subject.CommonName = "client"
+	client := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      subject,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if err := signCert(dir, "client", client, ca, caKey); err != nil {
+		return err
+	}
+
+	CAFile = filepath.Join(dir, "ca.pem")
+	ServerCertFile = filepath.Join(dir, "server.pem")
+	ServerKeyFile = filepath.Join(dir, "server-key.pem")
+	ClientCertFile = filepath.Join(dir, "client.pem")
+	ClientKeyFile = filepath.Join(dir, "client-key.pem")
+	return nil
+}
+
+// signCert writes the cert of the template signed by the ca into <name>.pem, and its key into <name>-key.pem
+func signCert(dir, name string, template, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template.NotBefore, template.NotAfter = ca.NotBefore, ca.NotAfter
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, name+"-key.pem"), "EC PRIVATE KEY", keyDER)
+}
+
+func writePEM(path, kind string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600)
+}
@@ -28,7 +28,7 @@ func configFile(filename string) string {
 	}
 
 	// for development purpose
-	if filepath.Base(dir) == "cmd" {
+	if filepath.Base(dir) == "cmd" || filepath.Base(dir) == "client" {
 		return filepath.Join(dir, "../", ".generation", filename)
 	} else if filepath.Base(dir) == "grpc" {
 		return filepath.Join(dir, "../../..", ".generation", filename)
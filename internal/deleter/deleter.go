@@ -2,6 +2,7 @@ package deleter
 
 import (
 	"context"
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/storage"
 	"go.opentelemetry.io/otel/label"
@@ -10,6 +11,8 @@ import (
 //go:generate mockgen -destination=../mocks/deleter/mockDeleter.go -package=deleter github.com/djedjethai/generation/internal/deleter Deleter
 type Deleter interface {
 	Delete(context.Context, string) error
+	// DeleteIf deletes the key only if the precondition holds
+	DeleteIf(context.Context, string, *api.Precondition) error
 }
 
 type deleter struct {
@@ -45,3 +48,22 @@ func (s *deleter) Delete(ctx context.Context, key string) error {
 	s.obs.Logger.Debug("Deleter/Delete()", "executed successfully")
 	return nil
 }
+
+func (s *deleter) DeleteIf(ctx context.Context, key string, pre *api.Precondition) error {
+
+	s.obs.Logger.Debug("Deleter/DeleteIf()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "DeleterDeleteIf")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	err := s.st.DeleteIf(ctx, key, pre)
+	if err != nil {
+		s.obs.Logger.Error("Deleter/DeleteIf() failed", err)
+		return err
+	}
+
+	s.obs.Logger.Debug("Deleter/DeleteIf()", "executed successfully")
+	return nil
+}
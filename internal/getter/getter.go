@@ -2,37 +2,89 @@ package getter
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/storage"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // run: go generate ./...
 
 //go:generate mockgen -destination=../mocks/getter/mockGetter.go -package=getter github.com/djedjethai/generation/internal/getter Getter
 type Getter interface {
-	Get(context.Context, string) (interface{}, error)
-	// Get(context.Context, string) interface{}
-	GetKeys(context.Context) []string
-	GetKeysValues(context.Context, chan models.KeysValues) error
+	Get(context.Context, string, api.Consistency) (interface{}, error)
+	// GetWithVersion returns the version of the value too, to write it back with a precondition
+	GetWithVersion(context.Context, string, api.Consistency) (interface{}, uint64, error)
+	// BatchGet reads the keys at once, the Value of a missing key is nil
+	BatchGet(context.Context, []string, api.Consistency) ([]models.KeysValues, error)
+	GetKeys(context.Context, api.Consistency) ([]string, error)
+	// GetKeysPage returns a page of the keys matching the query, or only their count
+	GetKeysPage(context.Context, models.KeysQuery, api.Consistency) (models.KeysPage, error)
+	// Scan returns a page of the records from start to end(excluded) in the keys order,
+	// with the token of the next page, empty on the last one
+	Scan(ctx context.Context, start, end string, limit int, pageToken string, c api.Consistency) ([]models.KeysValues, string, error)
+	ListPrefix(ctx context.Context, prefix string, limit int, pageToken string, c api.Consistency) ([]models.KeysValues, string, error)
+	// Watch returns the events of the key(or prefix) from the index, and the func to stop watching
+	Watch(context.Context, string, bool, uint64) (<-chan *api.WatchEvent, func(), error)
+	GetKeysValues(context.Context, api.Consistency, chan models.KeysValues) error
 	GetServers(context.Context) ([]*api.Server, error)
+	// GetPartitions returns the leader of each partition
+	GetPartitions(context.Context) ([]*api.Partition, error)
+	// PartitionOf returns the partition of the key, its writes go to the partition's leader
+	PartitionOf(string) int
+	// GetRebalance returns the moves of the partitions the node leads
+	GetRebalance(context.Context) (*api.RebalanceStatus, error)
+	// ListSnapshots returns the snapshots of the partitions of the node
+	ListSnapshots(context.Context) ([]*api.SnapshotInfo, error)
+	// OpenSnapshot returns the snapshot of the partition, the latest one if the id is empty
+	OpenSnapshot(context.Context, int, string) (*api.SnapshotInfo, io.ReadCloser, error)
+	// AppliedIndexes returns the last log index applied by the partitions of the keys,
+	// all of them without keys, nil for a standalone storage
+	AppliedIndexes(context.Context, ...string) map[int32]uint64
 }
 
+const (
+	// max records of a Scan page, also the default
+	MaxScanLimit = 1000
+	// max keys of a GetKeysPage page, all the keys are read page after page without limit
+	MaxKeysLimit = 10000
+)
+
+var (
+	ErrInvalidRange     = errors.New("invalid range")
+	ErrInvalidPageToken = errors.New("invalid page token")
+	ErrInvalidCursor    = errors.New("invalid cursor")
+	ErrInvalidFilter    = errors.New("invalid filter")
+)
+
 type getter struct {
-	st  storage.StorageRepo
-	obs *observability.Observability
+	st storage.StorageRepo
+	// nil if the storage is standalone
+	rep   storage.Replicated
+	snap  storage.Snapshotter
+	admin storage.Admin
+	obs   *observability.Observability
 }
 
 func NewGetter(s storage.StorageRepo, observ *observability.Observability) Getter {
-	return &getter{
+	g := &getter{
 		st:  s,
 		obs: observ,
 	}
+	g.rep, _ = s.(storage.Replicated)
+	g.snap, _ = s.(storage.Snapshotter)
+	g.admin, _ = s.(storage.Admin)
+	return g
 }
 
-func (s *getter) Get(ctx context.Context, key string) (interface{}, error) {
+func (s *getter) Get(ctx context.Context, key string, c api.Consistency) (interface{}, error) {
 	// func (s *getter) Get(ctx context.Context, key string) interface{} {
 
 	s.obs.Logger.Debug("Getter/Get()", "hit func")
@@ -42,6 +94,12 @@ func (s *getter) Get(ctx context.Context, key string) (interface{}, error) {
 
 	s.obs.AddMetricsAndSpecificLabel(ctx, "getter", "get")
 
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c, key); err != nil {
+		s.obs.Logger.Warning("Getter/Get() not consistent", fmt.Sprintf("%v", err))
+		return "", err
+	}
+
 	value, err := s.st.Get(ctx, key)
 	if err != nil {
 		s.obs.Logger.Warning("Getter/Get() failed", fmt.Sprintf("%v", err))
@@ -53,7 +111,147 @@ func (s *getter) Get(ctx context.Context, key string) (interface{}, error) {
 	return value, nil
 }
 
-func (s *getter) GetKeys(ctx context.Context) []string {
+func (s *getter) GetWithVersion(ctx context.Context, key string, c api.Consistency) (interface{}, uint64, error) {
+
+	s.obs.Logger.Debug("Getter/GetWithVersion()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "GetterGetWithVersion")
+	defer teardown()
+
+	s.obs.AddMetricsAndSpecificLabel(ctx, "getter", "get")
+
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c, key); err != nil {
+		s.obs.Logger.Warning("Getter/GetWithVersion() not consistent", fmt.Sprintf("%v", err))
+		return "", 0, err
+	}
+
+	value, version, err := s.st.GetWithVersion(ctx, key)
+	if err != nil {
+		s.obs.Logger.Warning("Getter/GetWithVersion() failed", fmt.Sprintf("%v", err))
+		// in case of err the handler expect a string as value
+		return "", 0, err
+	}
+
+	s.obs.Logger.Debug("Getter/GetWithVersion()", "executed successfully")
+	return value, version, nil
+}
+
+func (s *getter) BatchGet(ctx context.Context, keys []string, c api.Consistency) ([]models.KeysValues, error) {
+
+	s.obs.Logger.Debug("Getter/BatchGet()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "GetterBatchGet")
+	defer teardown()
+
+	s.obs.AddMetricsAndSpecificLabel(ctx, "getter", "batchget")
+
+	// a single consistency check for all the keys
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c, keys...); err != nil {
+		s.obs.Logger.Warning("Getter/BatchGet() not consistent", fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	results := make([]models.KeysValues, 0, len(keys))
+	for _, key := range keys {
+		value, version, err := s.st.GetWithVersion(ctx, key)
+		if errors.Is(err, storage.ErrorNoSuchKey) {
+			results = append(results, models.KeysValues{Key: key})
+			continue
+		}
+		if err != nil {
+			s.obs.Logger.Warning("Getter/BatchGet() failed", fmt.Sprintf("%v", err))
+			return nil, err
+		}
+		results = append(results, models.KeysValues{Key: key, Value: value, Version: version})
+	}
+
+	s.obs.Logger.Debug("Getter/BatchGet()", "executed successfully")
+	return results, nil
+}
+
+func (s *getter) Scan(ctx context.Context, start, end string, limit int, pageToken string, c api.Consistency) ([]models.KeysValues, string, error) {
+
+	s.obs.Logger.Debug("Getter/Scan()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "GetterScan")
+	defer teardown()
+
+	s.obs.AddMetricsAndSpecificLabel(ctx, "getter", "scan")
+
+	if limit < 0 || (end != "" && end < start) {
+		return nil, "", ErrInvalidRange
+	}
+	if limit == 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	if pageToken != "" {
+		last, err := base64.RawURLEncoding.DecodeString(pageToken)
+		if err != nil {
+			return nil, "", ErrInvalidPageToken
+		}
+		// the smallest key after the last one of the previous page
+		if next := string(last) + "\x00"; next > start {
+			start = next
+		}
+	}
+
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c); err != nil {
+		s.obs.Logger.Warning("Getter/Scan() not consistent", fmt.Sprintf("%v", err))
+		return nil, "", err
+	}
+
+	// one more record tells if there is a next page
+	kvs, err := s.st.Scan(ctx, start, end, limit+1)
+	if err != nil {
+		s.obs.Logger.Warning("Getter/Scan() failed", fmt.Sprintf("%v", err))
+		return nil, "", err
+	}
+
+	var next string
+	if len(kvs) > limit {
+		kvs = kvs[:limit]
+		next = base64.RawURLEncoding.EncodeToString([]byte(kvs[limit-1].Key))
+	}
+
+	s.obs.Logger.Debug("Getter/Scan()", "executed successfully")
+	return kvs, next, nil
+}
+
+func (s *getter) ListPrefix(ctx context.Context, prefix string, limit int, pageToken string, c api.Consistency) ([]models.KeysValues, string, error) {
+	return s.Scan(ctx, prefix, prefixEnd(prefix), limit, pageToken, c)
+}
+
+// prefixEnd is the smallest key greater than all the keys starting with prefix,
+// empty if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+func (s *getter) Watch(ctx context.Context, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+
+	s.obs.Logger.Debug("Getter/Watch()", "hit func")
+
+	events, cancel, err := s.st.Watch(ctx, key, prefix, startIndex)
+	if err != nil {
+		s.obs.Logger.Warning("Getter/Watch() failed", fmt.Sprintf("%v", err))
+		return nil, nil, err
+	}
+
+	return events, cancel, nil
+}
+
+func (s *getter) GetKeys(ctx context.Context, c api.Consistency) ([]string, error) {
 
 	s.obs.Logger.Debug("Getter/GetKeys()", "hit func")
 
@@ -62,18 +260,235 @@ func (s *getter) GetKeys(ctx context.Context) []string {
 
 	s.obs.AddMetricsAndSpecificLabel(ctx, "getter", "getkeys")
 
-	var keys []string
-	keys = s.st.Keys(ctx)
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c); err != nil {
+		s.obs.Logger.Warning("Getter/GetKeys() not consistent", fmt.Sprintf("%v", err))
+		return nil, err
+	}
+
+	keys, err := s.st.Keys(ctx)
+	if err != nil {
+		s.obs.Logger.Warning("Getter/GetKeys() failed", fmt.Sprintf("%v", err))
+		return nil, err
+	}
 
 	s.obs.Logger.Debug("Getter/Get()", "executed successfully")
 
-	return keys
+	return keys, nil
+}
+
+func (s *getter) GetKeysPage(ctx context.Context, q models.KeysQuery, c api.Consistency) (models.KeysPage, error) {
+
+	s.obs.Logger.Debug("Getter/GetKeysPage()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "GetterGetKeysPage")
+	defer teardown()
+
+	s.obs.AddMetricsAndSpecificLabel(ctx, "getter", "getkeyspage")
+
+	match, err := keysMatcher(q.Glob, q.Regex)
+	if err != nil {
+		return models.KeysPage{}, err
+	}
+	cursor, err := DecodeCursor(q.Cursor)
+	if err != nil {
+		return models.KeysPage{}, err
+	}
+	if q.Limit < 0 {
+		return models.KeysPage{}, ErrInvalidRange
+	}
+	// without limit all the keys are returned, as the legacy GetKeys callers expect
+	all := q.Limit == 0
+	if all || q.Limit > MaxKeysLimit {
+		q.Limit = MaxKeysLimit
+	}
+
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c); err != nil {
+		s.obs.Logger.Warning("Getter/GetKeysPage() not consistent", fmt.Sprintf("%v", err))
+		return models.KeysPage{}, err
+	}
+
+	if q.CountOnly {
+		count, err := s.st.CountKeys(ctx, match)
+		if err != nil {
+			s.obs.Logger.Warning("Getter/GetKeysPage() failed", fmt.Sprintf("%v", err))
+			return models.KeysPage{}, err
+		}
+		return models.KeysPage{Count: count}, nil
+	}
+
+	var page models.KeysPage
+	for {
+		keys, next, done, err := s.st.KeysPage(ctx, cursor, q.Limit, match)
+		if err != nil {
+			s.obs.Logger.Warning("Getter/GetKeysPage() failed", fmt.Sprintf("%v", err))
+			return models.KeysPage{}, err
+		}
+		page.Keys = append(page.Keys, keys...)
+		if done {
+			break
+		}
+		if !all {
+			page.NextCursor = EncodeCursor(next)
+			break
+		}
+		cursor = next
+	}
+
+	s.obs.Logger.Debug("Getter/GetKeysPage()", "executed successfully")
+	return page, nil
+}
+
+// EncodeCursor makes the cursor of a page, it is opaque for the clients
+func EncodeCursor(c models.KeysCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(c.Shard) + ":" + c.After))
+}
+
+// DecodeCursor reads the cursor of a page, the first page if it is empty
+func DecodeCursor(cursor string) (models.KeysCursor, error) {
+	if cursor == "" {
+		return models.KeysCursor{}, nil
+	}
+	bts, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return models.KeysCursor{}, ErrInvalidCursor
+	}
+	shard, after, ok := strings.Cut(string(bts), ":")
+	if !ok {
+		return models.KeysCursor{}, ErrInvalidCursor
+	}
+	i, err := strconv.Atoi(shard)
+	if err != nil || i < 0 {
+		return models.KeysCursor{}, ErrInvalidCursor
+	}
+	return models.KeysCursor{Shard: i, After: after}, nil
 }
 
-func (s *getter) GetKeysValues(ctx context.Context, kv chan models.KeysValues) error {
+// keysMatcher returns nil when there is no filter
+func keysMatcher(glob, regex string) (func(string) bool, error) {
+	var res []*regexp.Regexp
+	if glob != "" {
+		re, err := regexp.Compile(globToRegexp(glob))
+		if err != nil {
+			return nil, ErrInvalidFilter
+		}
+		res = append(res, re)
+	}
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, ErrInvalidFilter
+		}
+		res = append(res, re)
+	}
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return func(key string) bool {
+		for _, re := range res {
+			if !re.MatchString(key) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// unlike path.Match, * matches any character, the / included
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			if j := strings.IndexByte(glob[i:], ']'); j > 0 {
+				class := glob[i+1 : i+j]
+				if strings.HasPrefix(class, "!") {
+					class = "^" + class[1:]
+				}
+				b.WriteString("[" + class + "]")
+				i += j
+				continue
+			}
+			b.WriteString(`\[`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// the channel is closed in any case, so the caller can range over it
+func (s *getter) GetKeysValues(ctx context.Context, c api.Consistency, kv chan models.KeysValues) error {
+	ctx = storage.WithConsistency(ctx, c)
+	if err := s.consistent(ctx, c); err != nil {
+		close(kv)
+		return err
+	}
 	return s.st.KeysValues(ctx, kv)
 }
 
+// consistent waits for the consistency of the reads, a standalone storage always has it
+func (s *getter) consistent(ctx context.Context, c api.Consistency, keys ...string) error {
+	if s.rep == nil {
+		return nil
+	}
+	return s.rep.Consistent(ctx, c, keys...)
+}
+
+func (s *getter) AppliedIndexes(ctx context.Context, keys ...string) map[int32]uint64 {
+	if s.rep == nil {
+		return nil
+	}
+	indexes := make(map[int32]uint64)
+	for i, index := range s.rep.AppliedIndexes(keys...) {
+		indexes[int32(i)] = index
+	}
+	return indexes
+}
+
 func (s *getter) GetServers(ctx context.Context) ([]*api.Server, error) {
 	return s.st.Servers(ctx)
 }
+
+// a standalone storage is not partitioned
+func (s *getter) GetPartitions(ctx context.Context) ([]*api.Partition, error) {
+	if s.rep == nil {
+		return []*api.Partition{}, nil
+	}
+	return s.rep.Partitions(ctx)
+}
+
+func (s *getter) PartitionOf(key string) int {
+	if s.rep == nil {
+		return 0
+	}
+	return s.rep.PartitionOf(key)
+}
+
+func (s *getter) GetRebalance(ctx context.Context) (*api.RebalanceStatus, error) {
+	if s.admin == nil {
+		return &api.RebalanceStatus{Balanced: true}, nil
+	}
+	return s.admin.Rebalance(ctx)
+}
+
+func (s *getter) ListSnapshots(ctx context.Context) ([]*api.SnapshotInfo, error) {
+	if s.snap == nil {
+		return nil, nil
+	}
+	return s.snap.ListSnapshots(ctx)
+}
+
+func (s *getter) OpenSnapshot(ctx context.Context, partition int, id string) (*api.SnapshotInfo, io.ReadCloser, error) {
+	if s.snap == nil {
+		return nil, nil, storage.ErrorNotReplicated
+	}
+	return s.snap.OpenSnapshot(ctx, partition, id)
+}
@@ -2,9 +2,11 @@ package getter
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"testing"
 
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/storage"
@@ -18,7 +20,7 @@ func setup() {
 
 	str := storage.NewMockedShardedMap(1, 5)
 
-	getterMocked = getter{str, &obs}
+	getterMocked = getter{st: str, obs: &obs}
 }
 
 func Test_get_return_a_value_and_no_error(t *testing.T) {
@@ -28,7 +30,7 @@ func Test_get_return_a_value_and_no_error(t *testing.T) {
 	ctx := context.Background()
 
 	// create a moked service
-	value, err := getterMocked.Get(ctx, "key")
+	value, err := getterMocked.Get(ctx, "key", api.Consistency_LINEARIZABLE)
 
 	if value != "value" {
 		t.Error("test getter.Get() should return a value")
@@ -46,7 +48,7 @@ func Test_get_return_error_when_a_problem_occur(t *testing.T) {
 	ctx := context.Background()
 
 	// create a moked service
-	_, err := getterMocked.Get(ctx, "invalidKey")
+	_, err := getterMocked.Get(ctx, "invalidKey", api.Consistency_LINEARIZABLE)
 
 	if err == nil {
 		t.Error("test getter.Get() should return an err if the storage return an err")
@@ -60,7 +62,10 @@ func Test_keys_return_an_array_of_keys(t *testing.T) {
 	ctx := context.Background()
 
 	// create a moked service
-	keys := getterMocked.GetKeys(ctx)
+	keys, err := getterMocked.GetKeys(ctx, api.Consistency_STALE)
+	if err != nil {
+		t.Error("test getter.GetKeys() should not return an err when all is good")
+	}
 
 	rt := reflect.TypeOf(keys)
 
@@ -80,9 +85,9 @@ func Test_GetkeysValues_return_a_stream_modelsKeysValues(t *testing.T) {
 
 	ctx := context.Background()
 
-	_ = getterMocked.GetKeysValues(ctx, kv)
+	_ = getterMocked.GetKeysValues(ctx, api.Consistency_STALE, kv)
 
-	res := make(map[string]string)
+	res := make(map[string]interface{})
 	for v := range kv {
 		res[v.Key] = v.Value
 	}
@@ -92,3 +97,164 @@ func Test_GetkeysValues_return_a_stream_modelsKeysValues(t *testing.T) {
 	}
 
 }
+
+func Test_scan_pages_through_the_keys(t *testing.T) {
+
+	obs := observability.Observability{}
+	st := storage.NewShardedMap(2, 100, &obs)
+	gt := getter{st: st, obs: &obs}
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b:1", "b:2", "b:3", "c"} {
+		_ = st.Set(ctx, key, key, 0)
+	}
+
+	var keys []string
+	token := ""
+	for pages := 0; ; pages++ {
+		if pages == 3 {
+			t.Fatal("test getter.ListPrefix() should stop with an empty token")
+		}
+		kvs, next, err := gt.ListPrefix(ctx, "b:", 2, token, api.Consistency_LINEARIZABLE)
+		if err != nil {
+			t.Fatal("test getter.ListPrefix() should not return an err")
+		}
+		for _, kv := range kvs {
+			keys = append(keys, kv.Key)
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	if !reflect.DeepEqual(keys, []string{"b:1", "b:2", "b:3"}) {
+		t.Error("test getter.ListPrefix() should return all the keys of the prefix, got", keys)
+	}
+
+	if _, _, err := gt.Scan(ctx, "", "", 2, "%%", api.Consistency_LINEARIZABLE); err != ErrInvalidPageToken {
+		t.Error("test getter.Scan() should refuse an invalid token")
+	}
+	if _, _, err := gt.Scan(ctx, "c", "a", 2, "", api.Consistency_LINEARIZABLE); err != ErrInvalidRange {
+		t.Error("test getter.Scan() should refuse an invalid range")
+	}
+}
+
+func Test_a_standalone_storage_is_not_replicated(t *testing.T) {
+
+	obs := observability.Observability{}
+	gt := NewGetter(storage.NewShardedMap(2, 100, &obs), &obs)
+
+	ctx := context.Background()
+	if partitions, err := gt.GetPartitions(ctx); err != nil || len(partitions) != 0 {
+		t.Error("test getter.GetPartitions() should return no partition")
+	}
+	if st, err := gt.GetRebalance(ctx); err != nil || !st.Balanced {
+		t.Error("test getter.GetRebalance() should be balanced")
+	}
+	if gt.AppliedIndexes(ctx) != nil {
+		t.Error("test getter.AppliedIndexes() should be nil")
+	}
+	if _, _, err := gt.OpenSnapshot(ctx, 0, ""); err != storage.ErrorNotReplicated {
+		t.Error("test getter.OpenSnapshot() should return ErrorNotReplicated, got", err)
+	}
+}
+
+func Test_prefixEnd(t *testing.T) {
+	for prefix, end := range map[string]string{
+		"user:": "user;",
+		"a\xff": "b",
+		"\xff":  "",
+		"":      "",
+	} {
+		if got := prefixEnd(prefix); got != end {
+			t.Errorf("test prefixEnd(%q) should be %q, got %q", prefix, end, got)
+		}
+	}
+}
+
+func Test_getkeyspage_filters_and_counts(t *testing.T) {
+
+	obs := observability.Observability{}
+	st := storage.NewShardedMap(3, 100, &obs)
+	gt := getter{st: st, obs: &obs}
+
+	ctx := context.Background()
+	for _, key := range []string{"user:1:name", "user:2:name", "user:2:mail", "item/1"} {
+		_ = st.Set(ctx, key, "value", 0)
+	}
+
+	var keys []string
+	q := models.KeysQuery{Glob: "user:*:name", Limit: 1}
+	for {
+		page, err := gt.GetKeysPage(ctx, q, api.Consistency_LINEARIZABLE)
+		if err != nil {
+			t.Fatal("test getter.GetKeysPage() should not return an err")
+		}
+		keys = append(keys, page.Keys...)
+		if page.NextCursor == "" {
+			break
+		}
+		q.Cursor = page.NextCursor
+	}
+	if len(keys) != 2 {
+		t.Error("test getter.GetKeysPage() should return the keys matching the glob, got", keys)
+	}
+
+	page, _ := gt.GetKeysPage(ctx, models.KeysQuery{Regex: "^(item|user:1)", CountOnly: true}, api.Consistency_LINEARIZABLE)
+	if page.Count != 2 || page.Keys != nil {
+		t.Error("test getter.GetKeysPage() should only count the keys matching the regex")
+	}
+
+	if _, err := gt.GetKeysPage(ctx, models.KeysQuery{Regex: "("}, api.Consistency_LINEARIZABLE); err != ErrInvalidFilter {
+		t.Error("test getter.GetKeysPage() should refuse an invalid regex")
+	}
+	if _, err := gt.GetKeysPage(ctx, models.KeysQuery{Cursor: "bad"}, api.Consistency_LINEARIZABLE); err != ErrInvalidCursor {
+		t.Error("test getter.GetKeysPage() should refuse an invalid cursor")
+	}
+}
+
+func Test_getkeyspage_without_limit_returns_all_the_keys(t *testing.T) {
+
+	obs := observability.Observability{}
+	st := storage.NewShardedMap(3, MaxKeysLimit, &obs)
+	gt := getter{st: st, obs: &obs}
+
+	ctx := context.Background()
+	for i := 0; i <= MaxKeysLimit; i++ {
+		_ = st.Set(ctx, fmt.Sprintf("key-%d", i), "value", 0)
+	}
+
+	page, err := gt.GetKeysPage(ctx, models.KeysQuery{}, api.Consistency_LINEARIZABLE)
+	if err != nil {
+		t.Fatal("test getter.GetKeysPage() should not return an err")
+	}
+	if len(page.Keys) != MaxKeysLimit+1 || page.NextCursor != "" {
+		t.Error("test getter.GetKeysPage() without limit should return all the keys, got", len(page.Keys))
+	}
+
+	page, _ = gt.GetKeysPage(ctx, models.KeysQuery{Limit: MaxKeysLimit + 1}, api.Consistency_LINEARIZABLE)
+	if len(page.Keys) != MaxKeysLimit || page.NextCursor == "" {
+		t.Error("test getter.GetKeysPage() should cap the limit and return the next cursor")
+	}
+}
+
+func Test_globToRegexp(t *testing.T) {
+	for glob, matches := range map[string]map[string]bool{
+		"user:*":  {"user:1": true, "user:1/a": true, "users": false},
+		"user:?":  {"user:1": true, "user:12": false},
+		"k[ab].c": {"ka.c": true, "kb.c": true, "kc.c": false, "kaxc": false},
+		"k[!ab]":  {"kc": true, "ka": false},
+		"open[":   {"open[": true},
+	} {
+		for key, want := range matches {
+			match, err := keysMatcher(glob, "")
+			if err != nil {
+				t.Fatal("test keysMatcher() should accept the glob", glob)
+			}
+			if got := match(key); got != want {
+				t.Errorf("test the glob %q on %q should be %v", glob, key, want)
+			}
+		}
+	}
+}
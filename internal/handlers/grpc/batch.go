@@ -0,0 +1,161 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	pb "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/models"
+	"github.com/djedjethai/generation/internal/storage"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+)
+
+// max number of puts read from a PutStream before they are applied
+const streamBatchSize = 512
+
+func (s *Server) BatchPut(ctx context.Context, r *pb.BatchPutRequest) (*pb.BatchResponse, error) {
+	results, err := s.Services.Setter.Batch(ctx, &pb.WriteBatch{Puts: r.Puts})
+	// the items are all in the same partition, the others fail item by item
+	if errors.Is(err, raft.ErrNotLeader) {
+		ctx, leader, err := s.toLeader(ctx, r.Puts[0].GetRecords().GetKey())
+		if err != nil {
+			return nil, err
+		}
+		return leader.BatchPut(ctx, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, res := range results {
+		if res.Err == nil {
+			put := r.Puts[i]
+			s.LoggerFacade.WriteSet(put.Records.Key, put.Records.Data(), time.Duration(put.TtlMs)*time.Millisecond)
+		}
+	}
+
+	return &pb.BatchResponse{Results: itemResults(results)}, nil
+}
+
+func (s *Server) BatchDelete(ctx context.Context, r *pb.BatchDeleteRequest) (*pb.BatchResponse, error) {
+	results, err := s.Services.Setter.Batch(ctx, &pb.WriteBatch{Deletes: r.Deletes})
+	if errors.Is(err, raft.ErrNotLeader) {
+		ctx, leader, err := s.toLeader(ctx, r.Deletes[0].Key)
+		if err != nil {
+			return nil, err
+		}
+		return leader.BatchDelete(ctx, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range results {
+		if res.Err == nil {
+			s.LoggerFacade.WriteDelete(res.Key)
+		}
+	}
+
+	return &pb.BatchResponse{Results: itemResults(results)}, nil
+}
+
+func (s *Server) BatchGet(ctx context.Context, r *pb.BatchGetRequest) (*pb.BatchGetResponse, error) {
+	kvs, err := s.Services.Getter.BatchGet(ctx, r.Keys, r.Consistency)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &pb.BatchGetResponse{Results: make([]*pb.GetResult, 0, len(kvs))}
+	res.AppliedIndex, res.AppliedIndexes = s.appliedIndexes(ctx, r.Keys...)
+	for _, kv := range kvs {
+		result := &pb.GetResult{Key: kv.Key}
+		if kv.Value != nil {
+			typed, err := pb.NewValue(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			result.Found = true
+			result.TypedValue = typed
+			result.Version = kv.Version
+		}
+		res.Results = append(res.Results, result)
+	}
+
+	return res, nil
+}
+
+// the puts are applied by batches of streamBatchSize while they are received
+func (s *Server) PutStream(stream pb.KeyValue_PutStreamServer) error {
+	ctx := stream.Context()
+
+	res := &pb.BatchResponse{}
+	var puts []*pb.PutRequest
+
+	flush := func() error {
+		if len(puts) == 0 {
+			return nil
+		}
+		batch, err := s.BatchPut(ctx, &pb.BatchPutRequest{Puts: puts})
+		if err != nil {
+			return err
+		}
+		res.Results = append(res.Results, batch.Results...)
+		puts = nil
+		return nil
+	}
+
+	for {
+		put, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		puts = append(puts, put)
+		if len(puts) >= streamBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(res)
+}
+
+func itemResults(results []models.BatchResult) []*pb.ItemResult {
+	items := make([]*pb.ItemResult, 0, len(results))
+	for _, res := range results {
+		item := &pb.ItemResult{
+			Key:     res.Key,
+			Version: res.Version,
+			Code:    int32(itemCode(res.Err)),
+		}
+		if res.Err != nil {
+			item.Error = res.Err.Error()
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func itemCode(err error) codes.Code {
+	switch {
+	case err == nil:
+		return codes.OK
+	case errors.Is(err, storage.ErrorPreconditionFailed):
+		return codes.FailedPrecondition
+	case errors.Is(err, storage.ErrorInvalidItem), errors.Is(err, pb.ErrInvalidValue):
+		return codes.InvalidArgument
+	case errors.Is(err, raft.ErrNotLeader):
+		return codes.Unavailable
+	default:
+		return codes.Internal
+	}
+}
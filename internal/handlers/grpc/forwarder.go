@@ -0,0 +1,146 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"sync"
+
+	pb "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// set on the rpcs forwarded to the leader, a node receiving a forwarded rpc
+// while not being the leader(anymore) fails it instead of forwarding it again
+const forwardedHeader = "x-generation-forwarded"
+
+var errNoLeader = status.Error(codes.Unavailable, "no leader elected")
+
+// Forwarder keeps a connection per leader the node forwarded some rpcs to(or read some
+// partitions from, see Remote), the connections use the same tls config as the raft peers
+type Forwarder struct {
+	mu        sync.Mutex
+	tlsConfig *tls.Config
+	conns     map[string]*grpc.ClientConn
+}
+
+func NewForwarder(peerTLSConfig *tls.Config) *Forwarder {
+	return &Forwarder{
+		tlsConfig: peerTLSConfig,
+		conns:     make(map[string]*grpc.ClientConn),
+	}
+}
+
+// toLeader returns a client to the leader of the key's partition and the context to call it with,
+// the deadline of ctx goes along with the forwarded rpc
+func (s *Server) toLeader(ctx context.Context, key string) (context.Context, pb.KeyValueClient, error) {
+	if forwarded(ctx) {
+		return nil, nil, status.Error(codes.Unavailable, raft.ErrNotLeader.Error())
+	}
+	return s.toPartitionLeader(ctx, s.Services.Getter.PartitionOf(key))
+}
+
+// toPartitionLeader is toLeader for the leader of the partition p
+func (s *Server) toPartitionLeader(ctx context.Context, p int) (context.Context, pb.KeyValueClient, error) {
+	if forwarded(ctx) {
+		return nil, nil, status.Error(codes.Unavailable, raft.ErrNotLeader.Error())
+	}
+
+	partitions, err := s.Services.Getter.GetPartitions(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p < 0 || p >= len(partitions) || partitions[p].LeaderAddr == "" {
+		return nil, nil, errNoLeader
+	}
+
+	cc, err := s.forwarder.conn(partitions[p].LeaderAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true")
+	return ctx, pb.NewKeyValueClient(cc), nil
+}
+
+func forwarded(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	return ok && len(md.Get(forwardedHeader)) > 0
+}
+
+// the key of the first op of the transaction, they are all in the same partition
+func txnKey(r *pb.TxnRequest) string {
+	for _, c := range r.Compares {
+		return c.Key
+	}
+	for _, ops := range [][]*pb.TxnOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			switch o := op.GetOp().(type) {
+			case *pb.TxnOp_Put:
+				return o.Put.Key
+			case *pb.TxnOp_Delete:
+				return o.Delete.Key
+			case *pb.TxnOp_Get:
+				return o.Get.Key
+			}
+		}
+	}
+	return ""
+}
+
+// conn dials the node again when the connection failed
+func (f *Forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cc, ok := f.conns[addr]; ok {
+		switch cc.GetState() {
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			_ = cc.Close()
+			delete(f.conns, addr)
+		default:
+			return cc, nil
+		}
+	}
+
+	creds := insecure.NewCredentials()
+	if f.tlsConfig != nil {
+		creds = credentials.NewTLS(f.tlsConfig)
+	}
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+	f.conns[addr] = cc
+
+	return cc, nil
+}
+
+// Forget closes the connection to the node, it left the membership
+func (f *Forwarder) Forget(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cc, ok := f.conns[addr]; ok {
+		_ = cc.Close()
+		delete(f.conns, addr)
+	}
+}
+
+// Close closes all the connections, the server stopped
+func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	for addr, cc := range f.conns {
+		if e := cc.Close(); e != nil {
+			err = e
+		}
+		delete(f.conns, addr)
+	}
+	return err
+}
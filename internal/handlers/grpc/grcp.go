@@ -2,7 +2,8 @@ package grpc
 
 import (
 	"context"
-	"fmt"
+	"errors"
+	"time"
 
 	// "fmt"
 
@@ -10,20 +11,31 @@ import (
 	"github.com/djedjethai/generation/internal/config"
 	"github.com/djedjethai/generation/internal/logger"
 	"github.com/djedjethai/generation/internal/models"
+	"github.com/djedjethai/generation/internal/storage"
+	"github.com/hashicorp/raft"
 	"google.golang.org/grpc"
-	// "google.golang.org/grpc/status"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 type Server struct {
 	pb.UnimplementedKeyValueServer
 	Services     *config.Services
 	LoggerFacade *logger.LoggerFacade
+	forwarder    *Forwarder
 }
 
-func NewGRPCServer(services config.Services, loggerFacade *logger.LoggerFacade, opts ...grpc.ServerOption) (*grpc.Server, error) {
+// the mutating rpcs received by a follower are forwarded to the leader with the forwarder,
+// the caller closes it once the server stopped
+func NewGRPCServer(services config.Services, loggerFacade *logger.LoggerFacade, forwarder *Forwarder, opts ...grpc.ServerOption) (*grpc.Server, error) {
 
+	// the reads of a partition sent by another node are restricted to it, see Remote
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(partitionUnaryInterceptor),
+		grpc.ChainStreamInterceptor(partitionStreamInterceptor),
+	)
 	gsrv := grpc.NewServer(opts...)
 	// gsrv := grpc.NewServer() // uncomment here for no tls
 
@@ -32,7 +44,7 @@ func NewGRPCServer(services config.Services, loggerFacade *logger.LoggerFacade,
 	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(gsrv, hsrv)
 
-	srv, err := newgrpcserver(&services, loggerFacade)
+	srv, err := newgrpcserver(&services, loggerFacade, forwarder)
 	if err != nil {
 		return nil, err
 	}
@@ -42,10 +54,11 @@ func NewGRPCServer(services config.Services, loggerFacade *logger.LoggerFacade,
 	return gsrv, nil
 }
 
-func newgrpcserver(services *config.Services, loggerFacade *logger.LoggerFacade) (*Server, error) {
+func newgrpcserver(services *config.Services, loggerFacade *logger.LoggerFacade, forwarder *Forwarder) (*Server, error) {
 	return &Server{
 		Services:     services,
 		LoggerFacade: loggerFacade,
+		forwarder:    forwarder,
 	}, nil
 }
 
@@ -54,22 +67,124 @@ func (s *Server) GetServers(ctx context.Context, req *pb.GetServersRequest) (*pb
 	if err != nil {
 		return nil, err
 	}
-	return &pb.GetServersResponse{Servers: servers}, nil
+	partitions, err := s.Services.Getter.GetPartitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetServersResponse{Servers: servers, Partitions: partitions}, nil
+}
+
+// GetRebalance reports the moves led by this node, each node leads the moves of its partitions
+func (s *Server) GetRebalance(ctx context.Context, req *pb.GetRebalanceRequest) (*pb.GetRebalanceResponse, error) {
+	st, err := s.Services.Getter.GetRebalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetRebalanceResponse{Status: st}, nil
 }
 
 func (s *Server) Put(ctx context.Context, r *pb.PutRequest) (*pb.PutResponse, error) {
 
-	err := s.Services.Setter.Set(ctx, r.Records.Key, []byte(r.Records.Value))
-	if err == nil {
-		s.LoggerFacade.WriteSet(string(r.Records.Key), string(r.Records.Value))
+	if r.TtlMs < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl can not be negative")
+	}
+	ttl := time.Duration(r.TtlMs) * time.Millisecond
+
+	// the typed value if set, the string one otherwise
+	value := r.Records.Data()
+	if _, err := pb.NewValue(value); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	return &pb.PutResponse{}, err
+	version, err := s.Services.Setter.SetIf(ctx, r.Records.Key, value, ttl, r.Precondition)
+	if errors.Is(err, raft.ErrNotLeader) {
+		ctx, leader, err := s.toLeader(ctx, r.Records.Key)
+		if err != nil {
+			return nil, err
+		}
+		return leader.Put(ctx, r)
+	}
+	if errors.Is(err, storage.ErrorPreconditionFailed) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the precondition held, the replay only needs the value
+	s.LoggerFacade.WriteSet(r.Records.Key, value, ttl)
+
+	return &pb.PutResponse{Version: version}, nil
+}
+
+// Incr is applied by the leader, the now of the request is ignored
+func (s *Server) Incr(ctx context.Context, r *pb.IncrRequest) (*pb.IncrResponse, error) {
+	value, err := s.Services.Setter.Incr(ctx, r.Key, r.Delta)
+	if errors.Is(err, raft.ErrNotLeader) {
+		ctx, leader, err := s.toLeader(ctx, r.Key)
+		if err != nil {
+			return nil, err
+		}
+		return leader.Incr(ctx, r)
+	}
+	if errors.Is(err, storage.ErrorNotAnInteger) || errors.Is(err, storage.ErrorOverflow) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.LoggerFacade.WriteIncr(r.Key, r.Delta)
+
+	return &pb.IncrResponse{Value: value}, nil
+}
+
+func (s *Server) Txn(ctx context.Context, r *pb.TxnRequest) (*pb.TxnResponse, error) {
+	for _, ops := range [][]*pb.TxnOp{r.Success, r.Failure} {
+		for _, op := range ops {
+			if put := op.GetPut(); put != nil {
+				if _, err := pb.NewValue(put.Value.Interface()); err != nil {
+					return nil, status.Error(codes.InvalidArgument, err.Error())
+				}
+			}
+		}
+	}
+
+	res, err := s.Services.Setter.Txn(ctx, r)
+	if errors.Is(err, raft.ErrNotLeader) {
+		ctx, leader, err := s.toLeader(ctx, txnKey(r))
+		if err != nil {
+			return nil, err
+		}
+		return leader.Txn(ctx, r)
+	}
+	if errors.Is(err, storage.ErrorInvalidTxn) {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the writes of the applied branch, one by one, the replay does not need more
+	ops := r.Success
+	if !res.Succeeded {
+		ops = r.Failure
+	}
+	for _, op := range ops {
+		switch o := op.GetOp().(type) {
+		case *pb.TxnOp_Put:
+			s.LoggerFacade.WriteSet(o.Put.Key, o.Put.Value.Interface(), time.Duration(o.Put.TtlMs)*time.Millisecond)
+		case *pb.TxnOp_Delete:
+			s.LoggerFacade.WriteDelete(o.Delete.Key)
+		}
+	}
+
+	return res, nil
 }
 
 func (s *Server) Get(ctx context.Context, r *pb.GetRequest) (*pb.GetResponse, error) {
 
-	value, err := s.Services.Getter.Get(ctx, r.Key)
+	value, version, err := s.Services.Getter.GetWithVersion(ctx, r.Key, r.Consistency)
 	if err != nil {
 		if err.Error() == "no such key" {
 			// return &pb.GetResponse{Value: value.(string)}, status.Error(404, "and now")
@@ -79,19 +194,68 @@ func (s *Server) Get(ctx context.Context, r *pb.GetRequest) (*pb.GetResponse, er
 		}
 	}
 
-	// TODO if implement other types, the type assertion will have to be adapt
+	typed, err := pb.NewValue(value)
+	if err != nil {
+		return nil, err
+	}
+
 	// if value == "" grpc return it as nil
-	return &pb.GetResponse{Value: value.(string)}, err
+	index, _ := s.appliedIndexes(ctx, r.Key)
+	return &pb.GetResponse{
+		Value:        typed.Text(),
+		TypedValue:   typed,
+		AppliedIndex: index,
+		Version:      version,
+	}, nil
 }
 
 func (s *Server) GetKeys(ctx context.Context, r *pb.GetKeysRequest) (*pb.GetKeysResponse, error) {
-	keys := s.Services.Getter.GetKeys(ctx)
+	page, err := s.Services.Getter.GetKeysPage(ctx, models.KeysQuery{
+		Cursor:    r.Cursor,
+		Limit:     int(r.Limit),
+		Glob:      r.Glob,
+		Regex:     r.Regex,
+		CountOnly: r.CountOnly,
+	}, r.Consistency)
+	if err != nil {
+		return nil, scanError(err)
+	}
+
+	index, indexes := s.appliedIndexes(ctx)
+	return &pb.GetKeysResponse{
+		Keys:           page.Keys,
+		AppliedIndex:   index,
+		AppliedIndexes: indexes,
+		NextCursor:     page.NextCursor,
+		Count:          int64(page.Count),
+	}, nil
+}
 
-	return &pb.GetKeysResponse{Keys: keys}, nil
+// appliedIndexes returns the applied indexes of the partitions of the keys(all of them
+// without keys), and the one of the partition when there is a single one
+func (s *Server) appliedIndexes(ctx context.Context, keys ...string) (uint64, map[int32]uint64) {
+	indexes := s.Services.Getter.AppliedIndexes(ctx, keys...)
+	var index uint64
+	if len(indexes) == 1 {
+		for _, i := range indexes {
+			index = i
+		}
+	}
+	return index, indexes
 }
 
 func (s *Server) Delete(ctx context.Context, r *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	err := s.Services.Deleter.Delete(ctx, r.Key)
+	err := s.Services.Deleter.DeleteIf(ctx, r.Key, r.Precondition)
+	if errors.Is(err, raft.ErrNotLeader) {
+		ctx, leader, err := s.toLeader(ctx, r.Key)
+		if err != nil {
+			return nil, err
+		}
+		return leader.Delete(ctx, r)
+	}
+	if errors.Is(err, storage.ErrorPreconditionFailed) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
 	if err == nil {
 		s.LoggerFacade.WriteDelete(r.Key)
 	}
@@ -99,11 +263,13 @@ func (s *Server) Delete(ctx context.Context, r *pb.DeleteRequest) (*pb.DeleteRes
 	return &pb.DeleteResponse{}, err
 }
 
-func (s *Server) GetKeysValuesStream(r *pb.Empty, stream pb.KeyValue_GetKeysValuesStreamServer) error {
-	// get keys
-	ctx := context.Background()
+func (s *Server) GetKeysValuesStream(r *pb.GetKeysValuesRequest, stream pb.KeyValue_GetKeysValuesStreamServer) error {
+	// get keys, returning before the end stops the producer, it would hold a shard
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
 
 	kv := make(chan models.KeysValues)
+	errc := make(chan error, 1)
 
 	for {
 		select {
@@ -111,24 +277,60 @@ func (s *Server) GetKeysValuesStream(r *pb.Empty, stream pb.KeyValue_GetKeysValu
 			return nil
 		default:
 			go func() {
-				err := s.Services.Getter.GetKeysValues(ctx, kv)
-				if err != nil {
-					fmt.Println("see the GetKeysValuesStream:::::: ", err)
-					// return err
-				}
+				errc <- s.Services.Getter.GetKeysValues(ctx, r.Consistency, kv)
 			}()
 
+			appliedIndex, appliedIndexes := s.appliedIndexes(ctx)
 			for v := range kv {
+				typed, err := pb.NewValue(v.Value)
+				if err != nil {
+					return err
+				}
 				if err := stream.Send(&pb.GetRecords{
 					Records: &pb.Records{
-						Key:   v.Key,
-						Value: v.Value,
+						Key:        v.Key,
+						Value:      typed.Text(),
+						TypedValue: typed,
 					},
+					AppliedIndex:   appliedIndex,
+					AppliedIndexes: appliedIndexes,
 				}); err != nil {
 					return err
 				}
 			}
+			return <-errc
+		}
+	}
+}
+
+// Watch sends the events until the client leaves. A watcher too late is closed with Aborted,
+// it resumes from the index of the last event it received
+func (s *Server) Watch(r *pb.WatchRequest, stream pb.KeyValue_WatchServer) error {
+	ctx := stream.Context()
+
+	if len(r.StartIndexes) > 0 {
+		ctx = storage.WithStartIndexes(ctx, r.StartIndexes)
+	}
+	events, cancel, err := s.Services.Getter.Watch(ctx, r.Key, r.Prefix, r.StartIndex)
+	if errors.Is(err, storage.ErrorWatchCompacted) {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
 			return nil
+		case ev, ok := <-events:
+			if !ok {
+				return status.Error(codes.Aborted, "watcher too late, resume from the last index received")
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
 		}
 	}
 }
@@ -2,25 +2,48 @@ package grpc
 
 import (
 	"context"
+	"fmt"
 	pb "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/config"
 	"github.com/djedjethai/generation/internal/deleter"
 	"github.com/djedjethai/generation/internal/getter"
 	lgr "github.com/djedjethai/generation/internal/logger"
+	mockgetter "github.com/djedjethai/generation/internal/mocks/getter"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/setter"
 	"github.com/djedjethai/generation/internal/storage"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
 	"net"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 	// "google.golang.org/genproto/googleapis/rpc/errdetails"
 	// "google.golang.org/grpc"
 	gglGrpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+// the certs are generated for the run, see config.GenerateCerts
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		panic(err)
+	}
+	if err := config.GenerateCerts(dir); err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 func setupTest(t *testing.T) (pb.KeyValueClient, func()) {
 	t.Helper()
 	// s := gglGrpc.NewServer()
@@ -65,7 +88,7 @@ func setupTest(t *testing.T) (pb.KeyValueClient, func()) {
 	serverCreds := credentials.NewTLS(serverTLSConfig)
 	require.NoError(t, err)
 
-	s, err := NewGRPCServer(srv, loggerFacade, gglGrpc.Creds(serverCreds))
+	s, err := NewGRPCServer(srv, loggerFacade, NewForwarder(nil), gglGrpc.Creds(serverCreds))
 	require.NoError(t, err)
 
 	go func() {
@@ -159,6 +182,324 @@ func TestGetErr(t *testing.T) {
 	// fmt.Println("see err message: ", st.Message())
 }
 
+func TestTypedValues(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	values := map[string]*pb.Value{
+		"int":   {Kind: &pb.Value_IntValue{IntValue: 0}},
+		"float": {Kind: &pb.Value_FloatValue{FloatValue: 1.5}},
+		"bytes": {Kind: &pb.Value_BytesValue{BytesValue: []byte{0, 1, 2}}},
+		"json":  {Kind: &pb.Value_JsonValue{JsonValue: `{"a":1}`}},
+	}
+	for key, value := range values {
+		_, err := cl.Put(ctx, &pb.PutRequest{
+			Records: &pb.Records{
+				Key:        key,
+				TypedValue: value,
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	for key, value := range values {
+		resp, err := cl.Get(ctx, &pb.GetRequest{
+			Key: key,
+		})
+		require.NoError(t, err)
+		require.Equal(t, value.Interface(), resp.TypedValue.Interface())
+		require.Equal(t, value.Text(), resp.Value)
+	}
+
+	// an invalid json is rejected
+	_, err := cl.Put(ctx, &pb.PutRequest{
+		Records: &pb.Records{
+			Key:        "json",
+			TypedValue: &pb.Value{Kind: &pb.Value_JsonValue{JsonValue: `{"a":`}},
+		},
+	})
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+}
+
+func TestIncr(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	resp, err := cl.Incr(ctx, &pb.IncrRequest{Key: "counter", Delta: 5})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), resp.Value)
+
+	resp, err = cl.Incr(ctx, &pb.IncrRequest{Key: "counter", Delta: -7})
+	require.NoError(t, err)
+	require.Equal(t, int64(-2), resp.Value)
+
+	_, err = cl.Put(ctx, &pb.PutRequest{
+		Records: &pb.Records{
+			Key:   "name",
+			Value: "value",
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = cl.Incr(ctx, &pb.IncrRequest{Key: "name", Delta: 1})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestPreconditions(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	put, err := cl.Put(ctx, &pb.PutRequest{
+		Records:      &pb.Records{Key: "lock", Value: "owner-a"},
+		Precondition: &pb.Precondition{IfAbsent: true},
+	})
+	require.NoError(t, err)
+	require.NotZero(t, put.Version)
+
+	get, err := cl.Get(ctx, &pb.GetRequest{Key: "lock"})
+	require.NoError(t, err)
+	require.Equal(t, put.Version, get.Version)
+
+	_, err = cl.Put(ctx, &pb.PutRequest{
+		Records:      &pb.Records{Key: "lock", Value: "owner-b"},
+		Precondition: &pb.Precondition{IfAbsent: true},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	swapped, err := cl.Put(ctx, &pb.PutRequest{
+		Records:      &pb.Records{Key: "lock", Value: "owner-b"},
+		Precondition: &pb.Precondition{ExpectedVersion: get.Version},
+	})
+	require.NoError(t, err)
+	require.Greater(t, swapped.Version, get.Version)
+
+	_, err = cl.Delete(ctx, &pb.DeleteRequest{
+		Key:          "lock",
+		Precondition: &pb.Precondition{ExpectedVersion: get.Version},
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, err = cl.Delete(ctx, &pb.DeleteRequest{
+		Key:          "lock",
+		Precondition: &pb.Precondition{ExpectedVersion: swapped.Version},
+	})
+	require.NoError(t, err)
+}
+
+func TestTxn(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	put := func(key, value string) *pb.TxnOp {
+		return &pb.TxnOp{Op: &pb.TxnOp_Put{Put: &pb.TxnPut{
+			Key:   key,
+			Value: &pb.Value{Kind: &pb.Value_StringValue{StringValue: value}},
+		}}}
+	}
+
+	res, err := cl.Txn(ctx, &pb.TxnRequest{
+		Compares: []*pb.Compare{
+			{Key: "leader", Precondition: &pb.Precondition{IfAbsent: true}},
+		},
+		Success: []*pb.TxnOp{put("leader", "node-a"), put("term", "1")},
+	})
+	require.NoError(t, err)
+	require.True(t, res.Succeeded)
+	require.Equal(t, 2, len(res.Results))
+
+	res, err = cl.Txn(ctx, &pb.TxnRequest{
+		Compares: []*pb.Compare{
+			{Key: "leader", Precondition: &pb.Precondition{IfAbsent: true}},
+		},
+		Success: []*pb.TxnOp{put("leader", "node-b")},
+		Failure: []*pb.TxnOp{{Op: &pb.TxnOp_Get{Get: &pb.TxnGet{Key: "leader"}}}},
+	})
+	require.NoError(t, err)
+	require.False(t, res.Succeeded)
+	require.Equal(t, "node-a", res.Results[0].Value.GetStringValue())
+
+	_, err = cl.Txn(ctx, &pb.TxnRequest{
+		Success: []*pb.TxnOp{{Op: &pb.TxnOp_Put{Put: &pb.TxnPut{
+			Key:   "doc",
+			Value: &pb.Value{Kind: &pb.Value_JsonValue{JsonValue: `{"a":`}},
+		}}}},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestBatch(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	res, err := cl.BatchPut(ctx, &pb.BatchPutRequest{
+		Puts: []*pb.PutRequest{
+			{Records: &pb.Records{Key: "a", Value: "1"}},
+			{Records: &pb.Records{Key: "a", Value: "2"}, Precondition: &pb.Precondition{IfAbsent: true}},
+			{Records: &pb.Records{Key: "b", Value: "3"}},
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res.Results))
+	require.Equal(t, int32(codes.OK), res.Results[0].Code)
+	require.Equal(t, int32(codes.FailedPrecondition), res.Results[1].Code)
+	require.NotZero(t, res.Results[2].Version)
+
+	got, err := cl.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{"a", "b", "c"}})
+	require.NoError(t, err)
+	require.Equal(t, "1", got.Results[0].TypedValue.GetStringValue())
+	require.Equal(t, res.Results[2].Version, got.Results[1].Version)
+	require.False(t, got.Results[2].Found)
+
+	deleted, err := cl.BatchDelete(ctx, &pb.BatchDeleteRequest{
+		Deletes: []*pb.DeleteRequest{{Key: "a"}, {Key: "b"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(deleted.Results))
+
+	got, err = cl.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{"a", "b"}})
+	require.NoError(t, err)
+	require.False(t, got.Results[0].Found)
+	require.False(t, got.Results[1].Found)
+
+	// the puts of a stream
+	stream, err := cl.PutStream(ctx)
+	require.NoError(t, err)
+	for i := 0; i < streamBatchSize+1; i++ {
+		err = stream.Send(&pb.PutRequest{Records: &pb.Records{Key: fmt.Sprintf("s%d", i), Value: "v"}})
+		require.NoError(t, err)
+	}
+	streamed, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Equal(t, streamBatchSize+1, len(streamed.Results))
+
+	got, err = cl.BatchGet(ctx, &pb.BatchGetRequest{Keys: []string{fmt.Sprintf("s%d", streamBatchSize)}})
+	require.NoError(t, err)
+	require.True(t, got.Results[0].Found)
+}
+
+func TestWatch(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// from the first index, so the put is received even if it is applied
+	// before the watcher is registered
+	stream, err := cl.Watch(ctx, &pb.WatchRequest{Key: "user/", Prefix: true, StartIndex: 1})
+	require.NoError(t, err)
+
+	_, err = cl.Put(ctx, &pb.PutRequest{Records: &pb.Records{Key: "user/1", Value: "name"}})
+	require.NoError(t, err)
+
+	ev, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchEvent_PUT, ev.Type)
+	require.Equal(t, "user/1", ev.Key)
+
+	_, err = cl.Delete(ctx, &pb.DeleteRequest{Key: "user/1"})
+	require.NoError(t, err)
+	ev, err = stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchEvent_DELETE, ev.Type)
+
+	// a new watcher resumes from an index
+	replay, err := cl.Watch(ctx, &pb.WatchRequest{Key: "user/1", StartIndex: ev.Index})
+	require.NoError(t, err)
+	ev, err = replay.Recv()
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchEvent_DELETE, ev.Type)
+}
+
+func TestScan(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	for _, key := range []string{"user:2", "user:1", "item:1", "user:3"} {
+		_, err := cl.Put(ctx, &pb.PutRequest{Records: &pb.Records{Key: key, Value: key}})
+		require.NoError(t, err)
+	}
+
+	res, err := cl.ListPrefix(ctx, &pb.ListPrefixRequest{Prefix: "user:", Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Results))
+	require.Equal(t, "user:1", res.Results[0].Key)
+	require.Equal(t, "user:1", res.Results[0].TypedValue.GetStringValue())
+	require.NotEmpty(t, res.NextPageToken)
+
+	res, err = cl.ListPrefix(ctx, &pb.ListPrefixRequest{Prefix: "user:", Limit: 2, PageToken: res.NextPageToken})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res.Results))
+	require.Equal(t, "user:3", res.Results[0].Key)
+	require.Empty(t, res.NextPageToken)
+
+	res, err = cl.Scan(ctx, &pb.ScanRequest{Start: "item:", End: "user:2"})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res.Results))
+	require.Equal(t, "item:1", res.Results[0].Key)
+
+	_, err = cl.Scan(ctx, &pb.ScanRequest{Start: "b", End: "a"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGetExpired(t *testing.T) {
+	cl, teardown := setupTest(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	_, err := cl.Put(ctx, &pb.PutRequest{
+		Records: &pb.Records{
+			Key:   "session",
+			Value: "token",
+		},
+		TtlMs: 20,
+	})
+	require.NoError(t, err)
+
+	resp, err := cl.Get(ctx, &pb.GetRequest{
+		Key: "session",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "token", resp.Value)
+
+	time.Sleep(30 * time.Millisecond)
+
+	resp, err = cl.Get(ctx, &pb.GetRequest{
+		Key: "session",
+	})
+	require.Nil(t, resp)
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, st.Code().String(), "Code(404)")
+
+	// a negative ttl is rejected
+	_, err = cl.Put(ctx, &pb.PutRequest{
+		Records: &pb.Records{
+			Key:   "session",
+			Value: "token",
+		},
+		TtlMs: -1,
+	})
+	st, ok = status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.InvalidArgument, st.Code())
+}
+
 func TestGetKeys(t *testing.T) {
 	cl, teardown := setupTest(t)
 	defer teardown()
@@ -189,6 +530,24 @@ func TestGetKeys(t *testing.T) {
 	require.NoError(t, err)
 
 	require.Equal(t, len(want.Keys), len(resp.Keys))
+	require.Empty(t, resp.NextCursor)
+
+	// one key per page
+	resp, err = cl.GetKeys(ctx, &pb.GetKeysRequest{Limit: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp.Keys))
+	require.NotEmpty(t, resp.NextCursor)
+	resp1, err := cl.GetKeys(ctx, &pb.GetKeysRequest{Limit: 1, Cursor: resp.NextCursor})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(resp1.Keys))
+	require.NotEqual(t, resp.Keys[0], resp1.Keys[0])
+
+	resp, err = cl.GetKeys(ctx, &pb.GetKeysRequest{Glob: "key?", CountOnly: true})
+	require.NoError(t, err)
+	require.Equal(t, int64(1), resp.Count)
+
+	_, err = cl.GetKeys(ctx, &pb.GetKeysRequest{Regex: "("})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
 }
 
 func TestDelete(t *testing.T) {
@@ -247,7 +606,7 @@ func TestGetKeysValuesStream(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	stream, err := cl.GetKeysValuesStream(ctx, &pb.Empty{})
+	stream, err := cl.GetKeysValuesStream(ctx, &pb.GetKeysValuesRequest{})
 	require.NoError(t, err)
 
 	for {
@@ -272,3 +631,76 @@ func TestGetKeysValuesStream(t *testing.T) {
 		}
 	}
 }
+
+// a failed connection is dialed again, the ones of a node leaving or of a server stopped are closed
+func TestForwarderConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	// nothing listens on it anymore
+	require.NoError(t, ln.Close())
+
+	f := NewForwarder(nil)
+	cc, err := f.conn(addr)
+	require.NoError(t, err)
+	cc.Connect()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for state := cc.GetState(); state != connectivity.TransientFailure; state = cc.GetState() {
+		require.True(t, cc.WaitForStateChange(ctx, state))
+	}
+	redialed, err := f.conn(addr)
+	require.NoError(t, err)
+	require.NotSame(t, cc, redialed)
+	require.Equal(t, connectivity.Shutdown, cc.GetState())
+
+	f.Forget(addr)
+	require.NotContains(t, f.conns, addr)
+	require.Equal(t, connectivity.Shutdown, redialed.GetState())
+
+	other, err := f.conn("127.0.0.1:8401")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Empty(t, f.conns)
+	require.Equal(t, connectivity.Shutdown, other.GetState())
+}
+
+func TestToLeader(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	getSrv := mockgetter.NewMockGetter(ctrl)
+	s, err := newgrpcserver(&config.Services{Getter: getSrv}, nil, NewForwarder(nil))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+
+	// no leader elected
+	getSrv.EXPECT().GetPartitions(ctx).Return([]*pb.Partition{{Id: 0}, {Id: 1}}, nil)
+	getSrv.EXPECT().PartitionOf("key").Return(1)
+	_, _, err = s.toLeader(ctx, "key")
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Unavailable, st.Code())
+
+	// a forwarded rpc is not forwarded again
+	fwdCtx := metadata.NewIncomingContext(ctx, metadata.Pairs(forwardedHeader, "true"))
+	_, _, err = s.toLeader(fwdCtx, "key")
+	st, ok = status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Unavailable, st.Code())
+
+	// the client of the leader of the key's partition carries the forwarded header
+	getSrv.EXPECT().GetPartitions(ctx).Return([]*pb.Partition{
+		{Id: 0, LeaderId: "0", LeaderAddr: "127.0.0.1:8400"},
+		{Id: 1, LeaderId: "1", LeaderAddr: "127.0.0.1:8401"},
+	}, nil)
+	getSrv.EXPECT().PartitionOf("key").Return(1)
+	outCtx, leader, err := s.toLeader(ctx, "key")
+	require.NoError(t, err)
+	require.NotNil(t, leader)
+	require.Contains(t, s.forwarder.conns, "127.0.0.1:8401")
+	md, ok := metadata.FromOutgoingContext(outCtx)
+	require.True(t, ok)
+	require.Equal(t, []string{"true"}, md.Get(forwardedHeader))
+}
@@ -0,0 +1,218 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+
+	pb "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/getter"
+	"github.com/djedjethai/generation/internal/models"
+	"github.com/djedjethai/generation/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// set on the reads a node sends to the leader of a partition it does not serve,
+// the leader reads this partition only(see storage.WithPartition)
+const partitionHeader = "x-generation-partition"
+
+// Remote reads the partitions a node does not serve with the rpcs of their leader,
+// it shares the connections of the forwarder of the server
+type Remote struct {
+	forwarder *Forwarder
+}
+
+func NewRemote(forwarder *Forwarder) *Remote {
+	return &Remote{forwarder: forwarder}
+}
+
+func (r *Remote) client(ctx context.Context, addr string, partition int) (context.Context, pb.KeyValueClient, error) {
+	cc, err := r.forwarder.conn(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, partitionHeader, strconv.Itoa(partition))
+	return ctx, pb.NewKeyValueClient(cc), nil
+}
+
+func (r *Remote) GetWithVersion(ctx context.Context, addr string, partition int, key string) (interface{}, uint64, error) {
+	ctx, cl, err := r.client(ctx, addr, partition)
+	if err != nil {
+		return nil, 0, err
+	}
+	res, err := cl.Get(ctx, &pb.GetRequest{Key: key, Consistency: storage.ConsistencyOf(ctx)})
+	if status.Code(err) == codes.Code(404) {
+		return nil, 0, storage.ErrorNoSuchKey
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.TypedValue != nil {
+		return res.TypedValue.Interface(), res.Version, nil
+	}
+	return res.Value, res.Version, nil
+}
+
+func (r *Remote) KeysPage(ctx context.Context, addr string, partition int, cursor models.KeysCursor, limit int) ([]string, models.KeysCursor, bool, error) {
+	ctx, cl, err := r.client(ctx, addr, partition)
+	if err != nil {
+		return nil, models.KeysCursor{}, false, err
+	}
+	if limit > getter.MaxKeysLimit {
+		limit = getter.MaxKeysLimit
+	}
+	res, err := cl.GetKeys(ctx, &pb.GetKeysRequest{
+		Cursor:      getter.EncodeCursor(cursor),
+		Limit:       int32(limit),
+		Consistency: storage.ConsistencyOf(ctx),
+	})
+	if err != nil {
+		return nil, models.KeysCursor{}, false, err
+	}
+	if res.NextCursor == "" {
+		return res.Keys, models.KeysCursor{}, true, nil
+	}
+	next, err := getter.DecodeCursor(res.NextCursor)
+	return res.Keys, next, false, err
+}
+
+// Scan reads the pages of the leader until it has limit records, all of them if limit is 0
+func (r *Remote) Scan(ctx context.Context, addr string, partition int, start, end string, limit int) ([]models.KeysValues, error) {
+	ctx, cl, err := r.client(ctx, addr, partition)
+	if err != nil {
+		return nil, err
+	}
+	var records []models.KeysValues
+	var token string
+	for limit <= 0 || len(records) < limit {
+		size := getter.MaxScanLimit
+		if left := limit - len(records); limit > 0 && left < size {
+			size = left
+		}
+		res, err := cl.Scan(ctx, &pb.ScanRequest{
+			Start:       start,
+			End:         end,
+			Limit:       int32(size),
+			PageToken:   token,
+			Consistency: storage.ConsistencyOf(ctx),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range res.Results {
+			records = append(records, models.KeysValues{
+				Key:     result.Key,
+				Value:   result.TypedValue.Interface(),
+				Version: result.Version,
+			})
+		}
+		if token = res.NextPageToken; token == "" {
+			break
+		}
+	}
+	return records, nil
+}
+
+func (r *Remote) KeysValues(ctx context.Context, addr string, partition int, ch chan models.KeysValues) error {
+	defer close(ch)
+	ctx, cl, err := r.client(ctx, addr, partition)
+	if err != nil {
+		return err
+	}
+	stream, err := cl.GetKeysValuesStream(ctx, &pb.GetKeysValuesRequest{Consistency: storage.ConsistencyOf(ctx)})
+	if err != nil {
+		return err
+	}
+	for {
+		res, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kv := models.KeysValues{Key: res.Records.Key, Value: res.Records.Value}
+		if res.Records.TypedValue != nil {
+			kv.Value = res.Records.TypedValue.Interface()
+		}
+		select {
+		case ch <- kv:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Watch closes the channel when the stream of the leader breaks, like a watcher too late
+func (r *Remote) Watch(ctx context.Context, addr string, partition int, key string, prefix bool, startIndex uint64) (<-chan *pb.WatchEvent, func(), error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ctx, cl, err := r.client(ctx, addr, partition)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	stream, err := cl.Watch(ctx, &pb.WatchRequest{Key: key, Prefix: prefix, StartIndex: startIndex})
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	events := make(chan *pb.WatchEvent)
+	go func() {
+		defer close(events)
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, cancel, nil
+}
+
+// the reads sent by a node to the leader of a partition are restricted to it
+func restrictPartition(ctx context.Context) (context.Context, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(partitionHeader)) == 0 {
+		return ctx, nil
+	}
+	partition, err := strconv.Atoi(md.Get(partitionHeader)[0])
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid partition")
+	}
+	return storage.WithPartition(ctx, partition), nil
+}
+
+func partitionUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := restrictPartition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func partitionStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := restrictPartition(ss.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &partitionStream{ServerStream: ss, ctx: ctx})
+}
+
+type partitionStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *partitionStream) Context() context.Context {
+	return s.ctx
+}
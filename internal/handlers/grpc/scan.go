@@ -0,0 +1,58 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/getter"
+	"github.com/djedjethai/generation/internal/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *Server) Scan(ctx context.Context, r *pb.ScanRequest) (*pb.ScanResponse, error) {
+	kvs, next, err := s.Services.Getter.Scan(ctx, r.Start, r.End, int(r.Limit), r.PageToken, r.Consistency)
+	if err != nil {
+		return nil, scanError(err)
+	}
+	return s.scanResponse(ctx, kvs, next)
+}
+
+func (s *Server) ListPrefix(ctx context.Context, r *pb.ListPrefixRequest) (*pb.ScanResponse, error) {
+	kvs, next, err := s.Services.Getter.ListPrefix(ctx, r.Prefix, int(r.Limit), r.PageToken, r.Consistency)
+	if err != nil {
+		return nil, scanError(err)
+	}
+	return s.scanResponse(ctx, kvs, next)
+}
+
+func (s *Server) scanResponse(ctx context.Context, kvs []models.KeysValues, next string) (*pb.ScanResponse, error) {
+	res := &pb.ScanResponse{
+		Results:       make([]*pb.GetResult, 0, len(kvs)),
+		NextPageToken: next,
+	}
+	res.AppliedIndex, res.AppliedIndexes = s.appliedIndexes(ctx)
+	for _, kv := range kvs {
+		typed, err := pb.NewValue(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		res.Results = append(res.Results, &pb.GetResult{
+			Key:        kv.Key,
+			Found:      true,
+			TypedValue: typed,
+			Version:    kv.Version,
+		})
+	}
+	return res, nil
+}
+
+func scanError(err error) error {
+	switch {
+	case errors.Is(err, getter.ErrInvalidRange), errors.Is(err, getter.ErrInvalidPageToken),
+		errors.Is(err, getter.ErrInvalidCursor), errors.Is(err, getter.ErrInvalidFilter):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,148 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	pb "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/djedjethai/generation/internal/storage"
+	"github.com/hashicorp/raft"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// the size of the chunks of a download
+const downloadChunkSize = 64 << 10
+
+// CreateSnapshot snapshots the partitions of this node, each node has its own snapshots
+func (s *Server) CreateSnapshot(ctx context.Context, r *pb.CreateSnapshotRequest) (*pb.SnapshotsResponse, error) {
+	snapshots, err := s.Services.Setter.CreateSnapshot(ctx)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	return &pb.SnapshotsResponse{Snapshots: snapshots}, nil
+}
+
+func (s *Server) ListSnapshots(ctx context.Context, r *pb.ListSnapshotsRequest) (*pb.SnapshotsResponse, error) {
+	snapshots, err := s.Services.Getter.ListSnapshots(ctx)
+	if err != nil {
+		return nil, snapshotError(err)
+	}
+	return &pb.SnapshotsResponse{Snapshots: snapshots}, nil
+}
+
+func (s *Server) DownloadSnapshot(r *pb.DownloadSnapshotRequest, stream pb.KeyValue_DownloadSnapshotServer) error {
+	info, rc, err := s.Services.Getter.OpenSnapshot(stream.Context(), int(r.Partition), r.Id)
+	if err != nil {
+		return snapshotError(err)
+	}
+	defer rc.Close()
+
+	chunk := &pb.SnapshotChunk{Info: info}
+	buf := make([]byte, downloadChunkSize)
+	for {
+		n, err := io.ReadFull(rc, buf)
+		if n > 0 || chunk.Info != nil {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk = &pb.SnapshotChunk{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return snapshotError(err)
+		}
+	}
+}
+
+// RestoreSnapshot received by a follower of the partition is relayed to its leader,
+// the chunks are streamed as they arrive
+func (s *Server) RestoreSnapshot(stream pb.KeyValue_RestoreSnapshotServer) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if err == io.EOF || (err == nil && first.Info == nil) {
+		return status.Error(codes.InvalidArgument, "the first chunk must have the partition of the snapshot")
+	}
+	if err != nil {
+		return err
+	}
+	partition := int(first.Info.Partition)
+
+	r := &chunkReader{stream: stream, data: first.Data}
+	info, err := s.Services.Setter.RestoreSnapshot(ctx, partition, r)
+	// the storage checks it is the leader before reading the snapshot
+	if errors.Is(err, raft.ErrNotLeader) && !r.read {
+		ctx, leader, err := s.toPartitionLeader(ctx, partition)
+		if err != nil {
+			return err
+		}
+		out, err := leader.RestoreSnapshot(ctx)
+		if err != nil {
+			return err
+		}
+		for chunk := first; ; {
+			if err := out.Send(chunk); err != nil {
+				return err
+			}
+			if chunk, err = stream.Recv(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		res, err := out.CloseAndRecv()
+		if err != nil {
+			return err
+		}
+		return stream.SendAndClose(res)
+	}
+	if err != nil {
+		return snapshotError(err)
+	}
+	return stream.SendAndClose(&pb.RestoreSnapshotResponse{Snapshot: info})
+}
+
+// chunkReader reads the data of the chunks of a restore
+type chunkReader struct {
+	stream pb.KeyValue_RestoreSnapshotServer
+	data   []byte
+	read   bool
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	r.read = true
+	for len(r.data) == 0 {
+		chunk, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.data = chunk.Data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func snapshotError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrorNoSuchSnapshot):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, storage.ErrorNoSuchPartition),
+		errors.Is(err, storage.ErrorSnapshotPartition),
+		errors.Is(err, storage.ErrorSnapshotCorrupted),
+		errors.Is(err, storage.ErrorSnapshotVersion),
+		errors.Is(err, codec.ErrorCorrupted):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, storage.ErrorNotReplicated),
+		errors.Is(err, codec.ErrorUnknownKey):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, raft.ErrNotLeader):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return err
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"net/http"
 
+	"github.com/djedjethai/generation/internal/storage"
 	"github.com/gorilla/mux"
 )
 
@@ -18,10 +19,25 @@ func (h *Handler) keyValueDeleteHandler() func(w http.ResponseWriter, r *http.Re
 		// create a context
 		ctx := context.Background()
 
-		err := h.services.Deleter.Delete(ctx, key)
+		// optional precondition, from If-Match and If-None-Match
+		pre, err := parsePrecondition(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if pre == nil {
+			err = h.services.Deleter.Delete(ctx, key)
+		} else {
+			err = h.services.Deleter.DeleteIf(ctx, key, pre)
+		}
 		if errors.Is(err, ErrorNoSuchKey) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 		}
+		if errors.Is(err, storage.ErrorPreconditionFailed) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/storage"
 )
 
 func Test_delete_should_return_nil_if_value_is_deleted(t *testing.T) {
@@ -53,3 +56,23 @@ func Test_delete_should_return_err_if_delete_service_return_an_err(t *testing.T)
 		t.Error("Failed while checking status code")
 	}
 }
+
+func Test_delete_should_return_precondition_failed(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	pre := &api.Precondition{IfPresent: true}
+	mockDeleterSrv.EXPECT().DeleteIf(ctx, "key-a", pre).Return(storage.ErrorPreconditionFailed)
+
+	request, _ := http.NewRequest(http.MethodDelete, "/v1/key-a", nil)
+	request.Header.Set("If-Match", "*")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Error("Failed while checking status code")
+	}
+}
@@ -2,11 +2,17 @@ package rest
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/getter"
+	"github.com/djedjethai/generation/internal/models"
 	"github.com/gorilla/mux"
 )
 
@@ -19,7 +25,13 @@ func (h *Handler) keyValueGetHandler() func(w http.ResponseWriter, r *http.Reque
 
 		ctx := context.Background()
 
-		value, err := h.services.Getter.Get(ctx, key)
+		consistency, err := parseConsistency(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		value, version, err := h.services.Getter.GetWithVersion(ctx, key, consistency)
 		if errors.Is(err, ErrorNoSuchKey) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 		}
@@ -27,15 +39,23 @@ func (h *Handler) keyValueGetHandler() func(w http.ResponseWriter, r *http.Reque
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// the version, to send back in If-Match
+		w.Header().Set("ETag", etag(version))
 
 		var result string
-		switch value.(type) {
+		switch v := value.(type) {
 		case string:
-			result = value.(string)
+			result = v
 		case int64:
-			result = fmt.Sprintf("%v", value.(int64))
-		case float32:
-			result = fmt.Sprintf("%v", value.(float32))
+			result = fmt.Sprintf("%v", v)
+		case float64:
+			result = fmt.Sprintf("%v", v)
+		case []byte:
+			w.Header().Set("Content-Type", "application/octet-stream")
+			result = string(v)
+		case json.RawMessage:
+			w.Header().Set("Content-Type", "application/json")
+			result = string(v)
 		default:
 			result = "Invalid type"
 		}
@@ -48,9 +68,119 @@ func (h *Handler) keyValueGetKeysHandler() func(w http.ResponseWriter, r *http.R
 
 		ctx := context.Background()
 
-		value := h.services.Getter.GetKeys(ctx)
+		consistency, err := parseConsistency(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// with any of the scan params the keys are paginated and in order,
+		// the token of the next page is in the Next-Page-Token header
+		q := r.URL.Query()
+		if q.Has("prefix") || q.Has("start") || q.Has("end") || q.Has("limit") || q.Has("page_token") {
+			h.scanKeys(ctx, w, q, consistency)
+			return
+		}
+		if q.Has("cursor") || q.Has("glob") || q.Has("regex") || q.Has("count") {
+			h.keysPage(ctx, w, q, consistency)
+			return
+		}
+
+		value, err := h.services.Getter.GetKeys(ctx, consistency)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		stringByte := strings.Join(value, ",")
 
 		w.Write([]byte(stringByte))
 	}
 }
+
+func (h *Handler) scanKeys(ctx context.Context, w http.ResponseWriter, q url.Values, consistency api.Consistency) {
+	var limit int
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var kvs []models.KeysValues
+	var next string
+	var err error
+	if q.Has("prefix") {
+		kvs, next, err = h.services.Getter.ListPrefix(ctx, q.Get("prefix"), limit, q.Get("page_token"), consistency)
+	} else {
+		kvs, next, err = h.services.Getter.Scan(ctx, q.Get("start"), q.Get("end"), limit, q.Get("page_token"), consistency)
+	}
+	if errors.Is(err, getter.ErrInvalidRange) || errors.Is(err, getter.ErrInvalidPageToken) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	keys := make([]string, 0, len(kvs))
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	if next != "" {
+		w.Header().Set("Next-Page-Token", next)
+	}
+	w.Write([]byte(strings.Join(keys, ",")))
+}
+
+// the keys shard after shard, the cursor of the next page is in the Next-Cursor header.
+// With count=true only the number of keys is returned
+func (h *Handler) keysPage(ctx context.Context, w http.ResponseWriter, q url.Values, consistency api.Consistency) {
+	var limit int
+	if l := q.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.services.Getter.GetKeysPage(ctx, models.KeysQuery{
+		Cursor:    q.Get("cursor"),
+		Limit:     limit,
+		Glob:      q.Get("glob"),
+		Regex:     q.Get("regex"),
+		CountOnly: q.Get("count") == "true",
+	}, consistency)
+	if errors.Is(err, getter.ErrInvalidCursor) || errors.Is(err, getter.ErrInvalidFilter) || errors.Is(err, getter.ErrInvalidRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if q.Get("count") == "true" {
+		w.Write([]byte(strconv.Itoa(page.Count)))
+		return
+	}
+	if page.NextCursor != "" {
+		w.Header().Set("Next-Cursor", page.NextCursor)
+	}
+	w.Write([]byte(strings.Join(page.Keys, ",")))
+}
+
+// optional consistency of the read, "linearizable"(default), "leader" or "stale"
+func parseConsistency(r *http.Request) (api.Consistency, error) {
+	c := r.URL.Query().Get("consistency")
+	if c == "" {
+		return api.Consistency_LINEARIZABLE, nil
+	}
+	v, ok := api.Consistency_value[strings.ToUpper(c)]
+	if !ok {
+		return 0, errors.New("invalid consistency")
+	}
+	return api.Consistency(v), nil
+}
@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/models"
 )
 
 func Test_getter_should_return_a_value_from_key(t *testing.T) {
@@ -16,7 +19,7 @@ func Test_getter_should_return_a_value_from_key(t *testing.T) {
 
 	// arrange
 	mockedGetterResponse := "value"
-	mockGetterSrv.EXPECT().Get(ctx, "key-a").Return(mockedGetterResponse, nil)
+	mockGetterSrv.EXPECT().GetWithVersion(ctx, "key-a", api.Consistency_LINEARIZABLE).Return(mockedGetterResponse, uint64(7), nil)
 
 	request, _ := http.NewRequest(http.MethodGet, "/v1/key-a", nil)
 
@@ -33,6 +36,10 @@ func Test_getter_should_return_a_value_from_key(t *testing.T) {
 	if recorder.Body.String() != "value" {
 		t.Error("Failed while testing the value")
 	}
+
+	if recorder.Header().Get("ETag") != `"7"` {
+		t.Error("Failed while testing the version")
+	}
 }
 
 func Test_getter_should_return_an_error(t *testing.T) {
@@ -42,7 +49,7 @@ func Test_getter_should_return_an_error(t *testing.T) {
 	ctx := context.Background()
 
 	// arrange
-	mockGetterSrv.EXPECT().Get(ctx, "key-a").Return(nil, errors.New("what ever..."))
+	mockGetterSrv.EXPECT().GetWithVersion(ctx, "key-a", api.Consistency_LINEARIZABLE).Return(nil, uint64(0), errors.New("what ever..."))
 
 	request, _ := http.NewRequest(http.MethodGet, "/v1/key-a", nil)
 
@@ -64,7 +71,7 @@ func Test_getkeys_should_return_the_keys(t *testing.T) {
 	ctx := context.Background()
 
 	mockedGetKeysResponse := []string{"key1, key2"}
-	mockGetterSrv.EXPECT().GetKeys(ctx).Return(mockedGetKeysResponse)
+	mockGetterSrv.EXPECT().GetKeys(ctx, api.Consistency_LINEARIZABLE).Return(mockedGetKeysResponse, nil)
 
 	request, _ := http.NewRequest(http.MethodGet, "/util/keys", nil)
 
@@ -80,3 +87,80 @@ func Test_getkeys_should_return_the_keys(t *testing.T) {
 		t.Error("Failed while testing the value")
 	}
 }
+
+func Test_getkeys_should_list_a_prefix_by_pages(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	kvs := []models.KeysValues{{Key: "user:1"}, {Key: "user:2"}}
+	mockGetterSrv.EXPECT().ListPrefix(ctx, "user:", 2, "tok", api.Consistency_LINEARIZABLE).Return(kvs, "next", nil)
+
+	request, _ := http.NewRequest(http.MethodGet, "/util/keys?prefix=user:&limit=2&page_token=tok", nil)
+
+	router.HandleFunc("/util/keys", handler.keyValueGetKeysHandler())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Failed while checking status code")
+	}
+	if recorder.Body.String() != "user:1,user:2" || recorder.Header().Get("Next-Page-Token") != "next" {
+		t.Error("Failed while testing the page")
+	}
+}
+
+func Test_getkeys_should_count_the_matching_keys(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	q := models.KeysQuery{Glob: "user:*", CountOnly: true}
+	mockGetterSrv.EXPECT().GetKeysPage(ctx, q, api.Consistency_LINEARIZABLE).Return(models.KeysPage{Count: 42}, nil)
+
+	request, _ := http.NewRequest(http.MethodGet, "/util/keys?glob=user:*&count=true", nil)
+
+	router.HandleFunc("/util/keys", handler.keyValueGetKeysHandler())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "42" {
+		t.Error("Failed while testing the count")
+	}
+}
+
+func Test_getter_should_pass_the_consistency(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	mockGetterSrv.EXPECT().GetWithVersion(ctx, "key-a", api.Consistency_STALE).Return("value", uint64(7), nil)
+
+	request, _ := http.NewRequest(http.MethodGet, "/v1/key-a?consistency=stale", nil)
+
+	router.HandleFunc("/v1/{key}", handler.keyValueGetHandler())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Failed while testing the status code")
+	}
+}
+
+func Test_getter_should_reject_an_invalid_consistency(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	request, _ := http.NewRequest(http.MethodGet, "/v1/key-a?consistency=eventually", nil)
+
+	router.HandleFunc("/v1/{key}", handler.keyValueGetHandler())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Failed while testing the status code")
+	}
+}
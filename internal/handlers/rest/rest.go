@@ -29,6 +29,7 @@ func (h *Handler) Multiplex() http.Handler {
 	r.HandleFunc("/v1/{key}", h.keyValueSetHandler()).Methods("PUT")
 	r.HandleFunc("/v1/{key}", h.keyValueGetHandler()).Methods("GET")
 	r.HandleFunc("/v1/{key}", h.keyValueDeleteHandler()).Methods("DELETE")
+	r.HandleFunc("/v1/{key}/incr", h.keyValueIncrHandler()).Methods("POST")
 	r.HandleFunc("/v1/util/keys", h.keyValueGetKeysHandler()).Methods("GET")
 
 	return r
@@ -2,9 +2,15 @@ package rest
 
 import (
 	"context"
+	"errors"
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/storage"
 	"github.com/gorilla/mux"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (h *Handler) keyValueSetHandler() func(w http.ResponseWriter, r *http.Request) {
@@ -25,16 +31,152 @@ func (h *Handler) keyValueSetHandler() func(w http.ResponseWriter, r *http.Reque
 			return
 		}
 
-		err = h.services.Setter.Set(ctx, key, value)
+		// optional time to live, as a duration like "30s" or "1h"
+		var ttl time.Duration
+		if t := r.URL.Query().Get("ttl"); t != "" {
+			ttl, err = time.ParseDuration(t)
+			if err != nil || ttl < 0 {
+				http.Error(w,
+					"invalid ttl",
+					http.StatusBadRequest)
+				return
+			}
+		}
+
+		// optional type of the value, a string by default
+		typed, err := parseValue(r.URL.Query().Get("type"), value)
+		if err != nil {
+			http.Error(w,
+				err.Error(),
+				http.StatusBadRequest)
+			return
+		}
 
+		// optional precondition, from If-Match and If-None-Match
+		pre, err := parsePrecondition(r)
+		if err != nil {
+			http.Error(w,
+				err.Error(),
+				http.StatusBadRequest)
+			return
+		}
+
+		if pre == nil {
+			err = h.services.Setter.Set(ctx, key, typed, ttl)
+		} else {
+			var version uint64
+			version, err = h.services.Setter.SetIf(ctx, key, typed, ttl, pre)
+			if err == nil {
+				w.Header().Set("ETag", etag(version))
+			}
+		}
+
+		if errors.Is(err, storage.ErrorPreconditionFailed) {
+			http.Error(w,
+				err.Error(),
+				http.StatusPreconditionFailed)
+			return
+		}
 		if err != nil {
 			http.Error(w,
 				err.Error(),
 				http.StatusInternalServerError)
 			return
 		}
-		h.loggerFacade.WriteSet(key, string(value))
+		h.loggerFacade.WriteSet(key, typed, ttl)
 
 		w.WriteHeader(http.StatusCreated)
 	}
 }
+
+// adds the delta query param(1 by default, negative to decrement) to the integer
+// value of the key and returns the new value
+func (h *Handler) keyValueIncrHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		key := vars["key"]
+
+		// create a context
+		ctx := context.Background()
+
+		delta := int64(1)
+		if d := r.URL.Query().Get("delta"); d != "" {
+			var err error
+			delta, err = strconv.ParseInt(d, 10, 64)
+			if err != nil {
+				http.Error(w,
+					"invalid delta",
+					http.StatusBadRequest)
+				return
+			}
+		}
+
+		value, err := h.services.Setter.Incr(ctx, key, delta)
+		if errors.Is(err, storage.ErrorNotAnInteger) || errors.Is(err, storage.ErrorOverflow) {
+			http.Error(w,
+				err.Error(),
+				http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w,
+				err.Error(),
+				http.StatusInternalServerError)
+			return
+		}
+		h.loggerFacade.WriteIncr(key, delta)
+
+		w.Write([]byte(strconv.FormatInt(value, 10)))
+	}
+}
+
+// the body is the text form of the value, but for the bytes which are taken as they are
+func parseValue(typ string, body []byte) (interface{}, error) {
+	if typ == api.TypeBytes {
+		return body, nil
+	}
+	v, err := api.ParseValue(typ, string(body))
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+// the version of a key is its etag:
+//   - If-Match: "<version>", the key must be at this version
+//   - If-Match: *, the key must exist
+//   - If-None-Match: *, the key must not exist
+func parsePrecondition(r *http.Request) (*api.Precondition, error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil, nil
+	}
+
+	pre := &api.Precondition{}
+	switch ifNoneMatch {
+	case "":
+	case "*":
+		pre.IfAbsent = true
+	default:
+		return nil, errors.New("invalid If-None-Match, only * is supported")
+	}
+
+	switch ifMatch {
+	case "":
+	case "*":
+		pre.IfPresent = true
+	default:
+		version, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+		if err != nil || version == 0 {
+			return nil, errors.New("invalid If-Match")
+		}
+		pre.ExpectedVersion = version
+	}
+
+	return pre, nil
+}
+
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
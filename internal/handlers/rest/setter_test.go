@@ -7,6 +7,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/storage"
 )
 
 func Test_put_should_return_nil_if_value_is_added(t *testing.T) {
@@ -15,7 +19,7 @@ func Test_put_should_return_nil_if_value_is_added(t *testing.T) {
 
 	ctx := context.Background()
 
-	mockSetterSrv.EXPECT().Set(ctx, "key-a", []uint8{118, 97, 108, 117, 101, 45, 97}).Return(nil)
+	mockSetterSrv.EXPECT().Set(ctx, "key-a", "value-a", time.Duration(0)).Return(nil)
 
 	router.HandleFunc("/v1/{key}", handler.keyValueSetHandler())
 
@@ -40,7 +44,7 @@ func Test_put_should_return_err_service_return_err(t *testing.T) {
 
 	ctx := context.Background()
 
-	mockSetterSrv.EXPECT().Set(ctx, "key-a", []uint8{118, 97, 108, 117, 101, 45, 97}).Return(errors.New("what ever..."))
+	mockSetterSrv.EXPECT().Set(ctx, "key-a", "value-a", time.Duration(0)).Return(errors.New("what ever..."))
 
 	router.HandleFunc("/v1/{key}", handler.keyValueSetHandler())
 
@@ -54,3 +58,159 @@ func Test_put_should_return_err_service_return_err(t *testing.T) {
 		t.Error("Failed while checking status code")
 	}
 }
+
+func Test_put_should_pass_the_ttl_to_the_service(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	mockSetterSrv.EXPECT().Set(ctx, "key-a", "value-a", 30*time.Second).Return(nil)
+
+	router.HandleFunc("/v1/{key}", handler.keyValueSetHandler())
+
+	request, _ := http.NewRequest(http.MethodPut, "/v1/key-a?ttl=30s", strings.NewReader("value-a"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Error("Failed while checking status code")
+	}
+}
+
+func Test_put_should_return_bad_request_if_ttl_is_invalid(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	router.HandleFunc("/v1/{key}", handler.keyValueSetHandler())
+
+	request, _ := http.NewRequest(http.MethodPut, "/v1/key-a?ttl=tomorrow", strings.NewReader("value-a"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Failed while checking status code")
+	}
+}
+
+func Test_put_should_pass_the_typed_value_to_the_service(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	mockSetterSrv.EXPECT().Set(ctx, "counter", int64(42), time.Duration(0)).Return(nil)
+
+	router.HandleFunc("/v1/{key}", handler.keyValueSetHandler())
+
+	request, _ := http.NewRequest(http.MethodPut, "/v1/counter?type=int", strings.NewReader("42"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Error("Failed while checking status code")
+	}
+}
+
+func Test_put_should_return_bad_request_if_value_does_not_match_its_type(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	router.HandleFunc("/v1/{key}", handler.keyValueSetHandler())
+
+	request, _ := http.NewRequest(http.MethodPut, "/v1/doc?type=json", strings.NewReader("{not json"))
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusBadRequest {
+		t.Error("Failed while checking status code")
+	}
+}
+
+func Test_incr_should_return_the_new_value(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	mockSetterSrv.EXPECT().Incr(ctx, "counter", int64(-2)).Return(int64(40), nil)
+
+	request, _ := http.NewRequest(http.MethodPost, "/v1/counter/incr?delta=-2", nil)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Error("Failed while checking status code")
+	}
+
+	if recorder.Body.String() != "40" {
+		t.Error("Failed while testing the value")
+	}
+}
+
+func Test_incr_should_return_conflict_if_the_value_is_not_an_integer(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	mockSetterSrv.EXPECT().Incr(ctx, "key-a", int64(1)).Return(int64(0), storage.ErrorNotAnInteger)
+
+	request, _ := http.NewRequest(http.MethodPost, "/v1/key-a/incr", nil)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusConflict {
+		t.Error("Failed while checking status code")
+	}
+}
+
+func Test_put_should_pass_the_precondition_to_the_service(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	pre := &api.Precondition{ExpectedVersion: 7}
+	mockSetterSrv.EXPECT().SetIf(ctx, "key-a", "value-a", time.Duration(0), pre).Return(uint64(9), nil)
+
+	request, _ := http.NewRequest(http.MethodPut, "/v1/key-a", strings.NewReader("value-a"))
+	request.Header.Set("If-Match", `"7"`)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusCreated {
+		t.Error("Failed while checking status code")
+	}
+
+	if recorder.Header().Get("ETag") != `"9"` {
+		t.Error("Failed while testing the version")
+	}
+}
+
+func Test_put_should_return_precondition_failed(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	ctx := context.Background()
+
+	pre := &api.Precondition{IfAbsent: true}
+	mockSetterSrv.EXPECT().SetIf(ctx, "key-a", "value-a", time.Duration(0), pre).Return(uint64(0), storage.ErrorPreconditionFailed)
+
+	request, _ := http.NewRequest(http.MethodPut, "/v1/key-a", strings.NewReader("value-a"))
+	request.Header.Set("If-None-Match", "*")
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusPreconditionFailed {
+		t.Error("Failed while checking status code")
+	}
+}
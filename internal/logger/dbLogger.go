@@ -3,11 +3,13 @@ package logger
 import (
 	"database/sql"
 	"fmt"
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	cfg "github.com/djedjethai/generation/internal/config"
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
 	"log"
+	"strconv"
 	"time"
 )
 
@@ -57,6 +59,9 @@ func NewPostgresTransactionLogger(config cfg.PostgresDBParams) (TransactionLogge
 			return nil, fmt.Errorf("failed to create table: %w", err)
 		}
 	}
+	if err = logger.migrateTable(); err != nil {
+		return nil, fmt.Errorf("failed to migrate table: %w", err)
+	}
 
 	return logger, nil
 }
@@ -67,8 +72,23 @@ func (l *PostgresTransactionLogger) CloseFileLogger() {
 	}
 }
 
-func (l *PostgresTransactionLogger) WriteSet(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+func (l *PostgresTransactionLogger) WriteSet(key string, value *api.Value, expiresAt int64) {
+	l.events <- Event{
+		EventType: EventPut,
+		Key:       key,
+		Value:     value.Text(),
+		ValueType: value.TypeName(),
+		ExpiresAt: expiresAt,
+	}
+}
+
+func (l *PostgresTransactionLogger) WriteIncr(key string, delta int64) {
+	l.events <- Event{
+		EventType: EventIncr,
+		Key:       key,
+		Value:     strconv.FormatInt(delta, 10),
+		ValueType: api.TypeInt,
+	}
 }
 
 func (l *PostgresTransactionLogger) WriteDelete(key string) {
@@ -84,12 +104,12 @@ func (l *PostgresTransactionLogger) Run() {
 
 	go func() {
 		query := `INSERT INTO transactions
-			(event_type, key, value)
-			VALUES($1, $2, $3)`
+			(event_type, key, value, value_type, expires_at)
+			VALUES($1, $2, $3, $4, $5)`
 
 		for e := range events {
 
-			_, err := l.db.Exec(query, e.EventType, e.Key, e.Value)
+			_, err := l.db.Exec(query, e.EventType, e.Key, e.Value, e.ValueType, e.ExpiresAt)
 			if err != nil {
 				errors <- err
 			}
@@ -105,7 +125,7 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 		defer close(outEvent)
 		defer close(outError)
 
-		query := `SELECT sequence, event_type, key, value FROM transactions ORDER BY sequence`
+		query := `SELECT sequence, event_type, key, value, value_type, expires_at FROM transactions ORDER BY sequence`
 
 		rows, err := l.db.Query(query)
 		if err != nil {
@@ -117,7 +137,7 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 		e := Event{}
 
 		for rows.Next() {
-			err = rows.Scan(&e.Sequence, &e.EventType, &e.Key, &e.Value)
+			err = rows.Scan(&e.Sequence, &e.EventType, &e.Key, &e.Value, &e.ValueType, &e.ExpiresAt)
 			if err != nil {
 				outError <- fmt.Errorf("error reading row: %w", err)
 			}
@@ -161,7 +181,9 @@ func (l *PostgresTransactionLogger) createTable() error {
 		sequence      BIGSERIAL PRIMARY KEY,
 		event_type    SMALLINT,
 		key 		  TEXT,
-		value         TEXT
+		value         TEXT,
+		value_type    TEXT NOT NULL DEFAULT 'string',
+		expires_at    BIGINT NOT NULL DEFAULT 0
 	  );`
 
 	_, err = l.db.Exec(createQuery)
@@ -171,3 +193,13 @@ func (l *PostgresTransactionLogger) createTable() error {
 
 	return nil
 }
+
+// add the columns introduced after the table creation
+func (l *PostgresTransactionLogger) migrateTable() error {
+	migrateQuery := `ALTER TABLE transactions
+		ADD COLUMN IF NOT EXISTS expires_at BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS value_type TEXT NOT NULL DEFAULT 'string';`
+
+	_, err := l.db.Exec(migrateQuery)
+	return err
+}
@@ -1,9 +1,12 @@
 package logger
 
 import (
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/config"
 	"golang.org/x/net/context"
 	"log"
+	"strconv"
+	"time"
 )
 
 type EventType byte
@@ -12,12 +15,14 @@ const (
 	_                     = iota
 	EventDelete EventType = iota
 	EventPut
+	EventIncr
 )
 
 type TransactionLogger interface {
 	CloseFileLogger()
 	WriteDelete(key string)
-	WriteSet(key, value string)
+	WriteSet(key string, value *api.Value, expiresAt int64)
+	WriteIncr(key string, delta int64)
 	Err() <-chan error
 	Run()
 	ReadEvents() (<-chan Event, <-chan error)
@@ -27,7 +32,11 @@ type Event struct {
 	Sequence  uint64
 	EventType EventType
 	Key       string
+	// text form of the value, of type ValueType
 	Value     string
+	ValueType string
+	// unix nano deadline of the key, 0 if it never expire
+	ExpiresAt int64
 }
 
 type TransactionLoggerFactory struct {
@@ -52,9 +61,25 @@ func NewLoggerFacade(srv config.Services, dbLoggerActive bool, postgresConfig co
 	}, err
 }
 
-func (lf *LoggerFacade) WriteSet(key, value string) {
+func (lf *LoggerFacade) WriteSet(key string, value interface{}, ttl time.Duration) {
 	if lf.isDBRecord {
-		lf.dbLogger.WriteSet(key, value)
+		typed, err := api.NewValue(value)
+		if err != nil {
+			log.Println("Err when typing the value to log", err)
+			return
+		}
+		var expiresAt int64
+		if ttl > 0 {
+			expiresAt = time.Now().Add(ttl).UnixNano()
+		}
+		lf.dbLogger.WriteSet(key, typed, expiresAt)
+	}
+}
+
+// the delta is logged, not the result, the replay gives the same value
+func (lf *LoggerFacade) WriteIncr(key string, delta int64) {
+	if lf.isDBRecord {
+		lf.dbLogger.WriteIncr(key, delta)
 	}
 }
 
@@ -110,7 +135,27 @@ func (tlf *TransactionLoggerFactory) runner(logger TransactionLogger) error {
 			case EventDelete:
 				err = tlf.services.Deleter.Delete(ctx, e.Key)
 			case EventPut:
-				err = tlf.services.Setter.Set(ctx, e.Key, []byte(e.Value))
+				var ttl time.Duration
+				if e.ExpiresAt != 0 {
+					ttl = time.Until(time.Unix(0, e.ExpiresAt))
+					if ttl <= 0 {
+						// expired while the service was down
+						continue
+					}
+				}
+				var value *api.Value
+				value, err = api.ParseValue(e.ValueType, e.Value)
+				if err != nil {
+					continue
+				}
+				err = tlf.services.Setter.Set(ctx, e.Key, value.Interface(), ttl)
+			case EventIncr:
+				var delta int64
+				delta, err = strconv.ParseInt(e.Value, 10, 64)
+				if err != nil {
+					continue
+				}
+				_, err = tlf.services.Setter.Incr(ctx, e.Key, delta)
 			}
 		}
 	}
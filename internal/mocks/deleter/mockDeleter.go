@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/djedjethai/generation/pkg/deleter (interfaces: Deleter)
+// Source: github.com/djedjethai/generation/internal/deleter (interfaces: Deleter)
 
 // Package deleter is a generated GoMock package.
 package deleter
@@ -8,6 +8,7 @@ import (
 	context "context"
 	reflect "reflect"
 
+	keyvalue "github.com/djedjethai/generation/api/v1/keyvalue"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -47,3 +48,17 @@ func (mr *MockDeleterMockRecorder) Delete(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Delete", reflect.TypeOf((*MockDeleter)(nil).Delete), arg0, arg1)
 }
+
+// DeleteIf mocks base method.
+func (m *MockDeleter) DeleteIf(arg0 context.Context, arg1 string, arg2 *keyvalue.Precondition) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteIf", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteIf indicates an expected call of DeleteIf.
+func (mr *MockDeleterMockRecorder) DeleteIf(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIf", reflect.TypeOf((*MockDeleter)(nil).DeleteIf), arg0, arg1, arg2)
+}
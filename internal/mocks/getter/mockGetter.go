@@ -6,6 +6,7 @@ package getter
 
 import (
 	context "context"
+	io "io"
 	reflect "reflect"
 
 	keyvalue "github.com/djedjethai/generation/api/v1/keyvalue"
@@ -36,47 +37,127 @@ func (m *MockGetter) EXPECT() *MockGetterMockRecorder {
 	return m.recorder
 }
 
+// AppliedIndexes mocks base method.
+func (m *MockGetter) AppliedIndexes(arg0 context.Context, arg1 ...string) map[int32]uint64 {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0}
+	for _, a := range arg1 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "AppliedIndexes", varargs...)
+	ret0, _ := ret[0].(map[int32]uint64)
+	return ret0
+}
+
+// AppliedIndexes indicates an expected call of AppliedIndexes.
+func (mr *MockGetterMockRecorder) AppliedIndexes(arg0 interface{}, arg1 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0}, arg1...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppliedIndexes", reflect.TypeOf((*MockGetter)(nil).AppliedIndexes), varargs...)
+}
+
+// BatchGet mocks base method.
+func (m *MockGetter) BatchGet(arg0 context.Context, arg1 []string, arg2 keyvalue.Consistency) ([]models.KeysValues, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "BatchGet", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]models.KeysValues)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// BatchGet indicates an expected call of BatchGet.
+func (mr *MockGetterMockRecorder) BatchGet(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "BatchGet", reflect.TypeOf((*MockGetter)(nil).BatchGet), arg0, arg1, arg2)
+}
+
 // Get mocks base method.
-func (m *MockGetter) Get(arg0 context.Context, arg1 string) (interface{}, error) {
+func (m *MockGetter) Get(arg0 context.Context, arg1 string, arg2 keyvalue.Consistency) (interface{}, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Get", arg0, arg1)
+	ret := m.ctrl.Call(m, "Get", arg0, arg1, arg2)
 	ret0, _ := ret[0].(interface{})
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // Get indicates an expected call of Get.
-func (mr *MockGetterMockRecorder) Get(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockGetterMockRecorder) Get(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockGetter)(nil).Get), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Get", reflect.TypeOf((*MockGetter)(nil).Get), arg0, arg1, arg2)
 }
 
 // GetKeys mocks base method.
-func (m *MockGetter) GetKeys(arg0 context.Context) []string {
+func (m *MockGetter) GetKeys(arg0 context.Context, arg1 keyvalue.Consistency) ([]string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetKeys", arg0)
+	ret := m.ctrl.Call(m, "GetKeys", arg0, arg1)
 	ret0, _ := ret[0].([]string)
-	return ret0
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
 }
 
 // GetKeys indicates an expected call of GetKeys.
-func (mr *MockGetterMockRecorder) GetKeys(arg0 interface{}) *gomock.Call {
+func (mr *MockGetterMockRecorder) GetKeys(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeys", reflect.TypeOf((*MockGetter)(nil).GetKeys), arg0, arg1)
+}
+
+// GetKeysPage mocks base method.
+func (m *MockGetter) GetKeysPage(arg0 context.Context, arg1 models.KeysQuery, arg2 keyvalue.Consistency) (models.KeysPage, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetKeysPage", arg0, arg1, arg2)
+	ret0, _ := ret[0].(models.KeysPage)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetKeysPage indicates an expected call of GetKeysPage.
+func (mr *MockGetterMockRecorder) GetKeysPage(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeys", reflect.TypeOf((*MockGetter)(nil).GetKeys), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeysPage", reflect.TypeOf((*MockGetter)(nil).GetKeysPage), arg0, arg1, arg2)
 }
 
 // GetKeysValues mocks base method.
-func (m *MockGetter) GetKeysValues(arg0 context.Context, arg1 chan models.KeysValues) error {
+func (m *MockGetter) GetKeysValues(arg0 context.Context, arg1 keyvalue.Consistency, arg2 chan models.KeysValues) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetKeysValues", arg0, arg1)
+	ret := m.ctrl.Call(m, "GetKeysValues", arg0, arg1, arg2)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // GetKeysValues indicates an expected call of GetKeysValues.
-func (mr *MockGetterMockRecorder) GetKeysValues(arg0, arg1 interface{}) *gomock.Call {
+func (mr *MockGetterMockRecorder) GetKeysValues(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeysValues", reflect.TypeOf((*MockGetter)(nil).GetKeysValues), arg0, arg1, arg2)
+}
+
+// GetPartitions mocks base method.
+func (m *MockGetter) GetPartitions(arg0 context.Context) ([]*keyvalue.Partition, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetPartitions", arg0)
+	ret0, _ := ret[0].([]*keyvalue.Partition)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetPartitions indicates an expected call of GetPartitions.
+func (mr *MockGetterMockRecorder) GetPartitions(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetKeysValues", reflect.TypeOf((*MockGetter)(nil).GetKeysValues), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPartitions", reflect.TypeOf((*MockGetter)(nil).GetPartitions), arg0)
+}
+
+// GetRebalance mocks base method.
+func (m *MockGetter) GetRebalance(arg0 context.Context) (*keyvalue.RebalanceStatus, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRebalance", arg0)
+	ret0, _ := ret[0].(*keyvalue.RebalanceStatus)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetRebalance indicates an expected call of GetRebalance.
+func (mr *MockGetterMockRecorder) GetRebalance(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRebalance", reflect.TypeOf((*MockGetter)(nil).GetRebalance), arg0)
 }
 
 // GetServers mocks base method.
@@ -93,3 +174,112 @@ func (mr *MockGetterMockRecorder) GetServers(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetServers", reflect.TypeOf((*MockGetter)(nil).GetServers), arg0)
 }
+
+// GetWithVersion mocks base method.
+func (m *MockGetter) GetWithVersion(arg0 context.Context, arg1 string, arg2 keyvalue.Consistency) (interface{}, uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetWithVersion", arg0, arg1, arg2)
+	ret0, _ := ret[0].(interface{})
+	ret1, _ := ret[1].(uint64)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetWithVersion indicates an expected call of GetWithVersion.
+func (mr *MockGetterMockRecorder) GetWithVersion(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetWithVersion", reflect.TypeOf((*MockGetter)(nil).GetWithVersion), arg0, arg1, arg2)
+}
+
+// ListPrefix mocks base method.
+func (m *MockGetter) ListPrefix(arg0 context.Context, arg1 string, arg2 int, arg3 string, arg4 keyvalue.Consistency) ([]models.KeysValues, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListPrefix", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].([]models.KeysValues)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ListPrefix indicates an expected call of ListPrefix.
+func (mr *MockGetterMockRecorder) ListPrefix(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListPrefix", reflect.TypeOf((*MockGetter)(nil).ListPrefix), arg0, arg1, arg2, arg3, arg4)
+}
+
+// ListSnapshots mocks base method.
+func (m *MockGetter) ListSnapshots(arg0 context.Context) ([]*keyvalue.SnapshotInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListSnapshots", arg0)
+	ret0, _ := ret[0].([]*keyvalue.SnapshotInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListSnapshots indicates an expected call of ListSnapshots.
+func (mr *MockGetterMockRecorder) ListSnapshots(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListSnapshots", reflect.TypeOf((*MockGetter)(nil).ListSnapshots), arg0)
+}
+
+// OpenSnapshot mocks base method.
+func (m *MockGetter) OpenSnapshot(arg0 context.Context, arg1 int, arg2 string) (*keyvalue.SnapshotInfo, io.ReadCloser, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "OpenSnapshot", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*keyvalue.SnapshotInfo)
+	ret1, _ := ret[1].(io.ReadCloser)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// OpenSnapshot indicates an expected call of OpenSnapshot.
+func (mr *MockGetterMockRecorder) OpenSnapshot(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "OpenSnapshot", reflect.TypeOf((*MockGetter)(nil).OpenSnapshot), arg0, arg1, arg2)
+}
+
+// PartitionOf mocks base method.
+func (m *MockGetter) PartitionOf(arg0 string) int {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "PartitionOf", arg0)
+	ret0, _ := ret[0].(int)
+	return ret0
+}
+
+// PartitionOf indicates an expected call of PartitionOf.
+func (mr *MockGetterMockRecorder) PartitionOf(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PartitionOf", reflect.TypeOf((*MockGetter)(nil).PartitionOf), arg0)
+}
+
+// Scan mocks base method.
+func (m *MockGetter) Scan(arg0 context.Context, arg1, arg2 string, arg3 int, arg4 string, arg5 keyvalue.Consistency) ([]models.KeysValues, string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Scan", arg0, arg1, arg2, arg3, arg4, arg5)
+	ret0, _ := ret[0].([]models.KeysValues)
+	ret1, _ := ret[1].(string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Scan indicates an expected call of Scan.
+func (mr *MockGetterMockRecorder) Scan(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Scan", reflect.TypeOf((*MockGetter)(nil).Scan), arg0, arg1, arg2, arg3, arg4, arg5)
+}
+
+// Watch mocks base method.
+func (m *MockGetter) Watch(arg0 context.Context, arg1 string, arg2 bool, arg3 uint64) (<-chan *keyvalue.WatchEvent, func(), error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Watch", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(<-chan *keyvalue.WatchEvent)
+	ret1, _ := ret[1].(func())
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Watch indicates an expected call of Watch.
+func (mr *MockGetterMockRecorder) Watch(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Watch", reflect.TypeOf((*MockGetter)(nil).Watch), arg0, arg1, arg2, arg3)
+}
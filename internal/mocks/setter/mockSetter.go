@@ -1,13 +1,17 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/djedjethai/generation/pkg/setter (interfaces: Setter)
+// Source: github.com/djedjethai/generation/internal/setter (interfaces: Setter)
 
 // Package setter is a generated GoMock package.
 package setter
 
 import (
 	context "context"
+	io "io"
 	reflect "reflect"
+	time "time"
 
+	keyvalue "github.com/djedjethai/generation/api/v1/keyvalue"
+	models "github.com/djedjethai/generation/internal/models"
 	gomock "github.com/golang/mock/gomock"
 )
 
@@ -34,16 +38,106 @@ func (m *MockSetter) EXPECT() *MockSetterMockRecorder {
 	return m.recorder
 }
 
+// Batch mocks base method.
+func (m *MockSetter) Batch(arg0 context.Context, arg1 *keyvalue.WriteBatch) ([]models.BatchResult, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Batch", arg0, arg1)
+	ret0, _ := ret[0].([]models.BatchResult)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Batch indicates an expected call of Batch.
+func (mr *MockSetterMockRecorder) Batch(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Batch", reflect.TypeOf((*MockSetter)(nil).Batch), arg0, arg1)
+}
+
+// CreateSnapshot mocks base method.
+func (m *MockSetter) CreateSnapshot(arg0 context.Context) ([]*keyvalue.SnapshotInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateSnapshot", arg0)
+	ret0, _ := ret[0].([]*keyvalue.SnapshotInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateSnapshot indicates an expected call of CreateSnapshot.
+func (mr *MockSetterMockRecorder) CreateSnapshot(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateSnapshot", reflect.TypeOf((*MockSetter)(nil).CreateSnapshot), arg0)
+}
+
+// Incr mocks base method.
+func (m *MockSetter) Incr(arg0 context.Context, arg1 string, arg2 int64) (int64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Incr", arg0, arg1, arg2)
+	ret0, _ := ret[0].(int64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Incr indicates an expected call of Incr.
+func (mr *MockSetterMockRecorder) Incr(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Incr", reflect.TypeOf((*MockSetter)(nil).Incr), arg0, arg1, arg2)
+}
+
+// RestoreSnapshot mocks base method.
+func (m *MockSetter) RestoreSnapshot(arg0 context.Context, arg1 int, arg2 io.Reader) (*keyvalue.SnapshotInfo, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RestoreSnapshot", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*keyvalue.SnapshotInfo)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// RestoreSnapshot indicates an expected call of RestoreSnapshot.
+func (mr *MockSetterMockRecorder) RestoreSnapshot(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RestoreSnapshot", reflect.TypeOf((*MockSetter)(nil).RestoreSnapshot), arg0, arg1, arg2)
+}
+
 // Set mocks base method.
-func (m *MockSetter) Set(arg0 context.Context, arg1 string, arg2 []byte) error {
+func (m *MockSetter) Set(arg0 context.Context, arg1 string, arg2 interface{}, arg3 time.Duration) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Set", arg0, arg1, arg2)
+	ret := m.ctrl.Call(m, "Set", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Set indicates an expected call of Set.
-func (mr *MockSetterMockRecorder) Set(arg0, arg1, arg2 interface{}) *gomock.Call {
+func (mr *MockSetterMockRecorder) Set(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockSetter)(nil).Set), arg0, arg1, arg2, arg3)
+}
+
+// SetIf mocks base method.
+func (m *MockSetter) SetIf(arg0 context.Context, arg1 string, arg2 interface{}, arg3 time.Duration, arg4 *keyvalue.Precondition) (uint64, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetIf", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(uint64)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// SetIf indicates an expected call of SetIf.
+func (mr *MockSetterMockRecorder) SetIf(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetIf", reflect.TypeOf((*MockSetter)(nil).SetIf), arg0, arg1, arg2, arg3, arg4)
+}
+
+// Txn mocks base method.
+func (m *MockSetter) Txn(arg0 context.Context, arg1 *keyvalue.TxnRequest) (*keyvalue.TxnResponse, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Txn", arg0, arg1)
+	ret0, _ := ret[0].(*keyvalue.TxnResponse)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Txn indicates an expected call of Txn.
+func (mr *MockSetterMockRecorder) Txn(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Set", reflect.TypeOf((*MockSetter)(nil).Set), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Txn", reflect.TypeOf((*MockSetter)(nil).Txn), arg0, arg1)
 }
@@ -5,8 +5,40 @@ package models
 // )
 
 type KeysValues struct {
-	Key   string
-	Value string
+	Key string
+	// string, int64, float64, []byte or json.RawMessage
+	Value     interface{}
+	ExpiresAt int64
+	Version   uint64
+}
+
+// the result of an item of a batch, Err is nil when it has been applied
+type BatchResult struct {
+	Key     string
+	Version uint64
+	Err     error
+}
+
+// the position of a keys iteration, the keys of a shard are read in order
+type KeysCursor struct {
+	Shard int
+	After string
+}
+
+// KeysQuery selects a page of keys, Glob and Regex filter them
+type KeysQuery struct {
+	Cursor    string
+	Limit     int
+	Glob      string
+	Regex     string
+	CountOnly bool
+}
+
+// NextCursor is empty on the last page, Count is set in CountOnly mode
+type KeysPage struct {
+	Keys       []string
+	NextCursor string
+	Count      int
 }
 
 // type GetServerer interface {
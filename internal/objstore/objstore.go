@@ -0,0 +1,135 @@
+// Package objstore keeps objects by key, in a directory or in an S3-compatible bucket.
+// The keys are slash separated paths, like the names of the files of a directory
+package objstore
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var ErrorNotFound = errors.New("object not found")
+
+// the suffix of the files being written, they are not listed
+const tmpSuffix = ".tmp"
+
+type Store interface {
+	// Create returns the writer of the object, it is stored once closed, dropped if aborted
+	Create(key string) (Writer, error)
+	// Open returns the content of the object, ErrorNotFound if there is none
+	Open(key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, in the order of the keys
+	List(prefix string) ([]string, error)
+	// Delete removes the object, there is no error if it does not exist
+	Delete(key string) error
+}
+
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Dir keeps the objects as the files of a directory
+type Dir struct {
+	root string
+}
+
+func NewDir(root string) (*Dir, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &Dir{root: root}, nil
+}
+
+// Root returns the directory of the objects
+func (d *Dir) Root() string {
+	return d.root
+}
+
+func (d *Dir) path(key string) string {
+	return filepath.Join(d.root, filepath.FromSlash(key))
+}
+
+// Create writes the object in a temporary file, renamed once synced
+func (d *Dir) Create(key string) (Writer, error) {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(path + tmpSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: f, path: path}, nil
+}
+
+func (d *Dir) Open(key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrorNotFound
+	}
+	return f, err
+}
+
+func (d *Dir) List(prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.root, func(path string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() || strings.HasSuffix(path, tmpSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// Delete removes the file, then its parent directories left empty
+func (d *Dir) Delete(key string) error {
+	path := d.path(key)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != d.root && strings.HasPrefix(dir, d.root); dir = filepath.Dir(dir) {
+		// fails once a directory is not empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+type fileWriter struct {
+	*os.File
+	path string
+}
+
+func (w *fileWriter) Close() error {
+	if err := w.File.Sync(); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	if err := w.File.Close(); err != nil {
+		_ = os.Remove(w.File.Name())
+		return err
+	}
+	return os.Rename(w.File.Name(), w.path)
+}
+
+func (w *fileWriter) Abort() error {
+	_ = w.File.Close()
+	return os.Remove(w.File.Name())
+}
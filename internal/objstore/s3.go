@@ -0,0 +1,320 @@
+package objstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the credentials of S3Config when they are empty
+	EnvAccessKey = "AWS_ACCESS_KEY_ID"
+	EnvSecretKey = "AWS_SECRET_ACCESS_KEY"
+
+	defaultRegion = "us-east-1"
+	// the sha256 of an empty payload
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+var ErrorS3Config = errors.New("s3 needs an endpoint, a bucket and credentials")
+
+type S3Config struct {
+	// the url of the service, https://s3.<region>.amazonaws.com or the one of
+	// a compatible store(minio...), the bucket is in the path of the requests
+	Endpoint string
+	Bucket   string
+	// default to us-east-1
+	Region string
+	// read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY when empty
+	AccessKey string
+	SecretKey string
+	// an object is written to a temporary file of the directory, then uploaded
+	// once closed, default to the one of the os
+	TempDir string
+	// default to http.DefaultClient
+	Client *http.Client
+}
+
+// S3 keeps the objects in a bucket of an S3-compatible store, the requests are signed
+// with the signature version 4
+type S3 struct {
+	endpoint *url.URL
+	bucket   string
+	signer   Signer
+	tempDir  string
+	client   *http.Client
+}
+
+func NewS3(c S3Config) (*S3, error) {
+	if c.AccessKey == "" && c.SecretKey == "" {
+		c.AccessKey, c.SecretKey = os.Getenv(EnvAccessKey), os.Getenv(EnvSecretKey)
+	}
+	if c.Endpoint == "" || c.Bucket == "" || c.AccessKey == "" || c.SecretKey == "" {
+		return nil, ErrorS3Config
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if c.Region == "" {
+		c.Region = defaultRegion
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	return &S3{
+		endpoint: endpoint,
+		bucket:   c.Bucket,
+		signer:   Signer{AccessKey: c.AccessKey, SecretKey: c.SecretKey, Region: c.Region},
+		tempDir:  c.TempDir,
+		client:   c.Client,
+	}, nil
+}
+
+// do sends the signed request of the object(the bucket if key is empty)
+// and returns the response if its status is a success
+func (s *S3) do(method, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	s.signer.Sign(req, payloadHash, time.Now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+	defer res.Body.Close()
+	var e struct {
+		Code    string
+		Message string
+	}
+	_ = xml.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&e)
+	if res.StatusCode == http.StatusNotFound && e.Code != "NoSuchBucket" {
+		return nil, ErrorNotFound
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, u.Path, res.Status, e.Code, e.Message)
+}
+
+// Create writes the object to a temporary file, uploaded once closed,
+// as the size and the hash of the payload are signed
+func (s *S3) Create(key string) (Writer, error) {
+	f, err := os.CreateTemp(s.tempDir, "objstore-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{s3: s, key: key, file: f, hash: sha256.New()}, nil
+}
+
+func (s *S3) Open(key string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, key, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// List follows the pages of the listing(version 2)
+func (s *S3) List(prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		res, err := s.do(http.MethodGet, "", query, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !page.IsTruncated {
+			return keys, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (s *S3) Delete(key string) error {
+	res, err := s.do(http.MethodDelete, key, nil, nil, 0, emptySHA256)
+	if err == ErrorNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+type s3Writer struct {
+	s3   *S3
+	key  string
+	file *os.File
+	hash hash.Hash
+	size int64
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3Writer) Close() error {
+	defer w.Abort()
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	res, err := w.s3.do(http.MethodPut, w.key, nil, w.file, w.size, hex.EncodeToString(w.hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+func (w *s3Writer) Abort() error {
+	_ = w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// Signer signs the requests to S3 with the signature version 4
+type Signer struct {
+	AccessKey string
+	SecretKey string
+	Region    string
+}
+
+// Sign sets the headers of the signature, all the headers of r are signed.
+// The path and the query of r are rewritten with the encoding of the signature
+func (s Signer) Sign(r *http.Request, payloadHash string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	r.Header.Del("Authorization")
+
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range r.Header {
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := uriEncode(r.URL.Path, false)
+	if path == "" {
+		path = "/"
+	}
+	r.URL.RawPath = path
+	r.URL.RawQuery = canonicalQuery(r.URL.Query())
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		path,
+		r.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), amzDate[:8])
+	for _, part := range []string{s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// the parameters are sorted by name then by value
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return uriEncode(names[i], true) < uriEncode(names[j], true) })
+	pairs := make([]string, 0, len(query))
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, uriEncode(name, true)+"="+uriEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes all the bytes but the unreserved characters, and the slashes
+// unless encodeSlash
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,188 @@
+// Package s3test runs an in memory stand-in of an S3-compatible store, like minio,
+// for the tests. It checks the signatures and serves the requests of objstore.S3
+package s3test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/djedjethai/generation/internal/objstore"
+)
+
+const (
+	AccessKey = "test-access-key"
+	SecretKey = "test-secret-key"
+	Region    = "test-region"
+)
+
+type Server struct {
+	*httptest.Server
+	// the max keys of a page of the listings, default to 1000
+	MaxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+}
+
+// NewServer starts the server with the buckets, it must be closed
+func NewServer(buckets ...string) *Server {
+	s := &Server{MaxKeys: 1000, buckets: make(map[string]map[string][]byte)}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Config returns the config of the client of the bucket
+func (s *Server) Config(bucket string) objstore.S3Config {
+	return objstore.S3Config{
+		Endpoint:  s.URL,
+		Bucket:    bucket,
+		Region:    Region,
+		AccessKey: AccessKey,
+		SecretKey: SecretKey,
+	}
+}
+
+// Objects returns a copy of the objects of the bucket
+func (s *Server) Objects(bucket string) map[string][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects := make(map[string][]byte)
+	for key, b := range s.buckets[bucket] {
+		objects[key] = append([]byte(nil), b...)
+	}
+	return objects
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if code, msg := s.verify(r); code != "" {
+		writeError(w, http.StatusForbidden, code, msg)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPut && key != "":
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != r.Header.Get("X-Amz-Content-Sha256") {
+			writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", key)
+			return
+		}
+		objects[key] = b
+	case r.Method == http.MethodGet && key != "":
+		b, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		_, _ = w.Write(b)
+	case r.Method == http.MethodDelete && key != "":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, objects, r.URL.Query())
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+// list returns the keys after the continuation token, which is the last key of the previous page
+func (s *Server) list(w http.ResponseWriter, objects map[string][]byte, query url.Values) {
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key  string
+		Size int
+	}
+	var res struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []content
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(keys) > s.MaxKeys {
+		keys = keys[:s.MaxKeys]
+		res.IsTruncated = true
+		res.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		res.Contents = append(res.Contents, content{Key: key, Size: len(objects[key])})
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(res)
+}
+
+// verify signs again the signed headers of the request, the code of the error is empty
+// if the signatures match
+func (s *Server) verify(r *http.Request) (string, string) {
+	auth := r.Header.Get("Authorization")
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+	if !strings.HasPrefix(fields["Credential"], AccessKey+"/") {
+		return "InvalidAccessKeyId", fields["Credential"]
+	}
+	t, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "AccessDenied", "invalid x-amz-date"
+	}
+
+	u := *r.URL
+	u.Host = r.Host
+	signed := &http.Request{Method: r.Method, URL: &u, Host: r.Host, Header: make(http.Header)}
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		if name != "host" {
+			signed.Header[http.CanonicalHeaderKey(name)] = append([]string(nil), r.Header.Values(name)...)
+		}
+	}
+	signer := objstore.Signer{AccessKey: AccessKey, SecretKey: SecretKey, Region: Region}
+	signer.Sign(signed, r.Header.Get("X-Amz-Content-Sha256"), t)
+	if signed.Header.Get("Authorization") != auth {
+		return "SignatureDoesNotMatch", auth
+	}
+	return "", ""
+}
+
+func writeError(w http.ResponseWriter, status int, code, msg string) {
+	var b bytes.Buffer
+	_ = xml.NewEncoder(&b).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: msg})
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write(b.Bytes())
+}
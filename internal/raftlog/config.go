@@ -1,9 +1,33 @@
 package raftlog
 
+import (
+	"time"
+
+	"github.com/djedjethai/generation/internal/codec"
+)
+
+// the sync policies, when the records appended are written to the disk
+const (
+	// before Append returns
+	SyncAlways = "always"
+	// every Sync.Interval, the records of the last interval may be lost by a crash
+	SyncPeriodic = "periodic"
+	// when the system writes them
+	SyncNever = "never"
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	// compresses and encrypts the records of the new segments, nil for none
+	Codec *codec.Codec
+	Sync  struct {
+		// SyncNever if empty
+		Policy string
+		// default to 100 milliseconds
+		Interval time.Duration
+	}
 }
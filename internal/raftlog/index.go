@@ -29,8 +29,13 @@ func newIndex(f *os.File, c Config) (*index, error) {
 		return nil, err
 	}
 	idx.size = uint64(fi.Size())
+	// the entries of an index written with a greater max are kept
+	size := c.Segment.MaxIndexBytes
+	if idx.size > size {
+		size = idx.size
+	}
 	if err = os.Truncate(
-		f.Name(), int64(c.Segment.MaxIndexBytes),
+		f.Name(), int64(size),
 	); err != nil {
 		return nil, err
 	}
@@ -85,6 +90,19 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// rebuild writes the entries of the records at positions, as many as the index holds
+func (i *index) rebuild(positions []uint64) error {
+	i.size = 0
+	for off, pos := range positions {
+		if err := i.Write(uint32(off), pos); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (i *index) Name() string {
 	return i.file.Name()
 }
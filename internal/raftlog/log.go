@@ -10,6 +10,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+)
+
+var (
+	ErrorOffsetOutOfRange = errors.New("Offset out of range")
+	ErrorSyncPolicy       = errors.New("unknown sync policy, always, periodic or never")
 )
 
 type Record struct {
@@ -25,6 +31,9 @@ type Log struct {
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	// stops the periodic sync, closed once it is stopped
+	done    chan struct{}
+	stopped chan struct{}
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -34,6 +43,16 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	switch c.Sync.Policy {
+	case "":
+		c.Sync.Policy = SyncNever
+	case SyncAlways, SyncPeriodic, SyncNever:
+	default:
+		return nil, ErrorSyncPolicy
+	}
+	if c.Sync.Interval == 0 {
+		c.Sync.Interval = 100 * time.Millisecond
+	}
 	l := &Log{
 		Dir:    dir,
 		Config: c,
@@ -48,6 +67,10 @@ func (l *Log) setup() error {
 	}
 	var baseOffsets []uint64
 	for _, file := range files {
+		// the .head files go with the segments
+		if ext := path.Ext(file.Name()); ext != ".store" && ext != ".index" {
+			continue
+		}
 		offStr := strings.TrimSuffix(
 			file.Name(),
 			path.Ext(file.Name()),
@@ -59,12 +82,28 @@ func (l *Log) setup() error {
 		return baseOffsets[i] < baseOffsets[j]
 	})
 	for i := 0; i < len(baseOffsets); i++ {
+		// baseOffset contains dup for index and store so we skip
+		// the dup, a crash may have left a store without index
+		if i > 0 && baseOffsets[i] == baseOffsets[i-1] {
+			continue
+		}
 		if err = l.newSegment(baseOffsets[i]); err != nil {
 			return err
 		}
-		// baseOffset contains dup for index and store so we skip
-		// the dup
-		i++
+	}
+	// a segment torn by a crash ends before the next one, the records
+	// after the hole are dropped
+	for i := 1; i < len(l.segments); i++ {
+		if l.segments[i].baseOffset != l.segments[i-1].nextOffset {
+			for _, s := range l.segments[i:] {
+				if err := s.Remove(); err != nil {
+					return err
+				}
+			}
+			l.segments = l.segments[:i]
+			l.activeSegment = l.segments[i-1]
+			break
+		}
 	}
 	if l.segments == nil {
 		if err = l.newSegment(
@@ -73,7 +112,16 @@ func (l *Log) setup() error {
 			return err
 		}
 	}
-
+	// the segments may have been written with greater max bytes
+	if l.activeSegment.IsMaxed() {
+		if err := l.newSegment(l.activeSegment.nextOffset); err != nil {
+			return err
+		}
+	}
+	if l.Config.Sync.Policy == SyncPeriodic {
+		l.done, l.stopped = make(chan struct{}), make(chan struct{})
+		go l.syncEvery(l.Config.Sync.Interval, l.done, l.stopped)
+	}
 	return nil
 }
 
@@ -81,36 +129,108 @@ func (l *Log) Append(record *Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	off, err := l.append(record)
+	if err != nil {
+		return 0, err
+	}
+	return off, l.syncAlways()
+}
+
+// AppendBatch appends the records, synced once with SyncAlways
+func (l *Log) AppendBatch(records []*Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, record := range records {
+		if _, err := l.append(record); err != nil {
+			return err
+		}
+	}
+	return l.syncAlways()
+}
+
+func (l *Log) append(record *Record) (uint64, error) {
 	off, err := l.activeSegment.Append(record)
 	if err != nil {
 		return 0, err
 	}
 	if l.activeSegment.IsMaxed() {
+		// a full segment is not written anymore
+		if l.Config.Sync.Policy != SyncNever {
+			if err := l.activeSegment.store.sync(); err != nil {
+				return 0, err
+			}
+		}
 		err = l.newSegment(off + 1)
 	}
 	return off, err
 }
 
+func (l *Log) syncAlways() error {
+	if l.Config.Sync.Policy != SyncAlways {
+		return nil
+	}
+	return l.activeSegment.store.sync()
+}
+
+// Sync writes the records appended to the disk
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.activeSegment.store.sync()
+}
+
+func (l *Log) syncEvery(interval time.Duration, done, stopped chan struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// the next tick tries again
+			_ = l.Sync()
+		}
+	}
+}
+
 func (l *Log) Read(off uint64) (*Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	var s *segment
 	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
+		if segment.head <= off && off < segment.nextOffset {
 			s = segment
 			break
 		}
 	}
 	if s == nil || s.nextOffset <= off {
-		// return nil, api.ErrOffsetOutOfRange{Offset: off}
-		return nil, errors.New("Offset out of range")
+		return nil, ErrorOffsetOutOfRange
 	}
 	return s.Read(off)
 }
 
+// stopSync stops the periodic sync, which takes the lock, so the lock must not be held
+func (l *Log) stopSync() {
+	l.mu.Lock()
+	done, stopped := l.done, l.stopped
+	l.done, l.stopped = nil, nil
+	l.mu.Unlock()
+	if done != nil {
+		close(done)
+		<-stopped
+	}
+}
+
 func (l *Log) Close() error {
+	l.stopSync()
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	return l.close()
+}
+
+func (l *Log) close() error {
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
 			return err
@@ -122,7 +242,7 @@ func (l *Log) Close() error {
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	return l.segments[0].baseOffset, nil
+	return l.segments[0].head, nil
 }
 
 func (l *Log) HighestOffset() (uint64, error) {
@@ -143,12 +263,39 @@ func (l *Log) Remove() error {
 }
 
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	l.stopSync()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reset()
+}
+
+// ResetAt removes the records, the next one appended is at off
+func (l *Log) ResetAt(off uint64) error {
+	l.stopSync()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.Config.Segment.InitialOffset = off
+	return l.reset()
+}
+
+// reset runs under the lock, raft may truncate the log meanwhile
+func (l *Log) reset() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = nil, nil
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
 		return err
 	}
 	return l.setup()
 }
 
+// Truncate removes the records up to lowest, the segments whose records are all at most
+// lowest go, the records of the segment of lowest are masked until the whole segment goes.
+// Once they are all removed the log goes on at lowest+1
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
@@ -160,18 +307,80 @@ func (l *Log) Truncate(lowest uint64) error {
 			}
 			continue
 		}
+		if s.head <= lowest {
+			if err := s.SetHead(lowest + 1); err != nil {
+				return err
+			}
+		}
 		segments = append(segments, s)
 	}
 	l.segments = segments
+	if len(l.segments) == 0 {
+		return l.newSegment(lowest + 1)
+	}
 	return nil
 }
 
+// TruncateFrom removes the records from off to the highest one, the next record
+// appended is at off
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.segments) > 0 {
+		s := l.segments[len(l.segments)-1]
+		if s.baseOffset < off {
+			break
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+	}
+	if len(l.segments) == 0 {
+		return l.newSegment(off)
+	}
+	s := l.segments[len(l.segments)-1]
+	l.activeSegment = s
+	if off < s.nextOffset {
+		return s.Truncate(off)
+	}
+	if s.IsMaxed() {
+		return l.newSegment(s.nextOffset)
+	}
+	return nil
+}
+
+// Size is the number of bytes of the stores of the segments
+func (l *Log) Size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size
+	}
+	return size
+}
+
+// DropOldest removes the oldest segment unless it is the active one,
+// it returns the lowest offset left
+func (l *Log) DropOldest() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.segments) > 1 {
+		if err := l.segments[0].Remove(); err != nil {
+			return 0, err
+		}
+		l.segments = l.segments[1:]
+	}
+	return l.segments[0].head, nil
+}
+
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+		readers[i] = &originReader{segment.store, int64(segment.store.first)}
 	}
 	return io.MultiReader(readers...)
 }
@@ -181,6 +390,12 @@ func (l *Log) newSegment(off uint64) error {
 	if err != nil {
 		return err
 	}
+	if l.Config.Sync.Policy != SyncNever {
+		// the files of the segment are in the directory once it is synced
+		if err := syncDir(l.Dir); err != nil {
+			return err
+		}
+	}
 
 	l.segments = append(l.segments, s)
 
@@ -198,3 +413,12 @@ func (o *originReader) Read(p []byte) (int, error) {
 	o.off += int64(n)
 	return n, err
 }
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
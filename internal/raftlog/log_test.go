@@ -3,10 +3,14 @@ package raftlog
 import (
 	"bytes"
 	"encoding/gob"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
@@ -18,6 +22,11 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate all the segments":         testTruncateAll,
+		"truncate from an offset":           testTruncateFrom,
+		"drop the oldest segment":           testDropOldest,
+		"reset":                             testReset,
+		"reset at an offset":                testResetAt,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -86,7 +95,7 @@ func testReader(t *testing.T, log *Log) {
 	b, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 
-	breader := bytes.NewReader(b[lenWidth:])
+	breader := bytes.NewReader(b[lenWidth+crcWidth:])
 	var read Record
 	err = gob.NewDecoder(breader).Decode(&read)
 	require.NoError(t, err)
@@ -106,3 +115,278 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testTruncateAll(t *testing.T, log *Log) {
+	append := &Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(5))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), lowest)
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+}
+
+func testTruncateFrom(t *testing.T, log *Log) {
+	for _, maxBytes := range []uint64{32, 1024} {
+		c := log.Config
+		c.Segment.MaxStoreBytes = maxBytes
+		log, err := NewLog(t.TempDir(), c)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			_, err := log.Append(&Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+		require.NoError(t, log.TruncateFrom(2))
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), highest)
+		_, err = log.Read(2)
+		require.Equal(t, ErrorOffsetOutOfRange, err)
+
+		// the records appended again replace the truncated ones, also once reopened
+		off, err := log.Append(&Record{Value: []byte("again")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), off)
+		require.NoError(t, log.Close())
+		n, err := NewLog(log.Dir, log.Config)
+		require.NoError(t, err)
+		for off, value := range []string{"record 0", "record 1", "again"} {
+			read, err := n.Read(uint64(off))
+			require.NoError(t, err)
+			require.Equal(t, value, string(read.Value))
+		}
+		highest, err = n.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), highest)
+		require.NoError(t, n.Close())
+	}
+}
+
+func testDropOldest(t *testing.T, log *Log) {
+	append := &Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	size := log.Size()
+	require.NotZero(t, size)
+
+	lowest, err := log.DropOldest()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), lowest)
+	require.Less(t, log.Size(), size)
+	_, err = log.Read(0)
+	require.Error(t, err)
+	_, err = log.Read(1)
+	require.NoError(t, err)
+}
+
+func testReset(t *testing.T, log *Log) {
+	append := &Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Reset())
+	_, err := log.Read(0)
+	require.Error(t, err)
+
+	// the log starts again from an empty dir
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+}
+
+func testResetAt(t *testing.T, log *Log) {
+	append := &Record{
+		Value: []byte("hello world"),
+	}
+	_, err := log.Append(append)
+	require.NoError(t, err)
+	require.NoError(t, log.ResetAt(10))
+	_, err = log.Read(0)
+	require.Error(t, err)
+
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), lowest)
+
+	// the offset is kept once reopened
+	require.NoError(t, log.Close())
+	n, err := NewLog(log.Dir, Config{})
+	require.NoError(t, err)
+	highest, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), highest)
+}
+
+// the size of the files of the stores, the records not synced are not there
+func storeFilesSize(t *testing.T, dir string) int64 {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	require.NoError(t, err)
+	var size int64
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		require.NoError(t, err)
+		size += fi.Size()
+	}
+	return size
+}
+
+func TestLogSync(t *testing.T) {
+	c := Config{}
+	c.Sync.Policy = "sometimes"
+	_, err := NewLog(t.TempDir(), c)
+	require.Equal(t, ErrorSyncPolicy, err)
+
+	for _, policy := range []string{SyncAlways, SyncPeriodic, SyncNever} {
+		t.Run(policy, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			c.Sync.Policy = policy
+			c.Sync.Interval = 10 * time.Millisecond
+			log, err := NewLog(t.TempDir(), c)
+			require.NoError(t, err)
+			before := storeFilesSize(t, log.Dir)
+			_, err = log.Append(&Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.NoError(t, log.AppendBatch([]*Record{{Value: []byte("a")}, {Value: []byte("b")}}))
+			switch policy {
+			case SyncAlways:
+				require.Equal(t, int64(log.Size()), storeFilesSize(t, log.Dir))
+			case SyncPeriodic:
+				require.Eventually(t, func() bool {
+					return int64(log.Size()) == storeFilesSize(t, log.Dir)
+				}, time.Second, 10*time.Millisecond)
+			case SyncNever:
+				require.Equal(t, before, storeFilesSize(t, log.Dir))
+			}
+			require.NoError(t, log.Close())
+			require.Equal(t, int64(log.Size()), storeFilesSize(t, log.Dir))
+		})
+	}
+}
+
+// raft resets the log while it compacts it from the snapshots goroutine
+func TestLogConcurrentReset(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Sync.Policy = SyncPeriodic
+	c.Sync.Interval = time.Millisecond
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			require.NoError(t, log.ResetAt(uint64(i*10)))
+			_, err := log.Append(&Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err)
+			require.NoError(t, log.Truncate(lowest))
+		}
+	}()
+	wg.Wait()
+	require.NoError(t, log.Close())
+}
+
+// the log opens again after a crash with the records synced, whatever was torn
+func TestLogCrash(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 256
+	c.Sync.Policy = SyncAlways
+	dir := t.TempDir()
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, err := log.Append(&Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Greater(t, len(log.segments), 2)
+	// the segment of the last record, and the next one
+	var last *segment
+	for _, s := range log.segments {
+		if s.baseOffset <= 29 && 29 < s.nextOffset {
+			last = s
+		}
+	}
+	files := make(map[string][]byte)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		files[e.Name()], err = ioutil.ReadFile(filepath.Join(dir, e.Name()))
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	for name, test := range map[string]struct {
+		crash func(dir string)
+		// the records left
+		records uint64
+	}{
+		"torn record": {
+			crash: func(dir string) {
+				store := filepath.Join(dir, fmt.Sprintf("%d.store", last.baseOffset))
+				fi, err := os.Stat(store)
+				require.NoError(t, err)
+				require.NoError(t, os.Truncate(store, fi.Size()-3))
+			},
+			records: 29,
+		},
+		"segment being created": {
+			crash: func(dir string) {
+				next := filepath.Join(dir, fmt.Sprintf("%d.store", last.nextOffset))
+				require.NoError(t, ioutil.WriteFile(next, storeMagic[:3], 0644))
+			},
+			records: 30,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			crashed := t.TempDir()
+			for name, b := range files {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(crashed, name), b, 0644))
+			}
+			test.crash(crashed)
+
+			log, err := NewLog(crashed, c)
+			require.NoError(t, err)
+			highest, err := log.HighestOffset()
+			require.NoError(t, err)
+			require.Equal(t, test.records-1, highest)
+			for off := uint64(0); off < test.records; off++ {
+				read, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("record %d", off), string(read.Value))
+			}
+			off, err := log.Append(&Record{Value: []byte("next")})
+			require.NoError(t, err)
+			require.Equal(t, test.records, off)
+			require.NoError(t, log.Close())
+		})
+	}
+}
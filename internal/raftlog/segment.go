@@ -4,23 +4,45 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
+	"strconv"
 )
 
 type segment struct {
 	store                  *store
 	index                  *index
 	baseOffset, nextOffset uint64
-	config                 Config
+	// the lowest offset readable, the records before it are deleted(see Log.Truncate)
+	// but stay in the files until the whole segment goes
+	head     uint64
+	headFile string
+	config   Config
+	// the records are sealed by the codec, the segments written without
+	// codec keep their records in clear
+	sealed bool
 }
 
+// the first record of a sealed segment, the index does not refer to it
+var sealedMagic = []byte("GSEG\x01")
+
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
+		head:       baseOffset,
+		headFile:   path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".head")),
 		config:     c,
 	}
 
+	// a head torn by a crash is ignored, the deleted records are readable again
+	// which is what raft had before their deletion
+	if b, err := ioutil.ReadFile(s.headFile); err == nil {
+		if head, err := strconv.ParseUint(string(b), 10, 64); err == nil && head > baseOffset {
+			s.head = head
+		}
+	}
+
 	var err error
 	storeFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
@@ -34,6 +56,21 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	positions, err := s.store.recover()
+	if err != nil {
+		return nil, err
+	}
+	if len(positions) == 0 && c.Codec != nil {
+		if _, _, err := s.store.Append(sealedMagic); err != nil {
+			return nil, err
+		}
+		s.sealed = true
+	} else if len(positions) > 0 {
+		if first, err := s.store.Read(positions[0]); err == nil && bytes.Equal(first, sealedMagic) {
+			s.sealed = true
+			positions = positions[1:]
+		}
+	}
 
 	indexFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
@@ -47,16 +84,31 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.index, err = newIndex(indexFile, c); err != nil {
 		return nil, err
 	}
-
-	if off, _, err := s.index.Read(-1); err != nil {
-		s.nextOffset = baseOffset
-	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
-		fmt.Println("In newSegment: ", s.nextOffset)
+	// the index is written again from the store, a crash may have left it
+	// behind the store or full of zeros
+	if err := s.index.rebuild(positions); err != nil {
+		return nil, err
+	}
+	indexed := s.index.size / entWidth
+	if indexed < uint64(len(positions)) {
+		// the records appended once the index was full
+		if err := s.store.truncate(positions[indexed]); err != nil {
+			return nil, err
+		}
 	}
+	s.nextOffset = baseOffset + indexed
 	return s, nil
 }
 
+// SetHead makes the records before off unreadable
+func (s *segment) SetHead(off uint64) error {
+	if err := ioutil.WriteFile(s.headFile, []byte(strconv.FormatUint(off, 10)), 0644); err != nil {
+		return err
+	}
+	s.head = off
+	return nil
+}
+
 func (s *segment) Append(record *Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
@@ -67,7 +119,14 @@ func (s *segment) Append(record *Record) (offset uint64, err error) {
 		return 0, err
 	}
 
-	_, pos, err := s.store.Append(rec.Bytes())
+	p := rec.Bytes()
+	if s.sealed {
+		if p, err = s.config.Codec.Seal(p); err != nil {
+			return 0, err
+		}
+	}
+
+	_, pos, err := s.store.Append(p)
 	if err != nil {
 		return 0, err
 	}
@@ -91,6 +150,11 @@ func (s *segment) Read(off uint64) (*Record, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.sealed {
+		if p, err = s.config.Codec.Open(p); err != nil {
+			return nil, err
+		}
+	}
 
 	reader := bytes.NewReader(p)
 	var record Record
@@ -102,6 +166,24 @@ func (s *segment) Read(off uint64) (*Record, error) {
 	return &record, err
 }
 
+// Truncate removes the records from off
+func (s *segment) Truncate(off uint64) error {
+	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	if err != nil {
+		return err
+	}
+	if err := s.store.truncate(pos); err != nil {
+		return err
+	}
+	s.index.size = (off - s.baseOffset) * entWidth
+	s.nextOffset = off
+	if off < s.head {
+		// the next record appended at off is readable
+		return s.SetHead(off)
+	}
+	return nil
+}
+
 func (s *segment) IsMaxed() bool {
 	return s.store.size >= s.config.Segment.MaxStoreBytes ||
 		s.index.size >= s.config.Segment.MaxIndexBytes
@@ -117,6 +199,9 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(s.headFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	return nil
 }
 
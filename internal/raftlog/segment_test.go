@@ -1,11 +1,18 @@
 package raftlog
 
 import (
-	"github.com/stretchr/testify/require"
+	"bytes"
+	"encoding/base64"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"path"
 	"testing"
+
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/stretchr/testify/require"
 )
 
 func TestSegment(t *testing.T) {
@@ -43,3 +50,154 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSealedSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sealed-segment-test")
+	defer os.RemoveAll(dir)
+	keys, err := codec.ParseKeys("1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	require.NoError(t, err)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Codec, err = codec.New(codec.CompressionZstd, keys)
+	require.NoError(t, err)
+
+	want := Record{Value: []byte("customer data"), Term: 2}
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.True(t, s.sealed)
+	for i := uint64(0); i < 3; i++ {
+		_, err := s.Append(&want)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+
+	b, err := ioutil.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(b, want.Value))
+
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), s.nextOffset)
+	got, err := s.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, want.Value, got.Value)
+	require.Equal(t, want.Term, got.Term)
+	require.NoError(t, s.Close())
+
+	// the key is needed to read the segment
+	c.Codec = nil
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Read(0)
+	require.Equal(t, codec.ErrorUnknownKey, err)
+	require.NoError(t, s.Close())
+}
+
+// a segment written without codec keeps its records in clear
+func TestSegmentWithoutCodec(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "clear-segment-test")
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 0, c)
+	require.NoError(t, err)
+	_, err = s.Append(&Record{Value: []byte("clear")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	c.Codec, err = codec.New(codec.CompressionSnappy, nil)
+	require.NoError(t, err)
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	require.False(t, s.sealed)
+	_, err = s.Append(&Record{Value: []byte("still clear")})
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	b, err := ioutil.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.True(t, bytes.Contains(b, []byte("still clear")))
+	s, err = newSegment(dir, 0, c)
+	require.NoError(t, err)
+	for i, want := range []string{"clear", "still clear"} {
+		got, err := s.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, want, string(got.Value))
+	}
+	require.NoError(t, s.Close())
+}
+
+// a crash leaves the store cut anywhere and the index pre-sized, the segment opens
+// with the records written entirely
+func TestSegmentTornWrites(t *testing.T) {
+	keys, err := codec.ParseKeys("1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32)))
+	require.NoError(t, err)
+	sealed, err := codec.New(codec.CompressionSnappy, keys)
+	require.NoError(t, err)
+	for name, cdc := range map[string]*codec.Codec{"clear": nil, "sealed": sealed} {
+		t.Run(name, func(t *testing.T) {
+			testTornWrites(t, cdc)
+		})
+	}
+}
+
+func testTornWrites(t *testing.T, cdc *codec.Codec) {
+	dir := t.TempDir()
+	c := Config{Codec: cdc}
+	c.Segment.MaxStoreBytes = 4096
+	c.Segment.MaxIndexBytes = 1024
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	var ends []uint64
+	for i := 0; i < 20; i++ {
+		_, err := s.Append(&Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+		ends = append(ends, s.store.size)
+	}
+	// not closed, as by a crash
+	require.NoError(t, s.store.sync())
+	store, err := ioutil.ReadFile(path.Join(dir, "16.store"))
+	require.NoError(t, err)
+	index, err := ioutil.ReadFile(path.Join(dir, "16.index"))
+	require.NoError(t, err)
+	require.Len(t, index, 1024)
+	require.NoError(t, s.Close())
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		cut := r.Intn(len(store) + 1)
+		crashed := t.TempDir()
+		require.NoError(t, ioutil.WriteFile(path.Join(crashed, "16.store"), store[:cut], 0644))
+		require.NoError(t, ioutil.WriteFile(path.Join(crashed, "16.index"), index[:r.Intn(len(index)+1)], 0644))
+
+		var written uint64
+		for _, end := range ends {
+			if end <= uint64(cut) {
+				written++
+			}
+		}
+		s, err := newSegment(crashed, 16, c)
+		require.NoError(t, err, "cut at %d", cut)
+		require.Equal(t, cdc != nil, s.sealed)
+		require.Equal(t, 16+written, s.nextOffset, "cut at %d", cut)
+		for off := uint64(0); off < written; off++ {
+			got, err := s.Read(16 + off)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record %d", off), string(got.Value))
+		}
+		// the next records follow the ones recovered
+		off, err := s.Append(&Record{Value: []byte("next")})
+		require.NoError(t, err)
+		require.Equal(t, 16+written, off)
+		require.NoError(t, s.Close())
+		s, err = newSegment(crashed, 16, c)
+		require.NoError(t, err)
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, "next", string(got.Value))
+		require.NoError(t, s.Close())
+	}
+}
@@ -2,17 +2,29 @@ package raftlog
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
 )
 
 var (
 	enc = binary.BigEndian
+	// the checksums of the records
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+	// the header of the stores whose records are checksummed, the stores written
+	// before start with the length of their first record, its first byte is 0
+	storeMagic = []byte("GLOGCRC1")
 )
 
+var ErrorCorruptedRecord = errors.New("corrupted record")
+
 const (
 	lenWidth = 8
+	crcWidth = 4
 )
 
 type store struct {
@@ -20,6 +32,9 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// the records are checksummed, the position of the first one is after the header
+	checksums bool
+	first     uint64
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -27,12 +42,31 @@ func newStore(f *os.File) (*store, error) {
 	if err != nil {
 		return nil, err
 	}
-	size := uint64(fi.Size())
-	return &store{
+	s := &store{
 		File: f,
-		size: size,
+		size: uint64(fi.Size()),
 		buf:  bufio.NewWriter(f),
-	}, nil
+	}
+	header := make([]byte, len(storeMagic))
+	if s.size >= uint64(len(storeMagic)) {
+		if _, err := f.ReadAt(header, 0); err != nil {
+			return nil, err
+		}
+		if bytes.Equal(header, storeMagic) {
+			s.checksums, s.first = true, uint64(len(storeMagic))
+		}
+		return s, nil
+	}
+	// a new store, or one torn before its first record was written
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(storeMagic); err != nil {
+		return nil, err
+	}
+	s.size = uint64(len(storeMagic))
+	s.checksums, s.first = true, uint64(len(storeMagic))
+	return s, nil
 }
 
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
@@ -42,11 +76,18 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
 	}
-	w, err := s.buf.Write(p)
+	w := lenWidth
+	if s.checksums {
+		if err := binary.Write(s.buf, enc, crc32.Checksum(p, crcTable)); err != nil {
+			return 0, 0, err
+		}
+		w += crcWidth
+	}
+	nw, err := s.buf.Write(p)
 	if err != nil {
 		return 0, 0, err
 	}
-	w += lenWidth
+	w += nw
 	s.size += uint64(w)
 	return uint64(w), pos, nil
 }
@@ -57,15 +98,64 @@ func (s *store) Read(pos uint64) ([]byte, error) {
 	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	b, _, err := s.read(pos)
+	return b, err
+}
+
+// read returns the record at pos and the position of the next one
+func (s *store) read(pos uint64) ([]byte, uint64, error) {
+	width := uint64(lenWidth)
+	if s.checksums {
+		width += crcWidth
 	}
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	if pos+width > s.size {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	header := make([]byte, width)
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	size := enc.Uint64(header)
+	if size > s.size-pos-width {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, size)
+	if _, err := s.File.ReadAt(b, int64(pos+width)); err != nil {
+		return nil, 0, err
+	}
+	if s.checksums && enc.Uint32(header[lenWidth:]) != crc32.Checksum(b, crcTable) {
+		return nil, 0, ErrorCorruptedRecord
+	}
+	return b, pos + width + size, nil
+}
+
+// recover returns the positions of the records, a record torn by a crash, or failing
+// its checksum, is dropped with the ones after it
+func (s *store) recover() ([]uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
 		return nil, err
 	}
-	return b, nil
+	var positions []uint64
+	pos := s.first
+	for pos < s.size {
+		_, next, err := s.read(pos)
+		if err == io.ErrUnexpectedEOF || err == ErrorCorruptedRecord {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, pos)
+		pos = next
+	}
+	if pos < s.size {
+		if err := s.truncateFile(pos); err != nil {
+			return nil, err
+		}
+	}
+	return positions, nil
 }
 
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
@@ -77,6 +167,38 @@ func (s *store) ReadAt(p []byte, off int64) (int, error) {
 	return s.File.ReadAt(p, off)
 }
 
+// sync writes the records appended to the disk
+func (s *store) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.File.Sync()
+}
+
+// truncate drops the bytes from size, the next record is appended there
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	return s.truncateFile(size)
+}
+
+func (s *store) truncateFile(size uint64) error {
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	// the file may not be in append mode
+	if _, err := s.File.Seek(int64(size), io.SeekStart); err != nil {
+		return err
+	}
+	s.size = size
+	return nil
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -9,7 +9,9 @@ import (
 
 var (
 	write = []byte("hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth
+	// the records are after the header of the store
+	first = uint64(len(storeMagic))
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -34,12 +36,12 @@ func testAppend(t *testing.T, s *store) {
 	for i := uint64(1); i < 4; i++ {
 		n, pos, err := s.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, pos+n, width*i)
+		require.Equal(t, pos+n, first+width*i)
 	}
 }
 func testRead(t *testing.T, s *store) {
 	t.Helper()
-	var pos uint64
+	pos := first
 	for i := uint64(1); i < 4; i++ {
 		read, err := s.Read(pos)
 		require.NoError(t, err)
@@ -49,11 +51,11 @@ func testRead(t *testing.T, s *store) {
 }
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
-	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+	for i, off := uint64(1), int64(first); i < 4; i++ {
+		b := make([]byte, lenWidth+crcWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, lenWidth+crcWidth, n)
 		off += int64(n)
 
 		size := enc.Uint64(b)
@@ -98,3 +100,61 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreRecover(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_recover_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f)
+	require.NoError(t, err)
+	testAppend(t, s)
+	require.NoError(t, s.Close())
+
+	// a bit flipped in the last record
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	b[len(b)-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(f.Name(), b, 0644))
+	f, _, err = openFile(f.Name())
+	require.NoError(t, err)
+	s, err = newStore(f)
+	require.NoError(t, err)
+	_, err = s.Read(first + 2*width)
+	require.Equal(t, ErrorCorruptedRecord, err)
+	positions, err := s.recover()
+	require.NoError(t, err)
+	require.Equal(t, []uint64{first, first + width}, positions)
+	require.Equal(t, first+2*width, s.size)
+	require.NoError(t, s.Close())
+}
+
+// the stores written before the checksums are read as they are
+func TestStoreWithoutChecksums(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_without_checksums_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	var b []byte
+	for i := 0; i < 3; i++ {
+		b = enc.AppendUint64(b, uint64(len(write)))
+		b = append(b, write...)
+	}
+	// and a torn record
+	b = enc.AppendUint64(b, uint64(len(write)))
+	_, err = f.Write(append(b, write[:3]...))
+	require.NoError(t, err)
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	require.False(t, s.checksums)
+	positions, err := s.recover()
+	require.NoError(t, err)
+	require.Len(t, positions, 3)
+	read, err := s.Read(positions[2])
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	read, err = s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
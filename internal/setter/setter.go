@@ -2,8 +2,12 @@ package setter
 
 import (
 	"context"
+	"io"
+	"time"
 	// "fmt"
 
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/storage"
 	"go.opentelemetry.io/otel/label"
@@ -11,24 +15,42 @@ import (
 
 //go:generate mockgen -destination=../mocks/setter/mockSetter.go -package=setter github.com/djedjethai/generation/internal/setter Setter
 type Setter interface {
-	Set(context.Context, string, []byte) error
+	// the value is a string, an int64, a float64, a []byte or a json.RawMessage
+	Set(context.Context, string, interface{}, time.Duration) error
+	// SetIf sets the value only if the precondition holds and returns the new version of the key
+	SetIf(context.Context, string, interface{}, time.Duration, *api.Precondition) (uint64, error)
+	// adds delta to the integer value of the key and returns the new value
+	Incr(context.Context, string, int64) (int64, error)
+	// Txn applies the success or the failure ops of the request at once
+	Txn(context.Context, *api.TxnRequest) (*api.TxnResponse, error)
+	// Batch applies many puts and deletes, each item has its own result
+	Batch(context.Context, *api.WriteBatch) ([]models.BatchResult, error)
+	// CreateSnapshot takes a snapshot of each partition of the node
+	CreateSnapshot(context.Context) ([]*api.SnapshotInfo, error)
+	// RestoreSnapshot replaces the state of the partition with the snapshot, on all its nodes
+	RestoreSnapshot(context.Context, int, io.Reader) (*api.SnapshotInfo, error)
 }
 
 type setter struct {
-	st  storage.StorageRepo
-	obs *observability.Observability
+	st storage.StorageRepo
+	// nil if the storage is standalone
+	snap storage.Snapshotter
+	obs  *observability.Observability
 }
 
 func NewSetter(s storage.StorageRepo, observ *observability.Observability) Setter {
 	lb := label.Key("setter").String("set")
 	observ.Labels = append(observ.Labels, lb)
-	return &setter{
+	st := &setter{
 		st:  s,
 		obs: observ,
 	}
+	st.snap, _ = s.(storage.Snapshotter)
+	return st
 }
 
-func (s *setter) Set(ctx context.Context, key string, value []byte) error {
+// a ttl of 0 means the key never expire
+func (s *setter) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
 
 	s.obs.Logger.Debug("Setter/Set()", "hit func")
 
@@ -43,7 +65,7 @@ func (s *setter) Set(ctx context.Context, key string, value []byte) error {
 
 	s.obs.AddMetrics(ctx)
 
-	err := s.st.Set(ctx, key, string(value))
+	err := s.st.Set(ctx, key, value, ttl)
 	if err != nil {
 		s.obs.Logger.Error("Setter/Set() failed", err)
 		return err
@@ -53,3 +75,123 @@ func (s *setter) Set(ctx context.Context, key string, value []byte) error {
 	return nil
 
 }
+
+func (s *setter) SetIf(ctx context.Context, key string, value interface{}, ttl time.Duration, pre *api.Precondition) (uint64, error) {
+
+	s.obs.Logger.Debug("Setter/SetIf()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "SetterSetIf")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	version, err := s.st.SetIf(ctx, key, value, ttl, pre)
+	if err != nil {
+		s.obs.Logger.Error("Setter/SetIf() failed", err)
+		return 0, err
+	}
+
+	s.obs.Logger.Debug("Setter/SetIf()", "executed successfully")
+	return version, nil
+}
+
+func (s *setter) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+
+	s.obs.Logger.Debug("Setter/Incr()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "SetterIncr")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	value, err := s.st.Incr(ctx, key, delta)
+	if err != nil {
+		s.obs.Logger.Error("Setter/Incr() failed", err)
+		return 0, err
+	}
+
+	s.obs.Logger.Debug("Setter/Incr()", "executed successfully")
+	return value, nil
+}
+
+func (s *setter) Txn(ctx context.Context, req *api.TxnRequest) (*api.TxnResponse, error) {
+
+	s.obs.Logger.Debug("Setter/Txn()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "SetterTxn")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	res, err := s.st.Txn(ctx, req)
+	if err != nil {
+		s.obs.Logger.Error("Setter/Txn() failed", err)
+		return nil, err
+	}
+
+	s.obs.Logger.Debug("Setter/Txn()", "executed successfully")
+	return res, nil
+}
+
+func (s *setter) Batch(ctx context.Context, b *api.WriteBatch) ([]models.BatchResult, error) {
+
+	s.obs.Logger.Debug("Setter/Batch()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "SetterBatch")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	results, err := s.st.Batch(ctx, b)
+	if err != nil {
+		s.obs.Logger.Error("Setter/Batch() failed", err)
+		return nil, err
+	}
+
+	s.obs.Logger.Debug("Setter/Batch()", "executed successfully")
+	return results, nil
+}
+
+func (s *setter) CreateSnapshot(ctx context.Context) ([]*api.SnapshotInfo, error) {
+
+	s.obs.Logger.Debug("Setter/CreateSnapshot()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "SetterCreateSnapshot")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	if s.snap == nil {
+		return nil, storage.ErrorNotReplicated
+	}
+	snapshots, err := s.snap.CreateSnapshot(ctx)
+	if err != nil {
+		s.obs.Logger.Error("Setter/CreateSnapshot() failed", err)
+		return nil, err
+	}
+
+	s.obs.Logger.Debug("Setter/CreateSnapshot()", "executed successfully")
+	return snapshots, nil
+}
+
+func (s *setter) RestoreSnapshot(ctx context.Context, partition int, r io.Reader) (*api.SnapshotInfo, error) {
+
+	s.obs.Logger.Debug("Setter/RestoreSnapshot()", "hit func")
+
+	ctx, teardown := s.obs.StartTrace(ctx, "SetterRestoreSnapshot")
+	defer teardown()
+
+	s.obs.AddMetrics(ctx)
+
+	if s.snap == nil {
+		return nil, storage.ErrorNotReplicated
+	}
+	info, err := s.snap.RestoreSnapshot(ctx, partition, r)
+	if err != nil {
+		s.obs.Logger.Error("Setter/RestoreSnapshot() failed", err)
+		return nil, err
+	}
+
+	s.obs.Logger.Debug("Setter/RestoreSnapshot()", "executed successfully")
+	return info, nil
+}
@@ -14,7 +14,7 @@ func setup() {
 
 	storage := storage.NewMockedShardedMap(1, 0)
 
-	setterMocked = setter{storage, &obs}
+	setterMocked = setter{st: storage, obs: &obs}
 
 }
 
@@ -25,7 +25,7 @@ func Test_set_return_no_error_when_all_is_good(t *testing.T) {
 	ctx := context.Background()
 
 	// create a moked service
-	err := setterMocked.Set(ctx, "key", []byte("value"))
+	err := setterMocked.Set(ctx, "key", []byte("value"), 0)
 
 	if err != nil {
 		t.Error("test setter.Set() should not return an err when all is good")
@@ -39,9 +39,22 @@ func Test_set_return_error_when_a_problem_occur(t *testing.T) {
 	ctx := context.Background()
 
 	// create a moked service
-	err := setterMocked.Set(ctx, "error", []byte("value"))
+	err := setterMocked.Set(ctx, "error", []byte("value"), 0)
 
 	if err == nil {
 		t.Error("test setter.Set() should return an err if the storage return an err")
 	}
 }
+
+func Test_incr_return_the_new_value(t *testing.T) {
+
+	setup()
+
+	ctx := context.Background()
+
+	value, err := setterMocked.Incr(ctx, "counter", 3)
+
+	if err != nil || value != 3 {
+		t.Error("test setter.Incr() should return the new value")
+	}
+}
@@ -0,0 +1,164 @@
+package storage
+
+import "container/list"
+
+// the lists of the arc and tinylfu nodes
+const (
+	segRecent uint8 = iota
+	segFrequent
+	segWindow
+	segProbation
+	segProtected
+)
+
+// arc balances a list of the nodes seen once(recent) and a list of the nodes
+// seen again(frequent). The keys evicted from each list are remembered(ghosts),
+// a ghost set again tells which list deserves more room
+type arc struct {
+	recent   *dll
+	frequent *dll
+	// target length of recent
+	p int
+
+	recentGhosts   *ghosts
+	frequentGhosts *ghosts
+}
+
+func newARC() *arc {
+	return &arc{
+		recent:         newList(),
+		frequent:       newList(),
+		recentGhosts:   newGhosts(),
+		frequentGhosts: newGhosts(),
+	}
+}
+
+func (p *arc) add(nd *node) {
+	switch {
+	case p.recentGhosts.remove(nd.key):
+		// recent was too small
+		p.p = min(p.p+max(p.frequentGhosts.len()/max(p.recentGhosts.len(), 1), 1), p.len())
+	case p.frequentGhosts.remove(nd.key):
+		p.p = max(p.p-max(p.recentGhosts.len()/max(p.frequentGhosts.len(), 1), 1), 0)
+	default:
+		nd.seg = segRecent
+		_, _ = p.recent.unshiftNode(nd)
+		return
+	}
+	nd.seg = segFrequent
+	_, _ = p.frequent.unshiftNode(nd)
+}
+
+func (p *arc) hit(nd *node) {
+	p.remove(nd)
+	nd.seg = segFrequent
+	_, _ = p.frequent.unshiftNode(nd)
+}
+
+func (p *arc) remove(nd *node) {
+	if nd.seg == segFrequent {
+		_ = p.frequent.removeNode(nd)
+	} else {
+		_ = p.recent.removeNode(nd)
+	}
+}
+
+func (p *arc) evict() *node {
+	var nd *node
+	if p.recent.length > 0 && (p.recent.length > p.p || p.frequent.length == 0) {
+		nd = p.recent.tail
+	} else if p.frequent.length > 0 {
+		nd = p.frequent.tail
+	}
+	if nd != nil {
+		p.evicted(nd)
+	}
+	return nd
+}
+
+// walk follows evict, p does not change while evicting
+func (p *arc) walk(fn func(*node) bool) {
+	recent, frequent := p.recent.tail, p.frequent.tail
+	nRecent, nFrequent := p.recent.length, p.frequent.length
+	for nRecent > 0 || nFrequent > 0 {
+		if nRecent > 0 && (nRecent > p.p || nFrequent == 0) {
+			if !fn(recent) {
+				return
+			}
+			recent = recent.prev
+			nRecent--
+		} else {
+			if !fn(frequent) {
+				return
+			}
+			frequent = frequent.prev
+			nFrequent--
+		}
+	}
+}
+
+// the key of an evicted node becomes a ghost of its list
+func (p *arc) evicted(nd *node) {
+	p.remove(nd)
+	if nd.seg == segFrequent {
+		p.frequentGhosts.push(nd.key)
+	} else {
+		p.recentGhosts.push(nd.key)
+	}
+
+	// the ghosts are at most as many as the nodes
+	for p.recentGhosts.len()+p.frequentGhosts.len() > p.len() {
+		if p.recentGhosts.len() > p.frequentGhosts.len() {
+			p.recentGhosts.pop()
+		} else {
+			p.frequentGhosts.pop()
+		}
+	}
+}
+
+func (p *arc) len() int {
+	return p.recent.length + p.frequent.length
+}
+
+// ghosts are keys in lru order
+type ghosts struct {
+	l    *list.List
+	keys map[string]*list.Element
+}
+
+func newGhosts() *ghosts {
+	return &ghosts{l: list.New(), keys: make(map[string]*list.Element)}
+}
+
+func (g *ghosts) push(key string) {
+	g.remove(key)
+	g.keys[key] = g.l.PushFront(key)
+}
+
+func (g *ghosts) pop() {
+	if e := g.l.Back(); e != nil {
+		g.l.Remove(e)
+		delete(g.keys, e.Value.(string))
+	}
+}
+
+// remove returns true if the key was there
+func (g *ghosts) remove(key string) bool {
+	e, ok := g.keys[key]
+	if ok {
+		g.l.Remove(e)
+		delete(g.keys, key)
+	}
+	return ok
+}
+
+func (g *ghosts) len() int {
+	return g.l.Len()
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
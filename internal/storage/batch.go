@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/models"
+	"github.com/djedjethai/generation/internal/storage/command"
+)
+
+var ErrorInvalidItem = errors.New("invalid item")
+
+// max number of items of a batch applied as a single log entry
+const maxBatchSize = 512
+
+// Batch applies the puts, then the deletes, of the batch. Each item has its own result,
+// a failed precondition or an invalid value fails the item only
+func (m ShardedMap) Batch(ctx context.Context, b *api.WriteBatch) ([]models.BatchResult, error) {
+	return m.batch(ctx, newBatch(b, time.Now().UnixNano()), m.nextVersion()), nil
+}
+
+// newBatch is the command of the batch, the deadlines of its puts are computed from now
+func newBatch(b *api.WriteBatch, now int64) *command.Batch {
+	return &command.Batch{Puts: b.Puts, Deletes: b.Deletes, Now: now}
+}
+
+func (m ShardedMap) batch(ctx context.Context, b *command.Batch, version uint64) []models.BatchResult {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageBatch")
+	defer teardown()
+
+	results := make([]models.BatchResult, 0, len(b.Puts)+len(b.Deletes))
+	for _, p := range b.Puts {
+		res := models.BatchResult{Key: p.GetRecords().GetKey(), Version: version}
+		if res.Err = m.batchPut(ctx, p, version, b.Now); res.Err != nil {
+			res.Version = 0
+		}
+		results = append(results, res)
+	}
+	for _, d := range b.Deletes {
+		results = append(results, models.BatchResult{
+			Key: d.Key,
+			Err: m.deleteIf(ctx, d.Key, d.Precondition, b.Now, version),
+		})
+	}
+	return results
+}
+
+func (m ShardedMap) batchPut(ctx context.Context, p *api.PutRequest, version uint64, now int64) error {
+	if p.Records == nil || p.TtlMs < 0 {
+		return ErrorInvalidItem
+	}
+	value := p.Records.Data()
+	// validates the json values
+	if _, err := api.NewValue(value); err != nil {
+		return err
+	}
+	var expiresAt int64
+	if p.TtlMs > 0 {
+		expiresAt = now + int64(time.Duration(p.TtlMs)*time.Millisecond)
+	}
+	return m.set(ctx, p.Records.Key, value, expiresAt, version, p.Precondition, now)
+}
+
+// splitBatch cuts the batch in batches of at most size items
+func splitBatch(b *api.WriteBatch, size int) []*api.WriteBatch {
+	var batches []*api.WriteBatch
+	puts, deletes := b.Puts, b.Deletes
+	for len(puts) > 0 || len(deletes) > 0 {
+		chunk := &api.WriteBatch{}
+		n := min(size, len(puts))
+		chunk.Puts, puts = puts[:n], puts[n:]
+		n = min(size-n, len(deletes))
+		chunk.Deletes, deletes = deletes[:n], deletes[n:]
+		batches = append(batches, chunk)
+	}
+	return batches
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,9 @@
+package command
+
+// Data returns the go value of the record, its string value if it has no typed value
+func (x *Record) Data() interface{} {
+	if x.GetTypedValue() == nil {
+		return x.GetValue()
+	}
+	return x.GetTypedValue().Interface()
+}
@@ -1,14 +1,74 @@
 package storage
 
 import (
+	"time"
+
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/djedjethai/generation/internal/objstore"
 	"github.com/hashicorp/raft"
 )
 
 type Config struct {
+	// how often the leader looks for expired keys, default to one second
+	SweepInterval time.Duration
+	// the byte budgets and the eviction policy of the shards
+	Eviction Eviction
+	// max bytes of the disk tier keeping the evicted records of the node, 0 for none
+	DiskTierBytes uint64
+	// the hash placing the keys on the shards, fnv(default) or xxhash
+	Hash string
+	// the pace of the moves of the partitions between the nodes
+	Rebalance Rebalance
+	// compresses and encrypts the snapshots, the raft log and the disk tier, nil for none
+	Codec *codec.Codec
+	// where the raft snapshots are kept, and how many
+	Snapshots Snapshots
+	// SnapshotThreshold, SnapshotInterval and TrailingLogs of raft.Config decide when the
+	// log is compacted, the defaults of raft if zero
 	Raft struct {
 		raft.Config
 		BindAddr    string
 		StreamLayer *StreamLayer
 		Bootstrap   bool
+		// max bytes of a segment of the log, the log is compacted by whole segments,
+		// default to 1024
+		SegmentBytes uint64
+		// when the entries are synced to the disk, raftlog.SyncAlways(default), SyncNever,
+		// or SyncPeriodic every SyncInterval(default to 100 milliseconds)
+		Sync         string
+		SyncInterval time.Duration
 	}
+	// the partition of the group, set by NewPartitionedStorage
+	partition int
+}
+
+type Rebalance struct {
+	// how often the rebalancer takes a step, default to 250 milliseconds
+	Interval time.Duration
+	// bytes per second streamed to a server catching up(snapshot and entries), 0 for no limit
+	BytesPerSecond int64
+	// a server catching up becomes a voter once it is at most MaxLag entries behind, default to 64
+	MaxLag uint64
+	// the voters of each partition, 0 for all the nodes
+	Replicas int
+	// the servers catching up at once on the partitions the node leads, default to 1
+	MaxMoves int
+	// shared by the partitions of the node, set by NewPartitionedStorage
+	throttle *throttle
+}
+
+type Snapshots struct {
+	// file(default), in the data dir, or s3
+	Store string
+	// the snapshots kept, default to 1
+	Retain int
+	// the snapshots older than MaxAge are removed, the latest one is kept whatever its age,
+	// 0 for no limit
+	MaxAge time.Duration
+	// the bucket of the s3 store, the snapshots of each partition of each node are
+	// under <Prefix>/<node id>/<partition>
+	S3     objstore.S3Config
+	Prefix string
+	// the directory of the partition, set by NewPartitionedStorage
+	partition string
 }
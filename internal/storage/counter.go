@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+)
+
+var (
+	ErrorNotAnInteger = errors.New("value is not an integer")
+	ErrorOverflow     = errors.New("increment would overflow")
+)
+
+// Incr adds delta to the integer value of the key and returns the new value,
+// a missing(or expired) key starts from 0. The ttl of the key is kept
+func (m ShardedMap) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	return m.incr(ctx, key, delta, time.Now().UnixNano(), m.nextVersion())
+}
+
+// now is given by the caller(the leader in case of the fsm),
+// so all replicas agree on whether the key is expired
+func (m ShardedMap) incr(ctx context.Context, key string, delta int64, now int64, version uint64) (int64, error) {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageIncr")
+	defer teardown()
+
+	shard := m.getShard(key)
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	nd, ok := shard.m[key]
+	if !ok || nd.isExpired(now) {
+		if err := shard.set(key, delta, 0, version); err != nil {
+			return 0, err
+		}
+		return delta, nil
+	}
+
+	if nd.typ != intValue {
+		return 0, ErrorNotAnInteger
+	}
+	sum := nd.valInt + delta
+	if (delta > 0 && sum < nd.valInt) || (delta < 0 && sum > nd.valInt) {
+		return 0, ErrorOverflow
+	}
+	// a new node, the snapshots may still read the previous one
+	nd, err := shard.link(key, sum, nd.expiresAt, version)
+	if err != nil {
+		return 0, err
+	}
+	shard.publish(api.WatchEvent_PUT, nd, version)
+
+	// as for a Get
+	shard.touch(nd)
+
+	return sum, nil
+}
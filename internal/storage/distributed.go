@@ -1,7 +1,6 @@
 package storage
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"crypto/tls"
@@ -11,13 +10,16 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/codec"
 	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
 	"github.com/djedjethai/generation/internal/raftlog"
+	"github.com/djedjethai/generation/internal/storage/command"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 
@@ -28,42 +30,117 @@ type DistributedStorage struct {
 	logConfig raftlog.Config
 	config    Config
 	log       *raftlog.Log
+	stable    *raftboltdb.BoltStore
 	sm        *ShardedMap
 	raft      *raft.Raft
+	transport *progressTransport
+	snapshots *snapshotStore
+	dataDir   string
+	stopSweep func()
+	stopEvict func()
+	tier      *DiskTier
+	// set while the node is a voter of the group, refreshed by the rebalancer
+	replica atomic.Bool
+
+	// leadership tracks the leader terms of the node, a term becomes readable
+	// once the entries of the previous terms have been applied by the fsm
+	leadership struct {
+		sync.Mutex
+		epoch    uint64
+		readable bool
+	}
+	done chan struct{}
 }
 
+const (
+	defaultSweepInterval = time.Second
+	// max time a read waits for the leader to be readable
+	readTimeout = 10 * time.Second
+)
+
 func NewDistributedStorage(dataDir string, conf Config, nShard, maxLgt int, observ *observability.Observability) (*DistributedStorage, error) {
 	l := &DistributedStorage{
 		logConfig: raftlog.Config{},
 		config:    conf,
+		dataDir:   dataDir,
+		done:      make(chan struct{}),
 	}
 
 	if err := l.setupShardedMap(nShard, maxLgt, observ); err != nil {
 		return nil, err
 	}
+	if err := l.setupTier(dataDir, observ); err != nil {
+		return nil, err
+	}
 	if err := l.setupRaft(dataDir); err != nil {
 		return nil, err
 	}
+	l.refreshReplica(true)
+
+	sweepInterval := conf.SweepInterval
+	if sweepInterval == 0 {
+		sweepInterval = defaultSweepInterval
+	}
+	l.stopSweep = l.sm.Sweep(sweepInterval, l.reclaim)
+	l.stopEvict = l.sm.Evictions(sweepInterval, l.leads, l.evict)
+
 	return l, nil
 }
 
 func (l *DistributedStorage) setupShardedMap(nShard, maxLgt int, observ *observability.Observability) error {
-	if nShard < 1 || maxLgt < 1 {
+	// a shard is bounded by its number of records, its bytes or both
+	if nShard < 1 || maxLgt < 0 || (maxLgt == 0 && l.config.Eviction.shardBudget(nShard) == 0) {
 		return errors.New("Storage needs some rooms")
 	}
-	nsm := NewShardedMap(nShard, maxLgt, observ)
+	nsm, err := NewShardedMapWithEviction(nShard, maxLgt, l.config.Eviction, observ)
+	if err != nil {
+		return err
+	}
+	if err := nsm.SetHash(l.config.Hash); err != nil {
+		return err
+	}
+	// only the leader chooses the victims, before the fsm applies anything
+	nsm.deferEvictions()
+	nsm.watch.partition = int32(l.config.partition)
 	l.sm = &nsm
 	return nil
 }
 
+// setupTier opens the disk tier of the evicted records, the records of a previous run
+// are dropped as the fsm restores them from the snapshot, then applies the evictions
+// of the log again
+func (l *DistributedStorage) setupTier(dataDir string, observ *observability.Observability) error {
+	if l.config.DiskTierBytes == 0 {
+		return nil
+	}
+	tier, err := NewDiskTier(filepath.Join(dataDir, "tier"), l.config.DiskTierBytes, l.config.Codec, observ)
+	if err != nil {
+		return err
+	}
+	if err := tier.Reset(); err != nil {
+		return err
+	}
+	l.tier = tier
+	l.sm.SetEvictionHook(tier)
+	return nil
+}
+
 func (l *DistributedStorage) setupRaft(dataDir string) error {
-	fsm := &fsm{sm: l.sm}
+	fsm := &fsm{sm: l.sm, codec: l.config.Codec}
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
 	logConfig := l.logConfig
 	logConfig.Segment.InitialOffset = 1
+	logConfig.Segment.MaxStoreBytes = l.config.Raft.SegmentBytes
+	logConfig.Segment.MaxIndexBytes = l.config.Raft.SegmentBytes
+	logConfig.Sync.Policy = l.config.Raft.Sync
+	if logConfig.Sync.Policy == "" {
+		logConfig.Sync.Policy = raftlog.SyncAlways
+	}
+	logConfig.Sync.Interval = l.config.Raft.SyncInterval
+	logConfig.Codec = l.config.Codec
 	logStore, err := newLogStore(logDir, logConfig)
 	if err != nil {
 		return err
@@ -79,23 +156,24 @@ func (l *DistributedStorage) setupRaft(dataDir string) error {
 	if err != nil {
 		return err
 	}
-	retain := 1
-	snapshotStore, err := raft.NewFileSnapshotStore(
-		filepath.Join(dataDir, "raft"),
-		retain,
-		os.Stderr,
-	)
+	l.stable = stableStore
+	snapshotStore, err := newSnapshotStore(dataDir, l.config.Snapshots, l.config.Raft.LocalID)
 	if err != nil {
 		return err
 	}
+	l.snapshots = snapshotStore
 	maxPool := 5
 	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
+	throttle := l.config.Rebalance.throttle
+	if throttle == nil {
+		throttle = newThrottle(l.config.Rebalance.BytesPerSecond)
+	}
+	l.transport = newProgressTransport(raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
 		maxPool,
 		timeout,
 		os.Stderr,
-	)
+	), throttle)
 	config := raft.DefaultConfig()
 	config.LocalID = l.config.Raft.LocalID
 	if l.config.Raft.HeartbeatTimeout != 0 {
@@ -110,17 +188,33 @@ func (l *DistributedStorage) setupRaft(dataDir string) error {
 	if l.config.Raft.CommitTimeout != 0 {
 		config.CommitTimeout = l.config.Raft.CommitTimeout
 	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
+	// raft blocks until the notification is received, so a term can not
+	// start before the previous one has been seen ending
+	notifyCh := make(chan bool)
+	config.NotifyCh = notifyCh
+
 	l.raft, err = raft.NewRaft(
 		config,
 		fsm,
 		logStore,
 		stableStore,
 		snapshotStore,
-		transport,
+		l.transport,
 	)
 	if err != nil {
 		return err
 	}
+	go l.monitorLeadership(notifyCh)
+
 	hasState, err := raft.HasExistingState(
 		logStore,
 		stableStore,
@@ -145,38 +239,137 @@ func (l *DistributedStorage) setupRaft(dataDir string) error {
 }
 
 // should have Put/Get/Delete
-func (l *DistributedStorage) Set(ctx context.Context, key string, value interface{}) error {
-	_, err := l.apply(
+func (l *DistributedStorage) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	_, err := l.SetIf(ctx, key, value, ttl, nil)
+	return err
+}
+
+// the precondition is evaluated by the fsm, the version is the index of the entry
+func (l *DistributedStorage) SetIf(ctx context.Context, key string, value interface{}, ttl time.Duration, pre *api.Precondition) (uint64, error) {
+	// the deadline is set once here, on the leader, then replicated as it is
+	now := time.Now().UnixNano()
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now + int64(ttl)
+	}
+	typed, err := api.NewValue(value)
+	if err != nil {
+		return 0, err
+	}
+	res, err := l.apply(
 		SetRequestType,
-		&api.Records{
-			Key:   key,
-			Value: value.(string),
+		&command.Record{
+			Key:          key,
+			TypedValue:   typed,
+			ExpiresAt:    expiresAt,
+			Precondition: pre,
+			Now:          now,
 		},
 	)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return res.(uint64), nil
 }
 
-func (l *DistributedStorage) Get(ctx context.Context, key string) (interface{}, error) {
+// the leader gives its time, so all replicas agree on whether the key is expired
+func (l *DistributedStorage) Incr(ctx context.Context, key string, delta int64) (int64, error) {
 	res, err := l.apply(
-		GetRequestType,
-		&api.Records{
-			Key: key,
+		IncrRequestType,
+		&command.Incr{
+			Key:   key,
+			Delta: delta,
+			Now:   time.Now().UnixNano(),
 		},
 	)
 	if err != nil {
-		return res, err
+		return 0, err
 	}
-	return res, nil
+	return res.(int64), nil
+}
+
+// the transaction is a single entry, the fsm applies it at once on each node
+func (l *DistributedStorage) Txn(ctx context.Context, req *api.TxnRequest) (*api.TxnResponse, error) {
+	cmd, err := l.sm.prepareTxn(req, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	res, err := l.apply(TxnRequestType, cmd)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.TxnResponse), nil
+}
+
+// the batch is cut in entries of maxBatchSize items, when an entry fails
+// after some have been applied, the error becomes the result of its items
+func (l *DistributedStorage) Batch(ctx context.Context, b *api.WriteBatch) ([]models.BatchResult, error) {
+	results := make([]models.BatchResult, 0, len(b.Puts)+len(b.Deletes))
+	for _, chunk := range splitBatch(b, maxBatchSize) {
+		res, err := l.apply(BatchRequestType, newBatch(chunk, time.Now().UnixNano()))
+		if err != nil && len(results) == 0 {
+			return nil, err
+		}
+		if err != nil {
+			for _, p := range chunk.Puts {
+				results = append(results, models.BatchResult{Key: p.GetRecords().GetKey(), Err: err})
+			}
+			for _, d := range chunk.Deletes {
+				results = append(results, models.BatchResult{Key: d.Key, Err: err})
+			}
+			continue
+		}
+		results = append(results, res.([]models.BatchResult)...)
+	}
+	return results, nil
+}
+
+// every node publishes the events of the entries it applies, with the same indexes
+func (l *DistributedStorage) Watch(ctx context.Context, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+	return l.sm.Watch(ctx, key, prefix, startIndex)
+}
+
+func (l *DistributedStorage) Scan(ctx context.Context, start, end string, limit int) ([]models.KeysValues, error) {
+	return l.sm.Scan(ctx, start, end, limit)
+}
+
+func (l *DistributedStorage) KeysPage(ctx context.Context, cursor models.KeysCursor, limit int, match func(string) bool) ([]string, models.KeysCursor, bool, error) {
+	return l.sm.KeysPage(ctx, cursor, limit, match)
+}
+
+func (l *DistributedStorage) CountKeys(ctx context.Context, match func(string) bool) (int, error) {
+	return l.sm.CountKeys(ctx, match)
+}
+
+func (l *DistributedStorage) CacheStats() CacheStats {
+	return l.sm.CacheStats()
+}
+
+func (l *DistributedStorage) StopWatches() {
+	l.sm.StopWatches()
+}
+
+// the reads are served from the local ShardedMap, nothing is appended to the log,
+// Consistent must be called before to get the wanted consistency
+func (l *DistributedStorage) Get(ctx context.Context, key string) (interface{}, error) {
+	return l.sm.Get(ctx, key)
+}
+
+func (l *DistributedStorage) GetWithVersion(ctx context.Context, key string) (interface{}, uint64, error) {
+	return l.sm.GetWithVersion(ctx, key)
 }
 
 func (l *DistributedStorage) Delete(ctx context.Context, key string, sh *Shard) error {
+	return l.DeleteIf(ctx, key, nil)
+}
+
+func (l *DistributedStorage) DeleteIf(ctx context.Context, key string, pre *api.Precondition) error {
 	_, err := l.apply(
 		DeleteRequestType,
-		&api.Records{
-			Key: key,
+		&command.Record{
+			Key:          key,
+			Precondition: pre,
+			Now:          time.Now().UnixNano(),
 		},
 	)
 	if err != nil {
@@ -185,25 +378,164 @@ func (l *DistributedStorage) Delete(ctx context.Context, key string, sh *Shard)
 	return nil
 }
 
-// no replication to followers nodes
-// will be access directly from followers nodes
-func (l *DistributedStorage) Keys(ctx context.Context) []string {
+func (l *DistributedStorage) Keys(ctx context.Context) ([]string, error) {
 	return l.sm.Keys(ctx)
 }
 
-// no replication to followers nodes
-// will be access directly from followers nodes
 func (l *DistributedStorage) KeysValues(ctx context.Context, ch chan models.KeysValues) error {
 	return l.sm.KeysValues(ctx, ch)
 }
 
 // for testing purpose only
-func (l *DistributedStorage) Read(ctx context.Context, key string) (string, error) {
+func (l *DistributedStorage) Read(ctx context.Context, key string) (interface{}, error) {
 	val, err := l.sm.Get(ctx, key)
 	if err != nil {
 		return "", err
 	}
-	return val.(string), nil
+	return val, nil
+}
+
+// reclaim is called by the shards' sweepers, only the leader removes the expired keys
+// and it does it through the log, so all replicas remove them at the same index
+func (l *DistributedStorage) reclaim(ctx context.Context, expired []*command.Record) {
+	if l.raft.State() != raft.Leader {
+		return
+	}
+	_, err := l.apply(
+		ExpireRequestType,
+		&command.Expire{
+			Records: expired,
+		},
+	)
+	if err != nil {
+		l.sm.obs.Logger.Error("DistributedStorage.reclaim() failed", err)
+	}
+}
+
+// leads tells the evictor to choose the victims, the node is the leader
+func (l *DistributedStorage) leads() bool {
+	return l.raft.State() == raft.Leader
+}
+
+// evict is called by the evictor, only the leader evicts and it does it through the log,
+// so all replicas evict the keys it chose at the same index whatever their reads were
+func (l *DistributedStorage) evict(ctx context.Context, victims []*command.EvictItem) {
+	if l.raft.State() != raft.Leader {
+		return
+	}
+	_, err := l.apply(
+		EvictRequestType,
+		&command.Evict{
+			Items: victims,
+		},
+	)
+	if err != nil {
+		l.sm.obs.Logger.Error("DistributedStorage.evict() failed", err)
+	}
+}
+
+// Consistent is called before reading from the local ShardedMap:
+//   - stale, any node serves its local state
+//   - leader, the node must be the leader and its fsm must have applied the entries of the previous terms
+//   - linearizable, on top of that no other leader must have been elected meanwhile,
+//     which VerifyLeader checks with a round of heartbeats instead of a log entry
+func (l *DistributedStorage) Consistent(ctx context.Context, c api.Consistency, keys ...string) error {
+	switch c {
+	case api.Consistency_STALE:
+		return nil
+	case api.Consistency_LEADER:
+		return l.waitReadable(ctx)
+	default:
+		if err := l.waitReadable(ctx); err != nil {
+			return err
+		}
+		return l.raft.VerifyLeader().Error()
+	}
+}
+
+func (l *DistributedStorage) AppliedIndex() uint64 {
+	return l.raft.AppliedIndex()
+}
+
+// AppliedIndexes returns the index of the single partition of the group
+func (l *DistributedStorage) AppliedIndexes(keys ...string) map[int]uint64 {
+	return map[int]uint64{0: l.AppliedIndex()}
+}
+
+// waitReadable waits for the barrier of the leader's term
+func (l *DistributedStorage) waitReadable(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, readTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for !l.readable() {
+		if l.raft.State() != raft.Leader {
+			return raft.ErrNotLeader
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	if l.raft.State() != raft.Leader {
+		return raft.ErrNotLeader
+	}
+	return nil
+}
+
+func (l *DistributedStorage) readable() bool {
+	l.leadership.Lock()
+	defer l.leadership.Unlock()
+	return l.leadership.readable
+}
+
+// monitorLeadership starts a new epoch at each leadership change,
+// when the node becomes the leader a barrier is run to make the new term readable
+func (l *DistributedStorage) monitorLeadership(notifyCh <-chan bool) {
+	for {
+		select {
+		case <-l.done:
+			return
+		case isLeader := <-notifyCh:
+			l.leadership.Lock()
+			l.leadership.epoch++
+			l.leadership.readable = false
+			epoch := l.leadership.epoch
+			l.leadership.Unlock()
+
+			if isLeader {
+				go l.barrier(epoch)
+			}
+		}
+	}
+}
+
+// barrier appends a single entry per term(as raft does with its noop),
+// once applied every entry committed by the previous leaders is in the fsm
+func (l *DistributedStorage) barrier(epoch uint64) {
+	for {
+		err := l.raft.Barrier(readTimeout).Error()
+
+		l.leadership.Lock()
+		if l.leadership.epoch != epoch {
+			l.leadership.Unlock()
+			return
+		}
+		if err == nil {
+			l.leadership.readable = true
+			l.leadership.Unlock()
+			return
+		}
+		l.leadership.Unlock()
+
+		if err == raft.ErrRaftShutdown || l.raft.State() != raft.Leader {
+			return
+		}
+		l.sm.obs.Logger.Error("DistributedStorage.barrier() failed", err)
+	}
 }
 
 // health end-point, return the servers' addresses
@@ -223,6 +555,76 @@ func (l *DistributedStorage) Servers(ctx context.Context) ([]*api.Server, error)
 	return servers, nil
 }
 
+// Partitions returns the single partition of the group
+func (l *DistributedStorage) Partitions(ctx context.Context) ([]*api.Partition, error) {
+	id, addr := l.leader()
+	return []*api.Partition{{LeaderId: id, LeaderAddr: addr}}, nil
+}
+
+func (l *DistributedStorage) PartitionOf(key string) int {
+	return 0
+}
+
+// Rebalance has no move to report, the servers join the group with Join
+func (l *DistributedStorage) Rebalance(ctx context.Context) (*api.RebalanceStatus, error) {
+	return &api.RebalanceStatus{Balanced: true}, nil
+}
+
+func (l *DistributedStorage) configuration() ([]raft.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	return future.Configuration().Servers, nil
+}
+
+// refreshReplica records if the node is a voter of the latest configuration, the reads
+// of a node catching up or removed from the group are served by the leader. The leader
+// does not send its removal to the server removed, a node out of the placement of the
+// group which knows no leader was removed
+func (l *DistributedStorage) refreshReplica(placed bool) {
+	servers, err := l.configuration()
+	if err != nil {
+		return
+	}
+	var voter bool
+	for _, srv := range servers {
+		if srv.ID == l.config.Raft.LocalID && srv.Suffrage == raft.Voter {
+			voter = true
+		}
+	}
+	if _, addr := l.leader(); !placed && addr == "" {
+		voter = false
+	}
+	l.replica.Store(voter)
+}
+
+// serves tells if the node serves the reads of the group at the consistency,
+// the stale ones on a voter, the others on the leader
+func (l *DistributedStorage) serves(c api.Consistency) bool {
+	if c == api.Consistency_STALE {
+		return l.replica.Load()
+	}
+	return l.raft.State() == raft.Leader
+}
+
+// leader returns the id and the address of the leader, empty if none is elected
+func (l *DistributedStorage) leader() (string, string) {
+	addr := l.raft.Leader()
+	if addr == "" {
+		return "", ""
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err == nil {
+		for _, srv := range future.Configuration().Servers {
+			if srv.Address == addr {
+				return string(srv.ID), string(addr)
+			}
+		}
+	}
+	return "", string(addr)
+}
+
 // apply will switch on the RequestType(Put/Get/Delete)
 func (l *DistributedStorage) apply(reqType RequestType, req proto.Message) (interface{}, error) {
 	var buf bytes.Buffer
@@ -242,6 +644,9 @@ func (l *DistributedStorage) apply(reqType RequestType, req proto.Message) (inte
 
 	timeout := 10 * time.Second
 	future := l.raft.Apply(buf.Bytes(), timeout)
+	if future.Error() == raft.ErrLeadershipTransferInProgress {
+		future = l.applyAfterTransfer(buf.Bytes(), timeout)
+	}
 	if future.Error() != nil {
 		return nil, future.Error()
 	}
@@ -254,40 +659,87 @@ func (l *DistributedStorage) apply(reqType RequestType, req proto.Message) (inte
 	return res, nil
 }
 
+// applyAfterTransfer holds the entry while the partition moves to another node, it is
+// applied if the transfer fails. Otherwise ErrNotLeader is returned once the new leader
+// is known, so the entry can be forwarded to it
+func (l *DistributedStorage) applyAfterTransfer(cmd []byte, timeout time.Duration) raft.ApplyFuture {
+	deadline := time.Now().Add(timeout)
+	for {
+		time.Sleep(10 * time.Millisecond)
+		if l.raft.State() != raft.Leader {
+			for l.raft.Leader() == "" && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return errorFuture{raft.ErrNotLeader}
+		}
+		future := l.raft.Apply(cmd, timeout)
+		if future.Error() != raft.ErrLeadershipTransferInProgress || time.Now().After(deadline) {
+			return future
+		}
+	}
+}
+
+// errorFuture is an ApplyFuture failed before being applied
+type errorFuture struct {
+	err error
+}
+
+func (f errorFuture) Error() error          { return f.err }
+func (f errorFuture) Index() uint64         { return 0 }
+func (f errorFuture) Response() interface{} { return nil }
+
 var _ raft.FSM = (*fsm)(nil)
 
 type fsm struct {
 	sm *ShardedMap
+	// seals the chunks of the snapshots
+	codec *codec.Codec
 }
 
 type RequestType uint8
 
 const (
 	SetRequestType RequestType = iota
+	// Get is not appended anymore, kept for the entries already in the logs
 	GetRequestType
 	DeleteRequestType
 	AppendRequestType
+	ExpireRequestType
+	IncrRequestType
+	TxnRequestType
+	BatchRequestType
+	EvictRequestType
 )
 
 // will switch on reqType(Put/Get/Delete)
 func (l *fsm) Apply(record *raft.Log) interface{} {
 	buf := record.Data
 	reqType := RequestType(buf[0])
+	// the index of the entry is the version of the keys it writes
 	switch reqType {
 	case SetRequestType:
-		return l.applySet(buf[1:])
+		return l.applySet(buf[1:], record.Index)
 	case GetRequestType:
 		return l.applyGet(buf[1:])
 	case DeleteRequestType:
-		return l.applyDelete(buf[1:])
+		return l.applyDelete(buf[1:], record.Index)
+	case ExpireRequestType:
+		return l.applyExpire(buf[1:], record.Index)
+	case IncrRequestType:
+		return l.applyIncr(buf[1:], record.Index)
+	case TxnRequestType:
+		return l.applyTxn(buf[1:], record.Index)
+	case BatchRequestType:
+		return l.applyBatch(buf[1:], record.Index)
+	case EvictRequestType:
+		return l.applyEvict(buf[1:], record.Index)
 	}
 	return nil
 }
 
 // will have applyPut(records)/applyGet(key)/applyDelete(key)
-func (l *fsm) applySet(b []byte) interface{} {
-	// var req api.PutRequest
-	var req api.Records
+func (l *fsm) applySet(b []byte, version uint64) interface{} {
+	var req command.Record
 	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
@@ -297,13 +749,13 @@ func (l *fsm) applySet(b []byte) interface{} {
 
 	// fmt.Println("see in applySet: ", req.Records)
 	// err = l.sm.Set(ctx, req.Records.Key, req.Records.Value)
-	err = l.sm.Set(ctx, req.Key, req.Value)
+	err = l.sm.set(ctx, req.Key, req.Data(), req.ExpiresAt, version, req.Precondition, req.Now)
 	if err != nil {
 		return err
 	}
 
 	// will return the expected response from the method executed on the storage
-	return err
+	return version
 }
 
 // Get should return (interface{}, error) but raft accept only a single value
@@ -324,8 +776,8 @@ func (l *fsm) applyGet(b []byte) interface{} {
 	return ndVal
 }
 
-func (l *fsm) applyDelete(b []byte) interface{} {
-	var req api.DeleteRequest
+func (l *fsm) applyDelete(b []byte, index uint64) interface{} {
+	var req command.Record
 	err := proto.Unmarshal(b, &req)
 	if err != nil {
 		return err
@@ -333,8 +785,7 @@ func (l *fsm) applyDelete(b []byte) interface{} {
 
 	ctx := context.Background()
 
-	// TODO see here the story of the "nil" shardedMap.....
-	err = l.sm.Delete(ctx, req.Key, nil)
+	err = l.sm.deleteIf(ctx, req.Key, req.Precondition, req.Now, index)
 	if err != nil {
 		return err
 	}
@@ -343,77 +794,161 @@ func (l *fsm) applyDelete(b []byte) interface{} {
 	return err
 }
 
-// will read all the storage and snapshot it
-// should snapshot to the db...
-func (l *fsm) Snapshot() (raft.FSMSnapshot, error) {
+func (l *fsm) applyExpire(b []byte, index uint64) interface{} {
+	var req command.Expire
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+
 	ctx := context.Background()
-	var ch = make(chan models.KeysValues)
 
-	go func() {
-		err := l.sm.KeysValues(ctx, ch)
-		if err != nil {
-			return
+	for _, r := range req.Records {
+		if err = l.sm.expire(ctx, r.Key, r.ExpiresAt, index); err != nil {
+			return err
 		}
-	}()
+	}
 
-	r := strings.NewReader("")
-	buf := new(bytes.Buffer)
-	for d := range ch {
+	return nil
+}
 
-		b, err := proto.Marshal(&api.Records{
-			Key:   d.Key,
-			Value: d.Value,
-		})
-		if err != nil {
-			fmt.Println("err marshaling in snapshot()")
-		}
-		buf.Write(b)
-		buf.WriteString("\n")
+func (l *fsm) applyIncr(b []byte, version uint64) interface{} {
+	var req command.Incr
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	value, err := l.sm.incr(ctx, req.Key, req.Delta, req.Now, version)
+	if err != nil {
+		return err
+	}
+
+	return value
+}
+
+func (l *fsm) applyTxn(b []byte, version uint64) interface{} {
+	var req command.Txn
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	res, err := l.sm.txn(ctx, &req, version)
+	if err != nil {
+		return err
+	}
+
+	return res
+}
+
+func (l *fsm) applyBatch(b []byte, version uint64) interface{} {
+	var req command.Batch
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
 	}
-	r.Read(buf.Bytes())
 
-	return &snapshot{reader: r}, nil
+	ctx := context.Background()
+
+	return l.sm.batch(ctx, &req, version)
+}
+
+func (l *fsm) applyEvict(b []byte, index uint64) interface{} {
+	var req command.Evict
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+
+	l.sm.evict(context.Background(), req.Items, index)
+
+	return nil
+}
+
+// Snapshot only takes the nodes of each shard and the offsets of the tier, Persist writes
+// them while the fsm goes on. A node is not written once linked(a write links a new one),
+// and a record of the tier is not dropped until the snapshot is released, so they keep
+// the state of the snapshot
+func (l *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	return &snapshot{shards: l.sm.nodes(), tier: l.sm.tierSnapshot(), codec: l.codec}, nil
 }
 
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 type snapshot struct {
-	reader io.Reader
+	shards [][]*node
+	// nil without tier
+	tier  TierSnapshot
+	codec *codec.Codec
 }
 
-// a way to persist the fsm to the disk, memory, s3 or whatever...
-// if a node goes down, when back up it will use this snapshot to reset its fsm state
+// persists the fsm to the snapshot store of the config, the disk or s3
+// if a node goes down, when back up it will use this snapshot to reset its fsm state.
+// The records are written shard by shard, a chunk at a time(see snapshot.go)
 func (s *snapshot) Persist(sink raft.SnapshotSink) error {
-	if _, err := io.Copy(sink, s.reader); err != nil {
+	if err := s.write(sink); err != nil {
 		_ = sink.Cancel()
 		return err
 	}
 	return sink.Close()
 }
 
-func (s *snapshot) Release() {}
+func (s *snapshot) write(w io.Writer) error {
+	sw, err := newSnapshotWriter(w, s.codec)
+	if err != nil {
+		return err
+	}
+	// the expired keys are still part of the state until the fsm removes them
+	for _, nodes := range s.shards {
+		for _, nd := range nodes {
+			if err := sw.write(nd.records()); err != nil {
+				return err
+			}
+		}
+	}
+	if s.tier != nil {
+		if err := s.tier.Records(sw.writeEvicted); err != nil {
+			return err
+		}
+	}
+	return sw.close()
+}
+
+func (s *snapshot) Release() {
+	s.shards = nil
+	if s.tier != nil {
+		s.tier.Release()
+	}
+}
 
 // here read the snapshot from r io.ReadCloser(how come ??),
 // but in our case it will be the snapshot of the storage(which is managed by the fsm)
-// and reset the storage(executing the snapshot records) of the newly up node
+// and reset the storage(executing the snapshot records) of the newly up node.
+// The records are placed on the shards of the node, whatever its shards were when
+// the snapshot was taken
 func (l *fsm) Restore(r io.ReadCloser) error {
 
 	ctx := context.Background()
+	// the snapshots of the store tell their index, the watchers can not resume before it
+	var index uint64
+	if cr, ok := r.(*crcReader); ok {
+		index = cr.index
+	}
+	if err := l.sm.reset(index); err != nil {
+		return err
+	}
 
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		bts := scanner.Bytes()
-		dt := &api.Records{}
-		err := proto.Unmarshal(bts, dt)
-		if err != nil {
-			return err
+	return readSnapshot(r, l.codec, func(rec *command.Record, evicted bool) error {
+		if evicted {
+			return l.sm.restoreEvicted(ctx, rec)
 		}
-		err = l.sm.Set(ctx, dt.Key, dt.Value)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+		return l.sm.set(ctx, rec.Key, rec.Data(), rec.ExpiresAt, rec.Version, nil, 0)
+	})
 }
 
 // raft logger
@@ -445,6 +980,10 @@ func (l *logStore) LastIndex() (uint64, error) {
 
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
 	in, err := l.Read(index)
+	if err == raftlog.ErrorOffsetOutOfRange {
+		// raft sends its snapshot to the followers missing the log
+		return raft.ErrLogNotFound
+	}
 	if err != nil {
 		return err
 	}
@@ -459,21 +998,54 @@ func (l *logStore) StoreLog(record *raft.Log) error {
 	return l.StoreLogs([]*raft.Log{record})
 }
 func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+	// raft restoring a user snapshot skips indexes, the log restarts
+	// at the next entry as the snapshot has the previous ones
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	if records[0].Index > last+1 {
+		if err := l.ResetAt(records[0].Index); err != nil {
+			return err
+		}
+	}
+	batch := make([]*raftlog.Record, 0, len(records))
 	for _, record := range records {
-		if _, err := l.Append(&raftlog.Record{
+		batch = append(batch, &raftlog.Record{
 			Value: record.Data,
 			Term:  record.Term,
 			Type:  uint32(record.Type),
-		}); err != nil {
-			return err
-		}
+		})
 	}
-
-	return nil
+	// synced once by the sync policy
+	return l.AppendBatch(batch)
 }
 
+// DeleteRange removes the entries from min to max, raft removes either the oldest ones, once
+// a snapshot has them, or the newest ones of a follower which conflict with the leader
 func (l *logStore) DeleteRange(min, max uint64) error {
-	return l.Truncate(max)
+	first, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	last, err := l.HighestOffset()
+	if err != nil {
+		return err
+	}
+	switch {
+	case min <= first && max >= last:
+		// raft may store again from min
+		return l.ResetAt(min)
+	case min <= first:
+		// the entries of the segment of max are masked until the whole segment goes
+		return l.Truncate(max)
+	case max >= last:
+		return l.TruncateFrom(min)
+	}
+	return fmt.Errorf("can not delete the entries %d to %d of the log, from %d to %d", min, max, first, last)
 }
 
 // stream
@@ -483,6 +1055,9 @@ type StreamLayer struct {
 	ln              net.Listener
 	serverTLSConfig *tls.Config
 	peerTLSConfig   *tls.Config
+	// set when ln is shared by the raft groups of the partitions
+	demux     *streamDemux
+	partition int
 }
 
 func NewStreamLayer(ln net.Listener, serverTLSConfig *tls.Config, peerTLSConfig *tls.Config) *StreamLayer {
@@ -501,8 +1076,12 @@ func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.
 	if err != nil {
 		return nil, err
 	}
-	// identify to mux this is a raft rpc
-	_, err = conn.Write([]byte{byte(RaftRPC)})
+	// identify to mux this is a raft rpc, and to the demux its partition
+	header := []byte{byte(RaftRPC)}
+	if s.demux != nil {
+		header = append(header, byte(s.partition))
+	}
+	_, err = conn.Write(header)
 	if err != nil {
 		return nil, err
 	}
@@ -513,6 +1092,17 @@ func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.
 }
 
 func (s *StreamLayer) Accept() (net.Conn, error) {
+	if s.demux != nil {
+		conn, err := s.demux.accept(s.partition)
+		if err != nil {
+			return nil, err
+		}
+		if s.serverTLSConfig != nil {
+			return tls.Server(conn, s.serverTLSConfig), nil
+		}
+		return conn, nil
+	}
+
 	conn, err := s.ln.Accept()
 	if err != nil {
 		return nil, err
@@ -532,6 +1122,9 @@ func (s *StreamLayer) Accept() (net.Conn, error) {
 }
 
 func (s *StreamLayer) Close() error {
+	if s.demux != nil {
+		return s.demux.close()
+	}
 	return s.ln.Close()
 }
 
@@ -590,11 +1183,24 @@ func (l *DistributedStorage) WaitForLeader(timeout time.Duration) error {
 
 func (l *DistributedStorage) Close() error {
 
+	l.stopSweep()
+	l.stopEvict()
+
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
+	close(l.done)
 
-	// return nil
+	if l.tier != nil {
+		if err := l.tier.Close(); err != nil {
+			return err
+		}
+	}
+
+	// the node can be opened again on the same data dir
+	if err := l.stable.Close(); err != nil {
+		return err
+	}
 	return l.log.Close()
 }
@@ -1,17 +1,22 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
 	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/codec"
 	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/internal/raftlog"
 	"github.com/hashicorp/raft"
 	"github.com/stretchr/testify/require"
 	"github.com/travisjeffery/go-dynaport"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -44,6 +49,7 @@ func TestMultipleNodes(t *testing.T) {
 		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
 		config.Raft.CommitTimeout = 5 * time.Millisecond
 		config.Raft.BindAddr = ln.Addr().String()
+		config.SweepInterval = 20 * time.Millisecond
 		if i == 0 {
 			config.Raft.Bootstrap = true
 		}
@@ -70,7 +76,7 @@ func TestMultipleNodes(t *testing.T) {
 	time.Sleep(50 * time.Millisecond)
 	ctx := context.Background()
 	for _, record := range records {
-		err := logs[0].Set(ctx, record.Key, record.Value)
+		err := logs[0].Set(ctx, record.Key, record.Value, 0)
 		require.NoError(t, err)
 		require.Eventually(t, func() bool {
 			for j := 0; j < nodeCount; j++ {
@@ -86,14 +92,124 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	// the typed values are replicated with their type
+	err := logs[0].Set(ctx, "counter", int64(0), 0)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		got, err := logs[2].Read(ctx, "counter")
+		return err == nil && got == int64(0)
+	}, 500*time.Millisecond, 50*time.Millisecond)
+
+	// the increments are applied by the fsm of every node
+	n, err := logs[0].Incr(ctx, "counter", 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), n)
+	require.Eventually(t, func() bool {
+		got, err := logs[2].Read(ctx, "counter")
+		return err == nil && got == int64(3)
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[1].Incr(ctx, "counter", 1)
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// the version of a key is the index of its last write, the same on all the nodes
+	_, current, err := logs[0].GetWithVersion(ctx, "counter")
+	require.NoError(t, err)
+	version, err := logs[0].SetIf(ctx, "counter", int64(10), 0, &api.Precondition{ExpectedVersion: current})
+	require.NoError(t, err)
+	require.Greater(t, version, current)
+	require.Eventually(t, func() bool {
+		_, v, err := logs[2].sm.GetWithVersion(ctx, "counter")
+		return err == nil && v == version
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[0].SetIf(ctx, "counter", int64(11), 0, &api.Precondition{ExpectedVersion: current})
+	require.Equal(t, ErrorPreconditionFailed, err)
+
+	err = logs[0].Delete(ctx, "counter", nil)
+	require.NoError(t, err)
+
+	// the followers publish the events of the entries they apply, with the same index
+	events, cancel, err := logs[2].Watch(ctx, "watched", false, 0)
+	require.NoError(t, err)
+	version, err = logs[0].SetIf(ctx, "watched", "value", 0, nil)
+	require.NoError(t, err)
+	ev := nextEvent(t, events)
+	require.Equal(t, api.WatchEvent_PUT, ev.Type)
+	require.Equal(t, version, ev.Index)
+	err = logs[0].Delete(ctx, "watched", nil)
+	require.NoError(t, err)
+	ev = nextEvent(t, events)
+	require.Equal(t, api.WatchEvent_DELETE, ev.Type)
+	require.Equal(t, version+1, ev.Index)
+	cancel()
+
+	// a batch is a single entry
+	batchIndex := logs[0].raft.LastIndex()
+	results, err := logs[0].Batch(ctx, &api.WriteBatch{
+		Puts: []*api.PutRequest{
+			{Records: &api.Records{Key: "b1", Value: "v1"}},
+			{Records: &api.Records{Key: "b2", Value: "v2"}},
+		},
+		Deletes: []*api.DeleteRequest{{Key: "b1"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(results))
+	require.Equal(t, batchIndex+1, logs[0].raft.LastIndex())
+	require.Eventually(t, func() bool {
+		got, err := logs[2].Read(ctx, "b2")
+		return err == nil && got == "v2"
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[0].Batch(ctx, &api.WriteBatch{Deletes: []*api.DeleteRequest{{Key: "b2"}}})
+	require.NoError(t, err)
+
+	// a transaction is applied at once on all the nodes
+	res, err := logs[0].Txn(ctx, &api.TxnRequest{
+		Compares: []*api.Compare{
+			{Key: "from", Precondition: &api.Precondition{IfAbsent: true}},
+		},
+		Success: []*api.TxnOp{txnPut("from", 1), txnPut("to", 2)},
+	})
+	require.NoError(t, err)
+	require.True(t, res.Succeeded)
+	require.Eventually(t, func() bool {
+		from, err1 := logs[2].Read(ctx, "from")
+		to, err2 := logs[2].Read(ctx, "to")
+		return err1 == nil && err2 == nil && from == int64(1) && to == int64(2)
+	}, 500*time.Millisecond, 50*time.Millisecond)
+	_, err = logs[1].Txn(ctx, &api.TxnRequest{Success: []*api.TxnOp{txnPut("to", 3)}})
+	require.Equal(t, raft.ErrNotLeader, err)
+	_, err = logs[0].Txn(ctx, &api.TxnRequest{Success: []*api.TxnOp{
+		{Op: &api.TxnOp_Delete{Delete: &api.TxnDelete{Key: "from"}}},
+		{Op: &api.TxnOp_Delete{Delete: &api.TxnDelete{Key: "to"}}},
+	}})
+	require.NoError(t, err)
+
+	// a linearizable Get is served by the leader without appending to the log
+	lastIndex := logs[0].raft.LastIndex()
+	err = logs[0].Consistent(ctx, api.Consistency_LINEARIZABLE)
+	require.NoError(t, err)
+	got, err := logs[0].Get(ctx, "firstKey")
+	require.NoError(t, err)
+	require.Equal(t, "firstValue", got)
+	require.Equal(t, lastIndex, logs[0].raft.LastIndex())
+
+	err = logs[1].Consistent(ctx, api.Consistency_LINEARIZABLE)
+	require.Equal(t, raft.ErrNotLeader, err)
+	err = logs[1].Consistent(ctx, api.Consistency_LEADER)
+	require.Equal(t, raft.ErrNotLeader, err)
+
+	// a follower serves stale reads and reports where it is in the log
+	err = logs[1].Consistent(ctx, api.Consistency_STALE)
+	require.NoError(t, err)
+	require.NotZero(t, logs[1].AppliedIndex())
+
 	// kill the node 1
-	err := logs[0].Leave("1")
+	err = logs[0].Leave("1")
 	require.NoError(t, err)
 
 	time.Sleep(50 * time.Millisecond)
 
 	// add a new entry via the leader
-	err = logs[0].Set(ctx, "thirdKey", "thirdValue")
+	err = logs[0].Set(ctx, "thirdKey", "thirdValue", 0)
 	require.NoError(t, err)
 
 	time.Sleep(50 * time.Millisecond)
@@ -120,7 +236,7 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, "", record)
 
 	// test getKeys
-	keys := logs[2].Keys(ctx)
+	keys := allKeys(t, logs[2])
 	require.Equal(t, 2, len(keys))
 
 	// test get KeysValues
@@ -137,4 +253,378 @@ func TestMultipleNodes(t *testing.T) {
 	require.NotNil(t, datas[1].Key)
 	require.NotNil(t, datas[1].Value)
 
+	// a key with a ttl is removed from all nodes through the log
+	err = logs[0].Set(ctx, "session", "token", 50*time.Millisecond)
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	record, err = logs[2].Read(ctx, "session")
+	require.Error(t, err, "no such key")
+
+	require.Eventually(t, func() bool {
+		for _, j := range []int{0, 2} {
+			shard := logs[j].sm.getShard("session")
+			shard.RLock()
+			_, ok := shard.m["session"]
+			shard.RUnlock()
+			if ok {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 20*time.Millisecond)
+}
+
+// the number of shards and the hash change between two runs, the snapshot is
+// restored on the new shards
+func TestReshardOnRestore(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	dataDir, err := ioutil.TempDir("", "reshard-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+
+	open := func(nShard int, hash string) *DistributedStorage {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		config := Config{Hash: hash}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		l, err := NewDistributedStorage(dataDir, config, nShard, 100, &obs)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+
+	l := open(2, HashFNV)
+	values := make(map[string]interface{})
+	for i := 0; i < 50; i++ {
+		// the bytes of the records contain some newlines
+		values[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("line\n%d\n", i)
+	}
+	values["counter"] = int64(10)
+	for key, value := range values {
+		require.NoError(t, l.Set(ctx, key, value, 0))
+	}
+	require.NoError(t, l.raft.Snapshot().Error())
+	require.NoError(t, l.Close())
+
+	_, err = NewDistributedStorage(dataDir, Config{Hash: "md5"}, 5, 100, &obs)
+	require.Equal(t, ErrorUnknownHash, err)
+
+	l = open(5, HashXXHash)
+	defer l.Close()
+	require.Len(t, l.sm.shd, 5)
+	for key, value := range values {
+		got, err := l.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+
+		shard := l.sm.getShard(key)
+		shard.RLock()
+		_, ok := shard.m[key]
+		shard.RUnlock()
+		require.True(t, ok)
+	}
+	require.Len(t, allKeys(t, l), len(values))
+}
+
+// the snapshots, the log and the disk tier are sealed, the data dir opens again with the keys
+func TestEncryptedDataDir(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	dataDir, err := ioutil.TempDir("", "encrypted-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	port := dynaport.Get(1)[0]
+	keys, err := codec.ParseKeys("1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{3}, 32)))
+	require.NoError(t, err)
+	cdc, err := codec.New(codec.CompressionSnappy, keys)
+	require.NoError(t, err)
+
+	open := func() *DistributedStorage {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		require.NoError(t, err)
+		config := Config{Codec: cdc, DiskTierBytes: 1 << 20}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		l, err := NewDistributedStorage(dataDir, config, 2, 10, &obs)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+
+	l := open()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, l.Set(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("secret-%d", i), 0))
+	}
+	require.NoError(t, l.raft.Snapshot().Error())
+	// in the log only, and the evicted ones in the tier
+	for i := 10; i < 30; i++ {
+		require.NoError(t, l.Set(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("secret-%d", i), 0))
+	}
+	require.Eventually(t, func() bool {
+		return len(allKeys(t, l)) <= 20
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, l.Close())
+
+	err = filepath.Walk(dataDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		require.False(t, bytes.Contains(b, []byte("secret-")), path)
+		return nil
+	})
+	require.NoError(t, err)
+
+	l = open()
+	defer l.Close()
+	require.Eventually(t, func() bool {
+		v, err := l.Get(ctx, "key-29")
+		return err == nil && v == "secret-29"
+	}, 3*time.Second, 10*time.Millisecond)
+	v, err := l.Get(ctx, "key-3")
+	require.NoError(t, err)
+	require.Equal(t, "secret-3", v)
+}
+
+// raft deletes the oldest entries once they are in a snapshot, and the newest ones of a
+// follower conflicting with the leader
+func TestLogStoreDeleteRange(t *testing.T) {
+	dir := t.TempDir()
+	c := raftlog.Config{}
+	c.Segment.InitialOffset = 1
+	c.Segment.MaxStoreBytes = 256
+	c.Segment.MaxIndexBytes = 256
+	s, err := newLogStore(dir, c)
+	require.NoError(t, err)
+	store := func(from, to uint64, term uint64) {
+		var logs []*raft.Log
+		for i := from; i <= to; i++ {
+			logs = append(logs, &raft.Log{Index: i, Term: term, Data: []byte(fmt.Sprintf("entry-%d", i))})
+		}
+		require.NoError(t, s.StoreLogs(logs))
+	}
+	bounds := func() (uint64, uint64) {
+		first, err := s.FirstIndex()
+		require.NoError(t, err)
+		last, err := s.LastIndex()
+		require.NoError(t, err)
+		return first, last
+	}
+	store(1, 30, 1)
+
+	// exactly the prefix goes, even inside the segment of max
+	require.NoError(t, s.DeleteRange(1, 20))
+	first, last := bounds()
+	require.Equal(t, uint64(21), first)
+	require.Equal(t, uint64(30), last)
+	var out raft.Log
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(1, &out))
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(20, &out))
+	require.NoError(t, s.GetLog(21, &out))
+	require.Equal(t, "entry-21", string(out.Data))
+
+	// the suffix is replaced by the entries of the leader
+	require.NoError(t, s.DeleteRange(25, 30))
+	_, last = bounds()
+	require.Equal(t, uint64(24), last)
+	store(25, 26, 2)
+	require.Error(t, s.DeleteRange(first+1, 24))
+
+	require.NoError(t, s.Close())
+	s, err = newLogStore(dir, c)
+	require.NoError(t, err)
+	first, last = bounds()
+	require.Equal(t, uint64(21), first)
+	require.Equal(t, uint64(26), last)
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(20, &out))
+	require.NoError(t, s.GetLog(26, &out))
+	require.Equal(t, uint64(2), out.Term)
+	require.NoError(t, s.GetLog(24, &out))
+	require.Equal(t, "entry-24", string(out.Data))
+
+	// the whole log, then it goes on past the snapshot of the leader
+	require.NoError(t, s.DeleteRange(first, 26))
+	store(40, 41, 3)
+	first, last = bounds()
+	require.Equal(t, uint64(40), first)
+	require.Equal(t, uint64(41), last)
+	require.NoError(t, s.Close())
+}
+
+// the log stays bounded under the writes, the nodes restart from the snapshot and the rest of the log
+func TestLogCompaction(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	ports := dynaport.Get(3)
+	dataDirs := []string{t.TempDir(), t.TempDir(), t.TempDir()}
+	open := func(i int) *DistributedStorage {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		// the snapshots taken every few writes slow the nodes down, the leader must not
+		// lose the leadership meanwhile
+		config.Raft.HeartbeatTimeout = 500 * time.Millisecond
+		config.Raft.ElectionTimeout = 500 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 250 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		config.Raft.SnapshotThreshold = 100
+		config.Raft.SnapshotInterval = 20 * time.Millisecond
+		config.Raft.TrailingLogs = 20
+		config.Raft.SegmentBytes = 1024
+		l, err := NewDistributedStorage(dataDirs[i], config, 2, 100, &obs)
+		require.NoError(t, err)
+		return l
+	}
+	logSize := func(i int) int64 {
+		var size int64
+		entries, err := os.ReadDir(filepath.Join(dataDirs[i], "raft", "log"))
+		require.NoError(t, err)
+		for _, e := range entries {
+			info, err := e.Info()
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+
+	nodes := []*DistributedStorage{open(0)}
+	require.NoError(t, nodes[0].WaitForLeader(3*time.Second))
+	for i := 1; i < 3; i++ {
+		nodes = append(nodes, open(i))
+		require.NoError(t, nodes[0].Join(fmt.Sprintf("%d", i), fmt.Sprintf("127.0.0.1:%d", ports[i])))
+	}
+
+	value := string(bytes.Repeat([]byte("v"), 200))
+	write := func(from, to int) {
+		for i := from; i < to; i++ {
+			require.NoError(t, nodes[0].Set(ctx, fmt.Sprintf("key-%d", i%50), fmt.Sprintf("%s-%d", value, i), 0))
+			if i%100 == 0 {
+				// about 250 bytes by entry, the log holds at most the threshold and the trailing
+				// entries, and the entries written while the next snapshot is taken
+				require.Less(t, logSize(0), int64(150*1024))
+			}
+		}
+	}
+	write(0, 1000)
+	// the node misses the entries compacted meanwhile
+	require.NoError(t, nodes[2].Close())
+	write(1000, 3000)
+	first, err := nodes[0].log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, first, uint64(1000))
+
+	check := func(l *DistributedStorage) bool {
+		for i := 2950; i < 3000; i++ {
+			v, err := l.Read(ctx, fmt.Sprintf("key-%d", i%50))
+			if err != nil || v != fmt.Sprintf("%s-%d", value, i) {
+				return false
+			}
+		}
+		return true
+	}
+	nodes[2] = open(2)
+	// the leader backs off the replication to the stopped node, up to a few seconds
+	require.Eventually(t, func() bool { return check(nodes[2]) }, 20*time.Second, 50*time.Millisecond)
+	for _, l := range nodes {
+		require.NoError(t, l.Close())
+	}
+
+	for i := range nodes {
+		nodes[i] = open(i)
+	}
+	for _, l := range nodes {
+		require.Eventually(t, func() bool { return check(l) }, 5*time.Second, 50*time.Millisecond)
+	}
+	for _, l := range nodes {
+		require.NoError(t, l.Close())
+	}
+}
+
+// the evicted records are in the snapshot, a node restarting or joining after the log
+// is compacted has them in its tier
+func TestTierAfterCompaction(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	ports := dynaport.Get(2)
+	dataDirs := []string{t.TempDir(), t.TempDir()}
+	open := func(i int) *DistributedStorage {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ports[i]))
+		require.NoError(t, err)
+		config := Config{DiskTierBytes: 1 << 20, SweepInterval: 20 * time.Millisecond}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		config.Raft.TrailingLogs = 1
+		l, err := NewDistributedStorage(dataDirs[i], config, 2, 5, &obs)
+		require.NoError(t, err)
+		return l
+	}
+	check := func(l *DistributedStorage) bool {
+		for i := 0; i < 60; i++ {
+			v, err := l.Get(ctx, fmt.Sprintf("key-%d", i))
+			if err != nil || v != fmt.Sprintf("value-%d", i) {
+				return false
+			}
+		}
+		return true
+	}
+
+	l := open(0)
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+	for i := 0; i < 60; i++ {
+		require.NoError(t, l.Set(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i), 0))
+	}
+	require.Eventually(t, func() bool {
+		return len(allKeys(t, l)) <= 10 && l.tier.Len() >= 50
+	}, 3*time.Second, 10*time.Millisecond)
+	require.NoError(t, l.raft.Snapshot().Error())
+	// the writes are not in the log anymore
+	first, err := l.log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, first, uint64(40))
+
+	nodes := []*DistributedStorage{l, open(1)}
+	require.NoError(t, l.Join("1", fmt.Sprintf("127.0.0.1:%d", ports[1])))
+	require.Eventually(t, func() bool { return check(nodes[1]) }, 5*time.Second, 50*time.Millisecond)
+	require.GreaterOrEqual(t, nodes[1].tier.Len(), 50)
+	for _, l := range nodes {
+		require.NoError(t, l.Close())
+	}
+
+	for i := range nodes {
+		nodes[i] = open(i)
+	}
+	for _, l := range nodes {
+		require.Eventually(t, func() bool { return check(l) }, 5*time.Second, 50*time.Millisecond)
+		require.NoError(t, l.Close())
+	}
 }
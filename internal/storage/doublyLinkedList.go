@@ -1,17 +1,61 @@
 package storage
 
 import (
+	"encoding/json"
 	"errors"
 	"sync"
 )
 
+// the type of the value held by a node, so a zero value is not mistaken for another type
+type valueType uint8
+
+const (
+	stringValue valueType = iota
+	intValue
+	floatValue
+	bytesValue
+	jsonValue
+)
+
 type node struct {
 	prev     *node
 	next     *node
 	key      string
+	typ      valueType
 	val      string
 	valInt   int64
-	valFloat float32
+	valFloat float64
+	valBytes []byte
+	// unix nano deadline of the node, 0 if it never expire
+	expiresAt int64
+	// increases with each write of the key
+	version uint64
+	// kept by the eviction policy, the number of accesses and the list the node is in
+	freq uint32
+	seg  uint8
+	// set once the node left its shard, its buffered reads are skipped
+	removed bool
+}
+
+// bytes held by a node and its entries in the shard map and the index
+const nodeOverhead = 160
+
+// size is the memory accounted for the node in the byte budgets
+func (n *node) size() int64 {
+	size := int64(nodeOverhead + len(n.key))
+	switch n.typ {
+	case intValue, floatValue:
+		size += 8
+	case bytesValue:
+		size += int64(len(n.valBytes))
+	default:
+		size += int64(len(n.val))
+	}
+	return size
+}
+
+func (n *node) isExpired(now int64) bool {
+	return n.expiresAt != 0 && n.expiresAt <= now
 }
 
 func NewNode(key string, val interface{}) (*node, error) {
@@ -21,20 +65,46 @@ func NewNode(key string, val interface{}) (*node, error) {
 		next: nil,
 		key:  key,
 	}
-	// TODO idea: in case we store other types than string using gRPC
-	switch val.(type) {
+	switch v := val.(type) {
 	case string:
-		nd.val = val.(string)
+		nd.val = v
 	case int64:
-		nd.valInt = val.(int64)
+		nd.typ = intValue
+		nd.valInt = v
+	case float64:
+		nd.typ = floatValue
+		nd.valFloat = v
 	case float32:
-		nd.valFloat = val.(float32)
+		nd.typ = floatValue
+		nd.valFloat = float64(v)
+	case []byte:
+		nd.typ = bytesValue
+		nd.valBytes = v
+	case json.RawMessage:
+		nd.typ = jsonValue
+		nd.val = string(v)
 	default:
 		return nil, errors.New("Invalid input type")
 	}
 	return nd, nil
 }
 
+// value returns the go value as it has been set
+func (n *node) value() interface{} {
+	switch n.typ {
+	case intValue:
+		return n.valInt
+	case floatValue:
+		return n.valFloat
+	case bytesValue:
+		return n.valBytes
+	case jsonValue:
+		return json.RawMessage(n.val)
+	default:
+		return n.val
+	}
+}
+
 type dll struct {
 	sync.RWMutex
 	head   *node
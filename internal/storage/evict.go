@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/djedjethai/generation/internal/storage/command"
+)
+
+// max number of victims an evictor hands over per round, if there are more
+// the evictor goes for another round straight away
+const evictBatch = 512
+
+// Evictor receives the victims of the shards over their limits.
+// The victims carry the version they had when chosen
+type Evictor func(ctx context.Context, victims []*command.EvictItem)
+
+// deferEvictions makes the shards signal they are over their limits instead of evicting,
+// with raft the replicas would not choose the same victims as their reads differ.
+// It must be called before the first write
+func (m *ShardedMap) deferEvictions() {
+	m.overflow = make(chan struct{}, 1)
+	for _, shard := range m.shd {
+		shard.overflow = m.overflow
+	}
+}
+
+// Evictions starts the evictor of the deferred evictions, it runs when a shard
+// signals it is over its limits and every interval(for the signals missed by a follower).
+// The victims are chosen only while leads(nil for always) is true, the other replicas
+// evict the ones of the leader. The returned func stops the evictor
+func (m ShardedMap) Evictions(interval time.Duration, leads func() bool, evict Evictor) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-m.overflow:
+			case <-ticker.C:
+			}
+			if leads != nil && !leads() {
+				continue
+			}
+			for {
+				victims := m.victims(evictBatch)
+				if len(victims) > 0 {
+					evict(context.Background(), victims)
+				}
+				if len(victims) < evictBatch {
+					break
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// victims returns up to n nodes the policies would evict to bring the shards within their limits
+func (m ShardedMap) victims(n int) []*command.EvictItem {
+	var victims []*command.EvictItem
+	for _, shard := range m.shd {
+		victims = append(victims, shard.victims(n-len(victims))...)
+		if len(victims) == n {
+			break
+		}
+	}
+	return victims
+}
+
+func (s *Shard) victims(n int) []*command.EvictItem {
+	// the pending reads change the order of the policy
+	s.Lock()
+	defer s.Unlock()
+	s.flushReads()
+
+	var victims []*command.EvictItem
+	items, bytes := len(s.m), s.bytes
+	s.policy.walk(func(nd *node) bool {
+		if len(victims) == n || !s.over(items, bytes) {
+			return false
+		}
+		victims = append(victims, &command.EvictItem{Key: nd.key, Version: nd.version})
+		items--
+		bytes -= nd.size()
+		return true
+	})
+	return victims
+}
+
+// evict removes the victims which have not been written since they were chosen
+func (m ShardedMap) evict(ctx context.Context, victims []*command.EvictItem, index uint64) {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageEvict")
+	defer teardown()
+
+	for _, v := range victims {
+		shard := m.getShard(v.Key)
+
+		shard.Lock()
+		if nd, ok := shard.m[v.Key]; ok && nd.version == v.Version {
+			shard.policy.evicted(nd)
+			shard.forget(nd, index)
+		}
+		shard.Unlock()
+	}
+}
@@ -1,24 +1,54 @@
 package storage
 
 import (
-	"fmt"
-	"strconv"
-	"unicode/utf8"
+	"errors"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/djedjethai/generation/partition"
 )
 
-func calculeIndex(key string, arrLength int) int {
-	if len(key) > 100 {
-		key = key[0:100]
-	}
+// the hashes placing the keys on the shards
+const (
+	HashFNV    = "fnv"
+	HashXXHash = "xxhash"
+)
+
+var ErrorUnknownHash = errors.New("unknown hash, fnv or xxhash")
 
-	var total int
-	const WEIRD_PRIME = 31
-	for len(key) > 0 {
-		r, size := utf8.DecodeRuneInString(key)
-		rInt, _ := strconv.Atoi(fmt.Sprintf("%d", r))
-		total = (total*WEIRD_PRIME + rInt) % arrLength
-		key = key[size:]
+type hashFunc func(key string) uint32
+
+func newHash(name string) (hashFunc, error) {
+	switch name {
+	case "", HashFNV:
+		return hashKey, nil
+	case HashXXHash:
+		return xxHash, nil
+	default:
+		return nil, ErrorUnknownHash
 	}
+}
+
+// placement places the keys on the shards, the range of the hash is cut in n equal parts.
+// The shards are filled again at each start, so unlike the partitions they need no consistent hashing
+type placement struct {
+	hash hashFunc
+	n    uint64
+}
+
+func newPlacement(n int, hash hashFunc) *placement {
+	return &placement{hash: hash, n: uint64(n)}
+}
+
+func (p *placement) locate(key string) int {
+	return int(uint64(p.hash(key)) * p.n >> 32)
+}
+
+// hashKey is the hash of the partitions(see partition.Hash), fnv-1a with the finalizer of murmur3
+func hashKey(key string) uint32 {
+	return partition.Hash(key)
+}
 
-	return total
+func xxHash(key string) uint32 {
+	h := xxhash.Sum64String(key)
+	return uint32(h ^ h>>32)
 }
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlacement(t *testing.T) {
+	for _, name := range []string{HashFNV, HashXXHash} {
+		t.Run(name, func(t *testing.T) {
+			hash, err := newHash(name)
+			require.NoError(t, err)
+			p := newPlacement(7, hash)
+
+			const keys = 70000
+			counts := make([]int, 7)
+			for i := 0; i < keys; i++ {
+				// the keys only differ after their first 100 characters
+				counts[p.locate(strings.Repeat("k", 100)+fmt.Sprintf("%d", i))]++
+			}
+			for s, n := range counts {
+				require.InDelta(t, keys/7, n, keys/7*0.05, fmt.Sprintf("shard %d", s))
+			}
+		})
+	}
+
+	_, err := newHash("md5")
+	require.Equal(t, ErrorUnknownHash, err)
+}
+
+// the key patterns of the benchmarks, the long keys share their first 100 characters
+var keyPatterns = map[string]func(i int) string{
+	"counter":   func(i int) string { return fmt.Sprintf("%d", i) },
+	"user":      func(i int) string { return fmt.Sprintf("user:%d:profile", i) },
+	"session":   func(i int) string { return fmt.Sprintf("session-%016x", i*7919) },
+	"timestamp": func(i int) string { return fmt.Sprintf("event/2023-01-02T15:04:%02d.%06d", i%60, i) },
+	"long":      func(i int) string { return strings.Repeat("p", 100) + fmt.Sprintf("/%d", i) },
+}
+
+func BenchmarkHash(b *testing.B) {
+	for _, name := range []string{HashFNV, HashXXHash} {
+		hash, _ := newHash(name)
+		for pattern, key := range keyPatterns {
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = key(i)
+			}
+			b.Run(name+"/"+pattern, func(b *testing.B) {
+				b.ReportAllocs()
+				var sink uint32
+				for i := 0; i < b.N; i++ {
+					sink += hash(keys[i%len(keys)])
+				}
+				_ = sink
+			})
+		}
+	}
+}
+
+// BenchmarkShardDistribution reports how even the shards are, max/mean is 1 for perfectly
+// even shards, and the time to locate the shard of a key
+func BenchmarkShardDistribution(b *testing.B) {
+	const shards, n = 16, 100000
+	for _, name := range []string{HashFNV, HashXXHash} {
+		hash, _ := newHash(name)
+		p := newPlacement(shards, hash)
+		for pattern, key := range keyPatterns {
+			keys := make([]string, n)
+			for i := range keys {
+				keys[i] = key(i)
+			}
+			b.Run(name+"/"+pattern, func(b *testing.B) {
+				counts := make([]int, shards)
+				for _, key := range keys {
+					counts[p.locate(key)]++
+				}
+				max, min := 0, n
+				for _, c := range counts {
+					if c > max {
+						max = c
+					}
+					if c < min {
+						min = c
+					}
+				}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					p.locate(keys[i%n])
+				}
+				b.ReportMetric(float64(max)/float64(n/shards), "max/mean")
+				b.ReportMetric(float64(min)/float64(n/shards), "min/mean")
+			})
+		}
+	}
+}
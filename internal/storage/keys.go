@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/djedjethai/generation/internal/models"
+)
+
+// KeysPage reads the shards one after the other, the keys of a shard are sorted
+// so the cursor(shard, last key) stays valid while keys are added or removed
+func (m ShardedMap) KeysPage(ctx context.Context, cursor models.KeysCursor, limit int, match func(string) bool) ([]string, models.KeysCursor, bool, error) {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageKeysPage")
+	defer teardown()
+
+	now := time.Now().UnixNano()
+
+	var keys []string
+	after := cursor.After
+	for i := cursor.Shard; i >= 0 && i < len(m.shd); i++ {
+		if len(keys) == limit {
+			return keys, models.KeysCursor{Shard: i}, false, nil
+		}
+
+		shardKeys := m.shd[i].keysAfter(after, match, now)
+		sort.Strings(shardKeys)
+
+		if left := limit - len(keys); len(shardKeys) > left {
+			keys = append(keys, shardKeys[:left]...)
+			return keys, models.KeysCursor{Shard: i, After: shardKeys[left-1]}, false, nil
+		}
+		keys = append(keys, shardKeys...)
+		after = ""
+	}
+
+	return keys, models.KeysCursor{Shard: len(m.shd)}, true, nil
+}
+
+func (m ShardedMap) CountKeys(ctx context.Context, match func(string) bool) (int, error) {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageCountKeys")
+	defer teardown()
+
+	now := time.Now().UnixNano()
+
+	var count int
+	for _, s := range m.shd {
+		s.RLock()
+		for key, nd := range s.m {
+			if !nd.isExpired(now) && (match == nil || match(key)) {
+				count++
+			}
+		}
+		s.RUnlock()
+	}
+	return count, nil
+}
+
+// the live keys greater than after, which match
+func (s *Shard) keysAfter(after string, match func(string) bool, now int64) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	var keys []string
+	for key, nd := range s.m {
+		if key <= after || nd.isExpired(now) {
+			continue
+		}
+		if match == nil || match(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
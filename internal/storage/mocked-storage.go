@@ -5,6 +5,7 @@ import (
 	"errors"
 	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/models"
+	"time"
 )
 
 type mShardedMap struct {
@@ -17,7 +18,7 @@ func NewMockedShardedMap(nShard, maxLgt int) mShardedMap {
 	return mShardedMap{shards}
 }
 
-func (ms mShardedMap) Set(ctx context.Context, key string, value interface{}) error {
+func (ms mShardedMap) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
 	if key == "error" {
 		return errors.New("an errr...")
 	}
@@ -31,6 +32,50 @@ func (ms mShardedMap) Get(ctx context.Context, key string) (interface{}, error)
 	return nil, errors.New("an error")
 }
 
+func (ms mShardedMap) SetIf(ctx context.Context, key string, value interface{}, ttl time.Duration, pre *api.Precondition) (uint64, error) {
+	if key == "error" {
+		return 0, errors.New("an errr...")
+	}
+	if pre != nil && pre.IfAbsent {
+		return 0, ErrorPreconditionFailed
+	}
+	return 1, nil
+}
+
+func (ms mShardedMap) GetWithVersion(ctx context.Context, key string) (interface{}, uint64, error) {
+	if key == "key" {
+		return "value", 1, nil
+	}
+	return nil, 0, errors.New("an error")
+}
+
+func (ms mShardedMap) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	if key == "error" {
+		return 0, errors.New("an errr...")
+	}
+	return delta, nil
+}
+
+func (ms mShardedMap) Txn(ctx context.Context, req *api.TxnRequest) (*api.TxnResponse, error) {
+	return &api.TxnResponse{Succeeded: len(req.Compares) == 0}, nil
+}
+
+func (ms mShardedMap) Batch(ctx context.Context, b *api.WriteBatch) ([]models.BatchResult, error) {
+	var results []models.BatchResult
+	for _, p := range b.Puts {
+		results = append(results, models.BatchResult{Key: p.GetRecords().GetKey(), Version: 1})
+	}
+	for _, d := range b.Deletes {
+		results = append(results, models.BatchResult{Key: d.Key})
+	}
+	return results, nil
+}
+
+func (ms mShardedMap) Watch(ctx context.Context, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+	ch := make(chan *api.WatchEvent)
+	return ch, func() { close(ch) }, nil
+}
+
 func (ms mShardedMap) Delete(ctx context.Context, key string, shard *Shard) error {
 	if key == "err" {
 		return errors.New("an err")
@@ -38,17 +83,39 @@ func (ms mShardedMap) Delete(ctx context.Context, key string, shard *Shard) erro
 	return nil
 }
 
-func (ms mShardedMap) Keys(ctx context.Context) []string {
+func (ms mShardedMap) DeleteIf(ctx context.Context, key string, pre *api.Precondition) error {
+	if key == "err" {
+		return errors.New("an err")
+	}
+	if pre != nil && pre.IfPresent {
+		return ErrorPreconditionFailed
+	}
+	return nil
+}
+
+func (ms mShardedMap) Keys(ctx context.Context) ([]string, error) {
 	var str []string
 
-	return str
+	return str, nil
+}
+
+func (ms mShardedMap) KeysPage(ctx context.Context, cursor models.KeysCursor, limit int, match func(string) bool) ([]string, models.KeysCursor, bool, error) {
+	return []string{"key1", "key2"}, models.KeysCursor{Shard: 1}, true, nil
+}
+
+func (ms mShardedMap) CountKeys(ctx context.Context, match func(string) bool) (int, error) {
+	return 2, nil
+}
+
+func (ms mShardedMap) Scan(ctx context.Context, start, end string, limit int) ([]models.KeysValues, error) {
+	return []models.KeysValues{{Key: "key1", Value: "value1", Version: 1}}, nil
 }
 
 func (ms mShardedMap) KeysValues(ctx context.Context, kv chan models.KeysValues) error {
 
-	kv <- models.KeysValues{"key1", "value1"}
-	kv <- models.KeysValues{"key2", "value2"}
-	kv <- models.KeysValues{"key3", "value3"}
+	kv <- models.KeysValues{Key: "key1", Value: "value1"}
+	kv <- models.KeysValues{Key: "key2", Value: "value2"}
+	kv <- models.KeysValues{Key: "key3", Value: "value3"}
 
 	close(kv)
 
@@ -0,0 +1,831 @@
+package storage
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/models"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/partition"
+	"github.com/hashicorp/raft"
+)
+
+// the partition travels as a single byte after the raft rpc one
+const MaxPartitions = 256
+
+var (
+	ErrorCrossPartition = fmt.Errorf("%w: the keys are in different partitions", ErrorInvalidTxn)
+	ErrorPartitionCount = errors.New("the data dir has another number of partitions")
+	errStreamClosed     = errors.New("stream layer closed")
+)
+
+// PartitionedStorage splits the keys between raft groups(the partitions), placed
+// by a consistent hash ring. A group has Replicas of the nodes as voters(see placement),
+// the leaders of the groups, and so the writes, spread over the nodes. The reads of a
+// partition the node does not serve are sent to its leader with the remote
+type PartitionedStorage struct {
+	partitions []*DistributedStorage
+	ring       *partition.Ring
+	nShard     int
+	rebalancer *rebalancer
+	remote     Remote
+}
+
+// the services assert the interfaces, a missing one would serve the node as standalone
+var (
+	_ StorageRepo = (*PartitionedStorage)(nil)
+	_ Replicated  = (*PartitionedStorage)(nil)
+	_ Snapshotter = (*PartitionedStorage)(nil)
+	_ Admin       = (*PartitionedStorage)(nil)
+)
+
+// NewPartitionedStorage starts a raft group per stream layer(see NewStreamLayers).
+// The partition 0 keeps its data in dataDir, like a DistributedStorage, and the
+// others have their directory in dataDir. The ring places the keys by the number
+// of partitions, so a node does not start with another number than the one of its data
+func NewPartitionedStorage(dataDir string, conf Config, layers []*StreamLayer, nShard, maxLgt int, observ *observability.Observability) (*PartitionedStorage, error) {
+	if len(layers) < 1 || len(layers) > MaxPartitions {
+		return nil, fmt.Errorf("from 1 to %d partitions", MaxPartitions)
+	}
+	p := &PartitionedStorage{
+		ring:   partition.NewRing(len(layers)),
+		nShard: nShard,
+	}
+	// the servers catching up on the partitions share the bandwidth
+	conf.Rebalance.throttle = newThrottle(conf.Rebalance.BytesPerSecond)
+	conf, maxLgt = splitBudgets(conf, maxLgt, len(layers))
+	if err := checkPartitions(dataDir, len(layers)); err != nil {
+		return nil, err
+	}
+	for i, layer := range layers {
+		c := conf
+		c.partition = i
+		dir := dataDir
+		if i > 0 {
+			c.Snapshots.partition = fmt.Sprintf("partition-%d", i)
+			dir = filepath.Join(dataDir, c.Snapshots.partition)
+		}
+		c.Raft.StreamLayer = layer
+		ds, err := NewDistributedStorage(dir, c, nShard, maxLgt, observ)
+		if err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		p.partitions = append(p.partitions, ds)
+	}
+	p.rebalancer = newRebalancer(p.partitions, conf.Rebalance)
+	return p, nil
+}
+
+// checkPartitions records the number of partitions of the data dir, the data of
+// a single partition, before it was recorded, is the partition 0
+func checkPartitions(dataDir string, n int) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	file := filepath.Join(dataDir, "partitions")
+	recorded := n
+	b, err := ioutil.ReadFile(file)
+	switch {
+	case err == nil:
+		if recorded, err = strconv.Atoi(strings.TrimSpace(string(b))); err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+	case os.IsNotExist(err):
+		if _, err := os.Stat(filepath.Join(dataDir, "raft")); err == nil {
+			recorded = 1
+		}
+	default:
+		return err
+	}
+	if recorded != n {
+		return fmt.Errorf("%w: %d partitions in %s", ErrorPartitionCount, recorded, dataDir)
+	}
+	return ioutil.WriteFile(file, []byte(strconv.Itoa(n)), 0644)
+}
+
+// the budgets of the node are split between its n partitions, the per shard
+// byte limit bounds the shards of every partition
+func splitBudgets(conf Config, maxLgt, n int) (Config, int) {
+	conf.Eviction.MaxBytes /= int64(n)
+	conf.DiskTierBytes /= uint64(n)
+	if maxLgt > 0 {
+		maxLgt = (maxLgt + n - 1) / n
+	}
+	return conf, maxLgt
+}
+
+// SetRemote reads the partitions the node does not serve with r, it is called
+// before the node serves any read. Without remote the reads are all served locally
+func (p *PartitionedStorage) SetRemote(r Remote) {
+	p.remote = r
+}
+
+// PartitionOf returns the partition of the key
+func (p *PartitionedStorage) PartitionOf(key string) int {
+	return p.ring.Locate(key)
+}
+
+// reader returns the partition i if the node serves its reads at the consistency of ctx,
+// otherwise the address of its leader to read it with the remote. A read restricted
+// to the partition(see WithPartition) is not sent on
+func (p *PartitionedStorage) reader(ctx context.Context, i int) (*DistributedStorage, string, error) {
+	if i < 0 || i >= len(p.partitions) {
+		return nil, "", ErrorNoSuchPartition
+	}
+	ds := p.partitions[i]
+	if p.remote == nil || ds.serves(ConsistencyOf(ctx)) {
+		return ds, "", nil
+	}
+	if _, ok := PartitionFrom(ctx); ok {
+		return nil, "", raft.ErrNotLeader
+	}
+	_, addr := p.leaderOf(i, p.rebalancer.copyMembers())
+	if addr == "" || addr == ds.config.Raft.BindAddr {
+		return nil, "", raft.ErrNotLeader
+	}
+	return nil, addr, nil
+}
+
+// leaderOf returns the leader of the partition i, the target of its placement
+// while the node is not in the group and knows no leader
+func (p *PartitionedStorage) leaderOf(i int, members map[string]string) (string, string) {
+	ds := p.partitions[i]
+	id, addr := ds.leader()
+	if addr == "" && !ds.replica.Load() {
+		target := p.rebalancer.placement(i, members)[0]
+		return string(target.ID), string(target.Address)
+	}
+	return id, addr
+}
+
+// scope returns the first and the last partitions of the reads of ctx
+func (p *PartitionedStorage) scope(ctx context.Context) (int, int) {
+	if i, ok := PartitionFrom(ctx); ok {
+		return i, i
+	}
+	return 0, len(p.partitions) - 1
+}
+
+func (p *PartitionedStorage) partition(key string) *DistributedStorage {
+	return p.partitions[p.ring.Locate(key)]
+}
+
+func (p *PartitionedStorage) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	return p.partition(key).Set(ctx, key, value, ttl)
+}
+
+func (p *PartitionedStorage) SetIf(ctx context.Context, key string, value interface{}, ttl time.Duration, pre *api.Precondition) (uint64, error) {
+	return p.partition(key).SetIf(ctx, key, value, ttl, pre)
+}
+
+func (p *PartitionedStorage) Get(ctx context.Context, key string) (interface{}, error) {
+	i := p.ring.Locate(key)
+	ds, addr, err := p.reader(ctx, i)
+	if err != nil {
+		return nil, err
+	}
+	if ds == nil {
+		value, _, err := p.remote.GetWithVersion(ctx, addr, i, key)
+		return value, err
+	}
+	return ds.Get(ctx, key)
+}
+
+func (p *PartitionedStorage) GetWithVersion(ctx context.Context, key string) (interface{}, uint64, error) {
+	i := p.ring.Locate(key)
+	ds, addr, err := p.reader(ctx, i)
+	if err != nil {
+		return nil, 0, err
+	}
+	if ds == nil {
+		return p.remote.GetWithVersion(ctx, addr, i, key)
+	}
+	return ds.GetWithVersion(ctx, key)
+}
+
+func (p *PartitionedStorage) Delete(ctx context.Context, key string, sh *Shard) error {
+	return p.partition(key).Delete(ctx, key, sh)
+}
+
+func (p *PartitionedStorage) DeleteIf(ctx context.Context, key string, pre *api.Precondition) error {
+	return p.partition(key).DeleteIf(ctx, key, pre)
+}
+
+func (p *PartitionedStorage) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	return p.partition(key).Incr(ctx, key, delta)
+}
+
+// a transaction is a single entry of a single group, its keys must be in the same partition
+func (p *PartitionedStorage) Txn(ctx context.Context, req *api.TxnRequest) (*api.TxnResponse, error) {
+	keys := txnKeys(req)
+	if len(keys) == 0 {
+		return nil, ErrorInvalidTxn
+	}
+	i := p.ring.Locate(keys[0])
+	for _, key := range keys[1:] {
+		if p.ring.Locate(key) != i {
+			return nil, ErrorCrossPartition
+		}
+	}
+	return p.partitions[i].Txn(ctx, req)
+}
+
+// Batch applies the items of each partition with its group, the results keep the order
+// of the batch. An error of a group(not its leader) becomes the result of its items,
+// unless all the items are in the same partition
+func (p *PartitionedStorage) Batch(ctx context.Context, b *api.WriteBatch) ([]models.BatchResult, error) {
+	chunks := make(map[int]*api.WriteBatch)
+	// the position of each item in the results
+	positions := make(map[int][]int)
+	chunk := func(key string) int {
+		i := p.ring.Locate(key)
+		if _, ok := chunks[i]; !ok {
+			chunks[i] = &api.WriteBatch{}
+		}
+		return i
+	}
+	for j, put := range b.Puts {
+		i := chunk(put.GetRecords().GetKey())
+		chunks[i].Puts = append(chunks[i].Puts, put)
+		positions[i] = append(positions[i], j)
+	}
+	for j, del := range b.Deletes {
+		i := chunk(del.Key)
+		chunks[i].Deletes = append(chunks[i].Deletes, del)
+		positions[i] = append(positions[i], len(b.Puts)+j)
+	}
+
+	if len(chunks) == 1 {
+		for i, c := range chunks {
+			return p.partitions[i].Batch(ctx, c)
+		}
+	}
+
+	results := make([]models.BatchResult, len(b.Puts)+len(b.Deletes))
+	for i, c := range chunks {
+		res, err := p.partitions[i].Batch(ctx, c)
+		for k, j := range positions[i] {
+			if err != nil {
+				results[j] = models.BatchResult{Key: batchKey(c, k), Err: err}
+				continue
+			}
+			results[j] = res[k]
+		}
+	}
+	return results, nil
+}
+
+// the key of the kth item of the batch, the puts then the deletes
+func batchKey(b *api.WriteBatch, k int) string {
+	if k < len(b.Puts) {
+		return b.Puts[k].GetRecords().GetKey()
+	}
+	return b.Deletes[k-len(b.Puts)].Key
+}
+
+// Watch merges the events of the partitions, the indexes of the events are the ones
+// of their group, a startIndex is only meaningful with a single key
+// Watch of a prefix merges the events of the partitions, each one resumes from its start
+// index(see WithStartIndexes) as the partitions number their own indexes
+func (p *PartitionedStorage) Watch(ctx context.Context, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+	first, last := p.scope(ctx)
+	if !prefix {
+		first = p.ring.Locate(key)
+		last = first
+	}
+	if first == last {
+		return p.watch(ctx, first, key, prefix, startIndexOf(ctx, first, startIndex))
+	}
+
+	var cancels []func()
+	var chs []<-chan *api.WatchEvent
+	cancelAll := func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+	for i := first; i <= last; i++ {
+		ch, cancel, err := p.watch(ctx, i, key, prefix, startIndexOf(ctx, i, startIndex))
+		if err != nil {
+			cancelAll()
+			return nil, nil, err
+		}
+		chs = append(chs, ch)
+		cancels = append(cancels, cancel)
+	}
+
+	out := make(chan *api.WatchEvent, watchBuffer)
+	done := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(done)
+			cancelAll()
+		})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(chs))
+	for _, ch := range chs {
+		go func(ch <-chan *api.WatchEvent) {
+			defer wg.Done()
+			// a partition closing its watcher(late or stopped) ends the merged watch
+			defer stop()
+			for ev := range ch {
+				select {
+				case out <- ev:
+				case <-done:
+					return
+				}
+			}
+		}(ch)
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, stop, nil
+}
+
+func (p *PartitionedStorage) watch(ctx context.Context, i int, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+	ds, addr, err := p.reader(ctx, i)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ds == nil {
+		return p.remote.Watch(ctx, addr, i, key, prefix, startIndex)
+	}
+	return ds.Watch(ctx, key, prefix, startIndex)
+}
+
+func (p *PartitionedStorage) Keys(ctx context.Context) ([]string, error) {
+	var keys []string
+	first, last := p.scope(ctx)
+	for i := first; i <= last; i++ {
+		page, _, _, err := p.keysPage(ctx, i, models.KeysCursor{}, math.MaxInt, nil)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, page...)
+	}
+	return keys, nil
+}
+
+// the shard of the cursor counts the shards of the partitions before its own
+func (p *PartitionedStorage) KeysPage(ctx context.Context, cursor models.KeysCursor, limit int, match func(string) bool) ([]string, models.KeysCursor, bool, error) {
+	var keys []string
+	first, last := p.scope(ctx)
+	for i := cursor.Shard / p.nShard; i <= last; i++ {
+		if i < first {
+			continue
+		}
+		local := models.KeysCursor{}
+		if i == cursor.Shard/p.nShard {
+			local = models.KeysCursor{Shard: cursor.Shard % p.nShard, After: cursor.After}
+		}
+		page, next, done, err := p.keysPage(ctx, i, local, limit-len(keys), match)
+		if err != nil {
+			return nil, models.KeysCursor{}, false, err
+		}
+		keys = append(keys, page...)
+		if !done {
+			next.Shard += i * p.nShard
+			return keys, next, false, nil
+		}
+		if len(keys) == limit && i < last {
+			return keys, models.KeysCursor{Shard: (i + 1) * p.nShard}, false, nil
+		}
+	}
+	return keys, models.KeysCursor{}, true, nil
+}
+
+// keysPage reads a page of the keys of the partition i, the cursor is the one of the partition.
+// The keys read from the leader are filtered on the node, the match can not be sent
+func (p *PartitionedStorage) keysPage(ctx context.Context, i int, cursor models.KeysCursor, limit int, match func(string) bool) ([]string, models.KeysCursor, bool, error) {
+	ds, addr, err := p.reader(ctx, i)
+	if err != nil {
+		return nil, models.KeysCursor{}, false, err
+	}
+	if ds != nil {
+		return ds.KeysPage(ctx, cursor, limit, match)
+	}
+
+	var keys []string
+	cursor.Shard += i * p.nShard
+	for len(keys) < limit {
+		page, next, done, err := p.remote.KeysPage(ctx, addr, i, cursor, limit-len(keys))
+		if err != nil {
+			return nil, models.KeysCursor{}, false, err
+		}
+		for _, key := range page {
+			if match == nil || match(key) {
+				keys = append(keys, key)
+			}
+		}
+		if done {
+			return keys, models.KeysCursor{}, true, nil
+		}
+		cursor = next
+	}
+	cursor.Shard -= i * p.nShard
+	return keys, cursor, false, nil
+}
+
+func (p *PartitionedStorage) CountKeys(ctx context.Context, match func(string) bool) (int, error) {
+	var n int
+	first, last := p.scope(ctx)
+	for i := first; i <= last; i++ {
+		ds, _, err := p.reader(ctx, i)
+		if err != nil {
+			return 0, err
+		}
+		if ds != nil {
+			count, err := ds.CountKeys(ctx, match)
+			if err != nil {
+				return 0, err
+			}
+			n += count
+			continue
+		}
+		keys, _, _, err := p.keysPage(ctx, i, models.KeysCursor{}, math.MaxInt, match)
+		if err != nil {
+			return 0, err
+		}
+		n += len(keys)
+	}
+	return n, nil
+}
+
+// Scan merges the records of the partitions in the keys order
+func (p *PartitionedStorage) Scan(ctx context.Context, start, end string, limit int) ([]models.KeysValues, error) {
+	var records []models.KeysValues
+	first, last := p.scope(ctx)
+	for i := first; i <= last; i++ {
+		ds, addr, err := p.reader(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		var r []models.KeysValues
+		if ds != nil {
+			r, err = ds.Scan(ctx, start, end, limit)
+		} else {
+			r, err = p.remote.Scan(ctx, addr, i, start, end, limit)
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r...)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records, nil
+}
+
+// the channel is closed once all the partitions are read
+func (p *PartitionedStorage) KeysValues(ctx context.Context, ch chan models.KeysValues) error {
+	defer close(ch)
+	first, last := p.scope(ctx)
+	for i := first; i <= last; i++ {
+		ds, addr, err := p.reader(ctx, i)
+		if err != nil {
+			return err
+		}
+		part := make(chan models.KeysValues)
+		errc := make(chan error, 1)
+		go func(i int) {
+			if ds != nil {
+				errc <- ds.KeysValues(ctx, part)
+				return
+			}
+			errc <- p.remote.KeysValues(ctx, addr, i, part)
+		}(i)
+		for kv := range part {
+			select {
+			case ch <- kv:
+			case <-ctx.Done():
+				// the partition stops on ctx too
+				for range part {
+				}
+				<-errc
+				return ctx.Err()
+			}
+		}
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Servers returns the servers of the groups the node knows, a server leading
+// one of them is a leader
+func (p *PartitionedStorage) Servers(ctx context.Context) ([]*api.Server, error) {
+	var servers []*api.Server
+	seen := make(map[string]*api.Server)
+	for _, ds := range p.partitions {
+		part, err := ds.Servers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range part {
+			if known, ok := seen[srv.Id]; ok {
+				known.IsLeader = known.IsLeader || srv.IsLeader
+				continue
+			}
+			seen[srv.Id] = srv
+			servers = append(servers, srv)
+		}
+	}
+	return servers, nil
+}
+
+// Partitions returns the leader and the voters of each partition, the ones of its placement
+// for a partition the node is not a voter of
+func (p *PartitionedStorage) Partitions(ctx context.Context) ([]*api.Partition, error) {
+	members := p.rebalancer.copyMembers()
+	partitions := make([]*api.Partition, 0, len(p.partitions))
+	for i, ds := range p.partitions {
+		part := &api.Partition{Id: uint32(i)}
+		part.LeaderId, part.LeaderAddr = p.leaderOf(i, members)
+
+		servers := p.rebalancer.placement(i, members)
+		if ds.replica.Load() {
+			if config, err := ds.configuration(); err == nil {
+				servers = servers[:0]
+				for _, srv := range config {
+					if srv.Suffrage == raft.Voter {
+						servers = append(servers, srv)
+					}
+				}
+			}
+		}
+		for _, srv := range servers {
+			part.Servers = append(part.Servers, &api.Server{
+				Id:       string(srv.ID),
+				RpcAddr:  string(srv.Address),
+				IsLeader: string(srv.Address) == part.LeaderAddr,
+			})
+		}
+		partitions = append(partitions, part)
+	}
+	return partitions, nil
+}
+
+// Consistent checks the partitions of the keys, all of them without keys, the node serves
+// at the consistency. The others are read from their leader, unless ctx is restricted
+// to a partition(see WithPartition)
+func (p *PartitionedStorage) Consistent(ctx context.Context, c api.Consistency, keys ...string) error {
+	_, restricted := PartitionFrom(ctx)
+	check := func(i int) error {
+		if i < 0 || i >= len(p.partitions) {
+			return ErrorNoSuchPartition
+		}
+		ds := p.partitions[i]
+		if !restricted && p.remote != nil && !ds.serves(c) {
+			return nil
+		}
+		return ds.Consistent(ctx, c)
+	}
+
+	if len(keys) == 0 {
+		first, last := p.scope(ctx)
+		for i := first; i <= last; i++ {
+			if err := check(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	seen := make(map[int]bool)
+	for _, key := range keys {
+		i := p.ring.Locate(key)
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		if err := check(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PartitionedStorage) AppliedIndexes(keys ...string) map[int]uint64 {
+	indexes := make(map[int]uint64)
+	if len(keys) == 0 {
+		for i, ds := range p.partitions {
+			indexes[i] = ds.AppliedIndex()
+		}
+		return indexes
+	}
+	for _, key := range keys {
+		i := p.ring.Locate(key)
+		indexes[i] = p.partitions[i].AppliedIndex()
+	}
+	return indexes
+}
+
+func (p *PartitionedStorage) CacheStats() CacheStats {
+	var cs CacheStats
+	for _, ds := range p.partitions {
+		s := ds.CacheStats()
+		cs.Policy = s.Policy
+		cs.Hits += s.Hits
+		cs.Misses += s.Misses
+		cs.Evictions += s.Evictions
+		cs.Items += s.Items
+		cs.Bytes += s.Bytes
+	}
+	return cs
+}
+
+func (p *PartitionedStorage) StopWatches() {
+	for _, ds := range p.partitions {
+		ds.StopWatches()
+	}
+}
+
+// Join hands the server over to the rebalancer, it catches up on the groups the node leads
+// before voting. The leaders of the other groups add it on their side
+func (p *PartitionedStorage) Join(id, addr string) error {
+	p.rebalancer.join(id, addr)
+	return nil
+}
+
+// Rebalance returns the moves of the partitions the node leads
+func (p *PartitionedStorage) Rebalance(ctx context.Context) (*api.RebalanceStatus, error) {
+	return p.rebalancer.status(), nil
+}
+
+// CreateSnapshot persists the fsm of each partition on the node
+func (p *PartitionedStorage) CreateSnapshot(ctx context.Context) ([]*api.SnapshotInfo, error) {
+	snapshots := make([]*api.SnapshotInfo, 0, len(p.partitions))
+	for i, ds := range p.partitions {
+		info, err := ds.createSnapshot(i)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, info)
+	}
+	return snapshots, nil
+}
+
+// ListSnapshots returns the snapshots of the partitions, by partition
+func (p *PartitionedStorage) ListSnapshots(ctx context.Context) ([]*api.SnapshotInfo, error) {
+	var snapshots []*api.SnapshotInfo
+	for i, ds := range p.partitions {
+		s, err := ds.listSnapshots(i)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s...)
+	}
+	return snapshots, nil
+}
+
+func (p *PartitionedStorage) OpenSnapshot(ctx context.Context, partition int, id string) (*api.SnapshotInfo, io.ReadCloser, error) {
+	if partition < 0 || partition >= len(p.partitions) {
+		return nil, nil, ErrorNoSuchPartition
+	}
+	return p.partitions[partition].openSnapshot(partition, id)
+}
+
+// RestoreSnapshot restores the partition, the keys of the snapshot must be placed on it,
+// so the snapshot is one of a cluster with the same number of partitions
+func (p *PartitionedStorage) RestoreSnapshot(ctx context.Context, partition int, r io.Reader) (*api.SnapshotInfo, error) {
+	if partition < 0 || partition >= len(p.partitions) {
+		return nil, ErrorNoSuchPartition
+	}
+	return p.partitions[partition].restoreSnapshot(partition, r, func(key string) bool {
+		return p.ring.Locate(key) == partition
+	})
+}
+
+func (p *PartitionedStorage) Leave(id string) error {
+	p.rebalancer.leave(id)
+	for _, ds := range p.partitions {
+		if err := ds.Leave(id); err != nil && err != raft.ErrNotLeader {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PartitionedStorage) WaitForLeader(timeout time.Duration) error {
+	for _, ds := range p.partitions {
+		if err := ds.WaitForLeader(timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *PartitionedStorage) Close() error {
+	if p.rebalancer != nil {
+		p.rebalancer.close()
+	}
+	for _, ds := range p.partitions {
+		if err := ds.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewStreamLayers shares ln between the raft groups of n partitions, each connection
+// carries its partition after the raft rpc byte. A single partition uses a plain StreamLayer
+func NewStreamLayers(ln net.Listener, n int, serverTLSConfig *tls.Config, peerTLSConfig *tls.Config) []*StreamLayer {
+	if n <= 1 {
+		return []*StreamLayer{NewStreamLayer(ln, serverTLSConfig, peerTLSConfig)}
+	}
+	d := &streamDemux{
+		ln:    ln,
+		conns: make([]chan net.Conn, n),
+		done:  make(chan struct{}),
+	}
+	layers := make([]*StreamLayer, n)
+	for i := range layers {
+		d.conns[i] = make(chan net.Conn)
+		layers[i] = NewStreamLayer(ln, serverTLSConfig, peerTLSConfig)
+		layers[i].demux = d
+		layers[i].partition = i
+	}
+	go d.serve()
+	return layers
+}
+
+// max time a connection has to tell its partition
+const demuxTimeout = 10 * time.Second
+
+// streamDemux accepts the raft connections and hands each over to its partition
+type streamDemux struct {
+	ln    net.Listener
+	conns []chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (d *streamDemux) serve() {
+	for {
+		conn, err := d.ln.Accept()
+		if err != nil {
+			_ = d.close()
+			return
+		}
+		go d.route(conn)
+	}
+}
+
+func (d *streamDemux) route(conn net.Conn) {
+	header := make([]byte, 2)
+	_ = conn.SetReadDeadline(time.Now().Add(demuxTimeout))
+	if _, err := io.ReadFull(conn, header); err != nil ||
+		header[0] != byte(RaftRPC) || int(header[1]) >= len(d.conns) {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	select {
+	case d.conns[header[1]] <- conn:
+	case <-d.done:
+		_ = conn.Close()
+	}
+}
+
+func (d *streamDemux) accept(partition int) (net.Conn, error) {
+	select {
+	case conn := <-d.conns[partition]:
+		return conn, nil
+	case <-d.done:
+		return nil, errStreamClosed
+	}
+}
+
+// close is called by the layer of each partition, the listener is closed once
+func (d *streamDemux) close() error {
+	var err error
+	d.once.Do(func() {
+		close(d.done)
+		err = d.ln.Close()
+	})
+	return err
+}
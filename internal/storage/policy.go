@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/label"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const (
+	PolicyLRU     = "lru"
+	PolicyLFU     = "lfu"
+	PolicyARC     = "arc"
+	PolicyTinyLFU = "tinylfu"
+)
+
+var (
+	ErrorUnknownPolicy = errors.New("unknown eviction policy")
+	// the record alone is bigger than the byte budget of a shard
+	ErrorTooLarge = errors.New("record larger than the shard budget")
+)
+
+// Eviction bounds the memory of the ShardedMap, the zero value is the lru
+// with itemPerShard as only limit
+type Eviction struct {
+	// lru(default), lfu, arc or tinylfu
+	Policy string
+	// max bytes of the records of a shard, 0 for no limit
+	MaxBytesPerShard int64
+	// max bytes of the records of the node, split between the partitions and the shards
+	MaxBytes int64
+}
+
+// the byte budget of each shard, 0 for no limit
+func (e Eviction) shardBudget(nShard int) int64 {
+	budget := e.MaxBytesPerShard
+	if e.MaxBytes > 0 {
+		if perShard := e.MaxBytes / int64(nShard); budget == 0 || perShard < budget {
+			budget = perShard
+		}
+	}
+	return budget
+}
+
+// policy chooses the nodes of a shard to evict, it is called under the shard lock
+// and links the nodes through their prev and next fields
+type policy interface {
+	// add tracks a node newly set
+	add(nd *node)
+	// hit records a read or an update of the node
+	hit(nd *node)
+	// remove stops tracking a node deleted or replaced
+	remove(nd *node)
+	// evict stops tracking the node to evict and returns it, nil if there is none
+	evict() *node
+	// walk visits the nodes in the order evict would return them, without
+	// changing anything, until fn returns false
+	walk(fn func(*node) bool)
+	// evicted stops tracking a node evicted through the log, as evict would have
+	evicted(nd *node)
+	len() int
+}
+
+// walkBack visits the nodes of the list from its tail
+func walkBack(l *dll, fn func(*node) bool) bool {
+	for nd := l.tail; nd != nil; nd = nd.prev {
+		if !fn(nd) {
+			return false
+		}
+	}
+	return true
+}
+
+// capacity is the expected number of items of the shard, used to size the policies
+func newPolicy(name string, capacity int) (policy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return newLRU(), nil
+	case PolicyLFU:
+		return newLFU(), nil
+	case PolicyARC:
+		return newARC(), nil
+	case PolicyTinyLFU:
+		return newTinyLFU(capacity), nil
+	default:
+		return nil, ErrorUnknownPolicy
+	}
+}
+
+// a list of nodes without length limit
+func newList() *dll {
+	return &dll{maxLgt: math.MaxInt}
+}
+
+type lru struct {
+	l *dll
+}
+
+func newLRU() *lru {
+	return &lru{l: newList()}
+}
+
+func (p *lru) add(nd *node) {
+	_, _ = p.l.unshiftNode(nd)
+}
+
+func (p *lru) hit(nd *node) {
+	_ = p.l.removeNode(nd)
+	_, _ = p.l.unshiftNode(nd)
+}
+
+func (p *lru) remove(nd *node) {
+	_ = p.l.removeNode(nd)
+}
+
+func (p *lru) evict() *node {
+	return p.l.popNode()
+}
+
+func (p *lru) walk(fn func(*node) bool) {
+	walkBack(p.l, fn)
+}
+
+func (p *lru) evicted(nd *node) {
+	p.remove(nd)
+}
+
+func (p *lru) len() int {
+	return p.l.length
+}
+
+// lfu evicts the least accessed node, the least recently used between equals.
+// The nodes are in a list per access count
+type lfu struct {
+	lists   map[uint32]*dll
+	minFreq uint32
+	length  int
+}
+
+func newLFU() *lfu {
+	return &lfu{lists: make(map[uint32]*dll)}
+}
+
+func (p *lfu) push(nd *node) {
+	l, ok := p.lists[nd.freq]
+	if !ok {
+		l = newList()
+		p.lists[nd.freq] = l
+	}
+	_, _ = l.unshiftNode(nd)
+}
+
+func (p *lfu) unlink(nd *node) {
+	l := p.lists[nd.freq]
+	_ = l.removeNode(nd)
+	if l.length == 0 {
+		delete(p.lists, nd.freq)
+	}
+}
+
+func (p *lfu) add(nd *node) {
+	// a node replacing another one keeps its count
+	if nd.freq == 0 {
+		nd.freq = 1
+	}
+	p.push(nd)
+	if p.length == 0 || nd.freq < p.minFreq {
+		p.minFreq = nd.freq
+	}
+	p.length++
+}
+
+func (p *lfu) hit(nd *node) {
+	p.unlink(nd)
+	if _, ok := p.lists[p.minFreq]; !ok && p.minFreq == nd.freq {
+		p.minFreq++
+	}
+	if nd.freq < math.MaxUint32 {
+		nd.freq++
+	}
+	p.push(nd)
+}
+
+func (p *lfu) remove(nd *node) {
+	p.unlink(nd)
+	p.length--
+	if _, ok := p.lists[p.minFreq]; !ok {
+		p.resetMin()
+	}
+}
+
+func (p *lfu) evict() *node {
+	l, ok := p.lists[p.minFreq]
+	if !ok {
+		return nil
+	}
+	nd := l.tail
+	p.remove(nd)
+	return nd
+}
+
+// the lists from the least accessed
+func (p *lfu) walk(fn func(*node) bool) {
+	freqs := make([]uint32, 0, len(p.lists))
+	for freq := range p.lists {
+		freqs = append(freqs, freq)
+	}
+	sort.Slice(freqs, func(i, j int) bool { return freqs[i] < freqs[j] })
+	for _, freq := range freqs {
+		if !walkBack(p.lists[freq], fn) {
+			return
+		}
+	}
+}
+
+func (p *lfu) evicted(nd *node) {
+	p.remove(nd)
+}
+
+func (p *lfu) resetMin() {
+	first := true
+	for freq := range p.lists {
+		if first || freq < p.minFreq {
+			p.minFreq = freq
+			first = false
+		}
+	}
+}
+
+func (p *lfu) len() int {
+	return p.length
+}
+
+// cacheStats are shared by the shards, they feed the metrics of the policy
+type cacheStats struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+func (c *cacheStats) hit() {
+	atomic.AddUint64(&c.hits, 1)
+}
+
+func (c *cacheStats) miss() {
+	atomic.AddUint64(&c.misses, 1)
+}
+
+func (c *cacheStats) evicted() {
+	atomic.AddUint64(&c.evictions, 1)
+}
+
+// CacheStats are the counters of the eviction policy of the ShardedMap
+type CacheStats struct {
+	Policy    string
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Items     int
+	Bytes     int64
+}
+
+func (m ShardedMap) CacheStats() CacheStats {
+	cs := CacheStats{
+		Policy:    m.eviction.Policy,
+		Hits:      atomic.LoadUint64(&m.stats.hits),
+		Misses:    atomic.LoadUint64(&m.stats.misses),
+		Evictions: atomic.LoadUint64(&m.stats.evictions),
+	}
+	if cs.Policy == "" {
+		cs.Policy = PolicyLRU
+	}
+	for _, s := range m.shd {
+		s.RLock()
+		cs.Items += len(s.m)
+		cs.Bytes += s.bytes
+		s.RUnlock()
+		cs.Hits += uint64(s.reads.pending())
+	}
+	return cs
+}
+
+// registerMetrics exposes the CacheStats, labelled with the policy, so the policies
+// can be compared on the same traffic
+func (m ShardedMap) registerMetrics() {
+	if m.obs == nil || !m.obs.IsMetrics {
+		return
+	}
+	meter := otel.GetMeterProvider().Meter(m.obs.ServiceName)
+	policy := label.String("policy", m.CacheStats().Policy)
+
+	var cacheHits, cacheMisses, cacheEvictions metric.Int64SumObserver
+	var cacheBytes metric.Int64UpDownSumObserver
+	observer := meter.NewBatchObserver(func(_ context.Context, result metric.BatchObserverResult) {
+		cs := m.CacheStats()
+		result.Observe([]label.KeyValue{policy},
+			cacheHits.Observation(int64(cs.Hits)),
+			cacheMisses.Observation(int64(cs.Misses)),
+			cacheEvictions.Observation(int64(cs.Evictions)),
+			cacheBytes.Observation(cs.Bytes),
+		)
+	})
+	cacheHits, _ = observer.NewInt64SumObserver("storage_cache_hits_total",
+		metric.WithDescription("Reads of a key found in the storage."))
+	cacheMisses, _ = observer.NewInt64SumObserver("storage_cache_misses_total",
+		metric.WithDescription("Reads of a key missing from the storage."))
+	cacheEvictions, _ = observer.NewInt64SumObserver("storage_cache_evictions_total",
+		metric.WithDescription("Records evicted by the eviction policy."))
+	cacheBytes, _ = observer.NewInt64UpDownSumObserver("storage_cache_bytes",
+		metric.WithDescription("Bytes accounted for the records."))
+}
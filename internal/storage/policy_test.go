@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"github.com/stretchr/testify/require"
+)
+
+func testNodes(n int) []*node {
+	nds := make([]*node, n)
+	for i := range nds {
+		nds[i], _ = NewNode(fmt.Sprintf("key-%d", i), "value")
+	}
+	return nds
+}
+
+func TestPoliciesEvictEachNodeOnce(t *testing.T) {
+	for _, name := range []string{PolicyLRU, PolicyLFU, PolicyARC, PolicyTinyLFU} {
+		t.Run(name, func(t *testing.T) {
+			p, err := newPolicy(name, 100)
+			require.NoError(t, err)
+
+			nds := testNodes(100)
+			for i, nd := range nds {
+				p.add(nd)
+				if i%3 == 0 {
+					p.hit(nd)
+				}
+				// evicted keys come back for arc
+				if i%10 == 9 {
+					p.evict()
+				}
+			}
+			p.remove(nds[99])
+
+			seen := make(map[string]bool)
+			for _, nd := range nds {
+				seen[nd.key] = false
+			}
+			n := p.len()
+			for i := 0; i < n; i++ {
+				nd := p.evict()
+				require.NotNil(t, nd)
+				require.False(t, seen[nd.key], "evicted twice: "+nd.key)
+				seen[nd.key] = true
+			}
+			require.Nil(t, p.evict())
+			require.Equal(t, 0, p.len())
+		})
+	}
+
+	_, err := newPolicy("fifo", 10)
+	require.Equal(t, ErrorUnknownPolicy, err)
+}
+
+// the leader chooses the victims with walk, the replicas evict them
+func TestPoliciesWalkInEvictionOrder(t *testing.T) {
+	for _, name := range []string{PolicyLRU, PolicyLFU, PolicyARC, PolicyTinyLFU} {
+		t.Run(name, func(t *testing.T) {
+			p, err := newPolicy(name, 100)
+			require.NoError(t, err)
+
+			for i, nd := range testNodes(100) {
+				p.add(nd)
+				if i%3 == 0 {
+					p.hit(nd)
+				}
+				if i%10 == 9 {
+					p.evict()
+				}
+			}
+
+			var walked []string
+			p.walk(func(nd *node) bool {
+				walked = append(walked, nd.key)
+				return true
+			})
+			require.Equal(t, p.len(), len(walked))
+
+			for _, key := range walked {
+				require.Equal(t, key, p.evict().key)
+			}
+		})
+	}
+}
+
+func TestLFUEvictsTheLeastAccessed(t *testing.T) {
+	p := newLFU()
+	nds := testNodes(3)
+	for _, nd := range nds {
+		p.add(nd)
+	}
+	p.hit(nds[0])
+	p.hit(nds[0])
+	p.hit(nds[2])
+
+	require.Equal(t, "key-1", p.evict().key)
+	require.Equal(t, "key-2", p.evict().key)
+	require.Equal(t, "key-0", p.evict().key)
+}
+
+// a scan of keys read once must not evict the keys read often
+func TestPoliciesResistAScan(t *testing.T) {
+	for _, name := range []string{PolicyLFU, PolicyARC, PolicyTinyLFU} {
+		t.Run(name, func(t *testing.T) {
+			obs := observability.Observability{}
+			sm, err := NewShardedMapWithEviction(1, 50, Eviction{Policy: name}, &obs)
+			require.NoError(t, err)
+			ctx := context.Background()
+
+			for i := 0; i < 20; i++ {
+				require.NoError(t, sm.Set(ctx, fmt.Sprintf("hot-%d", i), "value", 0))
+			}
+			for round := 0; round < 5; round++ {
+				for i := 0; i < 20; i++ {
+					_, _ = sm.Get(ctx, fmt.Sprintf("hot-%d", i))
+				}
+			}
+			for i := 0; i < 500; i++ {
+				require.NoError(t, sm.Set(ctx, fmt.Sprintf("scan-%d", i), "value", 0))
+			}
+
+			var hot int
+			for _, key := range allKeys(t, sm) {
+				if strings.HasPrefix(key, "hot-") {
+					hot++
+				}
+			}
+			require.GreaterOrEqual(t, hot, 15)
+			require.LessOrEqual(t, len(allKeys(t, sm)), 50)
+		})
+	}
+}
+
+func TestByteBudget(t *testing.T) {
+	obs := observability.Observability{}
+	ev := Eviction{MaxBytesPerShard: 4096, MaxBytes: 3 * 2048}
+	require.Equal(t, int64(2048), ev.shardBudget(3))
+
+	sm, err := NewShardedMapWithEviction(3, 0, ev, &obs)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	value := strings.Repeat("v", 200)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key-%d", i), value, 0))
+		for _, s := range sm.shd {
+			require.LessOrEqual(t, s.bytes, int64(2048))
+		}
+	}
+
+	err = sm.Set(ctx, "big", strings.Repeat("v", 4096), 0)
+	require.Equal(t, ErrorTooLarge, err)
+
+	_, _ = sm.Get(ctx, "key-99")
+	_, _ = sm.Get(ctx, "key-0")
+	cs := sm.CacheStats()
+	require.Equal(t, PolicyLRU, cs.Policy)
+	require.Equal(t, uint64(1), cs.Hits)
+	require.Equal(t, uint64(1), cs.Misses)
+	require.Equal(t, uint64(100-cs.Items), cs.Evictions)
+	require.LessOrEqual(t, cs.Bytes, int64(3*2048))
+
+	// the bytes of a deleted key are released
+	before := sm.CacheStats().Bytes
+	require.NoError(t, sm.Delete(ctx, "key-99", nil))
+	require.Less(t, sm.CacheStats().Bytes, before)
+
+	// a transaction with a put over the budget is refused before any op is applied
+	put := func(key, value string) *api.TxnOp {
+		return &api.TxnOp{Op: &api.TxnOp_Put{Put: &api.TxnPut{Key: key, Value: &api.Value{Kind: &api.Value_StringValue{StringValue: value}}}}}
+	}
+	_, err = sm.Txn(ctx, &api.TxnRequest{Success: []*api.TxnOp{
+		put("key-98", "changed"),
+		{Op: &api.TxnOp_Delete{Delete: &api.TxnDelete{Key: "key-97"}}},
+		put("big", strings.Repeat("v", 4096)),
+	}})
+	require.Equal(t, ErrorTooLarge, err)
+	v, err := sm.Get(ctx, "key-98")
+	require.NoError(t, err)
+	require.Equal(t, value, v)
+	v, err = sm.Get(ctx, "key-97")
+	require.NoError(t, err)
+	require.Equal(t, value, v)
+}
+
+// a follower does not choose the victims, the evictor of the leader does
+func TestEvictionsOfTheLeaderOnly(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	sm := NewShardedMap(1, 5, &obs)
+	sm.deferEvictions()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key-%d", i), "value", 0))
+	}
+
+	var leader int32
+	evicted := make(chan []*command.EvictItem, 10)
+	stop := sm.Evictions(5*time.Millisecond, func() bool { return atomic.LoadInt32(&leader) == 1 }, func(ctx context.Context, victims []*command.EvictItem) {
+		select {
+		case evicted <- victims:
+		default:
+		}
+	})
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, evicted, 0)
+
+	atomic.StoreInt32(&leader, 1)
+	select {
+	case victims := <-evicted:
+		require.Len(t, victims, 5)
+	case <-time.After(time.Second):
+		t.Fatal("no victims")
+	}
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	readStripes = 16
+	// the reads a stripe keeps before they are applied to the policy
+	readBatch = 64
+)
+
+// readBuffer records the reads of a shard, so a Get only takes the read lock of the shard.
+// The reads are spread over the stripes, a full stripe is applied to the policy in a batch
+// if the shard lock is free and dropped otherwise, the policies only need an approximation
+// of the accesses. The shard applies all the pending reads before it evicts, see flushReads
+type readBuffer struct {
+	next    uint32
+	stripes [readStripes]readStripe
+}
+
+type readStripe struct {
+	mu    sync.Mutex
+	nodes []*node
+	// a stripe on its own cache line
+	_ [32]byte
+}
+
+// record returns the batch to apply once the stripe is full, nil otherwise
+func (b *readBuffer) record(nd *node) []*node {
+	st := &b.stripes[atomic.AddUint32(&b.next, 1)%readStripes]
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.nodes = append(st.nodes, nd)
+	if len(st.nodes) < readBatch {
+		return nil
+	}
+	batch := st.nodes
+	st.nodes = make([]*node, 0, readBatch)
+	return batch
+}
+
+// drain returns the reads of all the stripes
+func (b *readBuffer) drain() []*node {
+	var batch []*node
+	for i := range b.stripes {
+		st := &b.stripes[i]
+		st.mu.Lock()
+		batch = append(batch, st.nodes...)
+		st.nodes = st.nodes[:0]
+		st.mu.Unlock()
+	}
+	return batch
+}
+
+// pending is the number of reads not counted in the stats yet
+func (b *readBuffer) pending() int {
+	var n int
+	for i := range b.stripes {
+		st := &b.stripes[i]
+		st.mu.Lock()
+		n += len(st.nodes)
+		st.mu.Unlock()
+	}
+	return n
+}
+
+// read records a hit of the node found under the read lock of the shard
+func (s *Shard) read(nd *node) {
+	batch := s.reads.record(nd)
+	if batch == nil {
+		return
+	}
+	atomic.AddUint64(&s.stats.hits, uint64(len(batch)))
+	// a write is in progress, the batch is lost
+	if !s.TryLock() {
+		return
+	}
+	defer s.Unlock()
+	s.applyReads(batch)
+}
+
+// flushReads applies the pending reads, the shard lock must be held
+func (s *Shard) flushReads() {
+	batch := s.reads.drain()
+	atomic.AddUint64(&s.stats.hits, uint64(len(batch)))
+	s.applyReads(batch)
+}
+
+// applyReads skips the nodes removed since their read, the shard lock must be held
+func (s *Shard) applyReads(batch []*node) {
+	for _, nd := range batch {
+		if !nd.removed {
+			s.policy.hit(nd)
+		}
+	}
+}
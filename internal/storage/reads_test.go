@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/stretchr/testify/require"
+)
+
+// the buffered reads are all counted, and applied to the policy before it evicts
+func TestBufferedReads(t *testing.T) {
+	obs := observability.Observability{}
+	sm := NewShardedMap(1, 10, &obs)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key-%d", i), "value", 0))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				_, err := sm.Get(ctx, fmt.Sprintf("key-%d", i%10))
+				require.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, uint64(8*1000), sm.CacheStats().Hits)
+	shard := sm.shd[0]
+	shard.Lock()
+	shard.flushReads()
+	shard.Unlock()
+
+	// the stripes are not drained in the order of the reads, but after
+	// the flush key-0 is the least recently used
+	for i := 1; i < 10; i++ {
+		_, _ = sm.Get(ctx, fmt.Sprintf("key-%d", i))
+	}
+	require.NoError(t, sm.Set(ctx, "key-10", "value", 0))
+	_, err := sm.Get(ctx, "key-0")
+	require.Equal(t, ErrorNoSuchKey, err)
+
+	// a read of a node deleted meanwhile is skipped
+	shard.RLock()
+	nd := shard.m["key-1"]
+	shard.RUnlock()
+	require.NoError(t, sm.Delete(ctx, "key-1", nil))
+	shard.read(nd)
+	shard.Lock()
+	shard.flushReads()
+	shard.Unlock()
+	require.Len(t, allKeys(t, sm), 9)
+}
+
+// getLocked is the read path without the buffer, a write lock for each read
+func getLocked(ctx context.Context, m ShardedMap, key string) (interface{}, error) {
+	teardown := m.obs.CarryOnTrace(ctx, "StorageGet")
+	defer teardown()
+
+	shard := m.getShard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	nd, ok := shard.m[key]
+	if !ok || nd.isExpired(time.Now().UnixNano()) {
+		m.stats.miss()
+		return "", ErrorNoSuchKey
+	}
+	m.stats.hit()
+	shard.touch(nd)
+	return nd.value(), nil
+}
+
+// BenchmarkGetParallel reads the keys from GOMAXPROCS goroutines, run it with -cpu 1,2,4,8
+// to see the scaling. The hot keys all live in the same shard
+func BenchmarkGetParallel(b *testing.B) {
+	const shards, keys = 16, 1 << 14
+	obs := observability.Observability{}
+	ctx := context.Background()
+	sm := NewShardedMap(shards, 0, &obs)
+
+	names := make([]string, keys)
+	for i := range names {
+		names[i] = fmt.Sprintf("key-%d", i)
+		_ = sm.Set(ctx, names[i], "value", 0)
+	}
+	var hot []string
+	for _, key := range names {
+		if sm.getShardIndex(key) == 0 && len(hot) < 8 {
+			hot = append(hot, key)
+		}
+	}
+
+	reads := map[string]func(key string){
+		"buffered": func(key string) { _, _ = sm.Get(ctx, key) },
+		"locked":   func(key string) { _, _ = getLocked(ctx, sm, key) },
+	}
+	for _, path := range []string{"buffered", "locked"} {
+		read := reads[path]
+		for pattern, set := range map[string][]string{"hot": hot, "uniform": names} {
+			b.Run(path+"/"+pattern, func(b *testing.B) {
+				b.RunParallel(func(pb *testing.PB) {
+					var i int
+					for pb.Next() {
+						read(set[i%len(set)])
+						i++
+					}
+				})
+			})
+		}
+	}
+}
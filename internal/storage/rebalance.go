@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	defaultRebalanceInterval = 250 * time.Millisecond
+	defaultMaxLag            = 64
+	defaultMaxMoves          = 1
+	// the finished moves kept for the status
+	movesHistory = 32
+)
+
+var errServerLeft = errors.New("the server left")
+
+// rebalancer moves the partitions the node leads. Each partition is placed on Replicas of
+// the servers(see placement), a server of the placement catches up on the partition as a
+// nonvoter, from a snapshot then the entries, and becomes a voter in a single configuration
+// change. Once the servers of the placement are voters the ones out of it are removed, the
+// leader being out of it transfers the leadership first and the next one removes it, so the
+// partition keeps its voters while it moves. Then the leaders are spread over the servers,
+// a partition moves to its target with a leadership transfer.
+// A partition takes a step at a time, MaxMoves servers catch up at once and their streams
+// are throttled, so the clients keep their latency while the cluster grows
+type rebalancer struct {
+	partitions []*DistributedStorage
+	conf       Rebalance
+
+	mu sync.Mutex
+	// the servers of the membership, their rpc address by id
+	members map[string]string
+	// the replica catching up of each partition
+	active   map[int]*api.Move
+	history  []*api.Move
+	balanced bool
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newRebalancer(partitions []*DistributedStorage, conf Rebalance) *rebalancer {
+	if conf.Interval == 0 {
+		conf.Interval = defaultRebalanceInterval
+	}
+	if conf.MaxLag == 0 {
+		conf.MaxLag = defaultMaxLag
+	}
+	if conf.MaxMoves <= 0 {
+		conf.MaxMoves = defaultMaxMoves
+	}
+	r := &rebalancer{
+		partitions: partitions,
+		conf:       conf,
+		members:    make(map[string]string),
+		active:     make(map[int]*api.Move),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+func (r *rebalancer) run() {
+	defer close(r.done)
+	ticker := time.NewTicker(r.conf.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		case <-r.wake:
+		}
+		r.step()
+	}
+}
+
+func (r *rebalancer) join(id, addr string) {
+	r.mu.Lock()
+	r.members[id] = addr
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *rebalancer) leave(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.members, id)
+}
+
+func (r *rebalancer) close() {
+	close(r.stop)
+	<-r.done
+}
+
+// step moves each partition the node leads one step closer to its placement
+func (r *rebalancer) step() {
+	members := r.copyMembers()
+
+	balanced := true
+	self := r.partitions[0].config.Raft.LocalID
+	for i, ds := range r.partitions {
+		ds.refreshReplica(placed(r.placement(i, members), self))
+		if !r.stepReplicas(i, ds, members) {
+			balanced = false
+		}
+	}
+	if balanced && len(r.partitions) > 1 {
+		balanced = r.spreadLeaders(members)
+	}
+
+	r.mu.Lock()
+	r.balanced = balanced
+	r.mu.Unlock()
+}
+
+// stepReplicas follows the replica catching up on the partition, or starts the next one,
+// or removes a server out of the placement. It returns true if the voters of the partition
+// are the servers of the placement
+func (r *rebalancer) stepReplicas(i int, ds *DistributedStorage, members map[string]string) bool {
+	r.mu.Lock()
+	move := r.active[i]
+	r.mu.Unlock()
+
+	if ds.raft.State() != raft.Leader {
+		if move != nil {
+			ds.transport.untrack(raft.ServerID(move.ServerId))
+			r.finish(i, raft.ErrNotLeader)
+		}
+		return true
+	}
+	servers, err := ds.configuration()
+	if err != nil {
+		return false
+	}
+
+	if move != nil {
+		id := raft.ServerID(move.ServerId)
+		if _, ok := members[move.ServerId]; !ok {
+			ds.transport.untrack(id)
+			r.finish(i, errServerLeft)
+			return false
+		}
+		match, last := ds.transport.match(id), ds.raft.LastIndex()
+		r.mu.Lock()
+		move.MatchIndex, move.LastIndex = match, last
+		r.mu.Unlock()
+		if match+r.conf.MaxLag < last {
+			return false
+		}
+		// the server votes from the entry of its promotion
+		err := ds.raft.AddVoter(id, raft.ServerAddress(members[move.ServerId]), 0, 0).Error()
+		ds.transport.untrack(id)
+		r.finish(i, err)
+		return false
+	}
+
+	targets := r.placement(i, members)
+	// a nonvoter added by a previous leader catches up again
+	for _, srv := range servers {
+		if srv.Suffrage == raft.Nonvoter && placed(targets, srv.ID) {
+			if _, ok := members[string(srv.ID)]; ok {
+				if r.busy() {
+					return false
+				}
+				ds.transport.track(srv.ID)
+				r.begin(i, api.Move_REPLICA, string(srv.ID))
+				return false
+			}
+		}
+	}
+
+	for _, id := range sortedIDs(members) {
+		addr := raft.ServerAddress(members[id])
+		var joined bool
+		for _, srv := range servers {
+			if srv.ID == raft.ServerID(id) && srv.Address == addr {
+				joined = true
+				continue
+			}
+			// the server is back with another address, or another server has its address
+			if srv.ID == raft.ServerID(id) || srv.Address == addr {
+				if err := ds.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+					return false
+				}
+			}
+		}
+		if joined || !placed(targets, raft.ServerID(id)) {
+			continue
+		}
+		if r.busy() {
+			return false
+		}
+
+		ds.transport.track(raft.ServerID(id))
+		r.begin(i, api.Move_REPLICA, id)
+		if err := ds.raft.AddNonvoter(raft.ServerID(id), addr, 0, 0).Error(); err != nil {
+			ds.transport.untrack(raft.ServerID(id))
+			r.finish(i, err)
+		}
+		return false
+	}
+
+	// the servers of the placement vote, the others go one at a time
+	for _, srv := range servers {
+		if placed(targets, srv.ID) {
+			continue
+		}
+		if srv.ID == ds.config.Raft.LocalID {
+			// the next leader removes the node
+			target := targets[0]
+			r.begin(i, api.Move_LEADER, string(target.ID))
+			r.finish(i, ds.raft.LeadershipTransferToServer(target.ID, target.Address).Error())
+			return false
+		}
+		// a server which left is removed by Leave
+		if _, ok := members[string(srv.ID)]; !ok {
+			continue
+		}
+		r.begin(i, api.Move_REMOVE, string(srv.ID))
+		r.finish(i, ds.raft.RemoveServer(srv.ID, 0, 0).Error())
+		return false
+	}
+	return true
+}
+
+// busy tells if MaxMoves servers are catching up on the partitions of the node
+func (r *rebalancer) busy() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var moves int
+	for _, move := range r.active {
+		if move.Kind == api.Move_REPLICA {
+			moves++
+		}
+	}
+	return moves >= r.conf.MaxMoves
+}
+
+// spreadLeaders moves a partition to its target, the first server of its placement.
+// It returns true if the partitions the node leads are on their target
+func (r *rebalancer) spreadLeaders(members map[string]string) bool {
+	for i, ds := range r.partitions {
+		if ds.raft.State() != raft.Leader {
+			continue
+		}
+		servers, err := ds.configuration()
+		if err != nil {
+			return false
+		}
+		targets := r.placement(i, members)
+		// the targets move while the servers join
+		for _, target := range targets {
+			if !voter(servers, target.ID) {
+				return false
+			}
+		}
+		target := targets[0]
+		if target.ID == ds.config.Raft.LocalID {
+			continue
+		}
+
+		r.begin(i, api.Move_LEADER, string(target.ID))
+		// a write meanwhile waits for the end of the transfer, see applyAfterTransfer
+		r.finish(i, ds.raft.LeadershipTransferToServer(target.ID, target.Address).Error())
+		return false
+	}
+	return true
+}
+
+// placement returns the servers of the partition i, its leader first. The members and the
+// node are ranked by the hash of the partition and of their id(rendezvous hashing) and the
+// partition takes the Replicas first ones, so a server joining or leaving only moves the
+// partitions it ranks in, about 1/n of them
+func (r *rebalancer) placement(i int, members map[string]string) []raft.Server {
+	self := r.partitions[0].config.Raft
+	servers := []raft.Server{{ID: self.LocalID, Address: raft.ServerAddress(self.BindAddr)}}
+	for id, addr := range members {
+		if raft.ServerID(id) != self.LocalID {
+			servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+		}
+	}
+	scores := make(map[raft.ServerID]uint64, len(servers))
+	for _, srv := range servers {
+		scores[srv.ID] = xxhash.Sum64String(strconv.Itoa(i) + "#" + string(srv.ID))
+	}
+	sort.Slice(servers, func(a, b int) bool {
+		if sa, sb := scores[servers[a].ID], scores[servers[b].ID]; sa != sb {
+			return sa > sb
+		}
+		return servers[a].ID < servers[b].ID
+	})
+
+	n := r.conf.Replicas
+	if n <= 0 || n > len(servers) {
+		n = len(servers)
+	}
+	return servers[:n]
+}
+
+func (r *rebalancer) copyMembers() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make(map[string]string, len(r.members))
+	for id, addr := range r.members {
+		members[id] = addr
+	}
+	return members
+}
+
+func placed(targets []raft.Server, id raft.ServerID) bool {
+	for _, target := range targets {
+		if target.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func voter(servers []raft.Server, id raft.ServerID) bool {
+	for _, srv := range servers {
+		if srv.ID == id {
+			return srv.Suffrage == raft.Voter
+		}
+	}
+	return false
+}
+
+func (r *rebalancer) begin(i int, kind api.Move_Kind, id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active[i] = &api.Move{
+		Partition: uint32(i),
+		Kind:      kind,
+		State:     api.Move_CATCHING_UP,
+		ServerId:  id,
+		StartedAt: time.Now().UnixMilli(),
+	}
+}
+
+func (r *rebalancer) finish(i int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	move := r.active[i]
+	delete(r.active, i)
+	move.State = api.Move_DONE
+	if err != nil {
+		move.State = api.Move_FAILED
+		move.Error = err.Error()
+	}
+	move.FinishedAt = time.Now().UnixMilli()
+
+	r.history = append(r.history, move)
+	if len(r.history) > movesHistory {
+		r.history = r.history[len(r.history)-movesHistory:]
+	}
+}
+
+// status returns a copy of the moves, the active ones by partition then the last finished ones
+func (r *rebalancer) status() *api.RebalanceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	st := &api.RebalanceStatus{Balanced: r.balanced && len(r.active) == 0}
+	for i := range r.partitions {
+		if move, ok := r.active[i]; ok {
+			st.Moves = append(st.Moves, proto.Clone(move).(*api.Move))
+		}
+	}
+	for j := len(r.history) - 1; j >= 0; j-- {
+		st.Moves = append(st.Moves, proto.Clone(r.history[j]).(*api.Move))
+	}
+	return st
+}
+
+func sortedIDs(members map[string]string) []string {
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
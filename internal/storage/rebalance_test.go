@@ -0,0 +1,381 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+// the nodes joining catch up on the partitions then vote, the leaders are spread over them
+func TestPartitionedStorageRebalances(t *testing.T) {
+	ctx := context.Background()
+	nodeCount, partitionCount := 3, 2
+
+	var nodes []*PartitionedStorage
+	var addrs []string
+	ports := dynaport.Get(nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		p, addr := rebalanceNode(t, i, ports[i], partitionCount, Rebalance{})
+		if i == 0 {
+			require.NoError(t, p.WaitForLeader(3*time.Second))
+			for k := 0; k < 20; k++ {
+				require.NoError(t, p.Set(ctx, fmt.Sprintf("key-%d", k), "value", 0))
+			}
+		}
+		// the membership tells each node about the others
+		for j, other := range nodes {
+			require.NoError(t, other.Join(fmt.Sprintf("%d", i), addr))
+			require.NoError(t, p.Join(fmt.Sprintf("%d", j), addrs[j]))
+		}
+		nodes = append(nodes, p)
+		addrs = append(addrs, addr)
+	}
+
+	// each partition is led by the first server of its placement
+	leaders := placedLeaders(nodes, partitionCount)
+	require.Eventually(t, func() bool {
+		partitions, _ := nodes[2].Partitions(ctx)
+		for i, p := range partitions {
+			if p.LeaderId != leaders[i] {
+				return false
+			}
+			servers, err := nodeOf(nodes, leaders[i]).partitions[i].configuration()
+			if err != nil || len(servers) != nodeCount {
+				return false
+			}
+			for _, srv := range servers {
+				if srv.Suffrage != raft.Voter {
+					return false
+				}
+			}
+		}
+		for _, node := range nodes {
+			if st, _ := node.Rebalance(ctx); !st.Balanced {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// a move fails if its leader loses the partition, the new leader takes it over
+	replicas := make(map[string]bool)
+	var transfers int
+	for _, node := range nodes {
+		st, err := node.Rebalance(ctx)
+		require.NoError(t, err)
+		for _, move := range st.Moves {
+			if move.State != api.Move_DONE {
+				continue
+			}
+			if move.Kind == api.Move_LEADER {
+				transfers++
+				continue
+			}
+			require.GreaterOrEqual(t, move.MatchIndex+defaultMaxLag, move.LastIndex)
+			replicas[fmt.Sprintf("%d/%s", move.Partition, move.ServerId)] = true
+		}
+	}
+	// each node caught up on each partition, then the partitions moved to their leader
+	require.Len(t, replicas, (nodeCount-1)*partitionCount)
+	require.GreaterOrEqual(t, transfers, 1)
+
+	for k := 0; k < 20; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		require.Eventually(t, func() bool {
+			v, err := nodes[2].Get(ctx, key)
+			return err == nil && v == "value"
+		}, time.Second, 10*time.Millisecond)
+
+		// the writes go to the new leaders
+		leader := nodeOf(nodes, leaders[nodes[0].PartitionOf(key)])
+		require.NoError(t, leader.Set(ctx, key, "moved", 0))
+	}
+}
+
+// a node joining takes the replicas of a partition, the node out of its placement leaves it
+func TestPartitionedStorageMovesReplicas(t *testing.T) {
+	ctx := context.Background()
+	nodeCount, partitionCount := 3, 3
+
+	var nodes []*PartitionedStorage
+	var addrs []string
+	ports := dynaport.Get(nodeCount)
+	for i := 0; i < nodeCount; i++ {
+		p, addr := rebalanceNode(t, i, ports[i], partitionCount, Rebalance{Replicas: 2})
+		if i == 0 {
+			require.NoError(t, p.WaitForLeader(3*time.Second))
+			for k := 0; k < 30; k++ {
+				require.NoError(t, p.Set(ctx, fmt.Sprintf("key-%d", k), "value", 0))
+			}
+		}
+		for j, other := range nodes {
+			require.NoError(t, other.Join(fmt.Sprintf("%d", i), addr))
+			require.NoError(t, p.Join(fmt.Sprintf("%d", j), addrs[j]))
+		}
+		nodes = append(nodes, p)
+		addrs = append(addrs, addr)
+	}
+
+	// each partition is on the 2 servers of its placement, led by the first one
+	members := nodes[0].rebalancer.copyMembers()
+	require.Eventually(t, func() bool {
+		for i := 0; i < partitionCount; i++ {
+			targets := nodes[0].rebalancer.placement(i, members)
+			leader := nodeOf(nodes, string(targets[0].ID)).partitions[i]
+			if leader.raft.State() != raft.Leader {
+				return false
+			}
+			servers, err := leader.configuration()
+			if err != nil || len(servers) != 2 {
+				return false
+			}
+			for _, srv := range servers {
+				if srv.Suffrage != raft.Voter || !placed(targets, srv.ID) {
+					return false
+				}
+			}
+		}
+		for _, node := range nodes {
+			st, _ := node.Rebalance(ctx)
+			// the moves are throttled
+			var catchingUp int
+			for _, move := range st.Moves {
+				if move.State == api.Move_CATCHING_UP {
+					catchingUp++
+				}
+			}
+			require.LessOrEqual(t, catchingUp, defaultMaxMoves)
+			if !st.Balanced {
+				return false
+			}
+		}
+		return true
+	}, 15*time.Second, 50*time.Millisecond)
+
+	// the node 0 bootstrapped the partitions, it left the ones out of its placement
+	var removed []string
+	for _, node := range nodes {
+		st, err := node.Rebalance(ctx)
+		require.NoError(t, err)
+		for _, move := range st.Moves {
+			if move.Kind == api.Move_REMOVE && move.State == api.Move_DONE {
+				removed = append(removed, fmt.Sprintf("%d/%s", move.Partition, move.ServerId))
+			}
+		}
+	}
+	for i := 0; i < partitionCount; i++ {
+		if !placed(nodes[0].rebalancer.placement(i, members), "0") {
+			require.Contains(t, removed, fmt.Sprintf("%d/0", i))
+		}
+	}
+
+	for k := 0; k < 30; k++ {
+		key := fmt.Sprintf("key-%d", k)
+		i := nodes[0].PartitionOf(key)
+		targets := nodes[0].rebalancer.placement(i, members)
+		// the voters of the partition have the key
+		for _, target := range targets {
+			node := nodeOf(nodes, string(target.ID))
+			require.Eventually(t, func() bool {
+				v, err := node.partitions[i].Read(ctx, key)
+				return err == nil && v == "value"
+			}, time.Second, 10*time.Millisecond)
+		}
+		require.NoError(t, nodeOf(nodes, string(targets[0].ID)).Set(ctx, key, "moved", 0))
+	}
+}
+
+// a server joining takes about 1/n of the partitions, the others keep their servers
+func TestPlacementMovesFewPartitions(t *testing.T) {
+	self := &DistributedStorage{}
+	self.config.Raft.LocalID = "0"
+	r := &rebalancer{partitions: []*DistributedStorage{self}, conf: Rebalance{Replicas: 3}}
+
+	members := make(map[string]string)
+	for i := 1; i < 10; i++ {
+		members[fmt.Sprintf("%d", i)] = fmt.Sprintf("addr-%d", i)
+	}
+	const partitionCount = 1000
+	before := make([][]raft.Server, partitionCount)
+	leaders := make(map[raft.ServerID]int)
+	for i := range before {
+		before[i] = r.placement(i, members)
+		require.Len(t, before[i], 3)
+		leaders[before[i][0].ID]++
+	}
+	// the leaders spread over the servers
+	for id, n := range leaders {
+		require.InDelta(t, partitionCount/10, n, partitionCount/10*0.4, string(id))
+	}
+
+	members["10"] = "addr-10"
+	var moved int
+	for i := range before {
+		after := r.placement(i, members)
+		if !placed(after, "10") {
+			require.Equal(t, before[i], after)
+			continue
+		}
+		moved++
+		// the new server takes a place, the others keep their order
+		var kept []raft.Server
+		for _, srv := range after {
+			if srv.ID != "10" {
+				kept = append(kept, srv)
+			}
+		}
+		require.Equal(t, before[i][:2], kept)
+	}
+	require.InDelta(t, partitionCount*3/11, moved, partitionCount*3/11*0.3)
+}
+
+// the partitions number their own indexes, a prefix watch resumes each one from its index
+func TestPartitionedStorageWatchesEachPartition(t *testing.T) {
+	ctx := context.Background()
+	p, _ := rebalanceNode(t, 0, dynaport.Get(1)[0], 2, Rebalance{})
+	require.NoError(t, p.WaitForLeader(3*time.Second))
+	for k := 0; k < 10; k++ {
+		require.NoError(t, p.Set(ctx, fmt.Sprintf("key-%d", k), "v1", 0))
+	}
+
+	applied := p.AppliedIndexes()
+	require.Len(t, applied, 2)
+	start := make(map[int32]uint64)
+	for i, index := range applied {
+		require.NotZero(t, index)
+		start[int32(i)] = index + 1
+	}
+	require.Equal(t, map[int]uint64{p.PartitionOf("key-0"): applied[p.PartitionOf("key-0")]}, p.AppliedIndexes("key-0"))
+
+	events, cancel, err := p.Watch(WithStartIndexes(ctx, start), "key-", true, 0)
+	require.NoError(t, err)
+	defer cancel()
+	for k := 0; k < 10; k++ {
+		require.NoError(t, p.Set(ctx, fmt.Sprintf("key-%d", k), "v2", 0))
+	}
+	last := make(map[int32]uint64)
+	for k := 0; k < 10; k++ {
+		ev := nextEvent(t, events)
+		require.Equal(t, int32(p.PartitionOf(ev.Key)), ev.Partition)
+		require.Equal(t, "v2", ev.Value.Interface())
+		last[ev.Partition] = ev.Index
+	}
+	require.Len(t, last, 2)
+
+	// only the last event of each partition is sent again
+	resumed, cancelResumed, err := p.Watch(WithStartIndexes(ctx, last), "key-", true, 0)
+	require.NoError(t, err)
+	defer cancelResumed()
+	seen := make(map[int32]bool)
+	for i := 0; i < 2; i++ {
+		ev := nextEvent(t, resumed)
+		require.Equal(t, last[ev.Partition], ev.Index)
+		seen[ev.Partition] = true
+	}
+	require.Len(t, seen, 2)
+	select {
+	case ev := <-resumed:
+		t.Fatalf("unexpected event %v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSplitBudgets(t *testing.T) {
+	conf := Config{DiskTierBytes: 1 << 20}
+	conf.Eviction.MaxBytes = 900
+	conf.Eviction.MaxBytesPerShard = 100
+
+	c, maxLgt := splitBudgets(conf, 10, 3)
+	require.Equal(t, int64(300), c.Eviction.MaxBytes)
+	require.Equal(t, int64(100), c.Eviction.MaxBytesPerShard)
+	require.Equal(t, uint64(1<<20/3), c.DiskTierBytes)
+	require.Equal(t, 4, maxLgt)
+
+	// no limit stays no limit
+	_, maxLgt = splitBudgets(Config{}, 0, 3)
+	require.Equal(t, 0, maxLgt)
+}
+
+func TestCheckPartitions(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkPartitions(dir, 3))
+	require.NoError(t, checkPartitions(dir, 3))
+	require.ErrorIs(t, checkPartitions(dir, 2), ErrorPartitionCount)
+
+	// the data dir of a single partition, before the count was recorded
+	legacy := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(legacy, "raft"), 0755))
+	require.ErrorIs(t, checkPartitions(legacy, 2), ErrorPartitionCount)
+	require.NoError(t, checkPartitions(legacy, 1))
+	require.NoError(t, checkPartitions(legacy, 1))
+}
+
+// placedLeaders returns the leader of each partition, the first server of its placement
+func placedLeaders(nodes []*PartitionedStorage, partitionCount int) []string {
+	members := nodes[0].rebalancer.copyMembers()
+	leaders := make([]string, partitionCount)
+	for i := range leaders {
+		leaders[i] = string(nodes[0].rebalancer.placement(i, members)[0].ID)
+	}
+	return leaders
+}
+
+// nodeOf returns the node of the id, the node i has the id i
+func nodeOf(nodes []*PartitionedStorage, id string) *PartitionedStorage {
+	i, _ := strconv.Atoi(id)
+	return nodes[i]
+}
+
+// rebalanceNode opens the partitions of the node i, partition 0 bootstraps on the node 0
+func rebalanceNode(t *testing.T, i, port, partitionCount int, rebalance Rebalance) (*PartitionedStorage, string) {
+	obs := observability.Observability{}
+	dataDir, err := ioutil.TempDir("", "partitioned-test")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dataDir)
+	})
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+
+	config := Config{}
+	config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.BindAddr = ln.Addr().String()
+	config.Raft.Bootstrap = i == 0
+	config.Rebalance = rebalance
+	config.Rebalance.Interval = 20 * time.Millisecond
+	p, err := NewPartitionedStorage(dataDir, config, NewStreamLayers(ln, partitionCount, nil, nil), 2, 100, &obs)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+	return p, ln.Addr().String()
+}
+
+func TestThrottle(t *testing.T) {
+	var none *throttle
+	none.wait(1 << 20)
+	newThrottle(0).wait(1 << 20)
+
+	th := newThrottle(10000)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		th.wait(1000)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+}
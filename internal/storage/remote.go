@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"context"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/models"
+)
+
+// Remote reads a partition from the node at addr, its leader. The requests are restricted
+// to the partition(see WithPartition) and carry the consistency of ctx
+type Remote interface {
+	GetWithVersion(ctx context.Context, addr string, partition int, key string) (interface{}, uint64, error)
+	// KeysPage returns the keys from the cursor, its shard counts the shards of the partitions before
+	KeysPage(ctx context.Context, addr string, partition int, cursor models.KeysCursor, limit int) ([]string, models.KeysCursor, bool, error)
+	Scan(ctx context.Context, addr string, partition int, start, end string, limit int) ([]models.KeysValues, error)
+	// KeysValues closes the channel once the partition is read
+	KeysValues(ctx context.Context, addr string, partition int, ch chan models.KeysValues) error
+	Watch(ctx context.Context, addr string, partition int, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error)
+}
+
+type partitionKey struct{}
+
+type consistencyKey struct{}
+
+type startIndexesKey struct{}
+
+// WithPartition restricts the reads of ctx to the partition, the node serves them
+// or fails with raft.ErrNotLeader, it does not read them from another node
+func WithPartition(ctx context.Context, partition int) context.Context {
+	return context.WithValue(ctx, partitionKey{}, partition)
+}
+
+// PartitionFrom returns the partition the reads of ctx are restricted to
+func PartitionFrom(ctx context.Context) (int, bool) {
+	p, ok := ctx.Value(partitionKey{}).(int)
+	return p, ok
+}
+
+// WithConsistency tells the reads of ctx the consistency Consistent checked, a partition
+// the node does not serve at this consistency is read from its leader
+func WithConsistency(ctx context.Context, c api.Consistency) context.Context {
+	return context.WithValue(ctx, consistencyKey{}, c)
+}
+
+// WithStartIndexes tells the watch of ctx the index each partition resumes from
+func WithStartIndexes(ctx context.Context, indexes map[int32]uint64) context.Context {
+	return context.WithValue(ctx, startIndexesKey{}, indexes)
+}
+
+// startIndexOf returns the start index of the partition, startIndex if ctx has none
+func startIndexOf(ctx context.Context, partition int, startIndex uint64) uint64 {
+	indexes, _ := ctx.Value(startIndexesKey{}).(map[int32]uint64)
+	if index, ok := indexes[int32(partition)]; ok {
+		return index
+	}
+	return startIndex
+}
+
+// ConsistencyOf returns the consistency of the reads of ctx, stale if none is set
+func ConsistencyOf(ctx context.Context) api.Consistency {
+	if c, ok := ctx.Value(consistencyKey{}).(api.Consistency); ok {
+		return c
+	}
+	return api.Consistency_STALE
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/djedjethai/generation/internal/models"
+)
+
+// Scan reads the keys from the index by chunks, without holding its lock while
+// the shards are read. A key removed in between is skipped
+func (m ShardedMap) Scan(ctx context.Context, start, end string, limit int) ([]models.KeysValues, error) {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageScan")
+	defer teardown()
+
+	now := time.Now().UnixNano()
+
+	var kvs []models.KeysValues
+	for len(kvs) < limit {
+		keys := m.index.keys(start, end, limit-len(kvs))
+		if len(keys) == 0 {
+			break
+		}
+		for _, key := range keys {
+			if kv, ok := m.peek(key, now); ok {
+				kvs = append(kvs, kv)
+			}
+		}
+		// the smallest key after the last one
+		start = keys[len(keys)-1] + "\x00"
+	}
+
+	return kvs, nil
+}
+
+// peek reads the key without moving it in the lru
+func (m ShardedMap) peek(key string, now int64) (models.KeysValues, bool) {
+	shard := m.getShard(key)
+
+	shard.RLock()
+	defer shard.RUnlock()
+
+	nd, ok := shard.m[key]
+	if !ok || nd.isExpired(now) {
+		return models.KeysValues{}, false
+	}
+	return models.KeysValues{
+		Key:       key,
+		Value:     nd.value(),
+		ExpiresAt: nd.expiresAt,
+		Version:   nd.version,
+	}, true
+}
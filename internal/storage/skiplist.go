@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	skipMaxLevel = 32
+	// 1 chance out of skipP for a key to be promoted to the next level
+	skipP = 4
+)
+
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// keyIndex keeps all the keys of the ShardedMap in order, for the scans.
+// The shards update it under their own lock, so it is locked after the shard
+type keyIndex struct {
+	mu    sync.RWMutex
+	head  *skipNode
+	level int
+	rnd   *rand.Rand
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{
+		head:  &skipNode{next: make([]*skipNode, skipMaxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (ix *keyIndex) reset() {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.head = &skipNode{next: make([]*skipNode, skipMaxLevel)}
+	ix.level = 1
+}
+
+func (ix *keyIndex) randomLevel() int {
+	lvl := 1
+	for lvl < skipMaxLevel && ix.rnd.Intn(skipP) == 0 {
+		lvl++
+	}
+	return lvl
+}
+
+// the last node of each level which is before key, the lock must be held
+func (ix *keyIndex) predecessors(key string) []*skipNode {
+	update := make([]*skipNode, skipMaxLevel)
+	x := ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		update[i] = x
+	}
+	return update
+}
+
+// insert adds the key, nothing happens if it is already there
+func (ix *keyIndex) insert(key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	update := ix.predecessors(key)
+	if nx := update[0].next[0]; nx != nil && nx.key == key {
+		return
+	}
+
+	lvl := ix.randomLevel()
+	if lvl > ix.level {
+		for i := ix.level; i < lvl; i++ {
+			update[i] = ix.head
+		}
+		ix.level = lvl
+	}
+
+	nd := &skipNode{key: key, next: make([]*skipNode, lvl)}
+	for i := 0; i < lvl; i++ {
+		nd.next[i] = update[i].next[i]
+		update[i].next[i] = nd
+	}
+}
+
+func (ix *keyIndex) remove(key string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	update := ix.predecessors(key)
+	nd := update[0].next[0]
+	if nd == nil || nd.key != key {
+		return
+	}
+
+	for i := 0; i < len(nd.next); i++ {
+		update[i].next[i] = nd.next[i]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+}
+
+// keys returns at most n keys from start(included) to end(excluded),
+// an empty end means up to the last key
+func (ix *keyIndex) keys(start, end string, n int) []string {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	var keys []string
+	x := ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < start {
+			x = x.next[i]
+		}
+	}
+	for x = x.next[0]; x != nil && len(keys) < n; x = x.next[0] {
+		if end != "" && x.key >= end {
+			break
+		}
+		keys = append(keys, x.key)
+	}
+	return keys
+}
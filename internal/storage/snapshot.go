@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"google.golang.org/protobuf/proto"
+)
+
+// The snapshot of the fsm is
+//
+//	magic "GSNP" | version uint32 | chunks
+//
+// a chunk is
+//
+//	type uint8 | length uint32 | crc32c of the payload uint32 | payload
+//
+// The payload of a records chunk is a list of records, each prefixed by its uvarint length.
+// The last chunk is the end chunk, its payload is the number of records, so a truncated
+// snapshot is detected. The integers are big endian.
+// Since the version 2 the payloads are sealed by the codec(compressed and/or encrypted),
+// the crc is the one of the sealed payload. Since the version 3 the records evicted to the
+// disk tier follow the ones in memory, in tier chunks
+const (
+	snapshotVersion = 3
+	// the records are flushed to the sink by chunks of about this size
+	snapshotChunkSize = 64 << 10
+	// the header of a chunk
+	chunkHeaderSize = 9
+)
+
+const (
+	chunkRecords uint8 = iota + 1
+	chunkEnd
+	// the records of the disk tier
+	chunkTier
+)
+
+var snapshotMagic = []byte("GSNP")
+
+var (
+	ErrorSnapshotCorrupted = errors.New("snapshot corrupted")
+	ErrorSnapshotVersion   = errors.New("unknown snapshot version")
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotWriter writes the records by chunks, a chunk at a time is in memory
+type snapshotWriter struct {
+	w     io.Writer
+	codec *codec.Codec
+	chunk []byte
+	// the type of the pending chunk
+	typ   uint8
+	rec   []byte
+	count uint64
+}
+
+func newSnapshotWriter(w io.Writer, cdc *codec.Codec) (*snapshotWriter, error) {
+	header := make([]byte, len(snapshotMagic)+4)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint32(header[len(snapshotMagic):], snapshotVersion)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &snapshotWriter{
+		w:     w,
+		codec: cdc,
+		chunk: make([]byte, 0, snapshotChunkSize),
+	}, nil
+}
+
+func (sw *snapshotWriter) write(rec *command.Record) error {
+	return sw.add(chunkRecords, rec)
+}
+
+// writeEvicted writes a record of the disk tier, after the ones in memory
+func (sw *snapshotWriter) writeEvicted(rec *command.Record) error {
+	return sw.add(chunkTier, rec)
+}
+
+func (sw *snapshotWriter) add(typ uint8, rec *command.Record) error {
+	if len(sw.chunk) > 0 && typ != sw.typ {
+		if err := sw.flush(sw.typ); err != nil {
+			return err
+		}
+	}
+	sw.typ = typ
+	var err error
+	sw.rec, err = proto.MarshalOptions{}.MarshalAppend(sw.rec[:0], rec)
+	if err != nil {
+		return err
+	}
+	sw.chunk = binary.AppendUvarint(sw.chunk, uint64(len(sw.rec)))
+	sw.chunk = append(sw.chunk, sw.rec...)
+	sw.count++
+	if len(sw.chunk) >= snapshotChunkSize {
+		return sw.flush(typ)
+	}
+	return nil
+}
+
+// flush writes the pending records as a chunk of the type
+func (sw *snapshotWriter) flush(typ uint8) error {
+	payload, err := sw.codec.Seal(sw.chunk)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, chunkHeaderSize)
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[5:], crc32.Checksum(payload, crc32c))
+	if _, err := sw.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(payload); err != nil {
+		return err
+	}
+	sw.chunk = sw.chunk[:0]
+	return nil
+}
+
+// close flushes the last records then writes the end chunk
+func (sw *snapshotWriter) close() error {
+	if len(sw.chunk) > 0 {
+		if err := sw.flush(sw.typ); err != nil {
+			return err
+		}
+	}
+	sw.chunk = binary.BigEndian.AppendUint64(sw.chunk, sw.count)
+	return sw.flush(chunkEnd)
+}
+
+// readSnapshot calls fn with each record of the snapshot, evicted tells the record is one
+// of the disk tier. A snapshot without the magic is the one written before the snapshots
+// had a version, see readLines
+func readSnapshot(r io.Reader, cdc *codec.Codec, fn func(rec *command.Record, evicted bool) error) error {
+	br := bufio.NewReaderSize(r, snapshotChunkSize)
+	if magic, _ := br.Peek(len(snapshotMagic)); !bytes.Equal(magic, snapshotMagic) {
+		return readLines(br, fn)
+	}
+
+	header := make([]byte, len(snapshotMagic)+4)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return ErrorSnapshotCorrupted
+	}
+	version := binary.BigEndian.Uint32(header[len(snapshotMagic):])
+	if version < 1 || version > snapshotVersion {
+		return ErrorSnapshotVersion
+	}
+
+	var count uint64
+	chunk := make([]byte, chunkHeaderSize)
+	payload := new(bytes.Buffer)
+	for {
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			// the end chunk is missing
+			return ErrorSnapshotCorrupted
+		}
+		if err := readFull(br, payload, uint64(binary.BigEndian.Uint32(chunk[1:]))); err != nil {
+			return err
+		}
+		if crc32.Checksum(payload.Bytes(), crc32c) != binary.BigEndian.Uint32(chunk[5:]) {
+			return ErrorSnapshotCorrupted
+		}
+		plain := payload.Bytes()
+		if version > 1 {
+			var err error
+			if plain, err = cdc.Open(plain); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case chunk[0] == chunkRecords, chunk[0] == chunkTier && version > 2:
+			n, err := readRecords(bytes.NewReader(plain), chunk[0] == chunkTier, fn)
+			count += n
+			if err != nil {
+				return err
+			}
+		case chunk[0] == chunkEnd:
+			if len(plain) != 8 || binary.BigEndian.Uint64(plain) != count {
+				return ErrorSnapshotCorrupted
+			}
+			return nil
+		default:
+			return ErrorSnapshotCorrupted
+		}
+	}
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readRecords calls fn with each length prefixed record until the end of r,
+// it returns the number of records read
+func readRecords(r byteReader, evicted bool, fn func(rec *command.Record, evicted bool) error) (uint64, error) {
+	var n uint64
+	b := new(bytes.Buffer)
+	for {
+		size, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, ErrorSnapshotCorrupted
+		}
+		if err := readFull(r, b, size); err != nil {
+			return n, err
+		}
+		rec := &command.Record{}
+		if err := proto.Unmarshal(b.Bytes(), rec); err != nil {
+			return n, ErrorSnapshotCorrupted
+		}
+		if err := fn(rec, evicted); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// readLines calls fn with each record of a snapshot written before the version, each record
+// is the key and the string value marshaled then a newline. The bytes of the records may
+// contain some newlines, so the fields are read one by one: they are in order, and the tag
+// of the key(a newline too) following a field is the newline
+func readLines(r *bufio.Reader, fn func(rec *command.Record, evicted bool) error) error {
+	const (
+		keyTag   = 1<<3 | 2
+		valueTag = 2<<3 | 2
+	)
+	b := new(bytes.Buffer)
+	for {
+		tag, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		rec := &command.Record{}
+		for last := byte(0); ; {
+			if err != nil {
+				// the newline is missing
+				return ErrorSnapshotCorrupted
+			}
+			// the newline
+			if tag == keyTag && last != 0 {
+				break
+			}
+			if tag != keyTag && tag != valueTag || tag <= last {
+				return ErrorSnapshotCorrupted
+			}
+			var size uint64
+			if size, err = binary.ReadUvarint(r); err != nil {
+				return ErrorSnapshotCorrupted
+			}
+			if err := readFull(r, b, size); err != nil {
+				return err
+			}
+			if tag == keyTag {
+				rec.Key = b.String()
+			} else {
+				rec.Value = b.String()
+			}
+			last = tag
+			tag, err = r.ReadByte()
+		}
+		if err := fn(rec, false); err != nil {
+			return err
+		}
+	}
+}
+
+// readFull reads the size bytes into buf, which grows with the bytes read
+// rather than with a size that may be corrupted
+func readFull(r io.Reader, buf *bytes.Buffer, size uint64) error {
+	buf.Reset()
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(size)))
+	if err != nil {
+		return err
+	}
+	if uint64(n) != size {
+		return ErrorSnapshotCorrupted
+	}
+	return nil
+}
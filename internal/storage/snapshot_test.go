@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+type bufferSink struct {
+	bytes.Buffer
+	canceled bool
+}
+
+func (s *bufferSink) ID() string    { return "buffer" }
+func (s *bufferSink) Cancel() error { s.canceled = true; return nil }
+func (s *bufferSink) Close() error  { return nil }
+
+var _ raft.SnapshotSink = (*bufferSink)(nil)
+
+func persist(t testing.TB, sm *ShardedMap, cdc *codec.Codec) []byte {
+	f := &fsm{sm: sm, codec: cdc}
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	defer snap.Release()
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	return sink.Bytes()
+}
+
+func restore(t testing.TB, sm *ShardedMap, cdc *codec.Codec, b []byte) error {
+	f := &fsm{sm: sm, codec: cdc}
+	return f.Restore(io.NopCloser(bytes.NewReader(b)))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	sm := NewShardedMap(4, 0, &obs)
+
+	values := map[string]interface{}{
+		"string":  "line\nline\n",
+		"binary":  []byte{0, '\n', 0xff, '\r', 0, 1},
+		"int":     int64(-42),
+		"float":   3.5,
+		"json":    json.RawMessage(`{"a":"b\n"}`),
+		"big":     bytes.Repeat([]byte("\n\x00"), 100<<10),
+		"counter": int64(1),
+	}
+	for key, value := range values {
+		require.NoError(t, sm.Set(ctx, key, value, 0))
+	}
+	require.NoError(t, sm.Set(ctx, "ttl", "value", time.Hour))
+
+	snap, err := (&fsm{sm: &sm}).Snapshot()
+	require.NoError(t, err)
+	// the writes after the snapshot are not in it
+	_, err = sm.Incr(ctx, "counter", 1)
+	require.NoError(t, err)
+	require.NoError(t, sm.Set(ctx, "string", "changed", 0))
+	require.NoError(t, sm.Set(ctx, "later", "value", 0))
+	sink := &bufferSink{}
+	require.NoError(t, snap.Persist(sink))
+	require.False(t, sink.canceled)
+
+	// the previous state of the restored map is cleared
+	restored := NewShardedMap(3, 0, &obs)
+	require.NoError(t, restored.Set(ctx, "stale", "value", 0))
+	require.NoError(t, restore(t, &restored, nil, sink.Bytes()))
+
+	require.Len(t, allKeys(t, restored), len(values)+1)
+	for key, value := range values {
+		got, err := restored.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, value, got, key)
+	}
+	for _, key := range []string{"ttl", "big"} {
+		before, after := sm.getShard(key), restored.getShard(key)
+		before.RLock()
+		after.RLock()
+		require.Equal(t, before.m[key].expiresAt, after.m[key].expiresAt)
+		require.Equal(t, before.m[key].version, after.m[key].version)
+		after.RUnlock()
+		before.RUnlock()
+	}
+	_, err = restored.Get(ctx, "stale")
+	require.Equal(t, ErrorNoSuchKey, err)
+}
+
+func TestSnapshotCorrupted(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	sm := NewShardedMap(2, 0, &obs)
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key-%d", i), "value", 0))
+	}
+	b := persist(t, &sm, nil)
+	restored := NewShardedMap(2, 0, &obs)
+
+	flipped := append([]byte(nil), b...)
+	flipped[len(flipped)/2] ^= 0xff
+	require.Equal(t, ErrorSnapshotCorrupted, restore(t, &restored, nil, flipped))
+
+	// the end chunk(its header, the header of the codec and the count) is missing
+	require.Equal(t, ErrorSnapshotCorrupted, restore(t, &restored, nil, b[:len(b)-chunkHeaderSize-1-8]))
+	require.Equal(t, ErrorSnapshotCorrupted, restore(t, &restored, nil, b[:len(b)/2]))
+
+	// a length past the end of the snapshot
+	huge := append([]byte(nil), b...)
+	binary.BigEndian.PutUint32(huge[len(snapshotMagic)+4+1:], 1<<31)
+	require.Equal(t, ErrorSnapshotCorrupted, restore(t, &restored, nil, huge))
+
+	next := append([]byte(nil), b...)
+	binary.BigEndian.PutUint32(next[len(snapshotMagic):], snapshotVersion+1)
+	require.Equal(t, ErrorSnapshotVersion, restore(t, &restored, nil, next))
+
+	require.NoError(t, restore(t, &restored, nil, b))
+	require.Len(t, allKeys(t, restored), 5000)
+}
+
+func TestSnapshotSealed(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	keys, err := codec.ParseKeys("1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, err)
+	cdc, err := codec.New(codec.CompressionZstd, keys)
+	require.NoError(t, err)
+
+	sm := NewShardedMap(2, 0, &obs)
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key-%d", i), "customer data", 0))
+	}
+	b := persist(t, &sm, cdc)
+	require.False(t, bytes.Contains(b, []byte("customer data")))
+	require.Less(t, len(b), len(persist(t, &sm, nil)))
+
+	restored := NewShardedMap(3, 0, &obs)
+	require.Equal(t, codec.ErrorUnknownKey, restore(t, &restored, nil, b))
+	require.NoError(t, restore(t, &restored, cdc, b))
+	require.Len(t, allKeys(t, restored), 5000)
+	value, err := restored.Get(ctx, "key-42")
+	require.NoError(t, err)
+	require.Equal(t, "customer data", value)
+}
+
+// the payloads of the version 1 are not sealed
+func TestSnapshotVersion1(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+
+	typed, err := api.NewValue("value")
+	require.NoError(t, err)
+	rec, err := proto.Marshal(&api.Records{Key: "key", TypedValue: typed, Version: 1})
+	require.NoError(t, err)
+
+	b := append([]byte(nil), snapshotMagic...)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	chunk := func(typ uint8, payload []byte) {
+		b = append(b, typ)
+		b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+		b = binary.BigEndian.AppendUint32(b, crc32.Checksum(payload, crc32c))
+		b = append(b, payload...)
+	}
+	chunk(chunkRecords, append(binary.AppendUvarint(nil, uint64(len(rec))), rec...))
+	chunk(chunkEnd, binary.BigEndian.AppendUint64(nil, 1))
+
+	sm := NewShardedMap(2, 0, &obs)
+	require.NoError(t, restore(t, &sm, nil, b))
+	value, err := sm.Get(ctx, "key")
+	require.NoError(t, err)
+	require.Equal(t, "value", value)
+}
+
+// baselineSnapshot writes the records as the fsm did before the snapshots had a version
+func baselineSnapshot(t testing.TB, records map[string]string) []byte {
+	buf := new(bytes.Buffer)
+	for key, value := range records {
+		b, err := proto.Marshal(&api.Records{Key: key, Value: value})
+		require.NoError(t, err)
+		buf.Write(b)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotWithoutVersion(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+
+	records := map[string]string{"empty": ""}
+	for i := 0; i < 10; i++ {
+		records[fmt.Sprintf("key-%d", i)] = fmt.Sprintf("value\n%d", i)
+	}
+	// the newline and the tags of the fields in the keys and the values
+	records["\n\x12"] = "\n\n\x12\x0a"
+	records[strings.Repeat("k", 200)] = strings.Repeat("\n", 300)
+	b := baselineSnapshot(t, records)
+
+	sm := NewShardedMap(2, 0, &obs)
+	require.NoError(t, sm.Set(ctx, "stale", "value", 0))
+	require.NoError(t, restore(t, &sm, nil, b))
+	require.Len(t, allKeys(t, sm), len(records))
+	for key, value := range records {
+		got, err := sm.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, value, got, key)
+	}
+
+	// the last newline is missing
+	require.Equal(t, ErrorSnapshotCorrupted, restore(t, &sm, nil, b[:len(b)-1]))
+	require.Equal(t, ErrorSnapshotCorrupted, restore(t, &sm, nil, []byte("not a snapshot")))
+
+	require.NoError(t, restore(t, &sm, nil, nil))
+	require.Len(t, allKeys(t, sm), 0)
+}
+
+// the format streams any number of records, a chunk at a time
+func TestSnapshotMillionKeys(t *testing.T) {
+	const keys = 1<<20 + 1
+	obs := observability.Observability{}
+	ctx := context.Background()
+	value := func(i int) []byte { return []byte{byte(i), '\n', byte(i >> 8), 0} }
+	cdc, err := codec.New(codec.CompressionZstd, nil)
+	require.NoError(t, err)
+
+	// a few thousands records are evicted to the tier
+	withTier := func() (ShardedMap, *DiskTier) {
+		tier, err := NewDiskTier(t.TempDir(), 1<<30, cdc, &obs)
+		require.NoError(t, err)
+		t.Cleanup(func() { tier.Close() })
+		sm := NewShardedMap(8, keys/8-1<<10, &obs)
+		sm.SetEvictionHook(tier)
+		return sm, tier
+	}
+
+	sm, tier := withTier()
+	for i := 0; i < keys; i++ {
+		if err := sm.Set(ctx, strconv.Itoa(i), value(i), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evicted := tier.Len()
+	require.Greater(t, evicted, 1<<12)
+	b := persist(t, &sm, cdc)
+
+	restored, restoredTier := withTier()
+	require.NoError(t, restored.Set(ctx, "stale", "value", 0))
+	require.NoError(t, restore(t, &restored, cdc, b))
+
+	// the asserts of testify are too slow for a million records
+	count, err := restored.CountKeys(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, keys-evicted, count)
+	require.Equal(t, evicted, restoredTier.Len())
+	for i := 0; i < keys; i += 997 {
+		got, err := restored.Get(ctx, strconv.Itoa(i))
+		if err != nil || !bytes.Equal(got.([]byte), value(i)) {
+			t.Fatalf("key %d: %v %v", i, got, err)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/objstore"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	SnapshotsFile = "file"
+	SnapshotsS3   = "s3"
+)
+
+const (
+	snapshotStateKey = "state.bin"
+	snapshotMetaKey  = "meta.json"
+	// max time a restore waits to be taken by raft
+	restoreTimeout = time.Minute
+)
+
+var (
+	ErrorSnapshotStore     = errors.New("unknown snapshot store, file or s3")
+	ErrorNoSuchSnapshot    = errors.New("no such snapshot")
+	ErrorNoSuchPartition   = errors.New("no such partition")
+	ErrorNotReplicated     = errors.New("the storage is not replicated, it has no snapshot")
+	ErrorSnapshotPartition = errors.New("the snapshot has keys of another partition, the cluster must have the partitions of the cluster of the snapshot")
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// snapshotMeta is the meta of raft's FileSnapshotStore, its snapshots are still read
+type snapshotMeta struct {
+	raft.SnapshotMeta
+	CRC []byte
+}
+
+// snapshotStore keeps the raft snapshots of a group in an object store. A snapshot is the
+// objects <id>/state.bin and <id>/meta.json, the layout of raft's FileSnapshotStore.
+// The meta is written last, a snapshot without it is incomplete and removed
+type snapshotStore struct {
+	store objstore.Store
+	// the snapshots of the group in the store
+	prefix string
+	retain int
+	maxAge time.Duration
+
+	mu sync.Mutex
+	// the ids of the snapshots being written
+	creating map[string]bool
+}
+
+// newSnapshotStore opens the store of the config, the snapshots of the data dir
+// are in raft/snapshots and the ones of s3 under <prefix>/<node id>/<partition>
+func newSnapshotStore(dataDir string, conf Snapshots, id raft.ServerID) (*snapshotStore, error) {
+	s := &snapshotStore{
+		retain:   conf.Retain,
+		maxAge:   conf.MaxAge,
+		creating: make(map[string]bool),
+	}
+	if s.retain < 1 {
+		s.retain = 1
+	}
+	var err error
+	switch conf.Store {
+	case "", SnapshotsFile:
+		s.store, err = objstore.NewDir(filepath.Join(dataDir, "raft", "snapshots"))
+	case SnapshotsS3:
+		c := conf.S3
+		if c.TempDir == "" {
+			c.TempDir = filepath.Join(dataDir, "raft")
+		}
+		if err := os.MkdirAll(c.TempDir, 0755); err != nil {
+			return nil, err
+		}
+		s.store, err = objstore.NewS3(c)
+		s.prefix = path.Join(conf.Prefix, string(id), conf.partition) + "/"
+	default:
+		return nil, ErrorSnapshotStore
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *snapshotStore) key(id, name string) string {
+	return s.prefix + id + "/" + name
+}
+
+// Create is called by raft when the fsm is persisted, and when a snapshot is received or restored
+func (s *snapshotStore) Create(version raft.SnapshotVersion, index, term uint64, configuration raft.Configuration,
+	configurationIndex uint64, trans raft.Transport) (raft.SnapshotSink, error) {
+	id := fmt.Sprintf("%d-%d-%d", term, index, time.Now().UnixMilli())
+	w, err := s.store.Create(s.key(id, snapshotStateKey))
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.creating[id] = true
+	s.mu.Unlock()
+	return &snapshotSink{
+		store: s,
+		w:     w,
+		crc:   crc64.New(crc64Table),
+		meta: snapshotMeta{SnapshotMeta: raft.SnapshotMeta{
+			Version:            version,
+			ID:                 id,
+			Index:              index,
+			Term:               term,
+			Configuration:      configuration,
+			ConfigurationIndex: configurationIndex,
+		}},
+	}, nil
+}
+
+// List returns the complete snapshots, the latest first
+func (s *snapshotStore) List() ([]*raft.SnapshotMeta, error) {
+	snapshots, _, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+	metas := make([]*raft.SnapshotMeta, 0, len(snapshots))
+	for _, meta := range snapshots {
+		metas = append(metas, &meta.SnapshotMeta)
+	}
+	return metas, nil
+}
+
+// Open returns the state of the snapshot, its crc is checked once read to its end
+func (s *snapshotStore) Open(id string) (*raft.SnapshotMeta, io.ReadCloser, error) {
+	meta, err := s.meta(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := s.store.Open(s.key(id, snapshotStateKey))
+	if err == objstore.ErrorNotFound {
+		return nil, nil, ErrorNoSuchSnapshot
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &meta.SnapshotMeta, &crcReader{ReadCloser: r, crc: crc64.New(crc64Table), sum: meta.CRC, index: meta.Index}, nil
+}
+
+func (s *snapshotStore) meta(id string) (*snapshotMeta, error) {
+	r, err := s.store.Open(s.key(id, snapshotMetaKey))
+	if err == objstore.ErrorNotFound {
+		return nil, ErrorNoSuchSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	meta := &snapshotMeta{}
+	if err := json.NewDecoder(r).Decode(meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// list returns the complete snapshots sorted as raft does, the latest first,
+// and the ids of the incomplete ones(being written or not)
+func (s *snapshotStore) list() ([]*snapshotMeta, []string, error) {
+	keys, err := s.store.List(s.prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the ids and whether they have their meta
+	ids := make(map[string]bool)
+	for _, key := range keys {
+		id, name, ok := strings.Cut(strings.TrimPrefix(key, s.prefix), "/")
+		if ok {
+			// the temporary directories of raft's FileSnapshotStore are never complete
+			ids[id] = ids[id] || (name == snapshotMetaKey && !strings.HasSuffix(id, ".tmp"))
+		}
+	}
+
+	var snapshots []*snapshotMeta
+	var incomplete []string
+	for id, complete := range ids {
+		if !complete {
+			incomplete = append(incomplete, id)
+			continue
+		}
+		meta, err := s.meta(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		snapshots = append(snapshots, meta)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if a.Term != b.Term {
+			return a.Term > b.Term
+		}
+		if a.Index != b.Index {
+			return a.Index > b.Index
+		}
+		return a.ID > b.ID
+	})
+	return snapshots, incomplete, nil
+}
+
+// reap removes the snapshots past the retention and the incomplete ones not being written,
+// the latest snapshot is kept whatever its age
+func (s *snapshotStore) reap() error {
+	snapshots, incomplete, err := s.list()
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for i, meta := range snapshots {
+		if i >= s.retain || (i > 0 && s.maxAge > 0 && time.Since(snapshotTime(meta.ID)) > s.maxAge) {
+			ids = append(ids, meta.ID)
+		}
+	}
+	s.mu.Lock()
+	for _, id := range incomplete {
+		if !s.creating[id] {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		// without its meta first, the snapshot is no longer listed
+		for _, name := range []string{snapshotMetaKey, snapshotStateKey} {
+			if err := s.store.Delete(s.key(id, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *snapshotStore) done(id string) {
+	s.mu.Lock()
+	delete(s.creating, id)
+	s.mu.Unlock()
+}
+
+// snapshotTime returns the time in the id, term-index-milliseconds as raft does
+func snapshotTime(id string) time.Time {
+	ms, _ := strconv.ParseInt(id[strings.LastIndexByte(id, '-')+1:], 10, 64)
+	return time.UnixMilli(ms)
+}
+
+type snapshotSink struct {
+	store *snapshotStore
+	w     objstore.Writer
+	crc   hash.Hash64
+	meta  snapshotMeta
+	// Persist closes the sink, then raft closes it again
+	closed bool
+}
+
+func (s *snapshotSink) ID() string {
+	return s.meta.ID
+}
+
+func (s *snapshotSink) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	s.crc.Write(p[:n])
+	s.meta.Size += int64(n)
+	return n, err
+}
+
+// Close stores the state then the meta, and removes the snapshots past the retention
+func (s *snapshotSink) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	defer s.store.done(s.meta.ID)
+	if err := s.w.Close(); err != nil {
+		return err
+	}
+	s.meta.CRC = s.crc.Sum(nil)
+	b, err := json.Marshal(s.meta)
+	if err != nil {
+		return err
+	}
+	w, err := s.store.store.Create(s.store.key(s.meta.ID, snapshotMetaKey))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		_ = w.Abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return s.store.reap()
+}
+
+func (s *snapshotSink) Cancel() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	defer s.store.done(s.meta.ID)
+	return s.w.Abort()
+}
+
+type crcReader struct {
+	io.ReadCloser
+	crc hash.Hash64
+	sum []byte
+	// the last entry in the snapshot, raft restores the fsm from the reader only
+	index uint64
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.crc.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(r.crc.Sum(nil), r.sum) {
+		return n, ErrorSnapshotCorrupted
+	}
+	return n, err
+}
+
+func snapshotInfo(partition int, meta *raft.SnapshotMeta) *api.SnapshotInfo {
+	return &api.SnapshotInfo{
+		Partition: uint32(partition),
+		Id:        meta.ID,
+		Index:     meta.Index,
+		Term:      meta.Term,
+		Size:      meta.Size,
+		CreatedAt: snapshotTime(meta.ID).UnixMilli(),
+	}
+}
+
+// createSnapshot persists the fsm, raft has nothing to persist
+// until an entry is applied, then the latest snapshot is returned if any
+func (l *DistributedStorage) createSnapshot(partition int) (*api.SnapshotInfo, error) {
+	f := l.raft.Snapshot()
+	err := f.Error()
+	if err == raft.ErrNothingNewToSnapshot {
+		snapshots, lerr := l.listSnapshots(partition)
+		if lerr != nil || len(snapshots) == 0 {
+			return nil, err
+		}
+		return snapshots[0], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta, r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	r.Close()
+	return snapshotInfo(partition, meta), nil
+}
+
+func (l *DistributedStorage) listSnapshots(partition int) ([]*api.SnapshotInfo, error) {
+	metas, err := l.snapshots.List()
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*api.SnapshotInfo, 0, len(metas))
+	for _, meta := range metas {
+		snapshots = append(snapshots, snapshotInfo(partition, meta))
+	}
+	return snapshots, nil
+}
+
+// openSnapshot returns the snapshot of the id, the latest one if id is empty
+func (l *DistributedStorage) openSnapshot(partition int, id string) (*api.SnapshotInfo, io.ReadCloser, error) {
+	if id == "" {
+		metas, err := l.snapshots.List()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(metas) == 0 {
+			return nil, nil, ErrorNoSuchSnapshot
+		}
+		id = metas[0].ID
+	}
+	meta, r, err := l.snapshots.Open(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	return snapshotInfo(partition, meta), r, nil
+}
+
+// restoreSnapshot replaces the state of the group with the snapshot, on all its nodes.
+// The node must be the leader. The snapshot is spooled and read once before, raft panics
+// if the fsm fails to restore it. owns(nil for all) tells the keys of the partition
+func (l *DistributedStorage) restoreSnapshot(partition int, r io.Reader, owns func(string) bool) (*api.SnapshotInfo, error) {
+	if l.raft.State() != raft.Leader {
+		return nil, raft.ErrNotLeader
+	}
+	f, err := os.CreateTemp(filepath.Join(l.dataDir, "raft"), "restore-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	// the versions are indexes of the log, the next entries must come after them
+	var index uint64
+	err = readSnapshot(f, l.config.Codec, func(rec *command.Record, _ bool) error {
+		if owns != nil && !owns(rec.Key) {
+			return ErrorSnapshotPartition
+		}
+		if rec.Version > index {
+			index = rec.Version
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	meta := &raft.SnapshotMeta{Version: raft.SnapshotVersionMax, Index: index, Size: size}
+	if err := l.raft.Restore(meta, f, restoreTimeout); err != nil {
+		return nil, err
+	}
+	snapshots, err := l.listSnapshots(partition)
+	if err != nil {
+		return nil, err
+	}
+	return snapshots[0], nil
+}
+
+// CreateSnapshot persists the fsm of the group
+func (l *DistributedStorage) CreateSnapshot(ctx context.Context) ([]*api.SnapshotInfo, error) {
+	info, err := l.createSnapshot(0)
+	if err != nil {
+		return nil, err
+	}
+	return []*api.SnapshotInfo{info}, nil
+}
+
+func (l *DistributedStorage) ListSnapshots(ctx context.Context) ([]*api.SnapshotInfo, error) {
+	return l.listSnapshots(0)
+}
+
+func (l *DistributedStorage) OpenSnapshot(ctx context.Context, partition int, id string) (*api.SnapshotInfo, io.ReadCloser, error) {
+	if partition != 0 {
+		return nil, nil, ErrorNoSuchPartition
+	}
+	return l.openSnapshot(0, id)
+}
+
+func (l *DistributedStorage) RestoreSnapshot(ctx context.Context, partition int, r io.Reader) (*api.SnapshotInfo, error) {
+	if partition != 0 {
+		return nil, ErrorNoSuchPartition
+	}
+	return l.restoreSnapshot(0, r, nil)
+}
@@ -0,0 +1,255 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/djedjethai/generation/internal/objstore/s3test"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"github.com/travisjeffery/go-dynaport"
+)
+
+func TestSnapshotStoreRetention(t *testing.T) {
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	for name, conf := range map[string]Snapshots{
+		"file": {Retain: 2},
+		"s3":   {Store: SnapshotsS3, Retain: 2, S3: srv.Config("bucket"), Prefix: "backups"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s, err := newSnapshotStore(t.TempDir(), conf, "node")
+			require.NoError(t, err)
+			create := func(index uint64, state string) string {
+				sink, err := s.Create(raft.SnapshotVersionMax, index, 1, raft.Configuration{}, 1, nil)
+				require.NoError(t, err)
+				_, err = io.WriteString(sink, state)
+				require.NoError(t, err)
+				require.NoError(t, sink.Close())
+				return sink.ID()
+			}
+			list := func() []string {
+				metas, err := s.List()
+				require.NoError(t, err)
+				var ids []string
+				for _, meta := range metas {
+					ids = append(ids, meta.ID)
+				}
+				return ids
+			}
+
+			first := create(1, "first")
+			second := create(2, "second")
+			// a snapshot being written is neither listed nor removed
+			writing, err := s.Create(raft.SnapshotVersionMax, 4, 1, raft.Configuration{}, 1, nil)
+			require.NoError(t, err)
+			_, err = io.WriteString(writing, "canceled")
+			require.NoError(t, err)
+			third := create(3, "third")
+			require.Equal(t, []string{third, second}, list())
+			require.NoError(t, writing.Cancel())
+			require.Equal(t, []string{third, second}, list())
+
+			meta, r, err := s.Open(third)
+			require.NoError(t, err)
+			b, err := io.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			require.Equal(t, "third", string(b))
+			require.Equal(t, int64(len("third")), meta.Size)
+			require.Equal(t, uint64(3), meta.Index)
+			_, _, err = s.Open(first)
+			require.Equal(t, ErrorNoSuchSnapshot, err)
+
+			// past their max age, but the latest one
+			s.maxAge = time.Millisecond
+			time.Sleep(5 * time.Millisecond)
+			last := create(5, "last")
+			require.Equal(t, []string{last}, list())
+		})
+	}
+
+	// the snapshots of the node are under the prefix
+	var keys []string
+	for key := range srv.Objects("bucket") {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	require.Len(t, keys, 2)
+	require.Regexp(t, `^backups/node/1-5-\d+/meta.json$`, keys[0])
+	require.Regexp(t, `^backups/node/1-5-\d+/state.bin$`, keys[1])
+}
+
+// the snapshots written by raft's FileSnapshotStore are read
+func TestSnapshotStoreOfFileSnapshotStore(t *testing.T) {
+	dataDir := t.TempDir()
+	fss, err := raft.NewFileSnapshotStore(filepath.Join(dataDir, "raft"), 1, io.Discard)
+	require.NoError(t, err)
+	sink, err := fss.Create(raft.SnapshotVersionMax, 10, 2, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	_, err = io.WriteString(sink, "previous run")
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	s, err := newSnapshotStore(dataDir, Snapshots{}, "node")
+	require.NoError(t, err)
+	metas, err := s.List()
+	require.NoError(t, err)
+	require.Len(t, metas, 1)
+	require.Equal(t, uint64(10), metas[0].Index)
+	_, r, err := s.Open(sink.ID())
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, "previous run", string(b))
+
+	// the crc is checked once read
+	state := filepath.Join(dataDir, "raft", "snapshots", sink.ID(), snapshotStateKey)
+	require.NoError(t, os.WriteFile(state, []byte("previous ruN"), 0644))
+	_, r, err = s.Open(sink.ID())
+	require.NoError(t, err)
+	_, err = io.ReadAll(r)
+	require.Equal(t, ErrorSnapshotCorrupted, err)
+
+	// the temporary directory of an interrupted snapshot is removed with the previous snapshots
+	tmp := filepath.Join(dataDir, "raft", "snapshots", "2-11-1.tmp")
+	require.NoError(t, os.MkdirAll(tmp, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tmp, snapshotMetaKey), []byte("{}"), 0644))
+	next, err := s.Create(raft.SnapshotVersionMax, 12, 2, raft.Configuration{}, 1, nil)
+	require.NoError(t, err)
+	require.NoError(t, next.Close())
+	entries, err := os.ReadDir(filepath.Join(dataDir, "raft", "snapshots"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, next.ID(), entries[0].Name())
+}
+
+// the snapshot of a cluster, kept in s3, restores a fresh cluster
+func TestRestoreSnapshot(t *testing.T) {
+	obs := observability.Observability{}
+	ctx := context.Background()
+	srv := s3test.NewServer("bucket")
+	defer srv.Close()
+
+	open := func(dataDir string, snapshots Snapshots) *DistributedStorage {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", dynaport.Get(1)[0]))
+		require.NoError(t, err)
+		config := Config{Snapshots: snapshots}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = "0"
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = true
+		l, err := NewDistributedStorage(dataDir, config, 2, 100, &obs)
+		require.NoError(t, err)
+		require.NoError(t, l.WaitForLeader(3*time.Second))
+		return l
+	}
+
+	l := open(t.TempDir(), Snapshots{Store: SnapshotsS3, S3: srv.Config("bucket")})
+	for i := 0; i < 20; i++ {
+		require.NoError(t, l.Set(ctx, fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i), 0))
+	}
+	snapshots, err := l.CreateSnapshot(ctx)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	// at the same index, it replaces the previous one
+	again, err := l.CreateSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, snapshots[0].Index, again[0].Index)
+	snapshots = again
+	listed, err := l.ListSnapshots(ctx)
+	require.NoError(t, err)
+	require.Equal(t, snapshots, listed)
+
+	info, r, err := l.OpenSnapshot(ctx, 0, "")
+	require.NoError(t, err)
+	require.Equal(t, snapshots[0], info)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, info.Size, int64(len(b)))
+	_, _, err = l.OpenSnapshot(ctx, 1, "")
+	require.Equal(t, ErrorNoSuchPartition, err)
+	require.NoError(t, l.Close())
+
+	dataDir := t.TempDir()
+	fresh := open(dataDir, Snapshots{})
+	require.NoError(t, fresh.Set(ctx, "stale", "value", 0))
+	_, from, err := fresh.GetWithVersion(ctx, "stale")
+	require.NoError(t, err)
+	events, cancel, err := fresh.Watch(ctx, "", true, from)
+	require.NoError(t, err)
+	defer cancel()
+
+	// a snapshot failing to restore leaves the state as it is
+	corrupted := append([]byte(nil), b...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	_, err = fresh.RestoreSnapshot(ctx, 0, bytes.NewReader(corrupted))
+	require.Equal(t, ErrorSnapshotCorrupted, err)
+	_, err = fresh.restoreSnapshot(0, bytes.NewReader(b), func(string) bool { return false })
+	require.Equal(t, ErrorSnapshotPartition, err)
+	v, err := fresh.Get(ctx, "stale")
+	require.NoError(t, err)
+	require.Equal(t, "value", v)
+
+	restored, err := fresh.RestoreSnapshot(ctx, 0, bytes.NewReader(b))
+	require.NoError(t, err)
+	// the events before the restore are not in the history anymore, a watcher resuming is told so
+	require.Equal(t, "stale", (<-events).Key)
+	_, ok := <-events
+	require.False(t, ok)
+	_, _, err = fresh.Watch(ctx, "", true, from)
+	require.Equal(t, ErrorWatchCompacted, err)
+	_, _, err = fresh.Watch(ctx, "", true, restored.Index)
+	require.Equal(t, ErrorWatchCompacted, err)
+	events, cancel, err = fresh.Watch(ctx, "", true, restored.Index+1)
+	require.NoError(t, err)
+	defer cancel()
+	_, version, err := fresh.GetWithVersion(ctx, "key-19")
+	require.NoError(t, err)
+	check := func(l *DistributedStorage) {
+		require.Len(t, allKeys(t, l), 20)
+		v, err := l.Get(ctx, "key-7")
+		require.NoError(t, err)
+		require.Equal(t, "value-7", v)
+		_, err = l.Get(ctx, "stale")
+		require.Equal(t, ErrorNoSuchKey, err)
+	}
+	check(fresh)
+	// the writes go on after the restore, with greater versions
+	next, err := fresh.SetIf(ctx, "key-0", "new", 0, nil)
+	require.NoError(t, err)
+	require.Greater(t, next, version)
+	require.Equal(t, next, (<-events).Index)
+	require.NoError(t, fresh.Close())
+
+	fresh = open(dataDir, Snapshots{})
+	defer fresh.Close()
+	require.Eventually(t, func() bool {
+		v, err := fresh.Get(ctx, "key-0")
+		return err == nil && v == "new"
+	}, 3*time.Second, 10*time.Millisecond)
+	// at start the history begins after the restored snapshot, the log replays the writes after it
+	_, _, err = fresh.Watch(ctx, "", true, from)
+	require.Equal(t, ErrorWatchCompacted, err)
+	events, cancel, err = fresh.Watch(ctx, "key-0", false, next)
+	require.NoError(t, err)
+	defer cancel()
+	require.Equal(t, "new", (<-events).Value.GetStringValue())
+	require.NoError(t, fresh.Set(ctx, "key-0", "value-0", 0))
+	check(fresh)
+}
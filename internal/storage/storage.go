@@ -6,24 +6,100 @@ import (
 	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var ErrorNoSuchKey = errors.New("no such key")
+var (
+	ErrorNoSuchKey          = errors.New("no such key")
+	ErrorPreconditionFailed = errors.New("precondition failed")
+)
 
 type StorageRepo interface {
-	Set(context.Context, string, interface{}) error
+	Set(context.Context, string, interface{}, time.Duration) error
 	Get(context.Context, string) (interface{}, error)
-	Keys(context.Context) []string
+	// GetWithVersion returns the value and its version, read together
+	GetWithVersion(context.Context, string) (interface{}, uint64, error)
+	// SetIf sets the value if the precondition(nil for none) holds and returns the new version
+	SetIf(context.Context, string, interface{}, time.Duration, *api.Precondition) (uint64, error)
+	DeleteIf(context.Context, string, *api.Precondition) error
+	Incr(context.Context, string, int64) (int64, error)
+	// Txn applies the success or the failure ops of the request at once
+	Txn(context.Context, *api.TxnRequest) (*api.TxnResponse, error)
+	// Batch applies many writes with few log entries, each item has its own result
+	Batch(context.Context, *api.WriteBatch) ([]models.BatchResult, error)
+	// Watch returns the events of the key(or prefix) from the index, and the func to stop watching
+	Watch(context.Context, string, bool, uint64) (<-chan *api.WatchEvent, func(), error)
+	Keys(context.Context) ([]string, error)
+	// KeysPage returns at most limit keys matching from the cursor, one shard locked at a time,
+	// and the cursor of the next page, done is true when all the shards are read
+	KeysPage(ctx context.Context, cursor models.KeysCursor, limit int, match func(string) bool) (keys []string, next models.KeysCursor, done bool, err error)
+	CountKeys(ctx context.Context, match func(string) bool) (int, error)
+	// Scan returns at most limit records from start(included) to end(excluded, empty for no end), in the keys order
+	Scan(context.Context, string, string, int) ([]models.KeysValues, error)
 	Delete(context.Context, string, *Shard) error
 	KeysValues(context.Context, chan models.KeysValues) error
 	Servers(context.Context) ([]*api.Server, error)
 }
 
+// Replicated is a StorageRepo replicated by raft, a standalone ShardedMap is always consistent,
+// not partitioned and at the index 0
+type Replicated interface {
+	// Consistent returns once the node can serve a read at the consistency level,
+	// the reads themselves(Get, Keys, KeysValues) are served locally, except the ones of the
+	// partitions the node does not serve at the consistency of their ctx(see WithConsistency),
+	// the keys limit the check to their partitions, all of them without keys
+	Consistent(ctx context.Context, c api.Consistency, keys ...string) error
+	// AppliedIndexes returns the last log index applied by each partition, the partitions
+	// number their own indexes, the keys limit it to their partitions, all of them without keys
+	AppliedIndexes(keys ...string) map[int]uint64
+	// Partitions returns the leader of each partition
+	Partitions(context.Context) ([]*api.Partition, error)
+	// PartitionOf returns the partition of the key
+	PartitionOf(key string) int
+}
+
+// Snapshotter is a StorageRepo persisting its partitions in raft snapshots
+type Snapshotter interface {
+	// CreateSnapshot takes a snapshot of each partition of the node
+	CreateSnapshot(context.Context) ([]*api.SnapshotInfo, error)
+	ListSnapshots(context.Context) ([]*api.SnapshotInfo, error)
+	// OpenSnapshot returns the snapshot of the partition, the latest one if the id is empty
+	OpenSnapshot(ctx context.Context, partition int, id string) (*api.SnapshotInfo, io.ReadCloser, error)
+	// RestoreSnapshot replaces the state of the partition with the snapshot, the node must be its leader
+	RestoreSnapshot(ctx context.Context, partition int, r io.Reader) (*api.SnapshotInfo, error)
+}
+
+// Admin is a StorageRepo moving its partitions between the nodes
+type Admin interface {
+	// Rebalance returns the moves of the partitions the node leads
+	Rebalance(context.Context) (*api.RebalanceStatus, error)
+}
+
 type Shard struct {
 	sync.RWMutex
-	m   map[string]*node
-	dll dll
+	m map[string]*node
+	// chooses the nodes to evict when the shard is over one of its limits(0 for none)
+	policy   policy
+	maxItems int
+	maxBytes int64
+	bytes    int64
+	stats    *cacheStats
+	// the writes are published to the watchers of the ShardedMap
+	watch *watchHub
+	// the ordered keys of the ShardedMap
+	index *keyIndex
+	// set when the evictions go through the log, the shard signals it is
+	// over its limits instead of evicting
+	overflow chan struct{}
+	// told about the evicted nodes, tier is the hook if it keeps them
+	hook EvictionHook
+	tier Tier
+	// the reads waiting to be applied to the policy
+	reads *readBuffer
 }
 
 // TODO idea: improvement: encode key to save space ??
@@ -34,24 +110,138 @@ type Shard struct {
 type ShardedMap struct {
 	shd []*Shard
 	obs *observability.Observability
+	// last version given by a standalone ShardedMap,
+	// the fsm uses the log indexes instead
+	lastVersion *uint64
+	watch       *watchHub
+	index       *keyIndex
+	eviction    Eviction
+	stats       *cacheStats
+	// signaled by the shards over their limits, nil if they evict by themselves
+	overflow chan struct{}
+	// places the keys on the shards
+	placement *placement
 }
 
+// NewShardedMap keeps at most maxLgt records per shard, the least recently used are evicted
 func NewShardedMap(nShard, maxLgt int, observ *observability.Observability) ShardedMap {
+	// the lru policy can not fail
+	m, _ := NewShardedMapWithEviction(nShard, maxLgt, Eviction{}, observ)
+	return m
+}
+
+// NewShardedMapWithEviction bounds the shards by maxLgt records(0 for no limit)
+// and by the byte budgets, and evicts the records with the policy
+func NewShardedMapWithEviction(nShard, maxLgt int, ev Eviction, observ *observability.Observability) (ShardedMap, error) {
 	shards := make([]*Shard, nShard)
+	watch := newWatchHub()
+	index := newKeyIndex()
+	stats := &cacheStats{}
+	maxBytes := ev.shardBudget(nShard)
 
 	for i := 0; i < nShard; i++ {
-		shard := make(map[string]*node)
+		pol, err := newPolicy(ev.Policy, maxLgt)
+		if err != nil {
+			return ShardedMap{}, err
+		}
 		shards[i] = &Shard{
-			m:   shard,
-			dll: NewDll(maxLgt),
+			m:        make(map[string]*node),
+			policy:   pol,
+			maxItems: maxLgt,
+			maxBytes: maxBytes,
+			stats:    stats,
+			watch:    watch,
+			index:    index,
+			reads:    &readBuffer{},
 		}
 	}
 
-	return ShardedMap{shards, observ}
+	m := ShardedMap{shards, observ, new(uint64), watch, index, ev, stats, nil, newPlacement(nShard, hashKey)}
+	m.registerMetrics()
+	return m, nil
+}
+
+func (m ShardedMap) nextVersion() uint64 {
+	return atomic.AddUint64(m.lastVersion, 1)
 }
 
 func (m ShardedMap) getShardIndex(key string) int {
-	return calculeIndex(key, len(m.shd))
+	return m.placement.locate(key)
+}
+
+// SetHash places the keys on the shards with the hash(fnv or xxhash), it must be called
+// before the first write. With raft the shards are filled again from the snapshot and the log
+// at start, so the hash and the number of shards can change between two runs
+func (m ShardedMap) SetHash(name string) error {
+	hash, err := newHash(name)
+	if err != nil {
+		return err
+	}
+	*m.placement = *newPlacement(len(m.shd), hash)
+	return nil
+}
+
+// reset drops all the records and the events, the restore of the snapshot at index replaces the state
+func (m ShardedMap) reset(index uint64) error {
+	for _, shard := range m.shd {
+		shard.Lock()
+		defer shard.Unlock()
+	}
+	m.index.reset()
+	m.watch.reset(index)
+	for _, shard := range m.shd {
+		pol, err := newPolicy(m.eviction.Policy, shard.maxItems)
+		if err != nil {
+			return err
+		}
+		for _, nd := range shard.m {
+			nd.removed = true
+		}
+		shard.m = make(map[string]*node)
+		shard.policy = pol
+		shard.bytes = 0
+	}
+	// the tier is shared by the shards
+	if len(m.shd) > 0 && m.shd[0].tier != nil {
+		return m.shd[0].tier.Reset()
+	}
+	return nil
+}
+
+// tierSnapshot returns the records of the tier shared by the shards, nil without tier
+func (m ShardedMap) tierSnapshot() TierSnapshot {
+	if len(m.shd) == 0 || m.shd[0].tier == nil {
+		return nil
+	}
+	return m.shd[0].tier.Snapshot()
+}
+
+// restoreEvicted puts back a record of the tier from a snapshot, in memory if the node
+// has no tier
+func (m ShardedMap) restoreEvicted(ctx context.Context, rec *command.Record) error {
+	shard := m.getShard(rec.Key)
+	if shard.tier == nil {
+		return m.set(ctx, rec.Key, rec.Data(), rec.ExpiresAt, rec.Version, nil, 0)
+	}
+	shard.Lock()
+	defer shard.Unlock()
+	shard.tier.Evicted(rec)
+	return nil
+}
+
+// nodes returns the nodes of each shard, the expired ones included
+func (m ShardedMap) nodes() [][]*node {
+	shards := make([][]*node, len(m.shd))
+	for i, shard := range m.shd {
+		shard.RLock()
+		nodes := make([]*node, 0, len(shard.m))
+		for _, nd := range shard.m {
+			nodes = append(nodes, nd)
+		}
+		shard.RUnlock()
+		shards[i] = nodes
+	}
+	return shards
 }
 
 // retrieve the shard where the key is stored
@@ -61,76 +251,251 @@ func (m ShardedMap) getShard(key string) *Shard {
 	return m.shd[index]
 }
 
-func (m ShardedMap) Set(ctx context.Context, key string, value interface{}) error {
+// a ttl of 0 means the key never expire
+func (m ShardedMap) Set(ctx context.Context, key string, value interface{}, ttl time.Duration) error {
+	_, err := m.SetIf(ctx, key, value, ttl, nil)
+	return err
+}
+
+func (m ShardedMap) SetIf(ctx context.Context, key string, value interface{}, ttl time.Duration, pre *api.Precondition) (uint64, error) {
+	now := time.Now().UnixNano()
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = now + int64(ttl)
+	}
+	version := m.nextVersion()
+	err := m.set(ctx, key, value, expiresAt, version, pre, now)
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// the deadline and now are computed once by the caller(the leader in case of the fsm),
+// so all replicas store the same deadline and agree on the precondition
+func (m ShardedMap) set(ctx context.Context, key string, value interface{}, expiresAt int64, version uint64, pre *api.Precondition, now int64) error {
 
 	teardown := m.obs.CarryOnTrace(ctx, "StorageSet")
 	defer teardown()
 
 	shard := m.getShard(key)
 
-	// if key already exist, remove it first
-	shard.RLock()
-	_, ok := shard.m[key]
-	shard.RUnlock()
+	// the precondition is checked and the value set under the same lock
+	shard.Lock()
+	defer shard.Unlock()
 
-	if ok {
-		m.obs.Logger.Debug("ShardedMap.Set()", "delete existing key")
-		m.Delete(ctx, key, shard)
+	nd, ok := shard.m[key]
+	if err := checkPrecondition(nd, ok, pre, now); err != nil {
+		return err
 	}
 
-	shard.Lock()
-	defer shard.Unlock()
+	if err := shard.set(key, value, expiresAt, version); err != nil {
+		m.obs.Logger.Error("ShardedMap.Set() failed", err)
+		return err
+	}
 
-	newN, outN, err := shard.dll.unshift(key, value)
+	return nil
+}
+
+// set replaces the node of the key, the shard lock must be held
+func (s *Shard) set(key string, value interface{}, expiresAt int64, version uint64) error {
+	nd, err := s.link(key, value, expiresAt, version)
 	if err != nil {
-		m.obs.Logger.Error("ShardedMap.Set() failed", err)
 		return err
 	}
-	if outN != nil {
-		m.obs.Logger.Debug("ShardedMap.Set()", "delete existing expired queue element")
-		// delete the poped node from the shard record
-		delete(shard.m, outN.key)
+	s.publish(api.WatchEvent_PUT, nd, version)
+
+	if s.overflow == nil {
+		s.evict(version)
+	} else if s.over(len(s.m), s.bytes) {
+		select {
+		case s.overflow <- struct{}{}:
+		default:
+		}
 	}
 
-	shard.m[key] = newN
+	return nil
+}
+
+// link replaces the node of the key without telling the watchers or evicting
+func (s *Shard) link(key string, value interface{}, expiresAt int64, version uint64) (*node, error) {
+	nd, err := NewNode(key, value)
+	if err != nil {
+		return nil, err
+	}
+	if s.maxBytes > 0 && nd.size() > s.maxBytes {
+		return nil, ErrorTooLarge
+	}
 
+	// if key already exist, remove it first
+	if old := s.unlink(key); old != nil {
+		nd.freq = old.freq
+	}
+
+	nd.expiresAt = expiresAt
+	nd.version = version
+	s.m[key] = nd
+	s.index.insert(key)
+	s.policy.add(nd)
+	s.bytes += nd.size()
+	return nd, nil
+}
+
+// over tells if a shard of items records and bytes is over one of its limits
+func (s *Shard) over(items int, bytes int64) bool {
+	return (s.maxItems > 0 && items > s.maxItems) || (s.maxBytes > 0 && bytes > s.maxBytes)
+}
+
+// evict removes the nodes chosen by the policy until the shard is within its limits
+func (s *Shard) evict(version uint64) {
+	if !s.over(len(s.m), s.bytes) {
+		return
+	}
+	s.flushReads()
+	for s.over(len(s.m), s.bytes) {
+		nd := s.policy.evict()
+		if nd == nil {
+			return
+		}
+		s.forget(nd, version)
+	}
+}
+
+// forget removes a node the policy does not track anymore
+func (s *Shard) forget(nd *node, version uint64) {
+	nd.removed = true
+	delete(s.m, nd.key)
+	s.index.remove(nd.key)
+	s.bytes -= nd.size()
+	s.stats.evicted()
+	s.publish(api.WatchEvent_EVICT, nd, version)
+	if s.hook != nil {
+		s.hook.Evicted(nd.records())
+	}
+}
+
+// touch records a read or an update of the node
+func (s *Shard) touch(nd *node) {
+	s.policy.hit(nd)
+}
+
+// remove deletes the key at the index, the shard lock must be held
+func (s *Shard) remove(key string, index uint64) {
+	if nd := s.unlink(key); nd != nil {
+		s.publish(api.WatchEvent_DELETE, nd, index)
+	}
+}
+
+// the shard lock must be held
+func (s *Shard) unlink(key string) *node {
+	// the key is written or deleted, its evicted record is outdated
+	if s.tier != nil {
+		s.tier.Remove(key)
+	}
+	nd, ok := s.m[key]
+	if !ok {
+		return nil
+	}
+	s.policy.remove(nd)
+	nd.removed = true
+	delete(s.m, key)
+	s.index.remove(key)
+	s.bytes -= nd.size()
+	return nd
+}
+
+// an expired key does not exist anymore, even if the sweeper did not remove it yet
+func checkPrecondition(nd *node, ok bool, pre *api.Precondition, now int64) error {
+	if pre == nil {
+		return nil
+	}
+	exists := ok && !nd.isExpired(now)
+	switch {
+	case pre.IfAbsent && exists,
+		pre.IfPresent && !exists,
+		pre.ExpectedVersion != 0 && (!exists || nd.version != pre.ExpectedVersion):
+		return ErrorPreconditionFailed
+	}
 	return nil
 }
 
-// TODO get per type, check with gRPC if that works...
 func (m ShardedMap) Get(ctx context.Context, key string) (interface{}, error) {
+	value, _, err := m.GetWithVersion(ctx, key)
+	return value, err
+}
+
+func (m ShardedMap) GetWithVersion(ctx context.Context, key string) (interface{}, uint64, error) {
 
 	teardown := m.obs.CarryOnTrace(ctx, "StorageGet")
 	defer teardown()
 
 	shard := m.getShard(key)
 
+	// the read lock is enough, the hit is buffered then applied to the policy in a batch
 	shard.RLock()
+	now := time.Now().UnixNano()
 	nd, ok := shard.m[key]
-	shard.RUnlock()
-	if !ok {
-		return "", ErrorNoSuchKey
+	if !ok && shard.tier != nil {
+		shard.RUnlock()
+		return m.getFromTierLocked(shard, key)
 	}
+	// an expired key waits for the sweeper to be removed, meanwhile it does not exist
+	if !ok || nd.isExpired(now) {
+		shard.RUnlock()
+		m.stats.miss()
+		return "", 0, ErrorNoSuchKey
+	}
+	value, version := nd.value(), nd.version
+	shard.RUnlock()
 
+	shard.read(nd)
+	return value, version, nil
+}
+
+// getFromTierLocked takes the shard lock the promotion needs, the key may be
+// back in memory meanwhile
+func (m ShardedMap) getFromTierLocked(shard *Shard, key string) (interface{}, uint64, error) {
 	shard.Lock()
 	defer shard.Unlock()
 
-	ndExist := shard.dll.removeNode(nd)
-	if ndExist != nil {
-		m.obs.Logger.Debug("ShardedMap.Get()", "unshift shifted node")
-		_, _ = shard.dll.unshiftNode(ndExist)
+	now := time.Now().UnixNano()
+	nd, ok := shard.m[key]
+	if !ok {
+		return m.getFromTier(shard, key, now)
+	}
+	if nd.isExpired(now) {
+		m.stats.miss()
+		return "", 0, ErrorNoSuchKey
+	}
+	m.stats.hit()
+	shard.touch(nd)
+	return nd.value(), nd.version, nil
+}
+
+// getFromTier reads a key evicted from the memory, the shard lock must be held.
+// The record is promoted back in memory unless the evictions go through the log,
+// where a read of one replica must not change what it evicts
+func (m ShardedMap) getFromTier(shard *Shard, key string, now int64) (interface{}, uint64, error) {
+	rec, err := shard.tier.Get(key)
+	if err != nil {
+		m.obs.Logger.Error("ShardedMap.Get() tier failed", err)
+	}
+	if rec == nil || (rec.ExpiresAt != 0 && rec.ExpiresAt <= now) {
+		m.stats.miss()
+		return "", 0, ErrorNoSuchKey
 	}
 
-	// TODO idea: in case we store other types than string using gRPC
-	if nd.val != "" {
-		return nd.val, nil
-	} else if nd.valInt != 0 {
-		return nd.valInt, nil
-	} else if nd.valFloat != 0 {
-		return nd.valFloat, nil
-	} else {
-		return "", nil
+	m.stats.hit()
+	// the record is not written again, the watchers are not told
+	if shard.overflow == nil {
+		if _, err := shard.link(key, rec.Data(), rec.ExpiresAt, rec.Version); err != nil {
+			m.obs.Logger.Error("ShardedMap.Get() promote failed", err)
+		} else {
+			shard.evict(rec.Version)
+		}
 	}
+
+	return rec.Data(), rec.Version, nil
 }
 
 func (m ShardedMap) Delete(ctx context.Context, key string, sh *Shard) error {
@@ -146,24 +511,41 @@ func (m ShardedMap) Delete(ctx context.Context, key string, sh *Shard) error {
 		shard = m.getShard(key)
 	}
 
-	shard.RLock()
-	nd, ok := shard.m[key]
-	shard.RUnlock()
+	shard.Lock()
+	defer shard.Unlock()
+
+	m.obs.Logger.Debug("ShardedMap.Delete()", "delete node")
+	shard.remove(key, m.nextVersion())
+
+	return nil
+}
+
+func (m ShardedMap) DeleteIf(ctx context.Context, key string, pre *api.Precondition) error {
+	return m.deleteIf(ctx, key, pre, time.Now().UnixNano(), m.nextVersion())
+}
+
+func (m ShardedMap) deleteIf(ctx context.Context, key string, pre *api.Precondition, now int64, index uint64) error {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageDelete")
+	defer teardown()
+
+	shard := m.getShard(key)
 
 	shard.Lock()
 	defer shard.Unlock()
 
-	if ok {
-		m.obs.Logger.Debug("ShardedMap.Delete()", "delete node")
-		_ = shard.dll.removeNode(nd)
-		delete(shard.m, key)
+	nd, ok := shard.m[key]
+	if err := checkPrecondition(nd, ok, pre, now); err != nil {
+		return err
 	}
 
+	shard.remove(key, index)
+
 	return nil
 }
 
 // establish lock(concurrently) on all the table to get all the keys
-func (m ShardedMap) Keys(ctx context.Context) []string {
+func (m ShardedMap) Keys(ctx context.Context) ([]string, error) {
 
 	teardown := m.obs.CarryOnTrace(ctx, "StorageKeys")
 	defer teardown()
@@ -172,6 +554,8 @@ func (m ShardedMap) Keys(ctx context.Context) []string {
 
 	mutex := sync.Mutex{} // Mutex for write safety to keys
 
+	now := time.Now().UnixNano()
+
 	wg := sync.WaitGroup{}
 	wg.Add(len(m.shd))
 
@@ -179,7 +563,10 @@ func (m ShardedMap) Keys(ctx context.Context) []string {
 		go func(s *Shard) {
 			s.RLock()
 
-			for key := range s.m {
+			for key, nd := range s.m {
+				if nd.isExpired(now) {
+					continue
+				}
 				mutex.Lock()
 				keys = append(keys, key)
 				mutex.Unlock()
@@ -193,7 +580,7 @@ func (m ShardedMap) Keys(ctx context.Context) []string {
 
 	wg.Wait()
 
-	return keys
+	return keys, nil
 }
 
 // establish lock(concurrently) on all the table to get all the keys,
@@ -203,6 +590,14 @@ func (m ShardedMap) KeysValues(ctx context.Context, kv chan models.KeysValues) e
 	teardown := m.obs.CarryOnTrace(ctx, "StorageKeysValues")
 	defer teardown()
 
+	return m.keysValues(ctx, kv)
+}
+
+// keysValues stops when ctx is done, the reader leaving does not keep the shards locked
+func (m ShardedMap) keysValues(ctx context.Context, kv chan models.KeysValues) error {
+
+	now := time.Now().UnixNano()
+
 	wg := sync.WaitGroup{}
 	wg.Add(len(m.shd))
 
@@ -210,9 +605,21 @@ func (m ShardedMap) KeysValues(ctx context.Context, kv chan models.KeysValues) e
 		go func(s *Shard) {
 			s.RLock()
 
-			for key := range s.m {
-				nd, _ := s.m[key]
-				kv <- models.KeysValues{key, nd.val}
+		loop:
+			for key, nd := range s.m {
+				if nd.isExpired(now) {
+					continue
+				}
+				select {
+				case kv <- models.KeysValues{
+					Key:       key,
+					Value:     nd.value(),
+					ExpiresAt: nd.expiresAt,
+					Version:   nd.version,
+				}:
+				case <-ctx.Done():
+					break loop
+				}
 			}
 
 			s.RUnlock()
@@ -223,7 +630,7 @@ func (m ShardedMap) KeysValues(ctx context.Context, kv chan models.KeysValues) e
 
 	wg.Wait()
 	close(kv)
-	return nil
+	return ctx.Err()
 }
 
 // aim to fulfill the interface contract. Will be return from distributed.go
@@ -2,9 +2,19 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
 	"github.com/djedjethai/generation/internal/models"
 	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_storage(t *testing.T) {
@@ -16,10 +26,24 @@ func Test_storage(t *testing.T) {
 		"keys":                            testKeys,
 		"delete":                          testDelete,
 		"getKeysValues":                   testGetKeysValues,
+		"getKeysValuesStopsWithCtx":       testGetKeysValuesStopsWithCtx,
 		"keepSettedSizeOneShardManyItems": testStorageKeepSettedSizeOneShardManyItems,
 		"storageDeleteUnshiftItemWhenItemAlreadyExist":      testStorageDeleteUnshiftItemWhenItemAlreadyExist,
 		"itemHasBeenproperlyRemovedWhenOutboundStorageSize": testHasBeenProperlyRemovedWhenOutboundStorageSize,
 		"storageNotStoreTheSameKeyTwice":                    testStorageNotStoreTheSameKeyTwice,
+		"expiredKeyIsHiddenThenExpired":                     testExpiredKeyIsHiddenThenExpired,
+		"expireDoNotRemoveAKeySetAgain":                     testExpireDoNotRemoveAKeySetAgain,
+		"sweepReclaimExpiredKeys":                           testSweepReclaimExpiredKeys,
+		"zeroValuesKeepTheirType":                           testZeroValuesKeepTheirType,
+		"incr":                                              testIncr,
+		"versionsAndPreconditions":                          testVersionsAndPreconditions,
+		"txn":                                               testTxn,
+		"txnIsNeverSeenHalfApplied":                         testTxnIsNeverSeenHalfApplied,
+		"batch":                                             testBatch,
+		"watch":                                             testWatch,
+		"watchReplayAndCompaction":                          testWatchReplayAndCompaction,
+		"scan":                                              testScan,
+		"keysPage":                                          testKeysPage,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			obs := observability.Observability{}
@@ -33,7 +57,7 @@ func Test_storage(t *testing.T) {
 // test Put
 func testPut(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
 
-	_ = shardedMap.Set(ctx, "test", "put")
+	_ = shardedMap.Set(ctx, "test", "put", 0)
 
 	shard := shardedMap.getShard("test")
 
@@ -44,7 +68,7 @@ func testPut(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
 
 // test Get
 func testGet(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
-	_ = shardedMap.Set(ctx, "test", "put")
+	_ = shardedMap.Set(ctx, "test", "put", 0)
 
 	dt, _ := shardedMap.Get(ctx, "test")
 
@@ -55,9 +79,9 @@ func testGet(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
 
 // test get all Keys
 func testKeys(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
-	_ = shardedMap.Set(ctx, "test", "put")
+	_ = shardedMap.Set(ctx, "test", "put", 0)
 
-	keys := shardedMap.Keys(ctx)
+	keys := allKeys(t, shardedMap)
 
 	if len(keys) != 1 && keys[0] != "test" {
 		t.Error("err in store Keys() failed")
@@ -77,9 +101,9 @@ func testDelete(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
 
 // test getKeysValues
 func testGetKeysValues(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
-	shardedMap.Set(ctx, "key1", "value1")
-	shardedMap.Set(ctx, "key2", "value2")
-	shardedMap.Set(ctx, "key3", "value3")
+	shardedMap.Set(ctx, "key1", "value1", 0)
+	shardedMap.Set(ctx, "key2", "value2", 0)
+	shardedMap.Set(ctx, "key3", "value3", 0)
 
 	kv := make(chan models.KeysValues, 4)
 
@@ -88,7 +112,7 @@ func testGetKeysValues(t *testing.T, shardedMap ShardedMap, ctx context.Context)
 		t.Error("err in store TestGetKeysValues, .KeysValues() return an err: ", err)
 	}
 
-	var res = make(map[string]string)
+	var res = make(map[string]interface{})
 	for v := range kv {
 		t.Run(v.Key, func(t *testing.T) {
 			res[v.Key] = v.Value
@@ -100,15 +124,45 @@ func testGetKeysValues(t *testing.T, shardedMap ShardedMap, ctx context.Context)
 	}
 }
 
+// the reader leaving stops KeysValues, it does not keep a shard locked
+func testGetKeysValuesStopsWithCtx(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
+	for i := 0; i < 20; i++ {
+		shardedMap.Set(ctx, fmt.Sprintf("key%d", i), "value", 0)
+	}
+
+	readCtx, cancel := context.WithCancel(ctx)
+	kv := make(chan models.KeysValues)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- shardedMap.KeysValues(readCtx, kv)
+	}()
+	<-kv
+	cancel()
+
+	select {
+	case err := <-errc:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("err in store KeysValues() should return context.Canceled, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("err in store KeysValues() still running after the reader left")
+	}
+	for i := 0; i < 20; i++ {
+		if err := shardedMap.Set(ctx, fmt.Sprintf("key%d", i), "changed", 0); err != nil {
+			t.Error("err in store Set() after KeysValues() stopped", err)
+		}
+	}
+}
+
 // make sure the fixed size is respected when one shard and many items for this shard
 func testStorageKeepSettedSizeOneShardManyItems(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
 	obs := observability.Observability{}
 
 	sm := NewShardedMap(1, 3, &obs)
-	sm.Set(ctx, "key1", "val1")
-	sm.Set(ctx, "key2", "val2")
-	sm.Set(ctx, "key3", "val3")
-	sm.Set(ctx, "key4", "val4")
+	sm.Set(ctx, "key1", "val1", 0)
+	sm.Set(ctx, "key2", "val2", 0)
+	sm.Set(ctx, "key3", "val3", 0)
+	sm.Set(ctx, "key4", "val4", 0)
 
 	// check the remained element into the dll
 	_, t1 := sm.shd[0].m["key1"]
@@ -119,9 +173,9 @@ func testStorageKeepSettedSizeOneShardManyItems(t *testing.T, shardedMap Sharded
 		t.Error("err t3 or/and t4 in store TestStorageKeepTheSettedSizeWithOneShardAnsManyItemsPerShard")
 	}
 
-	head := sm.shd[0].dll.head.val
-	middle := sm.shd[0].dll.head.next.val
-	tail := sm.shd[0].dll.tail.val
+	head := lruList(sm.shd[0]).head.val
+	middle := lruList(sm.shd[0]).head.next.val
+	tail := lruList(sm.shd[0]).tail.val
 
 	if head != "val4" || middle != "val3" || tail != "val2" {
 		t.Error("err in store TestStorageKeepTheSettedSizeWithOneShardAnsManyItemsPerShard")
@@ -133,11 +187,11 @@ func testStorageDeleteUnshiftItemWhenItemAlreadyExist(t *testing.T, shardedMap S
 	obs := observability.Observability{}
 
 	sm := NewShardedMap(1, 3, &obs)
-	sm.Set(ctx, "key1", "val1")
-	sm.Set(ctx, "key2", "val2")
-	sm.Set(ctx, "key3", "val3")
-	sm.Set(ctx, "key4", "val4")
-	sm.Set(ctx, "key3", "val3")
+	sm.Set(ctx, "key1", "val1", 0)
+	sm.Set(ctx, "key2", "val2", 0)
+	sm.Set(ctx, "key3", "val3", 0)
+	sm.Set(ctx, "key4", "val4", 0)
+	sm.Set(ctx, "key3", "val3", 0)
 
 	// check the remained element into the dll
 	_, t1 := sm.shd[0].m["key1"]
@@ -148,9 +202,9 @@ func testStorageDeleteUnshiftItemWhenItemAlreadyExist(t *testing.T, shardedMap S
 		t.Error("err t3 or/and t4 in store TestStorageKeepTheSettedSizeWithOneShardAnsManyItemsPerShard")
 	}
 
-	head := sm.shd[0].dll.head.val
-	middle := sm.shd[0].dll.head.next.val
-	tail := sm.shd[0].dll.tail.val
+	head := lruList(sm.shd[0]).head.val
+	middle := lruList(sm.shd[0]).head.next.val
+	tail := lruList(sm.shd[0]).tail.val
 
 	if head != "val3" || middle != "val4" || tail != "val2" {
 		t.Error("err in store TestStorageKeepTheSettedSizeWithOneShardAnsManyItemsPerShard")
@@ -162,15 +216,15 @@ func testHasBeenProperlyRemovedWhenOutboundStorageSize(t *testing.T, shardedMap
 	obs := observability.Observability{}
 
 	sm := NewShardedMap(1, 2, &obs)
-	sm.Set(ctx, "key1", "val1")
-	sm.Set(ctx, "key3", "val3")
-	sm.Set(ctx, "key3", "val3")
-	sm.Set(ctx, "key4", "val4")
-
-	head := sm.shd[0].dll.head.val
-	headNext := sm.shd[0].dll.head.next.val
-	tail := sm.shd[0].dll.tail.val
-	tailPrev := sm.shd[0].dll.tail.prev.val
+	sm.Set(ctx, "key1", "val1", 0)
+	sm.Set(ctx, "key3", "val3", 0)
+	sm.Set(ctx, "key3", "val3", 0)
+	sm.Set(ctx, "key4", "val4", 0)
+
+	head := lruList(sm.shd[0]).head.val
+	headNext := lruList(sm.shd[0]).head.next.val
+	tail := lruList(sm.shd[0]).tail.val
+	tailPrev := lruList(sm.shd[0]).tail.prev.val
 	_, map1 := sm.shd[0].m["key1"]
 	_, map2 := sm.shd[0].m["key2"]
 	_, map3 := sm.shd[0].m["key3"]
@@ -183,11 +237,11 @@ func testHasBeenProperlyRemovedWhenOutboundStorageSize(t *testing.T, shardedMap
 		t.Error("err in store test ItemHasBeenProperlyRemovedWhenOutboud1")
 	}
 
-	sm.Set(ctx, "key3", "val3")
-	head = sm.shd[0].dll.head.val
-	headNext = sm.shd[0].dll.head.next.val
-	tail = sm.shd[0].dll.tail.val
-	tailPrev = sm.shd[0].dll.tail.prev.val
+	sm.Set(ctx, "key3", "val3", 0)
+	head = lruList(sm.shd[0]).head.val
+	headNext = lruList(sm.shd[0]).head.next.val
+	tail = lruList(sm.shd[0]).tail.val
+	tailPrev = lruList(sm.shd[0]).tail.prev.val
 	_, map3 = sm.shd[0].m["key3"]
 	_, map4 = sm.shd[0].m["key4"]
 	if head != "val3" ||
@@ -198,11 +252,11 @@ func testHasBeenProperlyRemovedWhenOutboundStorageSize(t *testing.T, shardedMap
 		t.Error("err in store test ItemHasBeenProperlyRemovedWhenOutboud2")
 	}
 
-	sm.Set(ctx, "key3", "val3")
-	head = sm.shd[0].dll.head.val
-	headNext = sm.shd[0].dll.head.next.val
-	tail = sm.shd[0].dll.tail.val
-	tailPrev = sm.shd[0].dll.tail.prev.val
+	sm.Set(ctx, "key3", "val3", 0)
+	head = lruList(sm.shd[0]).head.val
+	headNext = lruList(sm.shd[0]).head.next.val
+	tail = lruList(sm.shd[0]).tail.val
+	tailPrev = lruList(sm.shd[0]).tail.prev.val
 	_, map3 = sm.shd[0].m["key3"]
 	_, map4 = sm.shd[0].m["key4"]
 	if head != "val3" ||
@@ -219,17 +273,18 @@ func testHasBeenProperlyRemovedWhenOutboundStorageSize(t *testing.T, shardedMap
 func testStorageNotStoreTheSameKeyTwice(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
 	obs := observability.Observability{}
 
-	sm := NewShardedMap(2, 2, &obs)
-	sm.Set(ctx, "key1", "val1")
-	sm.Set(ctx, "key2", "val2")
-	sm.Set(ctx, "key3", "val3")
-	sm.Set(ctx, "key3", "val3")
-	sm.Set(ctx, "key4", "val4")
-	sm.Set(ctx, "key1", "val1")
-	sm.Set(ctx, "key2", "val2")
-	sm.Set(ctx, "key1", "val1")
-
-	ks := sm.Keys(ctx)
+	// room for the 4 keys even if they are in the same shard
+	sm := NewShardedMap(2, 4, &obs)
+	sm.Set(ctx, "key1", "val1", 0)
+	sm.Set(ctx, "key2", "val2", 0)
+	sm.Set(ctx, "key3", "val3", 0)
+	sm.Set(ctx, "key3", "val3", 0)
+	sm.Set(ctx, "key4", "val4", 0)
+	sm.Set(ctx, "key1", "val1", 0)
+	sm.Set(ctx, "key2", "val2", 0)
+	sm.Set(ctx, "key1", "val1", 0)
+
+	ks := allKeys(t, sm)
 	if len(ks) != 4 {
 		var val1 = false
 		var val2 = false
@@ -252,3 +307,555 @@ func testStorageNotStoreTheSameKeyTwice(t *testing.T, shardedMap ShardedMap, ctx
 		}
 	}
 }
+
+// an expired key can not be read anymore but remains stored until it is expired
+func testExpiredKeyIsHiddenThenExpired(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
+	_ = shardedMap.Set(ctx, "session", "token", 20*time.Millisecond)
+	_ = shardedMap.Set(ctx, "user", "name", 0)
+
+	dt, err := shardedMap.Get(ctx, "session")
+	if err != nil || dt != "token" {
+		t.Error("err in store Get() of a not yet expired key")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	_, err = shardedMap.Get(ctx, "session")
+	if err != ErrorNoSuchKey {
+		t.Error("err in store Get() should return ErrorNoSuchKey for an expired key")
+	}
+
+	keys := allKeys(t, shardedMap)
+	if len(keys) != 1 || keys[0] != "user" {
+		t.Error("err in store Keys() should not return an expired key")
+	}
+
+	shard := shardedMap.getShard("session")
+	nd := shard.m["session"]
+	_ = shardedMap.Expire(ctx, "session", nd.expiresAt)
+
+	if _, ok := shard.m["session"]; ok || shard.policy.len() != len(shard.m) {
+		t.Error("err in store Expire() failed")
+	}
+}
+
+// a key set again after being found expired must survive the expiry
+func testExpireDoNotRemoveAKeySetAgain(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
+	_ = shardedMap.Set(ctx, "session", "token", time.Millisecond)
+	expiresAt := shardedMap.getShard("session").m["session"].expiresAt
+
+	_ = shardedMap.Set(ctx, "session", "newToken", time.Minute)
+
+	_ = shardedMap.Expire(ctx, "session", expiresAt)
+
+	dt, err := shardedMap.Get(ctx, "session")
+	if err != nil || dt != "newToken" {
+		t.Error("err in store Expire() removed a key set again")
+	}
+}
+
+func testSweepReclaimExpiredKeys(t *testing.T, shardedMap ShardedMap, ctx context.Context) {
+	reclaimed := make(chan []*command.Record, 3)
+	stop := shardedMap.Sweep(5*time.Millisecond, func(ctx context.Context, expired []*command.Record) {
+		shardedMap.ReclaimLocally(ctx, expired)
+		reclaimed <- expired
+	})
+	defer stop()
+
+	_ = shardedMap.Set(ctx, "session", "token", 10*time.Millisecond)
+
+	select {
+	case expired := <-reclaimed:
+		if len(expired) != 1 || expired[0].Key != "session" {
+			t.Error("err in store Sweep() should hand over the expired key")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("err in store Sweep() never reclaimed the expired key")
+	}
+
+	if _, ok := shardedMap.getShard("session").m["session"]; ok {
+		t.Error("err in store Sweep() the expired key is still stored")
+	}
+}
+
+func testZeroValuesKeepTheirType(t *testing.T, sm ShardedMap, ctx context.Context) {
+	values := map[string]interface{}{
+		"string": "",
+		"int":    int64(0),
+		"float":  float64(0),
+		"bytes":  []byte{},
+		"json":   json.RawMessage(`{"a":1}`),
+	}
+	for key, value := range values {
+		if err := sm.Set(ctx, key, value, 0); err != nil {
+			t.Fatal("err in store Set() of a typed value: ", err)
+		}
+	}
+	for key, value := range values {
+		got, err := sm.Get(ctx, key)
+		if err != nil {
+			t.Fatal("err in store Get() of a typed value: ", err)
+		}
+		if !reflect.DeepEqual(got, value) {
+			t.Errorf("err in store Get(), %s: got %#v, want %#v", key, got, value)
+		}
+	}
+
+	if err := sm.Set(ctx, "bool", true, 0); err == nil {
+		t.Error("err in store Set(), an unsupported type should be refused")
+	}
+}
+
+func testIncr(t *testing.T, sm ShardedMap, ctx context.Context) {
+	// a missing key starts from 0
+	v, err := sm.Incr(ctx, "counter", 2)
+	if err != nil || v != 2 {
+		t.Error("err in store Incr() of a missing key")
+	}
+	v, err = sm.Incr(ctx, "counter", -5)
+	if err != nil || v != -3 {
+		t.Error("err in store Incr() of an existing key")
+	}
+	dt, err := sm.Get(ctx, "counter")
+	if err != nil || dt != int64(-3) {
+		t.Error("err in store Get() of an incremented key")
+	}
+
+	_ = sm.Set(ctx, "name", "value", 0)
+	if _, err = sm.Incr(ctx, "name", 1); err != ErrorNotAnInteger {
+		t.Error("err in store Incr() should refuse a value which is not an integer")
+	}
+
+	_ = sm.Set(ctx, "max", int64(math.MaxInt64), 0)
+	if _, err = sm.Incr(ctx, "max", 1); err != ErrorOverflow {
+		t.Error("err in store Incr() should refuse an overflow")
+	}
+	if dt, _ = sm.Get(ctx, "max"); dt != int64(math.MaxInt64) {
+		t.Error("err in store Incr() an overflow modified the value")
+	}
+
+	// the ttl is kept
+	_ = sm.Set(ctx, "session", int64(1), time.Minute)
+	expiresAt := sm.getShard("session").m["session"].expiresAt
+	_, _ = sm.Incr(ctx, "session", 1)
+	if sm.getShard("session").m["session"].expiresAt != expiresAt {
+		t.Error("err in store Incr() should keep the ttl")
+	}
+
+	// an expired key starts again from 0
+	_ = sm.Set(ctx, "old", int64(10), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	v, err = sm.Incr(ctx, "old", 1)
+	if err != nil || v != 1 {
+		t.Error("err in store Incr() of an expired key")
+	}
+}
+
+func testVersionsAndPreconditions(t *testing.T, sm ShardedMap, ctx context.Context) {
+	v1, err := sm.SetIf(ctx, "lock", "owner-a", 0, &api.Precondition{IfAbsent: true})
+	if err != nil || v1 == 0 {
+		t.Fatal("err in store SetIf() of an absent key")
+	}
+	if _, err = sm.SetIf(ctx, "lock", "owner-b", 0, &api.Precondition{IfAbsent: true}); err != ErrorPreconditionFailed {
+		t.Error("err in store SetIf() should refuse to overwrite an existing key")
+	}
+
+	dt, version, err := sm.GetWithVersion(ctx, "lock")
+	if err != nil || dt != "owner-a" || version != v1 {
+		t.Error("err in store GetWithVersion()")
+	}
+
+	// compare and swap
+	v2, err := sm.SetIf(ctx, "lock", "owner-b", 0, &api.Precondition{ExpectedVersion: v1})
+	if err != nil || v2 <= v1 {
+		t.Error("err in store SetIf() with the current version")
+	}
+	if _, err = sm.SetIf(ctx, "lock", "owner-c", 0, &api.Precondition{ExpectedVersion: v1}); err != ErrorPreconditionFailed {
+		t.Error("err in store SetIf() should refuse an outdated version")
+	}
+	if v3, _ := sm.Incr(ctx, "counter", 1); v3 == 0 {
+		t.Error("err in store Incr()")
+	}
+	if _, version, _ = sm.GetWithVersion(ctx, "counter"); version <= v2 {
+		t.Error("err in store Incr() should give a new version")
+	}
+
+	if _, err = sm.SetIf(ctx, "missing", "value", 0, &api.Precondition{IfPresent: true}); err != ErrorPreconditionFailed {
+		t.Error("err in store SetIf() should refuse to set a missing key")
+	}
+
+	if err = sm.DeleteIf(ctx, "lock", &api.Precondition{ExpectedVersion: v1}); err != ErrorPreconditionFailed {
+		t.Error("err in store DeleteIf() should refuse an outdated version")
+	}
+	if err = sm.DeleteIf(ctx, "lock", &api.Precondition{ExpectedVersion: v2}); err != nil {
+		t.Error("err in store DeleteIf() with the current version")
+	}
+	if _, err = sm.Get(ctx, "lock"); err != ErrorNoSuchKey {
+		t.Error("err in store DeleteIf() did not delete the key")
+	}
+
+	// an expired key is absent
+	_ = sm.Set(ctx, "session", "token", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, err = sm.SetIf(ctx, "session", "token", 0, &api.Precondition{IfAbsent: true}); err != nil {
+		t.Error("err in store SetIf() an expired key should be absent")
+	}
+}
+
+func txnPut(key string, value int64) *api.TxnOp {
+	typed, _ := api.NewValue(value)
+	return &api.TxnOp{Op: &api.TxnOp_Put{Put: &api.TxnPut{Key: key, Value: typed}}}
+}
+
+func txnGet(key string) *api.TxnOp {
+	return &api.TxnOp{Op: &api.TxnOp_Get{Get: &api.TxnGet{Key: key}}}
+}
+
+func testTxn(t *testing.T, sm ShardedMap, ctx context.Context) {
+	res, err := sm.Txn(ctx, &api.TxnRequest{
+		Compares: []*api.Compare{
+			{Key: "a", Precondition: &api.Precondition{IfAbsent: true}},
+			{Key: "b", Precondition: &api.Precondition{IfAbsent: true}},
+		},
+		Success: []*api.TxnOp{txnPut("a", 1), txnPut("b", 2), txnGet("a")},
+		Failure: []*api.TxnOp{txnGet("a")},
+	})
+	if err != nil || !res.Succeeded || len(res.Results) != 3 {
+		t.Fatal("err in store Txn() should apply the success ops")
+	}
+	if res.Results[2].Value.GetIntValue() != 1 || res.Results[2].Version != res.Results[0].Version {
+		t.Error("err in store Txn() a get should see the puts before it")
+	}
+
+	res, err = sm.Txn(ctx, &api.TxnRequest{
+		Compares: []*api.Compare{
+			{Key: "a", Precondition: &api.Precondition{IfAbsent: true}},
+		},
+		Success: []*api.TxnOp{txnPut("a", 3)},
+		Failure: []*api.TxnOp{
+			{Op: &api.TxnOp_Delete{Delete: &api.TxnDelete{Key: "b"}}},
+			txnGet("b"),
+		},
+	})
+	if err != nil || res.Succeeded {
+		t.Fatal("err in store Txn() should apply the failure ops")
+	}
+	if res.Results[1].Value != nil {
+		t.Error("err in store Txn() the key should be deleted")
+	}
+	if dt, _ := sm.Get(ctx, "a"); dt != int64(1) {
+		t.Error("err in store Txn() applied a success op of a failed transaction")
+	}
+
+	if _, err = sm.Txn(ctx, &api.TxnRequest{Success: []*api.TxnOp{{}}}); err != ErrorInvalidTxn {
+		t.Error("err in store Txn() should refuse an empty op")
+	}
+}
+
+// transfers between two keys, of different shards, keep their sum
+func testTxnIsNeverSeenHalfApplied(t *testing.T, sm ShardedMap, ctx context.Context) {
+	keys := []string{"a", "b"}
+	for c := 'b'; sm.getShardIndex(keys[0]) == sm.getShardIndex(keys[1]); c++ {
+		keys[1] = string(c)
+	}
+	b := keys[1]
+	_, _ = sm.Txn(ctx, &api.TxnRequest{Success: []*api.TxnOp{txnPut("a", 50), txnPut(b, 50)}})
+
+	read := func() (int64, int64, *api.TxnResponse) {
+		res, _ := sm.Txn(ctx, &api.TxnRequest{Success: []*api.TxnOp{txnGet("a"), txnGet(b)}})
+		return res.Results[0].Value.GetIntValue(), res.Results[1].Value.GetIntValue(), res
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				from, to := keys[i%2], keys[(i+1)%2]
+				x, y, res := read()
+				values := map[string]int64{"a": x, b: y}
+				_, _ = sm.Txn(ctx, &api.TxnRequest{
+					Compares: []*api.Compare{
+						{Key: "a", Precondition: &api.Precondition{ExpectedVersion: res.Results[0].Version}},
+						{Key: b, Precondition: &api.Precondition{ExpectedVersion: res.Results[1].Version}},
+					},
+					Success: []*api.TxnOp{txnPut(from, values[from]-1), txnPut(to, values[to]+1)},
+				})
+			}
+		}(i)
+	}
+
+	for i := 0; i < 100; i++ {
+		if x, y, _ := read(); x+y != 100 {
+			t.Fatalf("err in store Txn() seen half applied, %d + %d", x, y)
+		}
+	}
+	wg.Wait()
+}
+
+func testBatch(t *testing.T, sm ShardedMap, ctx context.Context) {
+	_ = sm.Set(ctx, "taken", "value", 0)
+
+	results, err := sm.Batch(ctx, &api.WriteBatch{
+		Puts: []*api.PutRequest{
+			{Records: &api.Records{Key: "a", Value: "1"}},
+			{Records: &api.Records{Key: "taken", Value: "2"}, Precondition: &api.Precondition{IfAbsent: true}},
+			{Records: &api.Records{Key: "b", Value: "3"}, TtlMs: -1},
+			{Records: &api.Records{Key: "c", TypedValue: &api.Value{Kind: &api.Value_JsonValue{JsonValue: "{"}}}},
+		},
+		Deletes: []*api.DeleteRequest{{Key: "taken"}},
+	})
+	if err != nil || len(results) != 5 {
+		t.Fatal("err in store Batch() should return a result per item")
+	}
+
+	if results[0].Err != nil || results[0].Version == 0 {
+		t.Error("err in store Batch() should apply a valid put")
+	}
+	if results[1].Err != ErrorPreconditionFailed {
+		t.Error("err in store Batch() should check the precondition of each item")
+	}
+	if results[2].Err != ErrorInvalidItem || !errors.Is(results[3].Err, api.ErrInvalidValue) {
+		t.Error("err in store Batch() should refuse the invalid items")
+	}
+	if results[4].Err != nil {
+		t.Error("err in store Batch() should apply the deletes")
+	}
+
+	if dt, _ := sm.Get(ctx, "a"); dt != "1" {
+		t.Error("err in store Batch() the put is not applied")
+	}
+	if _, err = sm.Get(ctx, "taken"); err != ErrorNoSuchKey {
+		t.Error("err in store Batch() the delete is not applied")
+	}
+}
+
+func TestSplitBatch(t *testing.T) {
+	b := &api.WriteBatch{}
+	for i := 0; i < 5; i++ {
+		b.Puts = append(b.Puts, &api.PutRequest{})
+	}
+	for i := 0; i < 3; i++ {
+		b.Deletes = append(b.Deletes, &api.DeleteRequest{})
+	}
+
+	batches := splitBatch(b, 3)
+	if len(batches) != 3 {
+		t.Fatalf("splitBatch() returned %d batches, want 3", len(batches))
+	}
+	sizes := [][2]int{{3, 0}, {2, 1}, {0, 2}}
+	for i, batch := range batches {
+		if len(batch.Puts) != sizes[i][0] || len(batch.Deletes) != sizes[i][1] {
+			t.Errorf("splitBatch() batch %d has %d puts and %d deletes", i, len(batch.Puts), len(batch.Deletes))
+		}
+	}
+}
+
+func nextEvent(t *testing.T, events <-chan *api.WatchEvent) *api.WatchEvent {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("err in store Watch() no event received")
+		return nil
+	}
+}
+
+func testWatch(t *testing.T, sm ShardedMap, ctx context.Context) {
+	events, cancel, err := sm.Watch(ctx, "user/", true, 0)
+	if err != nil {
+		t.Fatal("err in store Watch()")
+	}
+	defer cancel()
+
+	_ = sm.Set(ctx, "other", "value", 0)
+	_ = sm.Set(ctx, "user/1", "name", 0)
+	ev := nextEvent(t, events)
+	if ev.Type != api.WatchEvent_PUT || ev.Key != "user/1" || ev.Value.GetStringValue() != "name" {
+		t.Errorf("err in store Watch() got %v", ev)
+	}
+	_, version, _ := sm.GetWithVersion(ctx, "user/1")
+	if ev.Index != version {
+		t.Error("err in store Watch() the index of a put is the version of the key")
+	}
+
+	_ = sm.Delete(ctx, "user/1", nil)
+	if ev = nextEvent(t, events); ev.Type != api.WatchEvent_DELETE || ev.Key != "user/1" {
+		t.Errorf("err in store Watch() got %v", ev)
+	}
+
+	_ = sm.Set(ctx, "user/2", "name", time.Millisecond)
+	_ = nextEvent(t, events)
+	time.Sleep(5 * time.Millisecond)
+	sm.ReclaimLocally(ctx, sm.getShard("user/2").expired(time.Now().UnixNano()))
+	if ev = nextEvent(t, events); ev.Type != api.WatchEvent_EXPIRE || ev.Key != "user/2" {
+		t.Errorf("err in store Watch() got %v", ev)
+	}
+
+	// fill the shard of user/3 until it is evicted
+	_ = sm.Set(ctx, "user/3", "name", 0)
+	_ = nextEvent(t, events)
+	shard := sm.getShardIndex("user/3")
+	for i, n := 0, 0; n < 10; i++ {
+		key := fmt.Sprintf("filler%d", i)
+		if sm.getShardIndex(key) == shard {
+			_ = sm.Set(ctx, key, "value", 0)
+			n++
+		}
+	}
+	if ev = nextEvent(t, events); ev.Type != api.WatchEvent_EVICT || ev.Key != "user/3" {
+		t.Errorf("err in store Watch() got %v", ev)
+	}
+}
+
+func testWatchReplayAndCompaction(t *testing.T, sm ShardedMap, ctx context.Context) {
+	_ = sm.Set(ctx, "key", "v1", 0)
+	_, from, _ := sm.GetWithVersion(ctx, "key")
+	_ = sm.Set(ctx, "key", "v2", 0)
+
+	events, cancel, err := sm.Watch(ctx, "key", false, from)
+	if err != nil {
+		t.Fatal("err in store Watch() from an index")
+	}
+	if ev := nextEvent(t, events); ev.Value.GetStringValue() != "v1" {
+		t.Error("err in store Watch() should replay the events from the index")
+	}
+	if ev := nextEvent(t, events); ev.Value.GetStringValue() != "v2" {
+		t.Error("err in store Watch() should replay the events in order")
+	}
+
+	// a watcher which does not read is closed
+	for i := 0; i < watchHistory; i++ {
+		_ = sm.Set(ctx, "key", "value", 0)
+	}
+	for range events {
+	}
+	cancel()
+
+	if _, _, err = sm.Watch(ctx, "key", false, from); err != ErrorWatchCompacted {
+		t.Error("err in store Watch() should refuse an index not in the history anymore")
+	}
+}
+
+func scanKeys(kvs []models.KeysValues) []string {
+	var keys []string
+	for _, kv := range kvs {
+		keys = append(keys, kv.Key)
+	}
+	return keys
+}
+
+func testScan(t *testing.T, sm ShardedMap, ctx context.Context) {
+	for _, key := range []string{"user:3", "user:1", "item:1", "user:2", "user:10", "zed"} {
+		_ = sm.Set(ctx, key, key, 0)
+	}
+	_ = sm.Set(ctx, "user:4", "expired", time.Nanosecond)
+	_ = sm.Delete(ctx, "zed", nil)
+	time.Sleep(time.Millisecond)
+
+	kvs, err := sm.Scan(ctx, "", "", 100)
+	if err != nil {
+		t.Fatal("err in store Scan() should not return an err")
+	}
+	if got := scanKeys(kvs); !reflect.DeepEqual(got, []string{"item:1", "user:1", "user:10", "user:2", "user:3"}) {
+		t.Error("err in store Scan() should return the live keys in order, got", got)
+	}
+	if kvs[0].Value != "item:1" || kvs[0].Version == 0 {
+		t.Error("err in store Scan() should return the values and the versions")
+	}
+
+	kvs, _ = sm.Scan(ctx, "user:", "user;", 2)
+	if got := scanKeys(kvs); !reflect.DeepEqual(got, []string{"user:1", "user:10"}) {
+		t.Error("err in store Scan() should respect the range and the limit, got", got)
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	ix := newKeyIndex()
+	var want []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%04d", i)
+		want = append(want, key)
+		ix.insert(key)
+		ix.insert(key)
+	}
+	for i := 0; i < 1000; i += 2 {
+		ix.remove(want[i])
+	}
+
+	got := ix.keys("", "", 2000)
+	if len(got) != 500 || got[0] != "key-0001" || got[499] != "key-0999" {
+		t.Fatal("err in keyIndex should keep the keys in order, once")
+	}
+	if got = ix.keys("key-0100", "key-0106", 10); !reflect.DeepEqual(got, []string{"key-0101", "key-0103", "key-0105"}) {
+		t.Error("err in keyIndex.keys() should return the range, got", got)
+	}
+}
+
+func testKeysPage(t *testing.T, sm ShardedMap, ctx context.Context) {
+	want := make(map[string]bool)
+	for i := 0; i < 9; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		want[key] = true
+		_ = sm.Set(ctx, key, "value", 0)
+	}
+	_ = sm.Set(ctx, "other", "value", 0)
+	match := func(key string) bool { return strings.HasPrefix(key, "key-") }
+
+	got := make(map[string]bool)
+	cursor := models.KeysCursor{}
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("err in store KeysPage() should end")
+		}
+		keys, next, done, err := sm.KeysPage(ctx, cursor, 2, match)
+		if err != nil {
+			t.Fatal("err in store KeysPage() should not fail", err)
+		}
+		if len(keys) > 2 {
+			t.Fatal("err in store KeysPage() should respect the limit")
+		}
+		for _, key := range keys {
+			if got[key] {
+				t.Error("err in store KeysPage() should return a key once", key)
+			}
+			got[key] = true
+		}
+		// the keys set while iterating do not break the cursor
+		if pages < 2 {
+			_ = sm.Set(ctx, fmt.Sprintf("key-new-%d", pages), "value", 0)
+		}
+		if done {
+			break
+		}
+		cursor = next
+	}
+
+	for key := range want {
+		if !got[key] {
+			t.Error("err in store KeysPage() should return all the keys present during the iteration", key)
+		}
+	}
+	if n, _ := sm.CountKeys(ctx, match); n != 11 {
+		t.Error("err in store CountKeys() should count the matching keys, got", n)
+	}
+}
+
+// the list of the default lru policy
+func lruList(s *Shard) *dll {
+	return s.policy.(*lru).l
+}
+
+// the keys of the storage, the local reads do not fail
+func allKeys(t *testing.T, st interface {
+	Keys(context.Context) ([]string, error)
+}) []string {
+	t.Helper()
+	keys, err := st.Keys(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"os"
+	"sort"
+	"sync"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/internal/raftlog"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"google.golang.org/protobuf/proto"
+)
+
+// EvictionHook is told about the records evicted from the memory,
+// it is called under the lock of the shard
+type EvictionHook interface {
+	Evicted(rec *command.Record)
+}
+
+// Tier is a hook keeping the evicted records, a read missing in memory falls back to it
+type Tier interface {
+	EvictionHook
+	// Get returns the record of the key, nil if there is none
+	Get(key string) (*command.Record, error)
+	// Remove forgets the record of the key, it has been written again or deleted
+	Remove(key string)
+	// Reset forgets all the records, the state is restored from a snapshot
+	Reset() error
+	// Snapshot returns the records of the tier at the time of the call,
+	// they can be read until the snapshot is released
+	Snapshot() TierSnapshot
+}
+
+// TierSnapshot reads the records of a tier while the tier goes on
+type TierSnapshot interface {
+	Records(fn func(rec *command.Record) error) error
+	Release()
+}
+
+// SetEvictionHook must be called before the first write, if the hook is a Tier
+// the reads missing in memory fall back to it
+func (m ShardedMap) SetEvictionHook(h EvictionHook) {
+	tier, _ := h.(Tier)
+	for _, shard := range m.shd {
+		shard.hook = h
+		shard.tier = tier
+	}
+}
+
+// records is the record handed over to the hook
+func (n *node) records() *command.Record {
+	typed, _ := api.NewValue(n.value())
+	return &command.Record{
+		Key:        n.key,
+		TypedValue: typed,
+		ExpiresAt:  n.expiresAt,
+		Version:    n.version,
+	}
+}
+
+// the records of the disk tier
+const (
+	tierPut uint32 = iota
+	// the value is the key
+	tierRemove
+)
+
+// DiskTier keeps the evicted records in the segments of a log,
+// the oldest segments are dropped once the log is over its budget
+type DiskTier struct {
+	mu       sync.Mutex
+	log      *raftlog.Log
+	maxBytes uint64
+	// the offset of the last record of each key
+	keys map[string]uint64
+	// the snapshots being read, the oldest segments are kept meanwhile
+	pins int
+	obs  *observability.Observability
+}
+
+// NewDiskTier opens the tier of dir with the records of a previous run, the distributed
+// storage drops them as it restores the tier from the snapshot.
+// The tier holds up to maxBytes in segments of a quarter of it, sealed by the codec(nil for none)
+func NewDiskTier(dir string, maxBytes uint64, cdc *codec.Codec, observ *observability.Observability) (*DiskTier, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := raftlog.Config{Codec: cdc}
+	c.Segment.MaxStoreBytes = maxBytes / 4
+	// an entry of the index(12 bytes) is smaller than its record
+	c.Segment.MaxIndexBytes = maxBytes / 4
+	log, err := raftlog.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &DiskTier{
+		log:      log,
+		maxBytes: maxBytes,
+		keys:     make(map[string]uint64),
+		obs:      observ,
+	}
+	if err := t.load(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// load replays the records of the log, the last one of a key wins
+func (t *DiskTier) load() error {
+	lowest, err := t.log.LowestOffset()
+	if err != nil {
+		return err
+	}
+	highest, err := t.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	for off := lowest; off <= highest; off++ {
+		record, err := t.log.Read(off)
+		if err == raftlog.ErrorOffsetOutOfRange && highest == 0 {
+			// an empty log, its highest offset is 0 too
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if record.Type == tierRemove {
+			delete(t.keys, string(record.Value))
+			continue
+		}
+		var rec command.Record
+		if err := proto.Unmarshal(record.Value, &rec); err != nil {
+			return err
+		}
+		t.keys[rec.Key] = off
+	}
+	return nil
+}
+
+func (t *DiskTier) Evicted(rec *command.Record) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, err := proto.Marshal(rec)
+	if err != nil {
+		t.obs.Logger.Error("DiskTier.Evicted() failed", err)
+		return
+	}
+	off, err := t.log.Append(&raftlog.Record{Value: b, Type: tierPut})
+	if err != nil {
+		t.obs.Logger.Error("DiskTier.Evicted() failed", err)
+		return
+	}
+	t.keys[rec.Key] = off
+
+	for t.pins == 0 && t.log.Size() > t.maxBytes {
+		oldest, _ := t.log.LowestOffset()
+		lowest, err := t.log.DropOldest()
+		if err != nil {
+			t.obs.Logger.Error("DiskTier.Evicted() failed", err)
+			return
+		}
+		// only the active segment is left
+		if lowest == oldest {
+			return
+		}
+		for key, off := range t.keys {
+			if off < lowest {
+				delete(t.keys, key)
+			}
+		}
+	}
+}
+
+func (t *DiskTier) Get(key string) (*command.Record, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	off, ok := t.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	return t.read(off)
+}
+
+// the lock must be held
+func (t *DiskTier) read(off uint64) (*command.Record, error) {
+	record, err := t.log.Read(off)
+	if err != nil {
+		return nil, err
+	}
+	var rec command.Record
+	if err := proto.Unmarshal(record.Value, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (t *DiskTier) Remove(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.keys[key]; !ok {
+		return
+	}
+	delete(t.keys, key)
+	// the next run must not load the record again
+	if _, err := t.log.Append(&raftlog.Record{Value: []byte(key), Type: tierRemove}); err != nil {
+		t.obs.Logger.Error("DiskTier.Remove() failed", err)
+	}
+}
+
+// Len is the number of records of the tier
+func (t *DiskTier) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.keys)
+}
+
+func (t *DiskTier) Snapshot() TierSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	offsets := make([]uint64, 0, len(t.keys))
+	for _, off := range t.keys {
+		offsets = append(offsets, off)
+	}
+	// read in the order of the log
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	t.pins++
+	return &diskTierSnapshot{tier: t, offsets: offsets}
+}
+
+type diskTierSnapshot struct {
+	tier    *DiskTier
+	offsets []uint64
+}
+
+func (s *diskTierSnapshot) Records(fn func(rec *command.Record) error) error {
+	for _, off := range s.offsets {
+		s.tier.mu.Lock()
+		rec, err := s.tier.read(off)
+		s.tier.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *diskTierSnapshot) Release() {
+	s.tier.mu.Lock()
+	defer s.tier.mu.Unlock()
+	s.tier.pins--
+}
+
+// Reset drops all the records
+func (t *DiskTier) Reset() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.keys = make(map[string]uint64)
+	return t.log.Reset()
+}
+
+func (t *DiskTier) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.log.Close()
+}
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/djedjethai/generation/internal/codec"
+	"github.com/djedjethai/generation/internal/observability"
+	"github.com/djedjethai/generation/internal/storage/command"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskTier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	obs := observability.Observability{}
+	tier, err := NewDiskTier(dir, 1<<20, nil, &obs)
+	require.NoError(t, err)
+
+	sm := NewShardedMap(1, 3, &obs)
+	sm.SetEvictionHook(tier)
+	ctx := context.Background()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i), 0))
+	}
+	require.Len(t, allKeys(t, sm), 3)
+	require.Equal(t, 7, tier.Len())
+
+	// a miss in memory is read from the tier and promoted
+	value, version, err := sm.GetWithVersion(ctx, "key0")
+	require.NoError(t, err)
+	require.Equal(t, "value0", value)
+	require.Equal(t, uint64(1), version)
+	require.Contains(t, allKeys(t, sm), "key0")
+	require.Equal(t, 7, tier.Len())
+
+	// a key deleted or written again is forgotten by the tier
+	require.NoError(t, sm.Delete(ctx, "key1", nil))
+	_, err = sm.Get(ctx, "key1")
+	require.Equal(t, ErrorNoSuchKey, err)
+	require.NoError(t, sm.Set(ctx, "key2", "new", 0))
+	value, err = sm.Get(ctx, "key2")
+	require.NoError(t, err)
+	require.Equal(t, "new", value)
+
+	// the records are kept from a run to the next
+	n := tier.Len()
+	require.NoError(t, tier.Close())
+	tier, err = NewDiskTier(dir, 1<<20, nil, &obs)
+	require.NoError(t, err)
+	require.Equal(t, n, tier.Len())
+	rec, err := tier.Get("key3")
+	require.NoError(t, err)
+	require.Equal(t, "value3", rec.Data())
+	require.NoError(t, tier.Close())
+}
+
+func TestDiskTierDropsTheOldestRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	obs := observability.Observability{}
+	tier, err := NewDiskTier(dir, 4096, nil, &obs)
+	require.NoError(t, err)
+	defer tier.Close()
+
+	sm := NewShardedMap(1, 1, &obs)
+	sm.SetEvictionHook(tier)
+	ctx := context.Background()
+
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, sm.Set(ctx, fmt.Sprintf("key%d", i), value, 0))
+	}
+	require.LessOrEqual(t, tier.log.Size(), uint64(4096))
+	require.Less(t, tier.Len(), 199)
+
+	// the last evicted ones are still there
+	_, err = sm.Get(ctx, "key198")
+	require.NoError(t, err)
+	_, err = sm.Get(ctx, "key0")
+	require.Equal(t, ErrorNoSuchKey, err)
+}
+
+// a record the tier can not read fails the open, rather than loading an empty tier
+func TestDiskTierLoadFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	obs := observability.Observability{}
+	keys, err := codec.ParseKeys("1 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)))
+	require.NoError(t, err)
+	cdc, err := codec.New(codec.CompressionNone, keys)
+	require.NoError(t, err)
+	tier, err := NewDiskTier(dir, 1<<20, cdc, &obs)
+	require.NoError(t, err)
+	require.Equal(t, 0, tier.Len())
+	tier.Evicted(&command.Record{Key: "key", Value: "value"})
+	require.NoError(t, tier.Close())
+
+	other, err := codec.ParseKeys("2 " + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)))
+	require.NoError(t, err)
+	cdc, err = codec.New(codec.CompressionNone, other)
+	require.NoError(t, err)
+	_, err = NewDiskTier(dir, 1<<20, cdc, &obs)
+	require.Equal(t, codec.ErrorUnknownKey, err)
+}
@@ -0,0 +1,199 @@
+package storage
+
+import "hash/fnv"
+
+// W-TinyLFU: the new nodes go in a small lru window, the nodes out of the window
+// stay in the main space only if they are more frequent than its next victim.
+// The main space is a segmented lru, the nodes hit in probation are protected
+type tinyLFU struct {
+	window    *dll
+	probation *dll
+	protected *dll
+	sketch    *sketch
+}
+
+func newTinyLFU(capacity int) *tinyLFU {
+	return &tinyLFU{
+		window:    newList(),
+		probation: newList(),
+		protected: newList(),
+		sketch:    newSketch(capacity),
+	}
+}
+
+// 1% of the nodes are in the window, 80% of the main space is protected
+func (p *tinyLFU) windowTarget() int {
+	return max(p.len()/100, 1)
+}
+
+func (p *tinyLFU) protectedTarget() int {
+	return max((p.len()-p.window.length)*8/10, 1)
+}
+
+func (p *tinyLFU) list(seg uint8) *dll {
+	switch seg {
+	case segProbation:
+		return p.probation
+	case segProtected:
+		return p.protected
+	default:
+		return p.window
+	}
+}
+
+func (p *tinyLFU) add(nd *node) {
+	p.sketch.increment(nd.key)
+	nd.seg = segWindow
+	_, _ = p.window.unshiftNode(nd)
+
+	// the nodes out of the window are admission candidates, at the head of probation
+	for p.window.length > p.windowTarget() {
+		candidate := p.window.popNode()
+		candidate.seg = segProbation
+		_, _ = p.probation.unshiftNode(candidate)
+	}
+}
+
+func (p *tinyLFU) hit(nd *node) {
+	p.sketch.increment(nd.key)
+	if nd.seg == segWindow {
+		_ = p.window.removeNode(nd)
+		_, _ = p.window.unshiftNode(nd)
+		return
+	}
+
+	_ = p.list(nd.seg).removeNode(nd)
+	nd.seg = segProtected
+	_, _ = p.protected.unshiftNode(nd)
+	for p.protected.length > p.protectedTarget() {
+		demoted := p.protected.popNode()
+		demoted.seg = segProbation
+		_, _ = p.probation.unshiftNode(demoted)
+	}
+}
+
+func (p *tinyLFU) remove(nd *node) {
+	_ = p.list(nd.seg).removeNode(nd)
+}
+
+func (p *tinyLFU) evict() *node {
+	var nd *node
+	switch {
+	case p.probation.length > 1:
+		// admission, the less frequent of the last candidate and the victim is evicted
+		candidate, victim := p.probation.head, p.probation.tail
+		nd = victim
+		if p.sketch.estimate(candidate.key) <= p.sketch.estimate(victim.key) {
+			nd = candidate
+		}
+	case p.probation.length == 1:
+		nd = p.probation.head
+	case p.protected.length > 0:
+		nd = p.protected.tail
+	default:
+		nd = p.window.tail
+	}
+	if nd != nil {
+		p.remove(nd)
+	}
+	return nd
+}
+
+// walk follows evict, the duel of probation moves inwards from both ends
+func (p *tinyLFU) walk(fn func(*node) bool) {
+	candidate, victim := p.probation.head, p.probation.tail
+	for n := p.probation.length; n > 0; n-- {
+		nd := victim
+		if n > 1 && p.sketch.estimate(candidate.key) <= p.sketch.estimate(victim.key) {
+			nd = candidate
+		}
+		if !fn(nd) {
+			return
+		}
+		if nd == candidate {
+			candidate = candidate.next
+		} else {
+			victim = victim.prev
+		}
+	}
+	if walkBack(p.protected, fn) {
+		walkBack(p.window, fn)
+	}
+}
+
+func (p *tinyLFU) evicted(nd *node) {
+	p.remove(nd)
+}
+
+func (p *tinyLFU) len() int {
+	return p.window.length + p.probation.length + p.protected.length
+}
+
+const sketchDepth = 4
+
+// sketch is a count-min sketch estimating the access frequency of the keys,
+// the counters are halved from time to time so the old accesses fade
+type sketch struct {
+	rows    [sketchDepth][]uint8
+	mask    uint64
+	added   int
+	resetAt int
+}
+
+func newSketch(capacity int) *sketch {
+	width := 64
+	for width < capacity {
+		width *= 2
+	}
+	s := &sketch{
+		mask:    uint64(width - 1),
+		resetAt: 10 * width,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum, sum>>32|sum<<32
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+func (s *sketch) increment(key string) {
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < 15 {
+			s.rows[i][j]++
+		}
+	}
+	s.added++
+	if s.added >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	est := uint8(15)
+	for i, j := range s.indexes(key) {
+		if s.rows[i][j] < est {
+			est = s.rows[i][j]
+		}
+	}
+	return est
+}
+
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.added /= 2
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// progressTransport follows the replication to the servers catching up. Their entries
+// are not pipelined, so each append is seen, and their bytes are throttled
+type progressTransport struct {
+	raft.Transport
+	throttle *throttle
+
+	mu sync.Mutex
+	// the last entry known to be on each server catching up
+	tracked map[raft.ServerID]uint64
+}
+
+func newProgressTransport(trans raft.Transport, t *throttle) *progressTransport {
+	return &progressTransport{
+		Transport: trans,
+		throttle:  t,
+		tracked:   make(map[raft.ServerID]uint64),
+	}
+}
+
+// track must be called before the server is added, so its first append is seen
+func (t *progressTransport) track(id raft.ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.tracked[id]; !ok {
+		t.tracked[id] = 0
+	}
+}
+
+func (t *progressTransport) untrack(id raft.ServerID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.tracked, id)
+}
+
+func (t *progressTransport) isTracked(id raft.ServerID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.tracked[id]
+	return ok
+}
+
+// match returns the last entry known to be on the server
+func (t *progressTransport) match(id raft.ServerID) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tracked[id]
+}
+
+func (t *progressTransport) advance(id raft.ServerID, index uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if match, ok := t.tracked[id]; ok && index > match {
+		t.tracked[id] = index
+	}
+}
+
+// a server catching up falls back to the appends one at a time
+func (t *progressTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	if t.isTracked(id) {
+		return nil, raft.ErrPipelineReplicationNotSupported
+	}
+	return t.Transport.AppendEntriesPipeline(id, target)
+}
+
+func (t *progressTransport) AppendEntries(id raft.ServerID, target raft.ServerAddress, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) error {
+	if !t.isTracked(id) {
+		return t.Transport.AppendEntries(id, target, args, resp)
+	}
+
+	var n int
+	for _, entry := range args.Entries {
+		n += len(entry.Data)
+	}
+	t.throttle.wait(n)
+	if err := t.Transport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	if resp.Success {
+		t.advance(id, args.PrevLogEntry+uint64(len(args.Entries)))
+	}
+	return nil
+}
+
+func (t *progressTransport) InstallSnapshot(id raft.ServerID, target raft.ServerAddress, args *raft.InstallSnapshotRequest, resp *raft.InstallSnapshotResponse, data io.Reader) error {
+	if !t.isTracked(id) {
+		return t.Transport.InstallSnapshot(id, target, args, resp, data)
+	}
+
+	err := t.Transport.InstallSnapshot(id, target, args, resp, &throttledReader{r: data, t: t.throttle})
+	if err == nil && resp.Success {
+		t.advance(id, args.LastLogIndex)
+	}
+	return err
+}
+
+// raft closes its transport on shutdown
+func (t *progressTransport) Close() error {
+	if c, ok := t.Transport.(raft.WithClose); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// throttle paces the bytes to a rate per second, no limit if the rate is 0
+type throttle struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate}
+}
+
+// wait sleeps until the n bytes fit in the rate
+func (t *throttle) wait(n int) {
+	if t == nil || t.rate <= 0 || n == 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(int64(n) * int64(time.Second) / t.rate))
+	delay := t.next.Sub(now)
+	t.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.wait(n)
+	return n, err
+}
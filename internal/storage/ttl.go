@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/storage/command"
+)
+
+// max number of expired records a sweeper hand over per round,
+// the left over will be collected at the next round
+const sweepBatch = 512
+
+// Reclaimer receives the records found expired by a shard's sweeper.
+// The records carry the deadline they had when found expired
+type Reclaimer func(ctx context.Context, expired []*command.Record)
+
+// Expire remove the key only if its deadline is still the one which has been found expired,
+// so a key set again(with a new ttl) in between is not removed
+func (m ShardedMap) Expire(ctx context.Context, key string, expiresAt int64) error {
+	return m.expire(ctx, key, expiresAt, m.nextVersion())
+}
+
+func (m ShardedMap) expire(ctx context.Context, key string, expiresAt int64, index uint64) error {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageExpire")
+	defer teardown()
+
+	shard := m.getShard(key)
+
+	shard.Lock()
+	defer shard.Unlock()
+
+	nd, ok := shard.m[key]
+	if !ok || expiresAt == 0 || nd.expiresAt != expiresAt {
+		return nil
+	}
+
+	m.obs.Logger.Debug("ShardedMap.Expire()", "delete expired node")
+	shard.unlink(key)
+	shard.publish(api.WatchEvent_EXPIRE, nd, index)
+
+	return nil
+}
+
+// Sweep starts one sweeper per shard. Every interval each sweeper collects
+// the expired records of its shard and hands them over to reclaim.
+// The returned func stops the sweepers
+func (m ShardedMap) Sweep(interval time.Duration, reclaim Reclaimer) func() {
+	done := make(chan struct{})
+
+	for _, shard := range m.shd {
+		go func(s *Shard) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					expired := s.expired(time.Now().UnixNano())
+					if len(expired) > 0 {
+						reclaim(context.Background(), expired)
+					}
+				}
+			}
+		}(shard)
+	}
+
+	return func() {
+		close(done)
+	}
+}
+
+// ReclaimLocally is the Reclaimer of a standalone ShardedMap, with raft
+// the expired records have to go through the fsm instead
+func (m ShardedMap) ReclaimLocally(ctx context.Context, expired []*command.Record) {
+	for _, r := range expired {
+		_ = m.Expire(ctx, r.Key, r.ExpiresAt)
+	}
+}
+
+func (s *Shard) expired(now int64) []*command.Record {
+	s.RLock()
+	defer s.RUnlock()
+
+	var expired []*command.Record
+	for key, nd := range s.m {
+		if nd.isExpired(now) {
+			expired = append(expired, &command.Record{
+				Key:       key,
+				ExpiresAt: nd.expiresAt,
+			})
+			if len(expired) == sweepBatch {
+				break
+			}
+		}
+	}
+	return expired
+}
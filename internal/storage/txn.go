@@ -0,0 +1,193 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+	"github.com/djedjethai/generation/internal/storage/command"
+)
+
+var ErrorInvalidTxn = errors.New("invalid transaction")
+
+// Txn evaluates the compares and applies the success or the failure ops,
+// all the shards of the keys are locked so no one sees the transaction half applied
+func (m ShardedMap) Txn(ctx context.Context, req *api.TxnRequest) (*api.TxnResponse, error) {
+	cmd, err := m.prepareTxn(req, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	return m.txn(ctx, cmd, m.nextVersion())
+}
+
+// prepareTxn validates the ops and makes the command with the time and the deadlines,
+// it is done once by the caller(the leader in case of the fsm) so all replicas agree.
+// A put over the budget of its shard fails the whole transaction before any op is applied
+func (m ShardedMap) prepareTxn(req *api.TxnRequest, now int64) (*command.Txn, error) {
+	cmd := &command.Txn{Compares: req.Compares, Now: now}
+	var err error
+	if cmd.Success, err = m.prepareTxnOps(req.Success, now); err != nil {
+		return nil, err
+	}
+	if cmd.Failure, err = m.prepareTxnOps(req.Failure, now); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+func (m ShardedMap) prepareTxnOps(ops []*api.TxnOp, now int64) ([]*command.TxnOp, error) {
+	cmds := make([]*command.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		switch o := op.GetOp().(type) {
+		case *api.TxnOp_Put:
+			if o.Put.TtlMs < 0 {
+				return nil, ErrorInvalidTxn
+			}
+			nd, err := NewNode(o.Put.Key, o.Put.Value.Interface())
+			if err != nil {
+				return nil, err
+			}
+			if max := m.getShard(o.Put.Key).maxBytes; max > 0 && nd.size() > max {
+				return nil, ErrorTooLarge
+			}
+			put := &command.TxnPut{Key: o.Put.Key, Value: o.Put.Value}
+			if o.Put.TtlMs > 0 {
+				put.ExpiresAt = now + int64(time.Duration(o.Put.TtlMs)*time.Millisecond)
+			}
+			cmds = append(cmds, &command.TxnOp{Op: &command.TxnOp_Put{Put: put}})
+		case *api.TxnOp_Delete:
+			cmds = append(cmds, &command.TxnOp{Op: &command.TxnOp_Delete{Delete: o.Delete}})
+		case *api.TxnOp_Get:
+			cmds = append(cmds, &command.TxnOp{Op: &command.TxnOp_Get{Get: o.Get}})
+		default:
+			return nil, ErrorInvalidTxn
+		}
+	}
+	return cmds, nil
+}
+
+func (m ShardedMap) txn(ctx context.Context, req *command.Txn, version uint64) (*api.TxnResponse, error) {
+
+	teardown := m.obs.CarryOnTrace(ctx, "StorageTxn")
+	defer teardown()
+
+	unlock := m.lockShards(commandKeys(req))
+	defer unlock()
+
+	succeeded := true
+	for _, c := range req.Compares {
+		nd, ok := m.getShard(c.Key).m[c.Key]
+		if checkPrecondition(nd, ok, c.Precondition, req.Now) != nil {
+			succeeded = false
+			break
+		}
+	}
+
+	ops := req.Success
+	if !succeeded {
+		ops = req.Failure
+	}
+
+	res := &api.TxnResponse{Succeeded: succeeded}
+	for _, op := range ops {
+		switch o := op.GetOp().(type) {
+		case *command.TxnOp_Put:
+			shard := m.getShard(o.Put.Key)
+			err := shard.set(o.Put.Key, o.Put.Value.Interface(), o.Put.ExpiresAt, version)
+			if err != nil {
+				// prepareTxn checked the values and their size, the ops before are applied
+				return nil, err
+			}
+			res.Results = append(res.Results, &api.TxnResult{Key: o.Put.Key, Version: version})
+		case *command.TxnOp_Delete:
+			m.getShard(o.Delete.Key).remove(o.Delete.Key, version)
+			res.Results = append(res.Results, &api.TxnResult{Key: o.Delete.Key})
+		case *command.TxnOp_Get:
+			result := &api.TxnResult{Key: o.Get.Key}
+			nd, ok := m.getShard(o.Get.Key).m[o.Get.Key]
+			if ok && !nd.isExpired(req.Now) {
+				typed, err := api.NewValue(nd.value())
+				if err != nil {
+					return nil, err
+				}
+				result.Value = typed
+				result.Version = nd.version
+			}
+			res.Results = append(res.Results, result)
+		}
+	}
+
+	return res, nil
+}
+
+// the ops of both branches
+func txnOps(req *api.TxnRequest) []*api.TxnOp {
+	ops := make([]*api.TxnOp, 0, len(req.Success)+len(req.Failure))
+	ops = append(ops, req.Success...)
+	return append(ops, req.Failure...)
+}
+
+func txnKeys(req *api.TxnRequest) []string {
+	var keys []string
+	for _, c := range req.Compares {
+		keys = append(keys, c.Key)
+	}
+	for _, op := range txnOps(req) {
+		switch o := op.GetOp().(type) {
+		case *api.TxnOp_Put:
+			keys = append(keys, o.Put.Key)
+		case *api.TxnOp_Delete:
+			keys = append(keys, o.Delete.Key)
+		case *api.TxnOp_Get:
+			keys = append(keys, o.Get.Key)
+		}
+	}
+	return keys
+}
+
+// commandKeys are the keys of the command, as txnKeys the ones of the request
+func commandKeys(cmd *command.Txn) []string {
+	var keys []string
+	for _, c := range cmd.Compares {
+		keys = append(keys, c.Key)
+	}
+	for _, ops := range [][]*command.TxnOp{cmd.Success, cmd.Failure} {
+		for _, op := range ops {
+			switch o := op.GetOp().(type) {
+			case *command.TxnOp_Put:
+				keys = append(keys, o.Put.Key)
+			case *command.TxnOp_Delete:
+				keys = append(keys, o.Delete.Key)
+			case *command.TxnOp_Get:
+				keys = append(keys, o.Get.Key)
+			}
+		}
+	}
+	return keys
+}
+
+// lockShards locks the shards of the keys by increasing index, so two transactions
+// can not wait for each other, and returns the func to unlock them
+func (m ShardedMap) lockShards(keys []string) func() {
+	seen := make(map[int]bool)
+	var indexes []int
+	for _, key := range keys {
+		i := m.getShardIndex(key)
+		if !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	for _, i := range indexes {
+		m.shd[i].Lock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			m.shd[indexes[j]].Unlock()
+		}
+	}
+}
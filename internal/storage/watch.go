@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	api "github.com/djedjethai/generation/api/v1/keyvalue"
+)
+
+var ErrorWatchCompacted = errors.New("the events from this index are not in the history anymore")
+
+const (
+	// number of events kept to replay them to the watchers which reconnect
+	watchHistory = 4096
+	// events a watcher can be late of, after that it is closed
+	watchBuffer = 256
+)
+
+// watchHub keeps the last events of the ShardedMap and sends them to the watchers.
+// The events are published under the shard lock, so they are in the order of the writes
+type watchHub struct {
+	mu      sync.Mutex
+	history []*api.WatchEvent
+	first   int
+	// the history has the events after compacted, the index of the last event dropped
+	// or of the state restored(at start the one of the latest snapshot)
+	compacted uint64
+	watchers  map[*watcher]struct{}
+	// the partition of the ShardedMap, set on the events
+	partition int32
+}
+
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan *api.WatchEvent
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		history:  make([]*api.WatchEvent, 0, watchHistory),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+func (w *watcher) match(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return w.key == key
+}
+
+func (h *watchHub) publish(ev *api.WatchEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ev.Partition = h.partition
+	if len(h.history) < watchHistory {
+		h.history = append(h.history, ev)
+	} else {
+		if dropped := h.history[h.first].Index; dropped > h.compacted {
+			h.compacted = dropped
+		}
+		h.history[h.first] = ev
+		h.first = (h.first + 1) % watchHistory
+	}
+
+	for w := range h.watchers {
+		if !w.match(ev.Key) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			// too late, it resumes from its last index
+			delete(h.watchers, w)
+			close(w.ch)
+		}
+	}
+}
+
+// the history from the oldest event
+func (h *watchHub) events() []*api.WatchEvent {
+	return append(append([]*api.WatchEvent{}, h.history[h.first:]...), h.history[:h.first]...)
+}
+
+// watch returns the events of the key(or prefix) from startIndex,
+// the channel is closed when the watcher is late or cancel is called
+func (h *watchHub) watch(key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if startIndex != 0 && startIndex <= h.compacted {
+		return nil, nil, ErrorWatchCompacted
+	}
+
+	w := &watcher{key: key, prefix: prefix}
+
+	var replay []*api.WatchEvent
+	if startIndex != 0 {
+		for _, ev := range h.events() {
+			if ev.Index >= startIndex && w.match(ev.Key) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+
+	// the replay and the new events are sent under the same lock, none is missed
+	w.ch = make(chan *api.WatchEvent, len(replay)+watchBuffer)
+	for _, ev := range replay {
+		w.ch <- ev
+	}
+	h.watchers[w] = struct{}{}
+
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.watchers[w]; ok {
+			delete(h.watchers, w)
+			close(w.ch)
+		}
+	}
+
+	return w.ch, cancel, nil
+}
+
+// reset drops the history of the state replaced by the one at index, the watchers
+// are closed and resume with an index not in the history anymore
+func (h *watchHub) reset(index uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, ev := range h.history {
+		if ev.Index > h.compacted {
+			h.compacted = ev.Index
+		}
+	}
+	if index > h.compacted {
+		h.compacted = index
+	}
+	h.history = h.history[:0]
+	h.first = 0
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// closeAll closes the channels of all the watchers, they resume on an other node
+func (h *watchHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for w := range h.watchers {
+		delete(h.watchers, w)
+		close(w.ch)
+	}
+}
+
+// Watch streams the put, delete, evict and expire events of the key,
+// or of the keys starting with key if prefix is set
+func (m ShardedMap) Watch(ctx context.Context, key string, prefix bool, startIndex uint64) (<-chan *api.WatchEvent, func(), error) {
+	return m.watch.watch(key, prefix, startIndex)
+}
+
+func (s *Shard) publish(typ api.WatchEvent_Type, nd *node, index uint64) {
+	ev := &api.WatchEvent{
+		Type:  typ,
+		Key:   nd.key,
+		Index: index,
+	}
+	if typ == api.WatchEvent_PUT {
+		// the values of a node are all valid
+		ev.Value, _ = api.NewValue(nd.value())
+	}
+	s.watch.publish(ev)
+}
+
+// StopWatches ends the running watches, the grpc server can not stop while they stream
+func (m ShardedMap) StopWatches() {
+	m.watch.closeAll()
+}
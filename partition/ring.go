@@ -0,0 +1,79 @@
+// Package partition places the keys on the partitions, the nodes and the clients
+// share it so a client sends a key to the leader of its partition
+package partition
+
+import (
+	"sort"
+	"strconv"
+)
+
+// points of each bucket on the ring, the more the evener the buckets
+const ringVnodes = 64
+
+// Ring places the keys on n buckets(the partitions) with consistent hashing,
+// a key belongs to the first point of the ring after its hash.
+// Unlike a modulo, changing the number of buckets moves only about 1/n of the keys.
+// The keys of a partition are in its raft log, so the ring always hashes with Hash
+type Ring struct {
+	points  []uint32
+	buckets []int
+}
+
+func NewRing(n int) *Ring {
+	r := &Ring{
+		points:  make([]uint32, 0, n*ringVnodes),
+		buckets: make([]int, 0, n*ringVnodes),
+	}
+	owner := make(map[uint32]int, n*ringVnodes)
+	for b := 0; b < n; b++ {
+		for v := 0; v < ringVnodes; v++ {
+			point := Hash(strconv.Itoa(b) + "#" + strconv.Itoa(v))
+			// a collision keeps the first bucket, the same on every node
+			if _, ok := owner[point]; ok {
+				continue
+			}
+			owner[point] = b
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	for _, point := range r.points {
+		r.buckets = append(r.buckets, owner[point])
+	}
+	return r
+}
+
+// Locate returns the partition of the key
+func (r *Ring) Locate(key string) int {
+	if len(r.points) == 0 {
+		return 0
+	}
+	h := Hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.buckets[i]
+}
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// Hash is fnv-1a with the finalizer of murmur3, fnv alone clusters the points
+// of the ring as their names only differ by their last bytes.
+// The loop avoids the allocations of hash/fnv and of the []byte of the key
+func Hash(key string) uint32 {
+	x := uint32(fnvOffset32)
+	for i := 0; i < len(key); i++ {
+		x ^= uint32(key[i])
+		x *= fnvPrime32
+	}
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
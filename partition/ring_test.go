@@ -0,0 +1,35 @@
+package partition
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRing(t *testing.T) {
+	const keys = 10000
+	r := NewRing(4)
+
+	counts := make([]int, 4)
+	for i := 0; i < keys; i++ {
+		counts[r.Locate(fmt.Sprintf("key-%d", i))]++
+	}
+	for b, n := range counts {
+		require.InDelta(t, keys/4, n, keys/4*0.3, fmt.Sprintf("bucket %d", b))
+	}
+
+	// a fifth bucket takes about a fifth of the keys, from the other buckets only
+	grown := NewRing(5)
+	var moved int
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if before, after := r.Locate(key), grown.Locate(key); before != after {
+			require.Equal(t, 4, after)
+			moved++
+		}
+	}
+	require.InDelta(t, keys/5, moved, keys/5*0.3)
+
+	require.Equal(t, 0, NewRing(0).Locate("key"))
+}